@@ -0,0 +1,1140 @@
+// Package admin implements the `subscriptions admin` command, which allows operators to manage plans, subscriptions,
+// quotas and usages from the command line. The commands work directly against the database using the same code as
+// the NATS and HTTP handlers, so the service doesn't need to be running.
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/app"
+	"github.com/cyverse-de/subscriptions/common"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/pkg/errors"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+)
+
+// Output formats.
+const (
+	FormatTable = "table"
+	FormatJSON  = "json"
+)
+
+// command describes a single administrative command.
+type command struct {
+	summary string
+	run     func(ctx context.Context, c *commandContext, args []string) error
+}
+
+// commands lists the available administrative commands.
+var commands = map[string]command{
+	"list-plans": {
+		summary: "List the available subscription plans",
+		run:     listPlans,
+	},
+	"subscribe": {
+		summary: "Subscribe a user to a plan",
+		run:     subscribe,
+	},
+	"attach-addon": {
+		summary: "Apply an add-on to a user's active subscription",
+		run:     attachAddon,
+	},
+	"set-quota": {
+		summary: "Set a quota in a user's active subscription",
+		run:     setQuota,
+	},
+	"updates": {
+		summary: "List the usage and quota updates recorded for a user",
+		run:     listUpdates,
+	},
+	"recompute": {
+		summary: "Recalculate a user's usages from the usage updates",
+		run:     recompute,
+	},
+	"users": {
+		summary: "List users along with their active subscriptions",
+		run:     listUsers,
+	},
+	"subscriptions": {
+		summary: "List a user's past, current and scheduled subscriptions",
+		run:     listSubscriptions,
+	},
+	"cancel": {
+		summary: "Cancel a subscription immediately or at the end of its current period",
+		run:     cancelSubscription,
+	},
+	"set-grace-period": {
+		summary: "Set how many days an expired paid subscription's quotas still apply",
+		run:     setGracePeriod,
+	},
+	"groups": {
+		summary: "List the groups",
+		run:     listGroups,
+	},
+	"add-group": {
+		summary: "Add a group whose members share a subscription",
+		run:     addGroup,
+	},
+	"delete-group": {
+		summary: "Remove a group along with its memberships and subscriptions",
+		run:     deleteGroup,
+	},
+	"add-group-member": {
+		summary: "Add a user to a group",
+		run:     addGroupMember,
+	},
+	"remove-group-member": {
+		summary: "Remove a user from a group",
+		run:     removeGroupMember,
+	},
+	"subscribe-group": {
+		summary: "Subscribe a group to a plan whose quotas are pooled among its members",
+		run:     subscribeGroup,
+	},
+	"import-users": {
+		summary: "Subscribe the users listed in a CSV or JSON Lines file to plans",
+		run:     importUsers,
+	},
+	"export": {
+		summary: "Export subscriptions, quotas, usages, add-ons or updates as CSV, JSON Lines or Parquet",
+		run:     export,
+	},
+	"rename-user": {
+		summary: "Change a user's username",
+		run:     renameUser,
+	},
+	"merge-users": {
+		summary: "Move a user's subscriptions, updates and group memberships to another user and remove them",
+		run:     mergeUsers,
+	},
+	"fold-usernames": {
+		summary: "Rename or merge the users whose stored usernames contain upper case letters",
+		run:     foldUsernames,
+	},
+	"activate-subscriptions": {
+		summary: "Activate the scheduled subscriptions whose start dates have passed",
+		run:     activateSubscriptions,
+	},
+	"refresh-rollups": {
+		summary: "Refresh the daily and monthly usage rollups from the updates recorded since the last refresh",
+		run:     refreshRollups,
+	},
+	"rebuild-rollups": {
+		summary: "Rebuild the usage rollups for a user or for every user from all of the usage updates",
+		run:     rebuildRollups,
+	},
+}
+
+// commandContext contains the settings shared by all of the administrative commands.
+type commandContext struct {
+	app    *app.App
+	out    io.Writer
+	format string
+}
+
+// Run runs the administrative command named by the first argument. The remaining arguments are parsed as the flags
+// accepted by the command. Results are written to out.
+func Run(ctx context.Context, a *app.App, args []string, out io.Writer) error {
+	if len(args) == 0 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		usage(out)
+		return nil
+	}
+
+	cmd, ok := commands[args[0]]
+	if !ok {
+		usage(os.Stderr)
+		return fmt.Errorf("unrecognized admin command: %s", args[0])
+	}
+
+	err := cmd.run(ctx, &commandContext{app: a, out: out}, args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	return err
+}
+
+// usage writes the list of available commands to w.
+func usage(w io.Writer) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(w, "Usage: subscriptions admin <command> [flags]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(tw, "  %s\t%s\n", name, commands[name].summary)
+	}
+	tw.Flush() // nolint:errcheck
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Run `subscriptions admin <command> -h` to list the flags accepted by a command.")
+}
+
+// flagSet creates a flag set for a command and adds the flags shared by every command to it. The actor flag sets
+// the name recorded in the audit log and the created_by and last_modified_by columns.
+func (c *commandContext) flagSet(name string, actor *string) *flag.FlagSet {
+	fs := flag.NewFlagSet("subscriptions admin "+name, flag.ContinueOnError)
+	fs.StringVar(&c.format, "output", FormatTable, "The output format, either table or json")
+	fs.StringVar(actor, "actor", os.Getenv("USER"), "The username recorded as responsible for any changes")
+	return fs
+}
+
+// parse parses the flags for a command and validates the shared flags. The returned context identifies the actor.
+func (c *commandContext) parse(ctx context.Context, fs *flag.FlagSet, actor *string, args []string) (context.Context, error) {
+	if err := fs.Parse(args); err != nil {
+		return ctx, err
+	}
+	if fs.NArg() > 0 {
+		return ctx, fmt.Errorf("unexpected arguments: %s", strings.Join(fs.Args(), " "))
+	}
+	if c.format != FormatTable && c.format != FormatJSON {
+		return ctx, fmt.Errorf("unsupported output format: %s", c.format)
+	}
+	return common.WithActor(ctx, *actor), nil
+}
+
+// required returns an error if any of the named string flags are empty.
+func required(fs *flag.FlagSet, names ...string) error {
+	for _, name := range names {
+		if f := fs.Lookup(name); f == nil || f.Value.String() == "" {
+			return fmt.Errorf("the -%s flag is required", name)
+		}
+	}
+	return nil
+}
+
+// writeJSON writes one or more protocol buffer messages to the output as JSON. A single message is written as an
+// object and a list of messages is written as an array.
+func writeJSON[T proto.Message](c *commandContext, messages []T, list bool) error {
+	marshal := protojson.MarshalOptions{UseProtoNames: true}
+
+	values := make([]json.RawMessage, len(messages))
+	for i, m := range messages {
+		b, err := marshal.Marshal(m)
+		if err != nil {
+			return err
+		}
+		values[i] = b
+	}
+
+	var value any = values
+	if !list && len(values) == 1 {
+		value = values[0]
+	}
+
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeValue writes a value that isn't a protocol buffer message to the output as JSON.
+func writeValue(c *commandContext, value any) error {
+	encoder := json.NewEncoder(c.out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
+
+// writeTable writes rows of values to the output as an aligned table.
+func writeTable(c *commandContext, headers []string, rows [][]string) error {
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(headers, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// formatFloat formats a numeric value without unnecessary trailing zeros.
+func formatFloat(value float64) string {
+	return fmt.Sprintf("%g", value)
+}
+
+func listPlans(ctx context.Context, c *commandContext, args []string) error {
+	var actor string
+	fs := c.flagSet("list-plans", &actor)
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	plans, err := c.app.ListPlans(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to list plans")
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, plans, true)
+	}
+
+	rows := make([][]string, len(plans))
+	for i, p := range plans {
+		quotas := make([]string, 0, len(p.PlanQuotaDefaults))
+		for _, qd := range p.PlanQuotaDefaults {
+			quotas = append(quotas, fmt.Sprintf("%s=%s", qd.ResourceType.GetName(), formatFloat(qd.QuotaValue)))
+		}
+		rows[i] = []string{p.Uuid, p.Name, p.Description, strings.Join(quotas, ", ")}
+	}
+	return writeTable(c, []string{"ID", "NAME", "DESCRIPTION", "QUOTA DEFAULTS"}, rows)
+}
+
+func subscribe(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor     string
+		request   qms.AddUserRequest
+		periods   int
+		startDate string
+	)
+
+	fs := c.flagSet("subscribe", &actor)
+	fs.StringVar(&request.Username, "user", "", "The username of the user to subscribe (required)")
+	fs.StringVar(&request.PlanName, "plan", "", "The name of the plan to subscribe the user to (required)")
+	fs.BoolVar(&request.Paid, "paid", false, "Whether the user paid for the subscription")
+	fs.IntVar(&periods, "periods", 0, "The number of years the subscription lasts")
+	fs.StringVar(&startDate, "start-date", "", "The date the subscription starts, if it should start in the future")
+	fs.StringVar(&request.EndDate, "end-date", "", "The date the subscription ends")
+	fs.BoolVar(&request.Force, "force", false, "Create a new subscription even if the user is already on the plan")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user", "plan"); err != nil {
+		return err
+	}
+	request.Periods = int32(periods)
+
+	response, err := c.app.SubscribeUser(ctx, &request, startDate)
+	if err != nil {
+		return errors.Wrapf(err, "unable to subscribe %s to %s", request.Username, request.PlanName)
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, []*qms.AddUserResponse{response}, false)
+	}
+
+	rows := [][]string{{response.Uuid, response.Username, response.PlanUuid, response.PlanName}}
+	return writeTable(c, []string{"USER ID", "USERNAME", "PLAN ID", "PLAN"}, rows)
+}
+
+func attachAddon(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username, addonID string
+
+	fs := c.flagSet("attach-addon", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose subscription the add-on applies to (required)")
+	fs.StringVar(&addonID, "addon", "", "The ID of the add-on to apply (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user", "addon"); err != nil {
+		return err
+	}
+
+	subAddon, err := c.app.AttachAddon(ctx, username, addonID)
+	if err != nil {
+		return errors.Wrapf(err, "unable to apply add-on %s for %s", addonID, username)
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, []*qms.SubscriptionAddon{subAddon}, false)
+	}
+
+	rows := [][]string{{
+		subAddon.Uuid,
+		subAddon.Addon.GetName(),
+		subAddon.SubscriptionId,
+		formatFloat(subAddon.Amount),
+		fmt.Sprint(subAddon.Paid),
+	}}
+	return writeTable(c, []string{"ID", "ADD-ON", "SUBSCRIPTION ID", "AMOUNT", "PAID"}, rows)
+}
+
+func setQuota(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username, resourceType string
+	var value float64
+
+	fs := c.flagSet("set-quota", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose quota is being set (required)")
+	fs.StringVar(&resourceType, "resource-type", "", "The name of the resource type, for example cpu.hours (required)")
+	fs.Float64Var(&value, "value", 0, "The new quota value")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user", "resource-type"); err != nil {
+		return err
+	}
+
+	quota, err := c.app.SetQuota(ctx, username, resourceType, value)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the %s quota for %s", resourceType, username)
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, []*qms.Quota{quota}, false)
+	}
+
+	rows := [][]string{{
+		quota.Uuid,
+		quota.ResourceType.GetName(),
+		formatFloat(quota.Quota),
+		quota.ResourceType.GetUnit(),
+	}}
+	return writeTable(c, []string{"ID", "RESOURCE TYPE", "QUOTA", "UNIT"}, rows)
+}
+
+func listUpdates(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username string
+
+	fs := c.flagSet("updates", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose updates are listed (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user"); err != nil {
+		return err
+	}
+
+	updates, err := c.app.UserUpdates(ctx, username)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the updates for %s", username)
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, updates, true)
+	}
+
+	rows := make([][]string, len(updates))
+	for i, u := range updates {
+		rows[i] = []string{
+			u.Uuid,
+			u.EffectiveDate.AsTime().Format("2006-01-02T15:04:05Z07:00"),
+			u.ValueType,
+			u.Operation.GetName(),
+			u.ResourceType.GetName(),
+			formatFloat(u.Value),
+		}
+	}
+	return writeTable(c, []string{"ID", "EFFECTIVE DATE", "VALUE TYPE", "OPERATION", "RESOURCE TYPE", "VALUE"}, rows)
+}
+
+func recompute(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username string
+
+	fs := c.flagSet("recompute", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose usages are recalculated (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user"); err != nil {
+		return err
+	}
+
+	usages, err := c.app.RecomputeUsages(ctx, username)
+	if err != nil {
+		return errors.Wrapf(err, "unable to recompute the usages for %s", username)
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, usages, true)
+	}
+
+	rows := make([][]string, len(usages))
+	for i, u := range usages {
+		rows[i] = []string{u.Uuid, u.ResourceType.GetName(), formatFloat(u.Usage), u.ResourceType.GetUnit()}
+	}
+	return writeTable(c, []string{"ID", "RESOURCE TYPE", "USAGE", "UNIT"}, rows)
+}
+
+func activateSubscriptions(ctx context.Context, c *commandContext, args []string) error {
+	var actor string
+
+	fs := c.flagSet("activate-subscriptions", &actor)
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	subscriptions, err := c.app.ActivatePendingSubscriptions(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to activate the scheduled subscriptions")
+	}
+
+	if c.format == FormatJSON {
+		return writeJSON(c, subscriptions, true)
+	}
+
+	rows := make([][]string, len(subscriptions))
+	for i, s := range subscriptions {
+		rows[i] = []string{
+			s.Uuid,
+			s.User.GetUsername(),
+			s.Plan.GetName(),
+			s.EffectiveStartDate.AsTime().Format("2006-01-02T15:04:05Z07:00"),
+			s.EffectiveEndDate.AsTime().Format("2006-01-02T15:04:05Z07:00"),
+		}
+	}
+	return writeTable(c, []string{"ID", "USERNAME", "PLAN", "START DATE", "END DATE"}, rows)
+}
+
+func refreshRollups(ctx context.Context, c *commandContext, args []string) error {
+	var actor string
+
+	fs := c.flagSet("refresh-rollups", &actor)
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.app.RefreshUsageRollups(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to refresh the usage rollups")
+	}
+	return writeRollupRefresh(c, result)
+}
+
+func rebuildRollups(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username string
+
+	fs := c.flagSet("rebuild-rollups", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose rollups to rebuild; defaults to every user")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	result, err := c.app.RebuildUsageRollups(ctx, username)
+	if err != nil {
+		return errors.Wrap(err, "unable to rebuild the usage rollups")
+	}
+	return writeRollupRefresh(c, result)
+}
+
+// writeRollupRefresh writes the result of refreshing or rebuilding the usage rollups.
+func writeRollupRefresh(c *commandContext, result *app.UsageRollupRefresh) error {
+	if c.format == FormatJSON {
+		return writeValue(c, result)
+	}
+
+	rows := [][]string{{
+		result.RefreshedThrough.Format("2006-01-02T15:04:05Z07:00"),
+		strconv.Itoa(result.Rebuilt),
+		strconv.Itoa(result.Failed),
+	}}
+	return writeTable(c, []string{"REFRESHED THROUGH", "REBUILT", "FAILED"}, rows)
+}
+
+// subscriptionRows formats subscription records as table rows.
+func subscriptionRows(records ...app.SubscriptionRecord) [][]string {
+	rows := make([][]string, len(records))
+	for i, r := range records {
+		rows[i] = []string{
+			r.ID,
+			r.PlanName,
+			r.Status,
+			r.EffectiveStartDate.Format("2006-01-02T15:04:05Z07:00"),
+			r.EffectiveEndDate.Format("2006-01-02T15:04:05Z07:00"),
+			r.CancellationReason,
+		}
+	}
+	return rows
+}
+
+// subscriptionHeaders are the column headings for subscription records.
+var subscriptionHeaders = []string{"ID", "PLAN", "STATUS", "START DATE", "END DATE", "CANCELLATION REASON"}
+
+// optionalBool parses the value of a flag that can be true, false or blank. Nil is returned if the value is blank.
+func optionalBool(name, value string) (*bool, error) {
+	if value == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		return nil, fmt.Errorf("invalid value for -%s: %s", name, value)
+	}
+	return &parsed, nil
+}
+
+func listUsers(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, paid, inOverage, expiresAfter, expiresBefore string
+		limit, offset                                       uint
+		filter                                              db.UserFilter
+	)
+
+	fs := c.flagSet("users", &actor)
+	fs.StringVar(&filter.UsernamePrefix, "prefix", "", "Only list users whose usernames start with this prefix")
+	fs.StringVar(&filter.PlanName, "plan", "", "Only list users whose active subscription is to this plan")
+	fs.StringVar(&paid, "paid", "", "Only list users whose active subscription is (true) or isn't (false) paid")
+	fs.StringVar(&expiresAfter, "expires-after", "", "Only list users whose active subscription ends at or after this date")
+	fs.StringVar(&expiresBefore, "expires-before", "", "Only list users whose active subscription ends before this date")
+	fs.StringVar(&inOverage, "in-overage", "", "Only list users who are (true) or aren't (false) in overage")
+	fs.UintVar(&limit, "limit", 100, "The maximum number of users to list, up to 1000, or 0 for the maximum")
+	fs.UintVar(&offset, "offset", 0, "The number of users to skip")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	if filter.Paid, err = optionalBool("paid", paid); err != nil {
+		return err
+	}
+	if filter.InOverage, err = optionalBool("in-overage", inOverage); err != nil {
+		return err
+	}
+	if expiresAfter != "" {
+		if filter.ExpiresAfter, err = utils.ParseTimestamp(expiresAfter); err != nil {
+			return err
+		}
+	}
+	if expiresBefore != "" {
+		if filter.ExpiresBefore, err = utils.ParseTimestamp(expiresBefore); err != nil {
+			return err
+		}
+	}
+
+	users, err := c.app.ListUsers(ctx, &filter, limit, offset)
+	if err != nil {
+		return errors.Wrap(err, "unable to list users")
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, users)
+	}
+
+	rows := make([][]string, len(users.Users))
+	for i, u := range users.Users {
+		var plan, paid, endDate string
+		if u.Subscription != nil {
+			plan = u.Subscription.PlanName
+			paid = strconv.FormatBool(u.Subscription.Paid)
+			endDate = u.Subscription.EffectiveEndDate.Format("2006-01-02T15:04:05Z07:00")
+		}
+		rows[i] = []string{u.ID, u.Username, plan, paid, endDate, strconv.FormatBool(u.InOverage)}
+	}
+	return writeTable(c, []string{"ID", "USERNAME", "PLAN", "PAID", "END DATE", "IN OVERAGE"}, rows)
+}
+
+func listSubscriptions(ctx context.Context, c *commandContext, args []string) error {
+	var actor, username string
+
+	fs := c.flagSet("subscriptions", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose subscriptions are listed (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user"); err != nil {
+		return err
+	}
+
+	history, err := c.app.SubscriptionHistory(ctx, username)
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the subscriptions for %s", username)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, history.Subscriptions)
+	}
+
+	return writeTable(c, subscriptionHeaders, subscriptionRows(history.Subscriptions...))
+}
+
+func cancelSubscription(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, username, subscriptionID string
+		request                         app.CancellationRequest
+	)
+
+	fs := c.flagSet("cancel", &actor)
+	fs.StringVar(&username, "user", "", "The username of the user whose active subscription is cancelled")
+	fs.StringVar(&subscriptionID, "subscription", "", "The ID of the subscription to cancel, instead of -user")
+	fs.StringVar(&request.When, "when", app.CancelNow, "When the subscription ends, either now or period_end")
+	fs.StringVar(&request.Reason, "reason", "", "The reason for the cancellation")
+	fs.StringVar(&request.Addons, "addons", app.KeepAddons, "What happens to the subscription's add-ons, either keep or remove")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if (username == "") == (subscriptionID == "") {
+		return fmt.Errorf("exactly one of the -user and -subscription flags is required")
+	}
+
+	if subscriptionID == "" {
+		if subscriptionID, err = c.app.ActiveSubscriptionID(ctx, username); err != nil {
+			return errors.Wrapf(err, "unable to find the active subscription for %s", username)
+		}
+	}
+
+	record, err := c.app.CancelSubscription(ctx, subscriptionID, &request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to cancel subscription %s", subscriptionID)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, record)
+	}
+
+	return writeTable(c, subscriptionHeaders, subscriptionRows(*record))
+}
+
+func setGracePeriod(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, planName string
+		request         app.GracePeriodRequest
+	)
+
+	fs := c.flagSet("set-grace-period", &actor)
+	fs.StringVar(&planName, "plan", "", "The name of the plan (required)")
+	fs.IntVar(&request.Days, "days", 0, "The number of days in the grace period")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "plan"); err != nil {
+		return err
+	}
+
+	plans, err := c.app.ListPlans(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to list plans")
+	}
+	var planID string
+	for _, p := range plans {
+		if p.Name == planName {
+			planID = p.Uuid
+		}
+	}
+	if planID == "" {
+		return fmt.Errorf("plan not found: %s", planName)
+	}
+
+	gracePeriod, err := c.app.SetPlanGracePeriod(ctx, planID, &request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the grace period for %s", planName)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, gracePeriod)
+	}
+
+	rows := [][]string{{gracePeriod.PlanID, gracePeriod.PlanName, fmt.Sprintf("%d", gracePeriod.Days)}}
+	return writeTable(c, []string{"PLAN ID", "PLAN", "GRACE PERIOD DAYS"}, rows)
+}
+
+// groupRows formats groups as table rows.
+func groupRows(groups ...db.Group) [][]string {
+	rows := make([][]string, len(groups))
+	for i, g := range groups {
+		rows[i] = []string{g.ID, g.Name, g.Description}
+	}
+	return rows
+}
+
+// writeGroupDetails writes a group along with its members and the pooled usage of each of its quotas.
+func writeGroupDetails(c *commandContext, details *app.GroupDetails) error {
+	if c.format == FormatJSON {
+		return writeValue(c, details)
+	}
+
+	pooled := make([]string, len(details.Allocations))
+	for i, a := range details.Allocations {
+		pooled[i] = fmt.Sprintf("%s=%s/%s", a.ResourceTypeName, formatFloat(a.UsageValue), formatFloat(a.QuotaValue))
+	}
+	plan := ""
+	if details.Subscription != nil {
+		plan = details.Subscription.PlanName
+	}
+
+	rows := [][]string{{details.ID, details.Name, strings.Join(details.Members, ", "), plan, strings.Join(pooled, ", ")}}
+	return writeTable(c, []string{"ID", "NAME", "MEMBERS", "PLAN", "POOLED USAGE"}, rows)
+}
+
+func listGroups(ctx context.Context, c *commandContext, args []string) error {
+	var actor string
+
+	fs := c.flagSet("groups", &actor)
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	groups, err := c.app.ListGroups(ctx)
+	if err != nil {
+		return errors.Wrap(err, "unable to list groups")
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, groups.Groups)
+	}
+
+	return writeTable(c, []string{"ID", "NAME", "DESCRIPTION"}, groupRows(groups.Groups...))
+}
+
+func addGroup(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor   string
+		request app.GroupRequest
+	)
+
+	fs := c.flagSet("add-group", &actor)
+	fs.StringVar(&request.Name, "name", "", "The name of the group (required)")
+	fs.StringVar(&request.Description, "description", "", "A description of the group")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "name"); err != nil {
+		return err
+	}
+
+	group, err := c.app.AddGroup(ctx, &request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to add group %s", request.Name)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, group)
+	}
+
+	return writeTable(c, []string{"ID", "NAME", "DESCRIPTION"}, groupRows(*group))
+}
+
+func deleteGroup(ctx context.Context, c *commandContext, args []string) error {
+	var actor, name string
+
+	fs := c.flagSet("delete-group", &actor)
+	fs.StringVar(&name, "name", "", "The name of the group (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "name"); err != nil {
+		return err
+	}
+
+	details, err := c.app.DeleteGroup(ctx, name)
+	if err != nil {
+		return errors.Wrapf(err, "unable to delete group %s", name)
+	}
+	return writeGroupDetails(c, details)
+}
+
+func addGroupMember(ctx context.Context, c *commandContext, args []string) error {
+	var actor, groupName, username string
+
+	fs := c.flagSet("add-group-member", &actor)
+	fs.StringVar(&groupName, "group", "", "The name of the group (required)")
+	fs.StringVar(&username, "user", "", "The username of the user to add to the group (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "group", "user"); err != nil {
+		return err
+	}
+
+	details, err := c.app.AddGroupMember(ctx, groupName, username)
+	if err != nil {
+		return errors.Wrapf(err, "unable to add %s to group %s", username, groupName)
+	}
+
+	return writeGroupDetails(c, details)
+}
+
+func removeGroupMember(ctx context.Context, c *commandContext, args []string) error {
+	var actor, groupName, username string
+
+	fs := c.flagSet("remove-group-member", &actor)
+	fs.StringVar(&groupName, "group", "", "The name of the group (required)")
+	fs.StringVar(&username, "user", "", "The username of the user to remove from the group (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "group", "user"); err != nil {
+		return err
+	}
+
+	details, err := c.app.RemoveGroupMember(ctx, groupName, username)
+	if err != nil {
+		return errors.Wrapf(err, "unable to remove %s from group %s", username, groupName)
+	}
+
+	return writeGroupDetails(c, details)
+}
+
+func subscribeGroup(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, groupName string
+		request          app.GroupSubscriptionRequest
+		periods          int
+	)
+
+	fs := c.flagSet("subscribe-group", &actor)
+	fs.StringVar(&groupName, "group", "", "The name of the group to subscribe (required)")
+	fs.StringVar(&request.PlanName, "plan", "", "The name of the plan to subscribe the group to (required)")
+	fs.BoolVar(&request.Paid, "paid", false, "Whether the group paid for the subscription")
+	fs.IntVar(&periods, "periods", 0, "The number of years the subscription lasts")
+	fs.StringVar(&request.EndDate, "end-date", "", "The date the subscription ends")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "group", "plan"); err != nil {
+		return err
+	}
+	request.Periods = int32(periods)
+
+	if _, err = c.app.SubscribeGroup(ctx, groupName, &request); err != nil {
+		return errors.Wrapf(err, "unable to subscribe group %s to %s", groupName, request.PlanName)
+	}
+
+	details, err := c.app.GetGroup(ctx, groupName)
+	if err != nil {
+		return errors.Wrapf(err, "unable to look up group %s", groupName)
+	}
+
+	return writeGroupDetails(c, details)
+}
+
+func importUsers(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, path, format string
+		dryRun              bool
+	)
+
+	fs := c.flagSet("import-users", &actor)
+	fs.StringVar(&path, "file", "", "The path to the file to import, or - to read from standard input (required)")
+	fs.StringVar(&format, "format", "", "Either csv or jsonl; taken from the file extension by default")
+	fs.BoolVar(&dryRun, "dry-run", false, "Validate and report on the rows without saving them")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "file"); err != nil {
+		return err
+	}
+
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".csv":
+			format = app.ImportFormatCSV
+		case ".jsonl", ".ndjson":
+			format = app.ImportFormatJSONL
+		default:
+			return fmt.Errorf("unable to determine the format of %s; use the -format flag", path)
+		}
+	}
+
+	in := os.Stdin
+	if path != "-" {
+		if in, err = os.Open(path); err != nil {
+			return err
+		}
+		defer in.Close()
+	}
+
+	report, err := c.app.ImportUsers(ctx, in, format, dryRun)
+	if err != nil {
+		return errors.Wrapf(err, "unable to import users from %s", path)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, report)
+	}
+
+	rows := make([][]string, len(report.Rows))
+	for i, r := range report.Rows {
+		rows[i] = []string{fmt.Sprintf("%d", r.Row), r.Username, r.PlanName, r.Result, r.SubscriptionID, r.Error}
+	}
+	return writeTable(c, []string{"ROW", "USERNAME", "PLAN", "RESULT", "SUBSCRIPTION ID", "ERROR"}, rows)
+}
+
+func export(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, dataset, format, start, end, path string
+		filter                                   db.ExportFilter
+	)
+
+	fs := c.flagSet("export", &actor)
+	fs.StringVar(&dataset, "dataset", "", "One of "+strings.Join(app.ExportDatasets, ", ")+" (required)")
+	fs.StringVar(&format, "format", "", "Either csv, jsonl or parquet; taken from the file extension by default")
+	fs.StringVar(&start, "start", "", "Only export rows in effect at or after this date")
+	fs.StringVar(&end, "end", "", "Only export rows in effect before this date")
+	fs.StringVar(&filter.PlanName, "plan", "", "Only export rows for subscriptions to this plan")
+	fs.StringVar(&path, "file", "-", "The path to the file to write, or - to write to standard output")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "dataset"); err != nil {
+		return err
+	}
+
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(path)) {
+		case ".jsonl", ".ndjson":
+			format = app.ExportFormatJSONL
+		case ".parquet":
+			format = app.ExportFormatParquet
+		default:
+			format = app.ExportFormatCSV
+		}
+	}
+	if err = app.ValidateExport(dataset, format); err != nil {
+		return err
+	}
+	if start != "" {
+		if filter.Start, err = utils.ParseTimestamp(start); err != nil {
+			return err
+		}
+	}
+	if end != "" {
+		if filter.End, err = utils.ParseTimestamp(end); err != nil {
+			return err
+		}
+	}
+
+	// The rows are written to standard output if no file is given, so there's nothing else to report.
+	if path == "-" {
+		_, err = c.app.Export(ctx, c.out, dataset, format, &filter)
+		return errors.Wrapf(err, "unable to export %s", dataset)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	count, err := c.app.Export(ctx, out, dataset, format, &filter)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "unable to export %s to %s", dataset, path)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, map[string]any{"dataset": dataset, "format": format, "file": path, "rows": count})
+	}
+	return writeTable(
+		c, []string{"DATASET", "FORMAT", "FILE", "ROWS"}, [][]string{{dataset, format, path, strconv.Itoa(count)}},
+	)
+}
+
+func renameUser(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, username string
+		request         app.RenameUserRequest
+	)
+
+	fs := c.flagSet("rename-user", &actor)
+	fs.StringVar(&username, "user", "", "The current username of the user (required)")
+	fs.StringVar(&request.Username, "to", "", "The new username (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "user", "to"); err != nil {
+		return err
+	}
+
+	renamed, err := c.app.RenameUser(ctx, username, &request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to rename %s", username)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, renamed)
+	}
+
+	rows := [][]string{{renamed.ID, renamed.PreviousUsername, renamed.Username}}
+	return writeTable(c, []string{"ID", "PREVIOUS USERNAME", "USERNAME"}, rows)
+}
+
+func mergeUsers(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor, target string
+		request       app.MergeUsersRequest
+	)
+
+	fs := c.flagSet("merge-users", &actor)
+	fs.StringVar(&request.Source, "source", "", "The username of the user to merge and remove (required)")
+	fs.StringVar(&target, "target", "", "The username of the user to merge into (required)")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+	if err = required(fs, "source", "target"); err != nil {
+		return err
+	}
+
+	merged, err := c.app.MergeUsers(ctx, target, &request)
+	if err != nil {
+		return errors.Wrapf(err, "unable to merge %s into %s", request.Source, target)
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, merged)
+	}
+
+	rows := [][]string{{
+		merged.Source.Username,
+		merged.Target.Username,
+		fmt.Sprintf("%d", merged.Subscriptions),
+		fmt.Sprintf("%d", merged.Updates),
+		fmt.Sprintf("%d", merged.GroupMemberships),
+		merged.EndedSubscriptionID,
+		strings.Join(merged.CancelledSubscriptionIDs, ","),
+	}}
+	header := []string{
+		"SOURCE", "TARGET", "SUBSCRIPTIONS", "UPDATES", "GROUP MEMBERSHIPS", "ENDED SUBSCRIPTION", "CANCELLED SUBSCRIPTIONS",
+	}
+	return writeTable(c, header, rows)
+}
+
+func foldUsernames(ctx context.Context, c *commandContext, args []string) error {
+	var (
+		actor  string
+		dryRun bool
+	)
+
+	fs := c.flagSet("fold-usernames", &actor)
+	fs.BoolVar(&dryRun, "dry-run", false, "Report on the users that would be renamed or merged without changing them")
+	ctx, err := c.parse(ctx, fs, &actor, args)
+	if err != nil {
+		return err
+	}
+
+	report, err := c.app.FoldUsernames(ctx, dryRun)
+	if err != nil {
+		return errors.Wrap(err, "unable to fold the usernames")
+	}
+
+	if c.format == FormatJSON {
+		return writeValue(c, report)
+	}
+
+	rows := make([][]string, len(report.Users))
+	for i, u := range report.Users {
+		rows[i] = []string{u.Username, u.FoldedUsername, u.Action, u.Error}
+	}
+	return writeTable(c, []string{"USERNAME", "FOLDED USERNAME", "ACTION", "ERROR"}, rows)
+}
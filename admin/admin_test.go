@@ -0,0 +1,200 @@
+package admin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/app"
+	"github.com/cyverse-de/subscriptions/db"
+)
+
+const testUserDomain = "@example.org"
+
+// newTestApp returns an App backed by a MemoryDatabase that contains the default plan.
+func newTestApp(t *testing.T) *app.App {
+	t.Helper()
+	ctx := context.Background()
+	m := db.NewMemoryDatabase()
+
+	cpu, err := m.GetResourceTypeByName(ctx, "cpu.hours")
+	if err != nil || cpu == nil || cpu.ID == "" {
+		t.Fatalf("unable to look up the cpu.hours resource type: %v", err)
+	}
+
+	effective := time.Now().AddDate(-1, 0, 0)
+	_, err = m.AddPlan(ctx, &db.Plan{
+		Name:          db.DefaultPlanName,
+		Description:   "The default plan",
+		QuotaDefaults: []db.PlanQuotaDefault{{QuotaValue: 20, ResourceType: *cpu, EffectiveDate: effective}},
+		Rates:         []db.PlanRate{{Rate: 0, EffectiveDate: effective}},
+	})
+	if err != nil {
+		t.Fatalf("unable to add the default plan: %s", err)
+	}
+
+	return app.New(nil, m, testUserDomain, nil)
+}
+
+// runCommand runs an administrative command and returns its output.
+func runCommand(t *testing.T, a *app.App, args ...string) (string, error) {
+	t.Helper()
+	var out bytes.Buffer
+	err := Run(context.Background(), a, args, &out)
+	return out.String(), err
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		name       string
+		setup      [][]string
+		args       []string
+		wantErr    string
+		wantOutput []string
+	}{
+		{
+			name:       "usage",
+			args:       []string{"help"},
+			wantOutput: []string{"Usage: subscriptions admin", "list-plans", "merge-users"},
+		},
+		{
+			name:    "unknown command",
+			args:    []string{"frobnicate"},
+			wantErr: "unrecognized admin command: frobnicate",
+		},
+		{
+			name:       "list plans",
+			args:       []string{"list-plans"},
+			wantOutput: []string{"NAME", db.DefaultPlanName, "cpu.hours=20"},
+		},
+		{
+			name:    "unsupported output format",
+			args:    []string{"list-plans", "-output", "yaml"},
+			wantErr: "unsupported output format: yaml",
+		},
+		{
+			name:    "unexpected arguments",
+			args:    []string{"list-plans", "extra"},
+			wantErr: "unexpected arguments: extra",
+		},
+		{
+			name:       "subscribe",
+			args:       []string{"subscribe", "-user", "sarahr", "-plan", db.DefaultPlanName},
+			wantOutput: []string{"USERNAME", "sarahr", db.DefaultPlanName},
+		},
+		{
+			name:    "subscribe without a plan",
+			args:    []string{"subscribe", "-user", "sarahr"},
+			wantErr: "the -plan flag is required",
+		},
+		{
+			name:    "subscribe to an unknown plan",
+			args:    []string{"subscribe", "-user", "sarahr", "-plan", "Nonexistent"},
+			wantErr: "unable to subscribe sarahr to Nonexistent",
+		},
+		{
+			name:       "set quota",
+			setup:      [][]string{{"subscribe", "-user", "sarahr", "-plan", db.DefaultPlanName}},
+			args:       []string{"set-quota", "-user", "sarahr", "-resource-type", "cpu.hours", "-value", "50"},
+			wantOutput: []string{"RESOURCE TYPE", "cpu.hours", "50"},
+		},
+		{
+			name:    "set quota without a resource type",
+			args:    []string{"set-quota", "-user", "sarahr"},
+			wantErr: "the -resource-type flag is required",
+		},
+		{
+			name:       "list users",
+			setup:      [][]string{{"subscribe", "-user", "sarahr", "-plan", db.DefaultPlanName}},
+			args:       []string{"users"},
+			wantOutput: []string{"sarahr", db.DefaultPlanName},
+		},
+		{
+			name:       "list subscriptions",
+			setup:      [][]string{{"subscribe", "-user", "sarahr", "-plan", db.DefaultPlanName}},
+			args:       []string{"subscriptions", "-user", "sarahr"},
+			wantOutput: []string{db.DefaultPlanName},
+		},
+		{
+			name:       "delete group",
+			setup:      [][]string{{"add-group", "-name", "lab"}, {"add-group-member", "-group", "lab", "-user", "sarahr"}},
+			args:       []string{"delete-group", "-name", "lab"},
+			wantOutput: []string{"lab", "sarahr"},
+		},
+		{
+			name:    "delete unknown group",
+			args:    []string{"delete-group", "-name", "lab"},
+			wantErr: "unable to delete group lab",
+		},
+		{
+			name:       "fold usernames",
+			args:       []string{"fold-usernames", "-dry-run"},
+			wantOutput: []string{"FOLDED USERNAME", "ACTION"},
+		},
+		{
+			name:    "list updates without a user",
+			args:    []string{"updates"},
+			wantErr: "the -user flag is required",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestApp(t)
+			for _, args := range tt.setup {
+				if _, err := runCommand(t, a, args...); err != nil {
+					t.Fatalf("unable to run %s: %s", args[0], err)
+				}
+			}
+
+			output, err := runCommand(t, a, tt.args...)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("expected an error containing %q, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			for _, want := range tt.wantOutput {
+				if !strings.Contains(output, want) {
+					t.Errorf("expected the output to contain %q, got:\n%s", want, output)
+				}
+			}
+		})
+	}
+}
+
+func TestRunJSONOutput(t *testing.T) {
+	a := newTestApp(t)
+
+	output, err := runCommand(t, a, "subscribe", "-user", "sarahr", "-plan", db.DefaultPlanName, "-output", "json")
+	if err != nil {
+		t.Fatalf("unable to subscribe the user: %s", err)
+	}
+
+	var subscribed map[string]any
+	if err = json.Unmarshal([]byte(output), &subscribed); err != nil {
+		t.Fatalf("the output isn't a JSON object: %s\n%s", err, output)
+	}
+	if subscribed["username"] != "sarahr" || subscribed["plan_name"] != db.DefaultPlanName {
+		t.Errorf("unexpected subscription: %s", output)
+	}
+
+	output, err = runCommand(t, a, "list-plans", "-output", "json")
+	if err != nil {
+		t.Fatalf("unable to list the plans: %s", err)
+	}
+
+	var plans []map[string]any
+	if err = json.Unmarshal([]byte(output), &plans); err != nil {
+		t.Fatalf("the output isn't a JSON array: %s\n%s", err, output)
+	}
+	if len(plans) != 1 || plans[0]["name"] != db.DefaultPlanName {
+		t.Errorf("unexpected plans: %s", output)
+	}
+}
@@ -0,0 +1,417 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// RenameUserRequest is the request body for renaming a user.
+type RenameUserRequest struct {
+	// Username is the user's new username.
+	Username string `json:"username"`
+}
+
+// MergeUsersRequest is the request body for merging one user into another.
+type MergeUsersRequest struct {
+	// Source is the username of the user that is merged into the other user and then removed.
+	Source string `json:"source"`
+}
+
+// UserAccount identifies a user in the responses for renames and merges.
+type UserAccount struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+}
+
+// RenamedUser is the response body for renaming a user.
+type RenamedUser struct {
+	UserAccount
+	PreviousUsername string `json:"previous_username"`
+}
+
+// UserMergeResult is the response body for merging one user into another. EndedSubscriptionID is set when both users
+// had an active subscription and one of them was ended so that the merged user only has one.
+// CancelledSubscriptionIDs lists the scheduled subscriptions that were cancelled so that they don't overlap with the
+// subscriptions that the merged user keeps.
+type UserMergeResult struct {
+	Source UserAccount `json:"source"`
+	Target UserAccount `json:"target"`
+	db.UserMerge
+	EndedSubscriptionID      string   `json:"ended_subscription_id,omitempty"`
+	CancelledSubscriptionIDs []string `json:"cancelled_subscription_ids,omitempty"`
+}
+
+// Actions taken for the users whose usernames are folded to lower case.
+const (
+	// FoldActionRename renames a user to the folded username.
+	FoldActionRename = "rename"
+
+	// FoldActionMerge merges a user into the user that already has the folded username.
+	FoldActionMerge = "merge"
+
+	// FoldActionSkip leaves a user alone, because the username can't be folded or the rename or merge failed.
+	FoldActionSkip = "skip"
+)
+
+// FoldedUsername describes what happens to a user whose stored username contains upper case letters.
+type FoldedUsername struct {
+	Username       string `json:"username"`
+	FoldedUsername string `json:"folded_username,omitempty"`
+	Action         string `json:"action"`
+	Error          string `json:"error,omitempty"`
+}
+
+// UsernameFolding is the report produced when the stored usernames are folded to lower case.
+type UsernameFolding struct {
+	DryRun bool             `json:"dry_run"`
+	Users  []FoldedUsername `json:"users"`
+}
+
+// userAccount looks up a user by username and returns ErrUserNotFound if the user doesn't exist.
+func userAccount(ctx context.Context, d db.Repository, tx db.Tx, username string) (*UserAccount, error) {
+	id, err := d.GetUserID(ctx, username, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, errors.ErrUserNotFound.WithField("username", username)
+	}
+	return &UserAccount{ID: id, Username: username}, nil
+}
+
+// storedUsername returns a username that's used to look up a user exactly as it's stored. Stored usernames aren't
+// normalized, because usernames that no longer normalize to themselves, such as usernames with upper case letters
+// or usernames that are now aliases, have to be renamed or merged into another user by their stored names.
+func storedUsername(username, field string) (string, error) {
+	username = strings.TrimSpace(username)
+	if username == "" {
+		return "", errors.ErrMissingField.WithField("field", field)
+	}
+	return username, nil
+}
+
+// optionalActiveSubscription returns a user's active subscription, or nil if the user doesn't have one.
+func optionalActiveSubscription(
+	ctx context.Context, d db.Repository, tx db.Tx, username string,
+) (*db.Subscription, error) {
+	subscription, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+	if errors.Is(err, errors.ErrNoActiveSubscription) {
+		return nil, nil
+	}
+	return subscription, err
+}
+
+// cancelPendingSubscriptions cancels a user's scheduled subscriptions so that they're never activated, and returns
+// their IDs. Each cancellation is recorded in the audit log.
+func cancelPendingSubscriptions(
+	ctx context.Context, d db.Repository, tx db.Tx, username, reason string,
+) ([]string, error) {
+	pending, err := d.ListPendingSubscriptions(ctx, username, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for i := range pending {
+		subscription := &pending[i]
+		err = d.CancelSubscription(
+			ctx, subscription.ID, subscription.EffectiveStartDate, reason, db.WithTX(tx), actorOpt(ctx),
+		)
+		if err != nil {
+			return nil, err
+		}
+		after, err := d.GetSubscriptionByID(ctx, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return nil, err
+		}
+		err = recordAudit(
+			ctx, d, tx, db.AuditEntitySubscription, subscription.ID, db.AuditActionCancel, username,
+			subscription, after,
+		)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, subscription.ID)
+	}
+
+	return ids, nil
+}
+
+// RenameUser changes a user's username, for example when it has changed upstream. The user keeps all of their
+// subscriptions and usage updates. The user is looked up by the username that's stored, but the new username is
+// normalized. The rename is recorded in the audit log.
+func (a *App) RenameUser(ctx context.Context, username string, request *RenameUserRequest) (*RenamedUser, error) {
+	username, err := storedUsername(username, "username")
+	if err != nil {
+		return nil, err
+	}
+	if request.Username == "" {
+		return nil, errors.ErrMissingField.WithField("field", "username")
+	}
+	newUsername, err := a.FixUsername(request.Username)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *RenamedUser
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		before, err := userAccount(ctx, d, tx, username)
+		if err != nil {
+			return err
+		}
+		result = &RenamedUser{UserAccount: *before, PreviousUsername: username}
+		if newUsername == username {
+			return nil
+		}
+
+		existing, err := d.GetUserID(ctx, newUsername, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if existing != "" {
+			return errors.ErrUserExists.WithField("username", newUsername)
+		}
+
+		if err = d.RenameUser(ctx, before.ID, newUsername, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		after := &UserAccount{ID: before.ID, Username: newUsername}
+		result.UserAccount = *after
+		return recordAudit(ctx, d, tx, db.AuditEntityUser, before.ID, db.AuditActionUpdate, newUsername, before, after)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("renamed user %s to %s", username, newUsername)
+
+	return result, nil
+}
+
+// MergeUsers moves the subscriptions, usage updates and group memberships of the source user to the target user and
+// then removes the source user. The usages, quotas and add-ons of the subscriptions move with them. If both users have
+// an active subscription, the source user's subscription is ended unless it's the only paid one, in which case the
+// target user's subscription is ended instead. The scheduled subscriptions of the user whose active subscription was
+// ended, or of the source user if neither was ended, are cancelled if the other user has an active or scheduled
+// subscription, because they would overlap with it once the users are merged. The source user is looked up by the username that's stored, and the
+// target user's username is normalized. The merge is recorded in the audit log, and the target user's usage rollups
+// are rebuilt once it has been committed.
+func (a *App) MergeUsers(ctx context.Context, target string, request *MergeUsersRequest) (*UserMergeResult, error) {
+	target, err := a.FixUsername(target)
+	if err != nil {
+		return nil, err
+	}
+	source, err := storedUsername(request.Source, "source")
+	if err != nil {
+		return nil, err
+	}
+	if source == target {
+		return nil, errors.BadRequest("a user can't be merged into itself").WithField("username", target)
+	}
+
+	var result *UserMergeResult
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		sourceAccount, err := userAccount(ctx, d, tx, source)
+		if err != nil {
+			return err
+		}
+		targetAccount, err := userAccount(ctx, d, tx, target)
+		if err != nil {
+			return err
+		}
+		result = &UserMergeResult{Source: *sourceAccount, Target: *targetAccount}
+
+		// The merged user can only have one active subscription.
+		sourceSubscription, err := optionalActiveSubscription(ctx, d, tx, source)
+		if err != nil {
+			return err
+		}
+		targetSubscription, err := optionalActiveSubscription(ctx, d, tx, target)
+		if err != nil {
+			return err
+		}
+		var ended *db.Subscription
+		if sourceSubscription != nil && targetSubscription != nil {
+			ended = sourceSubscription
+			if sourceSubscription.Paid && !targetSubscription.Paid {
+				ended = targetSubscription
+			}
+			if err = d.SetSubscriptionEndDate(ctx, ended.ID, time.Now(), db.WithTX(tx), actorOpt(ctx)); err != nil {
+				return err
+			}
+			after, err := d.GetSubscriptionByID(ctx, ended.ID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			err = recordAudit(
+				ctx, d, tx, db.AuditEntitySubscription, ended.ID, db.AuditActionUpdate, ended.User.Username,
+				ended, after,
+			)
+			if err != nil {
+				return err
+			}
+			result.EndedSubscriptionID = ended.ID
+		}
+
+		// The merged user can only have one set of scheduled subscriptions, and they have to follow on from the
+		// active subscription that it keeps.
+		cancelled, kept := source, target
+		if ended != nil && ended == targetSubscription {
+			cancelled, kept = target, source
+		}
+		keptPending, err := d.ListPendingSubscriptions(ctx, kept, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		keptActive := sourceSubscription
+		if kept == target {
+			keptActive = targetSubscription
+		}
+		if keptActive != nil || len(keptPending) > 0 {
+			reason := "merged user " + source + " into user " + target
+			result.CancelledSubscriptionIDs, err = cancelPendingSubscriptions(ctx, d, tx, cancelled, reason)
+			if err != nil {
+				return err
+			}
+		}
+
+		merge, err := d.MergeUsers(ctx, sourceAccount.ID, targetAccount.ID, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return err
+		}
+		result.UserMerge = *merge
+
+		before := map[string]*UserAccount{"source": sourceAccount, "target": targetAccount}
+		return recordAudit(ctx, d, tx, db.AuditEntityUser, targetAccount.ID, db.AuditActionMerge, target, before, result)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("merged user %s into user %s: moved %d subscription(s), %d update(s) and %d group membership(s)",
+		source, target, result.Subscriptions, result.Updates, result.GroupMemberships)
+
+	// The source user's rollups were removed along with the user, and the updates and subscriptions that were moved
+	// change the usage of the target user, so the target user's rollups are rebuilt from all of their updates. The
+	// merge has already been committed, so failures are only logged; the updates that were moved are also picked up
+	// by the next refresh.
+	rollups := &UsageRollupRefresh{}
+	if err = a.rebuildUserUsageRollups(ctx, result.Target.ID, rollups); err != nil {
+		log.Errorf("unable to rebuild the usage rollups of user %s after the merge: %s", target, err)
+	} else if rollups.Failed > 0 {
+		log.Warnf("unable to rebuild the usage rollups of user %s for %d resource type(s) after the merge", target, rollups.Failed)
+	}
+
+	return result, nil
+}
+
+// FoldUsernames folds the stored usernames that contain upper case letters, which can't be looked up while case
+// folding is enabled. Each user is renamed to the normalized form of their username, or merged into the user that
+// already has it, in the same way as RenameUser and MergeUsers. The users are processed in order of their stored
+// usernames, so when none of the users whose usernames only differ in case has the folded username already, the
+// first one is renamed and the others are merged into it. Nothing is changed if dryRun is true, but the report
+// describes what would happen. Users whose usernames can't be normalized, or whose rename or merge fails, are skipped
+// and the reason is included in the report. Entries in the audit log keep the usernames they were recorded with.
+func (a *App) FoldUsernames(ctx context.Context, dryRun bool) (*UsernameFolding, error) {
+	if !a.Usernames.CaseFold {
+		return nil, errors.BadRequest("usernames can only be folded while case folding is enabled")
+	}
+
+	d := a.db
+
+	users, err := d.ListUnfoldedUsers(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// The folded usernames that are taken by the users that are renamed during a dry run.
+	renamed := make(map[string]bool)
+
+	result := &UsernameFolding{DryRun: dryRun, Users: make([]FoldedUsername, 0, len(users))}
+	for _, user := range users {
+		folded := FoldedUsername{Username: user.Username}
+
+		target, err := a.FixUsername(user.Username)
+		if err != nil {
+			folded.Action, folded.Error = FoldActionSkip, err.Error()
+			result.Users = append(result.Users, folded)
+			continue
+		}
+		folded.FoldedUsername = target
+
+		existing, err := d.GetUserID(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		folded.Action = FoldActionRename
+		if existing != "" || renamed[target] {
+			folded.Action = FoldActionMerge
+		}
+
+		switch {
+		case dryRun:
+			renamed[target] = true
+		case folded.Action == FoldActionRename:
+			_, err = a.RenameUser(ctx, user.Username, &RenameUserRequest{Username: target})
+		default:
+			_, err = a.MergeUsers(ctx, target, &MergeUsersRequest{Source: user.Username})
+		}
+		if err != nil {
+			log.Errorf("unable to fold the username %s: %s", user.Username, err)
+			folded.Action, folded.Error = FoldActionSkip, err.Error()
+		}
+
+		result.Users = append(result.Users, folded)
+	}
+
+	return result, nil
+}
+
+// RenameUserHTTPHandler renames a user.
+func (a *App) RenameUserHTTPHandler(c echo.Context) error {
+	var request RenameUserRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.RenameUser(c.Request().Context(), c.Param("username"), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// MergeUsersHTTPHandler merges one user into another.
+func (a *App) MergeUsersHTTPHandler(c echo.Context) error {
+	var request MergeUsersRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.MergeUsers(c.Request().Context(), c.Param("username"), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
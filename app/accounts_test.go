@@ -0,0 +1,273 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+)
+
+func TestRenameUser(t *testing.T) {
+	tests := []struct {
+		name        string
+		stored      string
+		username    string
+		newUsername string
+		want        string
+		wantErr     error
+	}{
+		{name: "normalized username", stored: "sarahr", username: "sarahr", newUsername: "sarah.r", want: "sarah.r"},
+		{name: "stored upper case username", stored: "SarahR", username: "SarahR", newUsername: "SarahR", want: "sarahr"},
+		{
+			name:        "stored username isn't normalized",
+			stored:      "SarahR",
+			username:    "sarahr",
+			newUsername: "sarah.r",
+			wantErr:     errors.ErrUserNotFound,
+		},
+		{name: "blank username", stored: "sarahr", username: " ", newUsername: "sarah.r", wantErr: errors.ErrMissingField},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			if _, err := m.EnsureUser(ctx, tt.stored); err != nil {
+				t.Fatalf("unable to add the user: %s", err)
+			}
+
+			result, err := a.RenameUser(ctx, tt.username, &RenameUserRequest{Username: tt.newUsername})
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if result.Username != tt.want {
+				t.Errorf("username = %q, want %q", result.Username, tt.want)
+			}
+			if exists, err := m.UserExists(ctx, tt.want); err != nil || !exists {
+				t.Errorf("user %s exists = %t (%v) after the rename", tt.want, exists, err)
+			}
+		})
+	}
+}
+
+func TestMergeUsers(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	subscribeTestUser(t, a, "sarahr")
+	duplicate, err := m.EnsureUser(ctx, "SarahR")
+	if err != nil {
+		t.Fatalf("unable to add the duplicate user: %s", err)
+	}
+
+	// The duplicate user's usage has to appear in the target user's rollups after the merge.
+	used := time.Now()
+	addTestUsage(t, m, duplicate.ID, used, 4)
+	if _, err = a.RefreshUsageRollups(ctx); err != nil {
+		t.Fatalf("unable to refresh the usage rollups: %s", err)
+	}
+
+	// The source must be looked up by its stored username, which normalizes to the target's username.
+	result, err := a.MergeUsers(ctx, "sarahr", &MergeUsersRequest{Source: "SarahR"})
+	if err != nil {
+		t.Fatalf("unable to merge the users: %s", err)
+	}
+	if result.Source.Username != "SarahR" || result.Target.Username != "sarahr" {
+		t.Errorf("merged %q into %q, want %q into %q", result.Source.Username, result.Target.Username, "SarahR", "sarahr")
+	}
+	if exists, err := m.UserExists(ctx, "SarahR"); err != nil || exists {
+		t.Errorf("source user exists = %t (%v) after the merge", exists, err)
+	}
+	if exists, err := m.UserExists(ctx, "sarahr"); err != nil || !exists {
+		t.Errorf("target user exists = %t (%v) after the merge", exists, err)
+	}
+	if value := testRollupValue(t, m, result.Target.ID, db.RollupPeriodDay, used); value != 4 {
+		t.Errorf("target user's usage = %g, want 4", value)
+	}
+}
+
+func TestMergeUsersScheduledSubscriptions(t *testing.T) {
+	tests := []struct {
+		name              string
+		targetActive      bool
+		targetScheduled   bool
+		sourcePaid        bool
+		wantCancelled     string
+		wantPendingSource bool
+	}{
+		{name: "target has an active subscription", targetActive: true, wantCancelled: "source"},
+		{name: "target has a scheduled subscription", targetScheduled: true, wantCancelled: "source"},
+		{name: "target has no subscriptions", wantPendingSource: true},
+		{
+			name:              "source's paid subscription is kept",
+			targetActive:      true,
+			targetScheduled:   true,
+			sourcePaid:        true,
+			wantCancelled:     "target",
+			wantPendingSource: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			addTestPlan(t, m, "Pro", 100, 5e10)
+			startDate := time.Now().AddDate(0, 1, 0).Format(utils.RFC3339)
+
+			// schedule subscribes a user to the Pro plan next month and returns the scheduled subscription's ID.
+			schedule := func(username string) string {
+				request := &qms.AddUserRequest{Username: username, PlanName: "Pro"}
+				if response := a.addUser(ctx, request, startDate); response.Error != nil {
+					t.Fatalf("unable to schedule a subscription for %s: %s", username, response.Error.Message)
+				}
+				pending, err := m.ListPendingSubscriptions(ctx, username)
+				if err != nil || len(pending) != 1 {
+					t.Fatalf("unable to look up the scheduled subscription of %s: %v", username, err)
+				}
+				return pending[0].ID
+			}
+
+			request := &qms.AddUserRequest{Username: "sarah.j", PlanName: db.DefaultPlanName, Paid: tt.sourcePaid}
+			if response := a.addUser(ctx, request, ""); response.Error != nil {
+				t.Fatalf("unable to subscribe the source user: %s", response.Error.Message)
+			}
+			scheduled := map[string]string{"source": schedule("sarah.j")}
+
+			if tt.targetActive {
+				subscribeTestUser(t, a, "sarahr")
+			} else if _, err := m.EnsureUser(ctx, "sarahr"); err != nil {
+				t.Fatalf("unable to add the target user: %s", err)
+			}
+			if tt.targetScheduled {
+				scheduled["target"] = schedule("sarahr")
+			}
+
+			result, err := a.MergeUsers(ctx, "sarahr", &MergeUsersRequest{Source: "sarah.j"})
+			if err != nil {
+				t.Fatalf("unable to merge the users: %s", err)
+			}
+
+			var wantCancelled []string
+			if tt.wantCancelled != "" {
+				wantCancelled = []string{scheduled[tt.wantCancelled]}
+			}
+			if len(result.CancelledSubscriptionIDs) != len(wantCancelled) ||
+				(len(wantCancelled) > 0 && result.CancelledSubscriptionIDs[0] != wantCancelled[0]) {
+				t.Errorf("cancelled subscriptions = %v, want %v", result.CancelledSubscriptionIDs, wantCancelled)
+			}
+
+			// The merged user is left with at most one scheduled subscription.
+			pending, err := m.ListPendingSubscriptions(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to list the pending subscriptions: %s", err)
+			}
+			wantPending := scheduled["target"]
+			if tt.wantPendingSource {
+				wantPending = scheduled["source"]
+			}
+			if wantPending == "" {
+				if len(pending) != 0 {
+					t.Errorf("found %d pending subscriptions, want none", len(pending))
+				}
+			} else if len(pending) != 1 || pending[0].ID != wantPending {
+				t.Errorf("pending subscriptions = %v, want [%s]", pending, wantPending)
+			}
+
+			for _, id := range wantCancelled {
+				cancelled, err := m.GetSubscriptionByID(ctx, id)
+				if err != nil {
+					t.Fatalf("unable to look up the cancelled subscription: %s", err)
+				}
+				if !cancelled.Cancelled() || !cancelled.EffectiveEndDate.Equal(cancelled.EffectiveStartDate) {
+					t.Errorf("scheduled subscription %s wasn't cancelled: %+v", id, cancelled)
+				}
+			}
+		})
+	}
+}
+
+func TestFoldUsernames(t *testing.T) {
+	// The stored usernames are processed in alphabetical order: "ALICE" < "Alice" < "JDoe" < "Sarah@Example.org" <
+	// "SarahR".
+	stored := []string{"sarahr", "SarahR", "JDoe", "ALICE", "Alice", "Sarah@Example.org"}
+	want := []FoldedUsername{
+		{Username: "ALICE", FoldedUsername: "alice", Action: FoldActionRename},
+		{Username: "Alice", FoldedUsername: "alice", Action: FoldActionMerge},
+		{Username: "JDoe", FoldedUsername: "jdoe", Action: FoldActionRename},
+		{Username: "Sarah@Example.org", Action: FoldActionSkip},
+		{Username: "SarahR", FoldedUsername: "sarahr", Action: FoldActionMerge},
+	}
+
+	tests := []struct {
+		name     string
+		dryRun   bool
+		caseFold bool
+		wantErr  bool
+		wantLeft []string
+	}{
+		{name: "dry run", dryRun: true, caseFold: true, wantLeft: []string{"ALICE", "Alice", "JDoe", "Sarah@Example.org", "SarahR"}},
+		{name: "fold", caseFold: true, wantLeft: []string{"Sarah@Example.org"}},
+		{name: "case folding disabled", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			a.Usernames = DefaultUsernameSettings(testUserDomain, tt.caseFold)
+			for _, username := range stored {
+				if _, err := m.EnsureUser(ctx, username); err != nil {
+					t.Fatalf("unable to add user %s: %s", username, err)
+				}
+			}
+
+			result, err := a.FoldUsernames(ctx, tt.dryRun)
+			if tt.wantErr {
+				if errors.CodeOf(err) != errors.CodeBadRequest {
+					t.Fatalf("expected a bad request error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to fold the usernames: %s", err)
+			}
+
+			if result.DryRun != tt.dryRun || len(result.Users) != len(want) {
+				t.Fatalf("unexpected report: %+v", result)
+			}
+			for i, w := range want {
+				got := result.Users[i]
+				if got.Username != w.Username || got.FoldedUsername != w.FoldedUsername || got.Action != w.Action {
+					t.Errorf("user %d = %+v, want %+v", i, got, w)
+				}
+				if (got.Action == FoldActionSkip) != (got.Error != "") {
+					t.Errorf("user %d error = %q for action %s", i, got.Error, got.Action)
+				}
+			}
+
+			left, err := m.ListUnfoldedUsers(ctx)
+			if err != nil {
+				t.Fatalf("unable to list the remaining users: %s", err)
+			}
+			if len(left) != len(tt.wantLeft) {
+				t.Fatalf("users left = %v, want %v", left, tt.wantLeft)
+			}
+			for i, username := range tt.wantLeft {
+				if left[i].Username != username {
+					t.Errorf("users left = %v, want %v", left, tt.wantLeft)
+					break
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/sirupsen/logrus"
+)
+
+// activationBatchSize is the maximum number of scheduled subscriptions activated in a single pass.
+const activationBatchSize = 100
+
+// PendingSubscriptions returns the user's subscriptions that are scheduled to start in the future, along with their
+// quotas.
+func (a *App) PendingSubscriptions(ctx context.Context, username string) ([]*qms.Subscription, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	d := a.db
+
+	subscriptions, err := d.ListPendingSubscriptions(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]*qms.Subscription, len(subscriptions))
+	for i := range subscriptions {
+		if err = d.LoadSubscriptionDetails(ctx, &subscriptions[i]); err != nil {
+			return nil, err
+		}
+		results[i] = subscriptions[i].ToQMSSubscription()
+	}
+
+	return results, nil
+}
+
+// activateSubscription activates a scheduled subscription whose start date has passed. Any other subscriptions of
+// the user that are still in effect at the start date are closed at that time, so that the scheduled subscription
+// takes over exactly at the boundary. Returns nil if another instance of the service activated the subscription
+// first.
+func (a *App) activateSubscription(ctx context.Context, pending *db.Subscription) (*db.Subscription, error) {
+	var activated *db.Subscription
+
+	d := a.db
+	start := pending.EffectiveStartDate
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		ok, err := d.ActivateSubscription(ctx, pending.ID, db.WithTX(tx), actorOpt(ctx))
+		if err != nil || !ok {
+			return err
+		}
+
+		previous, err := d.ListSubscriptionsInEffectAt(ctx, pending.User.ID, start, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		for i := range previous {
+			err = d.SetSubscriptionEndDate(ctx, previous[i].ID, start, db.WithTX(tx), actorOpt(ctx))
+			if err != nil {
+				return err
+			}
+
+			after, err := d.GetSubscriptionByID(ctx, previous[i].ID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			err = recordAudit(
+				ctx, d, tx, db.AuditEntitySubscription, previous[i].ID, db.AuditActionUpdate,
+				previous[i].User.Username, &previous[i], after,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		activated, err = d.GetSubscriptionByID(ctx, pending.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		return recordAudit(
+			ctx, d, tx, db.AuditEntitySubscription, pending.ID, db.AuditActionUpdate,
+			pending.User.Username, pending, activated,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return activated, nil
+}
+
+// ActivatePendingSubscriptions activates every scheduled subscription whose start date has passed and returns the
+// subscriptions that were activated. Each subscription is activated in its own transaction, so a failure to activate
+// one subscription is logged and doesn't prevent the others from being activated.
+func (a *App) ActivatePendingSubscriptions(ctx context.Context) ([]*qms.Subscription, error) {
+	log := log.WithField("context", "subscription activation")
+
+	results := make([]*qms.Subscription, 0)
+	failed := make(map[string]bool)
+
+	for {
+		due, err := a.db.ListDueSubscriptions(ctx, db.WithQueryLimit(activationBatchSize+uint(len(failed))))
+		if err != nil {
+			return results, err
+		}
+
+		attempted := 0
+		for i := range due {
+			if failed[due[i].ID] {
+				continue
+			}
+			attempted++
+
+			subscriptionLog := log.WithFields(logrus.Fields{
+				"subscription": due[i].ID,
+				"user":         due[i].User.Username,
+				"plan":         due[i].Plan.Name,
+			})
+
+			activated, err := a.activateSubscription(ctx, &due[i])
+			if err != nil {
+				subscriptionLog.Errorf("unable to activate the subscription: %s", err)
+				failed[due[i].ID] = true
+				continue
+			}
+			if activated == nil {
+				continue
+			}
+
+			subscriptionLog.Info("activated the scheduled subscription")
+			metrics.SubscriptionsActivated.WithLabelValues(activated.Plan.Name).Inc()
+			metrics.SubscriptionsCreated.WithLabelValues(activated.Plan.Name, metrics.SubscriptionKindScheduled).Inc()
+			results = append(results, activated.ToQMSSubscription())
+		}
+
+		// Stop once every subscription that is due has either been activated or failed.
+		if attempted == 0 {
+			return results, nil
+		}
+	}
+}
+
+// RunSubscriptionActivator activates scheduled subscriptions at the given interval until the context is cancelled.
+func (a *App) RunSubscriptionActivator(ctx context.Context, interval time.Duration) {
+	log := log.WithField("context", "subscription activation")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := a.ActivatePendingSubscriptions(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("unable to activate the scheduled subscriptions: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,143 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+)
+
+func TestScheduleSubscription(t *testing.T) {
+	future := time.Now().AddDate(0, 1, 0).Format(utils.RFC3339)
+
+	tests := []struct {
+		name        string
+		startDate   string
+		endDate     string
+		wantStatus  int32
+		wantPending int
+	}{
+		{name: "starts now", wantPending: 0},
+		{name: "starts in the future", startDate: future, wantPending: 1},
+		{name: "start date in the past", startDate: "2020-01-01", wantStatus: http.StatusBadRequest},
+		{name: "unparseable start date", startDate: "tomorrow", wantStatus: http.StatusBadRequest},
+		{
+			name:       "ends before it starts",
+			startDate:  future,
+			endDate:    time.Now().AddDate(0, 0, 1).Format(utils.DateOnly),
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			addTestPlan(t, m, "Pro", 100, 5e10)
+			current := subscribeTestUser(t, a, "sarahr")
+
+			request := &qms.AddUserRequest{Username: "sarahr", PlanName: "Pro", EndDate: tt.endDate}
+			response := a.addUser(ctx, request, tt.startDate)
+			if tt.wantStatus != 0 {
+				if response.Error == nil || response.Error.StatusCode != tt.wantStatus {
+					t.Fatalf("expected an error with status %d, got %v", tt.wantStatus, response.Error)
+				}
+				return
+			}
+			if response.Error != nil {
+				t.Fatalf("unexpected error: %s", response.Error.Message)
+			}
+
+			pending, err := a.PendingSubscriptions(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to list the pending subscriptions: %s", err)
+			}
+			if len(pending) != tt.wantPending {
+				t.Fatalf("found %d pending subscriptions, want %d", len(pending), tt.wantPending)
+			}
+
+			// The current subscription stays in effect until a scheduled subscription is activated.
+			active, err := m.GetActiveSubscription(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to look up the active subscription: %s", err)
+			}
+			wantPlan := "Pro"
+			if tt.wantPending > 0 {
+				wantPlan = db.DefaultPlanName
+				if active.ID != current.ID {
+					t.Errorf("active subscription = %s, want %s", active.ID, current.ID)
+				}
+			}
+			if active.Plan.Name != wantPlan {
+				t.Errorf("active plan = %s, want %s", active.Plan.Name, wantPlan)
+			}
+		})
+	}
+}
+
+func TestActivatePendingSubscriptions(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	addTestPlan(t, m, "Pro", 100, 5e10)
+	current := subscribeTestUser(t, a, "sarahr")
+
+	// Start dates are only accepted if they're in the future, so schedule the subscription to start shortly.
+	start := time.Now().Truncate(time.Second).Add(2 * time.Second)
+	request := &qms.AddUserRequest{Username: "sarahr", PlanName: "Pro"}
+	if response := a.addUser(ctx, request, start.Format(utils.RFC3339)); response.Error != nil {
+		t.Fatalf("unable to schedule the subscription: %s", response.Error.Message)
+	}
+
+	activated, err := a.ActivatePendingSubscriptions(ctx)
+	if err != nil {
+		t.Fatalf("unable to activate the pending subscriptions: %s", err)
+	}
+	if len(activated) != 0 {
+		t.Fatalf("activated %d subscriptions before their start dates", len(activated))
+	}
+
+	time.Sleep(time.Until(start))
+
+	activated, err = a.ActivatePendingSubscriptions(ctx)
+	if err != nil {
+		t.Fatalf("unable to activate the pending subscriptions: %s", err)
+	}
+	if len(activated) != 1 || activated[0].GetPlan().GetName() != "Pro" {
+		t.Fatalf("unexpected activated subscriptions: %v", activated)
+	}
+
+	active, err := m.GetActiveSubscription(ctx, "sarahr")
+	if err != nil {
+		t.Fatalf("unable to look up the active subscription: %s", err)
+	}
+	if active.ID != activated[0].GetUuid() {
+		t.Errorf("active subscription = %s, want %s", active.ID, activated[0].GetUuid())
+	}
+
+	// The previous subscription ends exactly when the scheduled one starts.
+	previous, err := m.GetSubscriptionByID(ctx, current.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the previous subscription: %s", err)
+	}
+	if !previous.EffectiveEndDate.Equal(start) {
+		t.Errorf("previous subscription ends at %v, want %s", previous.EffectiveEndDate, start)
+	}
+
+	// Activating again does nothing.
+	activated, err = a.ActivatePendingSubscriptions(ctx)
+	if err != nil {
+		t.Fatalf("unable to activate the pending subscriptions: %s", err)
+	}
+	if len(activated) != 0 {
+		t.Errorf("activated %d subscriptions twice", len(activated))
+	}
+
+	if _, err = a.PendingSubscriptions(ctx, ""); !errors.Is(err, errors.ErrInvalidUsername) {
+		t.Errorf("expected ErrInvalidUsername for an empty username, got %v", err)
+	}
+}
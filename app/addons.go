@@ -4,8 +4,6 @@ import (
 	"context"
 	"net/http"
 
-	"errors"
-
 	serrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/labstack/echo/v4"
 
@@ -13,27 +11,28 @@ import (
 	reqinit "github.com/cyverse-de/go-mod/pbinit/requests"
 	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/p/go/requests"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 )
 
 func (a *App) addAddon(ctx context.Context, request *qms.AddAddonRequest) *qms.AddonResponse {
 	var newAddon *db.Addon
-	d := db.New(a.db)
+	d := a.db
 	response := qmsinit.NewAddonResponse()
 
 	// Validate the incoming request.
 	requestedAddon := db.NewAddonFromQMS(request.Addon)
 	if err := requestedAddon.Validate(); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 	}
 	if err := requestedAddon.ValidateAddonRateUniqueness(); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 	}
 
 	// Start a transaction.
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
@@ -57,10 +56,10 @@ func (a *App) addAddon(ctx context.Context, request *qms.AddAddonRequest) *qms.A
 			return err
 		}
 
-		return nil
+		return recordAudit(ctx, d, tx, db.AuditEntityAddon, addonID, db.AuditActionCreate, "", nil, newAddon)
 	})
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -74,6 +73,7 @@ func (a *App) AddAddonHandler(subject, reply string, request *qms.AddAddonReques
 
 	ctx, span := qmsinit.InitAddAddonRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	log := log.WithField("context", "adding new available addon")
 
@@ -114,11 +114,11 @@ func (a *App) AddAddonHTTPHandler(c echo.Context) error {
 
 func (a *App) listAddons(ctx context.Context) *qms.AddonListResponse {
 	response := qmsinit.NewAddonListResponse()
-	d := db.New(a.db)
+	d := a.db
 
 	results, err := d.ListAddons(ctx)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -165,10 +165,10 @@ func (a *App) ListAddonsHTTPHandler(c echo.Context) error {
 
 func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest) *qms.AddonResponse {
 	response := qmsinit.NewAddonResponse()
-	d := db.New(a.db)
+	d := a.db
 
 	if request.Addon.Uuid == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("uuid must be set in the request"))
+		response.Error = serrors.NatsError(ctx, response.Header, serrors.ErrMissingField.WithField("field", "uuid"))
 		return response
 	}
 
@@ -176,11 +176,16 @@ func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest)
 
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
-		err := d.UpdateAddon(ctx, updateAddon, db.WithTX(tx))
+		before, err := d.GetAddonByID(ctx, updateAddon.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		err = d.UpdateAddon(ctx, updateAddon, db.WithTX(tx))
 		if err != nil {
 			return err
 		}
@@ -191,10 +196,10 @@ func (a *App) updateAddon(ctx context.Context, request *qms.UpdateAddonRequest)
 		}
 		response.Addon = result.ToQMSType()
 
-		return nil
+		return recordAudit(ctx, d, tx, db.AuditEntityAddon, result.ID, db.AuditActionUpdate, "", before, result)
 	})
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 	}
 	return response
 }
@@ -206,6 +211,7 @@ func (a *App) UpdateAddonHandler(subject, reply string, request *qms.UpdateAddon
 
 	ctx, span := qmsinit.InitUpdateAddonRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.updateAddon(ctx, request)
 
@@ -247,21 +253,36 @@ func (a *App) UpdateAddonHTTPHandler(c echo.Context) error {
 func (a *App) deleteAddon(ctx context.Context, request *requests.ByUUID) *qms.AddonResponse {
 	response := qmsinit.NewAddonResponse()
 
-	d := db.New(a.db)
+	d := a.db
 
-	subAddons, err := d.ListSubscriptionAddonsByAddonID(ctx, request.Uuid)
+	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
+	err = tx.Wrap(func() error {
+		subAddons, err := d.ListSubscriptionAddonsByAddonID(ctx, request.Uuid, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
 
-	if len(subAddons) > 0 {
-		response.Error = serrors.NatsError(ctx, serrors.ErrSubscriptionAddonsExist)
-		return response
-	}
+		if len(subAddons) > 0 {
+			return serrors.ErrSubscriptionAddonsExist
+		}
+
+		before, err := d.GetAddonByID(ctx, request.Uuid, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if err = d.DeleteAddon(ctx, request.Uuid, db.WithTX(tx)); err != nil {
+			return err
+		}
 
-	if err = d.DeleteAddon(ctx, request.Uuid); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		return recordAudit(ctx, d, tx, db.AuditEntityAddon, request.Uuid, db.AuditActionDelete, "", before, nil)
+	})
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -279,6 +300,7 @@ func (a *App) DeleteAddonHandler(subject, reply string, request *requests.ByUUID
 
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.deleteAddon(ctx, request)
 
@@ -310,10 +332,10 @@ func (a *App) DeleteAddonHTTPHandler(c echo.Context) error {
 func (a *App) listSubscriptionAddons(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonListResponse {
 	response := qmsinit.NewSubscriptionAddonListResponse()
 
-	d := db.New(a.db)
+	d := a.db
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -330,7 +352,7 @@ func (a *App) listSubscriptionAddons(ctx context.Context, request *requests.ByUU
 		return nil
 	})
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 	}
 
 	return response
@@ -360,7 +382,7 @@ func (a *App) ListSubscriptionAddonsHTTPHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	request := &requests.ByUUID{
-		Uuid: c.Param("uuid"),
+		Uuid: c.Param("sub_uuid"),
 	}
 
 	response := a.listSubscriptionAddons(ctx, request)
@@ -375,11 +397,11 @@ func (a *App) ListSubscriptionAddonsHTTPHandler(c echo.Context) error {
 func (a *App) getSubscriptionAddon(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
 
-	d := db.New(a.db)
+	d := a.db
 
 	subAddon, err := d.GetSubscriptionAddonByID(ctx, request.Uuid)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -424,62 +446,71 @@ func (a *App) GetSubscriptionAddonHTTPHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, response)
 }
 
+// attachAddonInTx applies an add-on to a subscription within the given transaction, adding the add-on's amount to the
+// subscription's quota for the add-on's resource type. The transaction isn't committed.
+func (a *App) attachAddonInTx(
+	ctx context.Context, d db.Repository, tx db.Tx, subscriptionID, addonID string,
+) (*db.SubscriptionAddon, error) {
+	subAddon, err := d.AddSubscriptionAddon(ctx, subscriptionID, addonID, db.WithTXRollbackCommit(tx, false, false))
+	if err != nil {
+		return nil, err
+	}
+
+	quotaValue, _, err := d.GetCurrentQuota(
+		ctx,
+		subAddon.Addon.ResourceType.ID,
+		subscriptionID,
+		db.WithTXRollbackCommit(tx, false, false),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	quotaValue = quotaValue + subAddon.Amount
+	if _, err = upsertQuota(ctx, d, tx, quotaValue, subAddon.Addon.ResourceType.ID, subscriptionID); err != nil {
+		return nil, err
+	}
+
+	if err = a.auditSubscriptionAddon(ctx, d, tx, db.AuditActionCreate, nil, subAddon); err != nil {
+		return nil, err
+	}
+
+	return subAddon, nil
+}
+
 func (a *App) addSubscriptionAddon(ctx context.Context, request *requests.AssociateByUUIDs) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
-	d := db.New(a.db)
+	d := a.db
 
 	subscriptionID := request.ParentUuid
 	if subscriptionID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("parent_uuid must be set to the subscription UUID"))
+		response.Error = serrors.NatsError(ctx, response.Header, serrors.ErrMissingField.WithField("field", "parent_uuid"))
 		return response
 	}
 
 	addonID := request.ChildUuid
 	if addonID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("child_id must be set to the add-on UUID"))
+		response.Error = serrors.NatsError(ctx, response.Header, serrors.ErrMissingField.WithField("field", "child_id"))
 		return response
 	}
 
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	defer func() {
 		_ = tx.Rollback()
 	}()
 
-	subAddon, err := d.AddSubscriptionAddon(ctx, subscriptionID, addonID, db.WithTXRollbackCommit(tx, false, false))
-	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
-	}
-
-	quotaValue, _, err := d.GetCurrentQuota(
-		ctx,
-		subAddon.Addon.ResourceType.ID,
-		subscriptionID,
-		db.WithTXRollbackCommit(tx, false, false),
-	)
+	subAddon, err := a.attachAddonInTx(ctx, d, tx, subscriptionID, addonID)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
-	}
-
-	quotaValue = quotaValue + subAddon.Amount
-	if err = d.UpsertQuota(
-		ctx,
-		quotaValue,
-		subAddon.Addon.ResourceType.ID,
-		subscriptionID,
-		db.WithTXRollbackCommit(tx, false, false),
-	); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	if err = tx.Commit(); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -492,6 +523,7 @@ func (a *App) AddSubscriptionAddonHandler(subject, reply string, request *reques
 
 	ctx, span := reqinit.InitAssociateByUUIDs(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	log := log.WithField("context", "adding subscription add-on")
 
@@ -525,19 +557,19 @@ func (a *App) AddSubscriptionAddonHTTPHandler(c echo.Context) error {
 
 func (a *App) deleteSubscriptionAddon(ctx context.Context, request *requests.ByUUID) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
-	d := db.New(a.db)
+	d := a.db
 
 	// Get the subscription add-on ID out of the request.
 	subAddonID := request.Uuid
 	if subAddonID == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("subscription addon-on UUID must be set"))
+		response.Error = serrors.NatsError(ctx, response.Header, serrors.ErrMissingField.WithField("field", "uuid"))
 		return response
 	}
 
 	/// Start the database transaction.
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	defer func() {
@@ -548,47 +580,19 @@ func (a *App) deleteSubscriptionAddon(ctx context.Context, request *requests.ByU
 	// the quota value.
 	subAddon, err := d.GetSubscriptionAddonByID(ctx, subAddonID, db.WithTX(tx))
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
-	// Get the current quota value.
-	quotaValue, _, err := d.GetCurrentQuota(
-		ctx,
-		subAddon.Addon.ResourceType.ID,
-		subAddon.SubscriptionID,
-		db.WithTXRollbackCommit(tx, false, false),
-	)
-	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
-	}
-
-	// Update the quota value by subtracting the amount configured in the
-	// subscription add-on. We don't want the available add-on value, we want
-	// the subscription add-on value, which may have been modified from the
-	// available add-on value.
-	quotaValue = quotaValue - subAddon.Amount
-	if err = d.UpsertQuota(
-		ctx,
-		quotaValue,
-		subAddon.Addon.ResourceType.ID,
-		subAddon.SubscriptionID,
-		db.WithTXRollbackCommit(tx, false, false),
-	); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
-		return response
-	}
-
-	// Delete the subscription add-on.
-	if err = d.DeleteSubscriptionAddon(ctx, subAddonID, db.WithTX(tx)); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+	// Remove the add-on from the subscription.
+	if err = a.removeSubscriptionAddon(ctx, d, tx, subAddon); err != nil {
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	// Commit all of the changes.
 	if err = tx.Commit(); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -603,6 +607,7 @@ func (a *App) DeleteSubscriptionAddonHandler(subject, reply string, request *req
 
 	ctx, span := reqinit.InitByUUID(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	log := log.WithField("context", "deleting subscription add-ons")
 
@@ -636,10 +641,10 @@ func (a *App) DeleteSubscriptionAddonHTTPHandler(c echo.Context) error {
 func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSubscriptionAddonRequest) *qms.SubscriptionAddonResponse {
 	response := qmsinit.NewSubscriptionAddonResponse()
 
-	d := db.New(a.db)
+	d := a.db
 
 	if request.SubscriptionAddon.Uuid == "" {
-		response.Error = serrors.NatsError(ctx, errors.New("uuid must be set in the request"))
+		response.Error = serrors.NatsError(ctx, response.Header, serrors.ErrMissingField.WithField("field", "uuid"))
 		return response
 	}
 
@@ -649,21 +654,22 @@ func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSu
 	/// Start the database transaction.
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	defer func() {
 		_ = tx.Rollback()
 	}()
 
+	// Get the pre-update subscription add-on details from the database. Needed
+	// to modify the quota value and to record the change.
+	preUpdateSubAddon, err := d.GetSubscriptionAddonByID(ctx, subAddonID, db.WithTX(tx))
+	if err != nil {
+		response.Error = serrors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
 	if updateSubAddon.UpdateAmount {
-		// Get the pre-update subscription add-on details from the database. Needed
-		// to modify the quota value.
-		preUpdateSubAddon, err := d.GetSubscriptionAddonByID(ctx, subAddonID, db.WithTX(tx))
-		if err != nil {
-			response.Error = serrors.NatsError(ctx, err)
-			return response
-		}
 
 		// Get the current quota value.
 		quotaValue, _, err := d.GetCurrentQuota(
@@ -673,7 +679,7 @@ func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSu
 			db.WithTXRollbackCommit(tx, false, false),
 		)
 		if err != nil {
-			response.Error = serrors.NatsError(ctx, err)
+			response.Error = serrors.NatsError(ctx, response.Header, err)
 			return response
 		}
 
@@ -685,26 +691,32 @@ func (a *App) updateSubscriptionAddon(ctx context.Context, request *qms.UpdateSu
 		quotaValue = quotaValue + updateSubAddon.Amount
 
 		// Now update the quota value
-		if err = d.UpsertQuota(
+		if _, err = upsertQuota(
 			ctx,
+			d,
+			tx,
 			quotaValue,
 			preUpdateSubAddon.Addon.ResourceType.ID,
 			preUpdateSubAddon.SubscriptionID,
-			db.WithTXRollbackCommit(tx, false, false),
 		); err != nil {
-			response.Error = serrors.NatsError(ctx, err)
+			response.Error = serrors.NatsError(ctx, response.Header, err)
 			return response
 		}
 	}
 
 	result, err := d.UpdateSubscriptionAddon(ctx, updateSubAddon, db.WithTXRollbackCommit(tx, false, false))
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
+	if err = a.auditSubscriptionAddon(ctx, d, tx, db.AuditActionUpdate, preUpdateSubAddon, result); err != nil {
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	if err = tx.Commit(); err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -718,6 +730,7 @@ func (a *App) UpdateSubscriptionAddonHandler(subject, reply string, request *qms
 
 	ctx, span := qmsinit.InitUpdateSubscriptionAddonRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	log := log.WithField("context", "update subscription addon")
 
@@ -754,3 +767,66 @@ func (a *App) UpdateSubscriptionAddonHTTPHandler(c echo.Context) error {
 
 	return c.JSON(http.StatusOK, response)
 }
+
+// removeSubscriptionAddon deletes a subscription add-on and takes the amount that it added away from the quota of the
+// subscription.
+func (a *App) removeSubscriptionAddon(ctx context.Context, d db.Repository, tx db.Tx, subAddon *db.SubscriptionAddon) error {
+	// Get the current quota value.
+	quotaValue, _, err := d.GetCurrentQuota(
+		ctx,
+		subAddon.Addon.ResourceType.ID,
+		subAddon.SubscriptionID,
+		db.WithTXRollbackCommit(tx, false, false),
+	)
+	if err != nil {
+		return err
+	}
+
+	// Update the quota value by subtracting the amount configured in the
+	// subscription add-on. We don't want the available add-on value, we want
+	// the subscription add-on value, which may have been modified from the
+	// available add-on value.
+	quotaValue = quotaValue - subAddon.Amount
+	if _, err = upsertQuota(ctx, d, tx, quotaValue, subAddon.Addon.ResourceType.ID, subAddon.SubscriptionID); err != nil {
+		return err
+	}
+
+	// Delete the subscription add-on.
+	if err = d.DeleteSubscriptionAddon(ctx, subAddon.ID, db.WithTX(tx)); err != nil {
+		return err
+	}
+
+	return a.auditSubscriptionAddon(ctx, d, tx, db.AuditActionDelete, subAddon, nil)
+}
+
+// auditSubscriptionAddon records a change to a subscription add-on in the audit log.
+func (a *App) auditSubscriptionAddon(
+	ctx context.Context,
+	d db.Repository,
+	tx db.Tx,
+	action string,
+	before, after *db.SubscriptionAddon,
+) error {
+	var subAddon *db.SubscriptionAddon
+	var beforeValue, afterValue any
+	if before != nil {
+		subAddon, beforeValue = before, before
+	}
+	if after != nil {
+		subAddon, afterValue = after, after
+	}
+
+	// Include the name of the subscriber in the audit record if we can find it.
+	var username string
+	subscription, err := d.GetSubscriptionByID(ctx, subAddon.SubscriptionID, db.WithTX(tx))
+	if err != nil {
+		return err
+	}
+	if subscription != nil {
+		username = subscription.User.Username
+	}
+
+	return recordAudit(
+		ctx, d, tx, db.AuditEntitySubscriptionAddon, subAddon.ID, action, username, beforeValue, afterValue,
+	)
+}
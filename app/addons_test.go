@@ -0,0 +1,136 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/requests"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/google/uuid"
+)
+
+// addTestAddon adds an add-on that provides the given amount of a resource type, and returns its ID.
+func addTestAddon(t *testing.T, m *db.MemoryDatabase, resourceName string, amount float64) string {
+	t.Helper()
+	addonID, err := m.AddAddon(context.Background(), &db.Addon{
+		Name:          "extra " + resourceName,
+		Description:   "More " + resourceName,
+		ResourceType:  *testResourceType(t, m, resourceName),
+		DefaultAmount: amount,
+		AddonRates:    []db.AddonRate{{EffectiveDate: time.Now().AddDate(-1, 0, 0), Rate: 10}},
+	})
+	if err != nil {
+		t.Fatalf("unable to add the add-on: %s", err)
+	}
+	return addonID
+}
+
+func TestAddSubscriptionAddon(t *testing.T) {
+	tests := []struct {
+		name           string
+		attachEarlier  int
+		subscriptionID func(subscription *db.Subscription) string
+		addonID        func(addonID string) string
+		wantStatus     int32
+		wantQuota      float64
+	}{
+		{
+			name:      "first add-on",
+			wantQuota: 120,
+		},
+		{
+			name:          "second copy of an add-on",
+			attachEarlier: 1,
+			wantQuota:     220,
+		},
+		{
+			name:           "missing subscription ID",
+			subscriptionID: func(_ *db.Subscription) string { return "" },
+			wantStatus:     http.StatusBadRequest,
+			wantQuota:      20,
+		},
+		{
+			name:       "missing add-on ID",
+			addonID:    func(_ string) string { return "" },
+			wantStatus: http.StatusBadRequest,
+			wantQuota:  20,
+		},
+		{
+			name:       "unknown add-on",
+			addonID:    func(_ string) string { return uuid.NewString() },
+			wantStatus: http.StatusNotFound,
+			wantQuota:  20,
+		},
+		{
+			name:           "unknown subscription",
+			subscriptionID: func(_ *db.Subscription) string { return uuid.NewString() },
+			wantStatus:     http.StatusBadRequest,
+			wantQuota:      20,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			subscription := subscribeTestUser(t, a, "sarahr")
+			addonID := addTestAddon(t, m, "cpu.hours", 100)
+
+			for i := 0; i < tt.attachEarlier; i++ {
+				request := &requests.AssociateByUUIDs{ParentUuid: subscription.ID, ChildUuid: addonID}
+				if response := a.addSubscriptionAddon(ctx, request); response.Error != nil {
+					t.Fatalf("unable to attach an earlier add-on: %s", response.Error.Message)
+				}
+			}
+
+			request := &requests.AssociateByUUIDs{ParentUuid: subscription.ID, ChildUuid: addonID}
+			if tt.subscriptionID != nil {
+				request.ParentUuid = tt.subscriptionID(subscription)
+			}
+			if tt.addonID != nil {
+				request.ChildUuid = tt.addonID(addonID)
+			}
+
+			response := a.addSubscriptionAddon(ctx, request)
+			if tt.wantStatus != 0 {
+				if response.Error == nil || response.Error.StatusCode != tt.wantStatus {
+					t.Errorf("error = %v, want status %d", response.Error, tt.wantStatus)
+				}
+			} else {
+				if response.Error != nil {
+					t.Fatalf("unexpected error: %s", response.Error.Message)
+				}
+				if response.SubscriptionAddon.GetAddon().GetUuid() != addonID {
+					t.Errorf("add-on ID = %q, want %q", response.SubscriptionAddon.GetAddon().GetUuid(), addonID)
+				}
+				if response.SubscriptionAddon.GetAmount() != 100 {
+					t.Errorf("amount = %g, want 100", response.SubscriptionAddon.GetAmount())
+				}
+			}
+
+			// The quota must only change if the add-on was attached.
+			cpu := testResourceType(t, m, "cpu.hours")
+			quota, _, err := m.GetCurrentQuota(ctx, cpu.ID, subscription.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the quota: %s", err)
+			}
+			if quota != tt.wantQuota {
+				t.Errorf("quota = %g, want %g", quota, tt.wantQuota)
+			}
+
+			subAddons, err := m.ListSubscriptionAddonsByAddonID(ctx, addonID)
+			if err != nil {
+				t.Fatalf("unable to list the subscription add-ons: %s", err)
+			}
+			wantAttached := tt.attachEarlier
+			if tt.wantStatus == 0 {
+				wantAttached++
+			}
+			if len(subAddons) != wantAttached {
+				t.Errorf("got %d subscription add-ons, want %d", len(subAddons), wantAttached)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package app
+
+import (
+	"context"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/requests"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+// The methods in this file expose the operations used by the administrative command-line interface. They perform
+// the same work as the corresponding NATS and HTTP handlers, but report errors as Go errors rather than in the
+// response messages.
+
+// responseError converts the error in a response message to a Go error. Nil is returned if the response doesn't
+// contain an error.
+func responseError(e *svcerror.ServiceError) error {
+	if e == nil {
+		return nil
+	}
+	return errors.New(e.Message)
+}
+
+// ActiveSubscriptionID returns the ID of the user's active subscription.
+func (a *App) ActiveSubscriptionID(ctx context.Context, username string) (string, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return "", err
+	}
+
+	subscription, err := a.db.GetActiveSubscription(ctx, username)
+	if err != nil {
+		return "", err
+	}
+
+	return subscription.ID, nil
+}
+
+// ListPlans returns the available subscription plans.
+func (a *App) ListPlans(ctx context.Context) ([]*qms.Plan, error) {
+	response := a.listPlans(ctx)
+	if err := responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response.Plans, nil
+}
+
+// SubscribeUser subscribes a user to a plan, adding the user if necessary. The subscription is scheduled to start on
+// the start date if one is given.
+func (a *App) SubscribeUser(ctx context.Context, request *qms.AddUserRequest, startDate string) (*qms.AddUserResponse, error) {
+	response := a.addUser(ctx, request, startDate)
+	if err := responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// AttachAddon applies an add-on to the user's active subscription.
+func (a *App) AttachAddon(ctx context.Context, username, addonID string) (*qms.SubscriptionAddon, error) {
+	subscriptionID, err := a.ActiveSubscriptionID(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	response := a.addSubscriptionAddon(ctx, &requests.AssociateByUUIDs{
+		ParentUuid: subscriptionID,
+		ChildUuid:  addonID,
+	})
+	if err = responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response.SubscriptionAddon, nil
+}
+
+// SetQuota sets the quota for a resource type in the user's active subscription.
+func (a *App) SetQuota(ctx context.Context, username, resourceTypeName string, value float64) (*qms.Quota, error) {
+	subscriptionID, err := a.ActiveSubscriptionID(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	resourceType, err := a.db.GetResourceTypeByName(ctx, resourceTypeName)
+	if err != nil {
+		return nil, err
+	}
+	if resourceType == nil || resourceType.ID == "" {
+		return nil, errors.ErrInvalidResourceName
+	}
+
+	response := a.addQuota(ctx, &qms.AddQuotaRequest{
+		Quota: &qms.Quota{
+			Quota:          value,
+			ResourceType:   &qms.ResourceType{Uuid: resourceType.ID},
+			SubscriptionId: subscriptionID,
+		},
+	})
+	if err = responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response.Quota, nil
+}
+
+// UserUpdates returns the usage and quota updates recorded for a user.
+func (a *App) UserUpdates(ctx context.Context, username string) ([]*qms.Update, error) {
+	response := a.getUserUpdates(ctx, &qms.UpdateListRequest{User: &qms.QMSUser{Username: username}})
+	if err := responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response.Updates, nil
+}
+
+// RecomputeUsages recalculates the usages in the user's active subscription from the usage updates and returns the
+// new usages.
+func (a *App) RecomputeUsages(ctx context.Context, username string) ([]*qms.Usage, error) {
+	response := a.recomputeUsages(ctx, &qms.GetUsages{Username: username})
+	if err := responseError(response.Error); err != nil {
+		return nil, err
+	}
+	return response.Usages, nil
+}
@@ -4,16 +4,17 @@ import (
 	"context"
 	"fmt"
 	"net/http"
-	"regexp"
 
 	"github.com/cyverse-de/go-mod/logging"
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/auth"
 	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
 	"github.com/cyverse-de/subscriptions/natscl"
-	"github.com/jmoiron/sqlx"
+	"github.com/cyverse-de/subscriptions/openapi"
 	"github.com/labstack/echo/v4"
 	"github.com/samber/lo"
 	"github.com/sirupsen/logrus"
@@ -24,19 +25,31 @@ var log = logging.Log.WithFields(logrus.Fields{"package": "apps"})
 
 type App struct {
 	client         *natscl.Client
-	db             *sqlx.DB
+	db             db.Repository
+	auth           *auth.Authenticator
+	openAPI        *openapi.Document
 	Router         *echo.Echo
-	userSuffix     string
 	ReportOverages bool
+	Provisioning   *ProvisioningSettings
+	Usernames      *UsernameSettings
+
+	readinessChecks map[string]HealthCheck
 }
 
-func New(client *natscl.Client, db *sqlx.DB, userSuffix string) *App {
+// New creates a new App that stores its data in the given repository. HTTP requests are authenticated using the
+// given Authenticator. Authentication is disabled if the Authenticator is nil. Usernames qualified with the given
+// domain are accepted.
+func New(client *natscl.Client, repo db.Repository, userDomain string, authenticator *auth.Authenticator) *App {
 	app := &App{
 		client:         client,
-		db:             db,
-		userSuffix:     userSuffix,
+		db:             repo,
+		auth:           authenticator,
 		Router:         echo.New(),
 		ReportOverages: true,
+		Provisioning:   DefaultProvisioningSettings(),
+		Usernames:      DefaultUsernameSettings(userDomain, true),
+
+		readinessChecks: make(map[string]HealthCheck),
 	}
 
 	app.Router.HTTPErrorHandler = func(err error, c echo.Context) {
@@ -53,48 +66,30 @@ func New(client *natscl.Client, db *sqlx.DB, userSuffix string) *App {
 		case *echo.HTTPError:
 			echoErr := err
 			code = echoErr.Code
-			body = common.NewErrorResponse(err)
+			body = common.ErrorResponse{Message: fmt.Sprint(echoErr.Message)}
 		default:
-			body = common.NewErrorResponse(err)
+			code = errors.HTTPStatusCode(err)
+			response := common.NewErrorResponse(err)
+			var e *errors.Error
+			if errors.As(err, &e) && len(e.Fields) > 0 {
+				details := map[string]interface{}(e.Fields)
+				response.Message = e.Message
+				response.Details = &details
+			}
+			body = response
 		}
 
 		c.JSON(code, body) // nolint:errcheck
 	}
 
-	app.Router.GET("/", app.GreetingHTTPHandler).Name = "greeting"
-	app.Router.GET("/summary/:user", app.GetUserSummaryHTTPHandler)
-	app.Router.PUT("/addons", app.AddAddonHTTPHandler)
-	app.Router.GET("/addons", app.ListAddonsHTTPHandler)
-	app.Router.POST("/addons/:uuid", app.UpdateAddonHTTPHandler)
-	app.Router.DELETE("/addons/:uuid", app.DeleteAddonHTTPHandler)
-	app.Router.GET("/subscriptions/:uuid/addons", app.ListSubscriptionAddonsHTTPHandler)
-	app.Router.GET("/subscriptions/:sub_uuid/addons/:addon_uuid", app.GetSubscriptionAddonHTTPHandler)
-	app.Router.PUT("/subscriptions/:sub_uuid/addons/:addon_uuid", app.AddSubscriptionAddonHTTPHandler)
-	app.Router.DELETE("/subscriptions/:sub_uuid/addons/:addon_uuid", app.DeleteSubscriptionAddonHTTPHandler)
-	app.Router.POST("/subscriptions/:sub_uuid/addons/:addon_uuid", app.UpdateSubscriptionAddonHTTPHandler)
-	app.Router.PUT("/users", app.AddUserHTTPHandler)
-	app.Router.GET("/users/:username/updates", app.GetUserUpdatesHTTPHandler)
-	app.Router.PUT("/user/:username/updates", app.AddUserUpdateHTTPHandler)
-	app.Router.GET("/users/:username/overages", app.GetUserOveragesHTTPHandler)
-	app.Router.GET("/users/:username/overages/:resource_name", app.CheckUserOveragesHTTPHandler)
-	app.Router.GET("/users/:username/usages", app.GetUsagesHTTPHandler)
-	app.Router.PUT("/users/:username/usages", app.AddUsageHTTPHandler)
-	app.Router.GET("/plans", app.ListPlansHTTPHandler)
-	app.Router.PUT("/plans", app.AddPlanHTTPHandler)
-	app.Router.GET("/plans/:plan_id", app.GetPlanHTTPHandler)
-	app.Router.POST("/quotas/defaults", app.UpsertQuotaDefaultsHTTPHandler)
-	app.Router.PUT("/quotas", app.AddQuotaHTTPHandler)
+	app.registerRoutes()
 
 	return app
 }
 
+// FixUsername returns the canonical form of a username using the App's username settings.
 func (a *App) FixUsername(username string) (string, error) {
-
-	re, err := regexp.Compile(`@.*$`)
-	if err != nil {
-		return "", err
-	}
-	return re.ReplaceAllString(username, ""), nil
+	return a.Usernames.Normalize(username)
 }
 
 func (a *App) validateUpdate(request *qms.AddUpdateRequest) (string, error) {
@@ -147,17 +142,17 @@ func (a *App) getUserUpdates(ctx context.Context, request *qms.UpdateListRequest
 
 	username, err := a.FixUsername(request.User.Username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	log = log.WithFields(logrus.Fields{"user": username})
 
-	d := db.New(a.db)
+	d := a.db
 
 	mUpdates, err := d.UserUpdates(ctx, username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -228,6 +223,7 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 	var (
 		err                                 error
 		userID, resourceTypeID, operationID string
+		newPlanName                         string
 		update                              *db.Update
 	)
 
@@ -236,7 +232,7 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 	// Validate the request.
 	username, err := a.validateUpdate(request)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -244,12 +240,12 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 	log = log.WithFields(logrus.Fields{"user": username})
 
 	// Create a new database client.
-	d := db.New(a.db)
+	d := a.db
 
 	// Begin a transaction.
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
@@ -326,7 +322,7 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 
 		// Add the update to the database. AddUserUpdate will populate the structure with the update ID.
 		log.Info("adding update to the database")
-		_, err = d.AddUserUpdate(ctx, update, db.WithTX(tx))
+		_, err = d.AddUserUpdate(ctx, update, db.WithTX(tx), actorOpt(ctx))
 		if err != nil {
 			return err
 		}
@@ -335,21 +331,27 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 		// Process the update.
 		switch update.ValueType {
 		case db.UsagesTrackedMetric:
+			// Usage can be reported before the user has done anything else, so the user may have to be subscribed to
+			// the default plan first.
+			if _, newPlanName, err = a.activeOrDefaultSubscription(ctx, d, tx, username); err != nil {
+				return err
+			}
+
 			log.Info("processing update for usage")
-			if err = d.ProcessUpdateForUsage(ctx, update, db.WithTX(tx)); err != nil {
+			if err = d.ProcessUpdateForUsage(ctx, update, db.WithTX(tx), actorOpt(ctx)); err != nil {
 				return err
 			}
 			log.Info("after processing update for usage")
 
 		case db.QuotasTrackedMetric:
 			log.Info("processing update for quota")
-			if err = d.ProcessUpdateForQuota(ctx, update, db.WithTX(tx)); err != nil {
+			if err = d.ProcessUpdateForQuota(ctx, update, db.WithTX(tx), actorOpt(ctx)); err != nil {
 				return err
 			}
 			log.Info("after processing update for quota")
 
 		default:
-			return fmt.Errorf("unknown value type in update: %s", update.ValueType)
+			return errors.ErrInvalidValueType.WithField("value_type", update.ValueType)
 		}
 
 		// Look up the recorded update and store it in the response.
@@ -384,8 +386,17 @@ func (a *App) addUserUpdate(ctx context.Context, request *qms.AddUpdateRequest)
 		return nil
 	})
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
+	if newPlanName != "" {
+		metrics.SubscriptionsCreated.WithLabelValues(newPlanName, metrics.SubscriptionKindUser).Inc()
 	}
+	metrics.UpdatesProcessed.WithLabelValues(
+		update.ValueType, update.ResourceType.Name, update.UpdateOperation.Name,
+	).Inc()
+
 	return response
 }
 
@@ -397,6 +408,7 @@ func (a *App) AddUserUpdateHandler(subject, reply string, request *qms.AddUpdate
 
 	ctx, span := pbinit.InitQMSAddUpdateRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.addUserUpdate(ctx, request)
 
@@ -424,6 +436,12 @@ func (a *App) AddUserUpdateHTTPHandler(c echo.Context) error {
 		})
 	}
 
+	if request.Update == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "the request body must contain an update")
+	}
+	if request.Update.User == nil {
+		request.Update.User = &qms.QMSUser{}
+	}
 	request.Update.User.Username = c.Param("username")
 
 	response := a.addUserUpdate(ctx, &request)
@@ -0,0 +1,233 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/auth"
+	"github.com/cyverse-de/subscriptions/db"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testUserDomain is the domain that usernames may be qualified with in tests.
+const testUserDomain = "iplantcollaborative.org"
+
+// newTestApp returns an App backed by a MemoryDatabase that contains the default plan. Authentication is disabled
+// unless an Authenticator is given.
+func newTestApp(t *testing.T, authenticator *auth.Authenticator) (*App, *db.MemoryDatabase) {
+	t.Helper()
+	m := db.NewMemoryDatabase()
+	addTestPlan(t, m, db.DefaultPlanName, 20, 5e9)
+	return New(nil, m, testUserDomain, authenticator), m
+}
+
+// addTestPlan adds a plan with quota defaults for CPU hours and data storage, and returns it.
+func addTestPlan(t *testing.T, m *db.MemoryDatabase, name string, cpuHours, dataSize float64) *db.Plan {
+	t.Helper()
+	ctx := context.Background()
+
+	cpu := testResourceType(t, m, "cpu.hours")
+	data := testResourceType(t, m, "data.size")
+	effective := time.Now().AddDate(-1, 0, 0)
+
+	planID, err := m.AddPlan(ctx, &db.Plan{
+		Name:        name,
+		Description: "The " + name + " plan",
+		QuotaDefaults: []db.PlanQuotaDefault{
+			{QuotaValue: cpuHours, ResourceType: *cpu, EffectiveDate: effective},
+			{QuotaValue: dataSize, ResourceType: *data, EffectiveDate: effective},
+		},
+		Rates: []db.PlanRate{{Rate: 0, EffectiveDate: effective}},
+	})
+	if err != nil {
+		t.Fatalf("unable to add the %s plan: %s", name, err)
+	}
+
+	plan, err := m.GetPlanByID(ctx, planID)
+	if err != nil {
+		t.Fatalf("unable to look up the %s plan: %s", name, err)
+	}
+	return plan
+}
+
+// testResourceType looks up one of the resource types that a MemoryDatabase starts with.
+func testResourceType(t *testing.T, m *db.MemoryDatabase, name string) *db.ResourceType {
+	t.Helper()
+	rt, err := m.GetResourceTypeByName(context.Background(), name)
+	if err != nil || rt == nil || rt.ID == "" {
+		t.Fatalf("unable to look up the %s resource type: %v", name, err)
+	}
+	return rt
+}
+
+// subscribeTestUser subscribes a user to the default plan and returns the subscription.
+func subscribeTestUser(t *testing.T, a *App, username string) *db.Subscription {
+	t.Helper()
+	ctx := context.Background()
+	if _, err := a.GetUserSummary(ctx, username); err != nil {
+		t.Fatalf("unable to subscribe %s to the default plan: %s", username, err)
+	}
+	subscription, err := a.db.GetActiveSubscription(ctx, username)
+	if err != nil {
+		t.Fatalf("unable to look up the subscription of %s: %s", username, err)
+	}
+	return subscription
+}
+
+// testUpdate returns an update request for the given user and resource type that takes effect immediately.
+func testUpdate(username, valueType, resourceName, operation string, value float64) *qms.AddUpdateRequest {
+	units := map[string]string{"cpu.hours": "cpu hours", "data.size": "bytes"}
+	return &qms.AddUpdateRequest{
+		Update: &qms.Update{
+			ValueType:     valueType,
+			Value:         value,
+			EffectiveDate: timestamppb.Now(),
+			ResourceType:  &qms.ResourceType{Name: resourceName, Unit: units[resourceName]},
+			Operation:     &qms.UpdateOperation{Name: operation},
+			User:          &qms.QMSUser{Username: username},
+		},
+	}
+}
+
+func TestAddUserUpdate(t *testing.T) {
+	withoutDate := testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 1)
+	withoutDate.Update.EffectiveDate = nil
+
+	tests := []struct {
+		name       string
+		subscribed bool
+		earlier    []*qms.AddUpdateRequest
+		request    *qms.AddUpdateRequest
+		wantStatus int32
+		wantUsage  float64
+		wantQuota  float64
+	}{
+		{
+			name:      "usage for a new user",
+			request:   testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 2.5),
+			wantUsage: 2.5,
+			wantQuota: 20,
+		},
+		{
+			name:       "usage with a qualified username",
+			subscribed: true,
+			request:    testUpdate("sarahr@"+testUserDomain, db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 1),
+			wantUsage:  1,
+			wantQuota:  20,
+		},
+		{
+			name:       "usage added to earlier usage",
+			subscribed: true,
+			earlier: []*qms.AddUpdateRequest{
+				testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 3),
+			},
+			request:   testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 4),
+			wantUsage: 7,
+			wantQuota: 20,
+		},
+		{
+			name:       "usage replacing earlier usage",
+			subscribed: true,
+			earlier: []*qms.AddUpdateRequest{
+				testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 3),
+			},
+			request:   testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeSet, 1),
+			wantUsage: 1,
+			wantQuota: 20,
+		},
+		{
+			name:       "quota",
+			subscribed: true,
+			request:    testUpdate("sarahr", db.QuotasTrackedMetric, "cpu.hours", db.UpdateTypeSet, 50),
+			wantQuota:  50,
+		},
+		{
+			name:       "invalid username",
+			request:    testUpdate("", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown resource type",
+			request:    testUpdate("sarahr", db.UsagesTrackedMetric, "gpu.hours", db.UpdateTypeAdd, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown operation",
+			request:    testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", "SUBTRACT", 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "unknown value type",
+			request:    testUpdate("sarahr", "rates", "cpu.hours", db.UpdateTypeAdd, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "missing effective date",
+			request:    withoutDate,
+			wantStatus: http.StatusBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			if tt.subscribed {
+				subscribeTestUser(t, a, "sarahr")
+			}
+			for _, request := range tt.earlier {
+				if response := a.addUserUpdate(ctx, request); response.Error != nil {
+					t.Fatalf("unable to add an earlier update: %s", response.Error.Message)
+				}
+			}
+
+			response := a.addUserUpdate(ctx, tt.request)
+			if tt.wantStatus != 0 {
+				if response.Error == nil || response.Error.StatusCode != tt.wantStatus {
+					t.Fatalf("error = %v, want status %d", response.Error, tt.wantStatus)
+				}
+				if exists, err := m.UserExists(ctx, "sarahr"); err != nil || exists {
+					t.Errorf("user exists = %t (%v) after a rejected update", exists, err)
+				}
+				return
+			}
+			if response.Error != nil {
+				t.Fatalf("unexpected error: %s", response.Error.Message)
+			}
+			if response.Update.GetUser().GetUsername() != "sarahr" {
+				t.Errorf("username = %q, want %q", response.Update.GetUser().GetUsername(), "sarahr")
+			}
+
+			subscription, err := m.GetActiveSubscription(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to look up the subscription: %s", err)
+			}
+			cpu := testResourceType(t, m, "cpu.hours")
+			usage, _, err := m.GetCurrentUsage(ctx, cpu.ID, subscription.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the usage: %s", err)
+			}
+			if usage != tt.wantUsage {
+				t.Errorf("usage = %g, want %g", usage, tt.wantUsage)
+			}
+			quota, _, err := m.GetCurrentQuota(ctx, cpu.ID, subscription.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the quota: %s", err)
+			}
+			if quota != tt.wantQuota {
+				t.Errorf("quota = %g, want %g", quota, tt.wantQuota)
+			}
+
+			updates, err := m.UserUpdates(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to list the updates: %s", err)
+			}
+			if len(updates) != len(tt.earlier)+1 {
+				t.Errorf("got %d updates, want %d", len(updates), len(tt.earlier)+1)
+			}
+		})
+	}
+}
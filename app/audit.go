@@ -0,0 +1,202 @@
+package app
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/cyverse-de/subscriptions/common"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// AuditRecordList is the response body for audit log queries.
+type AuditRecordList struct {
+	Records []db.AuditRecord `json:"records"`
+}
+
+// actorOpt returns a query option that attributes database changes to the user identified in the request context.
+func actorOpt(ctx context.Context) db.QueryOption {
+	return db.WithActor(common.ActorFromContext(ctx))
+}
+
+// recordAudit adds an entry to the audit log inside the given transaction. The before and after values are snapshots
+// of the entity on either side of the change; either one may be nil.
+func recordAudit(
+	ctx context.Context,
+	d db.Repository,
+	tx db.Tx,
+	entityType, entityID, action, username string,
+	before, after any,
+) error {
+	record, err := db.NewAuditRecord(entityType, entityID, action, username, before, after)
+	if err != nil {
+		return err
+	}
+	return d.AddAuditRecord(ctx, record, db.WithTX(tx), actorOpt(ctx))
+}
+
+// upsertQuota stores a new quota value for a subscription and records the change in the audit log.
+func upsertQuota(
+	ctx context.Context,
+	d db.Repository,
+	tx db.Tx,
+	value float64,
+	resourceTypeID, subscriptionID string,
+) (*db.Quota, error) {
+	before, err := d.LoadQuotaDetails(ctx, resourceTypeID, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+
+	err = d.UpsertQuota(ctx, value, resourceTypeID, subscriptionID, db.WithTX(tx), actorOpt(ctx))
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := d.LoadQuotaDetails(ctx, resourceTypeID, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+	if after == nil {
+		return nil, nil
+	}
+
+	// Include the name of the subscriber in the audit record if we can find it.
+	var username string
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return nil, err
+	}
+	if subscription != nil {
+		username = subscription.User.Username
+	}
+
+	action := db.AuditActionUpdate
+	if before == nil {
+		action = db.AuditActionCreate
+	}
+	err = recordAudit(ctx, d, tx, db.AuditEntityQuota, after.ID, action, username, before, after)
+	if err != nil {
+		return nil, err
+	}
+
+	return after, nil
+}
+
+func (a *App) listAuditRecords(ctx context.Context, filter *db.AuditFilter, limit, offset uint) (*AuditRecordList, error) {
+	d := a.db
+
+	opts := []db.QueryOption{db.WithQueryOffset(offset)}
+	if limit > 0 {
+		opts = append(opts, db.WithQueryLimit(limit))
+	}
+
+	records, err := d.ListAuditRecords(ctx, filter, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if records == nil {
+		records = make([]db.AuditRecord, 0)
+	}
+
+	return &AuditRecordList{Records: records}, nil
+}
+
+// ListAuditRecordsHTTPHandler lists entries in the audit log. The results can be filtered by the affected user, the
+// user who made the change, the entity type and a time range.
+func (a *App) ListAuditRecordsHTTPHandler(c echo.Context) error {
+	var err error
+
+	ctx := c.Request().Context()
+
+	filter := &db.AuditFilter{
+		Username:   c.QueryParam("username"),
+		Actor:      c.QueryParam("actor"),
+		EntityType: c.QueryParam("entity_type"),
+	}
+
+	if v := c.QueryParam("start"); v != "" {
+		if filter.Start, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if v := c.QueryParam("end"); v != "" {
+		if filter.End, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	limit, err := uintQueryParam(c, "limit", 100)
+	if err != nil {
+		return err
+	}
+	offset, err := uintQueryParam(c, "offset", 0)
+	if err != nil {
+		return err
+	}
+
+	response, err := a.listAuditRecords(ctx, filter, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
+
+// uintQueryParam parses an optional non-negative integer query parameter.
+func uintQueryParam(c echo.Context, name string, defaultValue uint) (uint, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+	parsed, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, echo.NewHTTPError(http.StatusBadRequest, "invalid value for "+name+": "+v)
+	}
+	return uint(parsed), nil
+}
+
+// boolQueryParam parses an optional boolean query parameter. Nil is returned if the parameter isn't present.
+func boolQueryParam(c echo.Context, name string) (*bool, error) {
+	v := c.QueryParam(name)
+	if v == "" {
+		return nil, nil
+	}
+	parsed, err := strconv.ParseBool(v)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid value for "+name+": "+v)
+	}
+	return &parsed, nil
+}
+
+// auditNewSubscription records the creation of a subscription in the audit log.
+func (a *App) auditNewSubscription(ctx context.Context, d db.Repository, tx db.Tx, subscriptionID string) error {
+	subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return err
+	}
+	if subscription == nil {
+		return fmt.Errorf("the newly created subscription could not be found: %s", subscriptionID)
+	}
+
+	quotas, err := d.SubscriptionQuotas(ctx, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return err
+	}
+	subscription.Quotas = quotas
+
+	return recordAudit(
+		ctx,
+		d,
+		tx,
+		db.AuditEntitySubscription,
+		subscriptionID,
+		db.AuditActionCreate,
+		subscription.User.Username,
+		nil,
+		subscription,
+	)
+}
@@ -0,0 +1,278 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// When a cancelled subscription ends.
+const (
+	// CancelNow ends the subscription immediately.
+	CancelNow = "now"
+
+	// CancelAtPeriodEnd ends the subscription at the end of its current yearly period.
+	CancelAtPeriodEnd = "period_end"
+)
+
+// What happens to the add-ons attached to a cancelled subscription.
+const (
+	// KeepAddons leaves the add-ons attached to the subscription after it ends.
+	KeepAddons = "keep"
+
+	// RemoveAddons detaches the add-ons from the subscription and takes their amounts away from its quotas.
+	RemoveAddons = "remove"
+)
+
+// Subscription statuses reported in subscription histories.
+const (
+	SubscriptionStatusPending = "pending"
+	SubscriptionStatusActive  = "active"
+	SubscriptionStatusEnded   = "ended"
+)
+
+// CancellationRequest is the request body for cancelling a subscription.
+type CancellationRequest struct {
+	// When is either "now" or "period_end".
+	When string `json:"when"`
+
+	// Reason is an optional explanation that is stored with the subscription.
+	Reason string `json:"reason,omitempty"`
+
+	// Addons is either "keep" or "remove", and defaults to "keep". Add-ons can only be removed when the subscription
+	// is cancelled immediately.
+	Addons string `json:"addons,omitempty"`
+}
+
+// SubscriptionRecord describes one of a user's subscriptions, including whether and why it was cancelled.
+type SubscriptionRecord struct {
+	ID                 string     `json:"id"`
+	Username           string     `json:"username"`
+	PlanID             string     `json:"plan_id"`
+	PlanName           string     `json:"plan_name"`
+	PlanVersionID      string     `json:"plan_version_id"`
+	Status             string     `json:"status"`
+	EffectiveStartDate time.Time  `json:"effective_start_date"`
+	EffectiveEndDate   time.Time  `json:"effective_end_date"`
+	Paid               bool       `json:"paid"`
+	ActivatedAt        *time.Time `json:"activated_at,omitempty"`
+	CancelledAt        *time.Time `json:"cancelled_at,omitempty"`
+	CancelledBy        string     `json:"cancelled_by,omitempty"`
+	CancellationReason string     `json:"cancellation_reason,omitempty"`
+	CreatedBy          string     `json:"created_by"`
+	CreatedAt          time.Time  `json:"created_at"`
+}
+
+// SubscriptionHistory is the response body for subscription history listings.
+type SubscriptionHistory struct {
+	Subscriptions []SubscriptionRecord `json:"subscriptions"`
+}
+
+// subscriptionStatus determines whether a subscription is pending, active or ended at the given time. A subscription
+// that was cancelled before it started never takes effect, so it's reported as ended.
+func subscriptionStatus(s *db.Subscription, now time.Time) string {
+	switch {
+	case !now.Before(s.EffectiveEndDate) || !s.EffectiveEndDate.After(s.EffectiveStartDate):
+		return SubscriptionStatusEnded
+	case now.Before(s.EffectiveStartDate):
+		return SubscriptionStatusPending
+	default:
+		return SubscriptionStatusActive
+	}
+}
+
+// newSubscriptionRecord converts a subscription to a SubscriptionRecord.
+func newSubscriptionRecord(s *db.Subscription, now time.Time) *SubscriptionRecord {
+	return &SubscriptionRecord{
+		ID:                 s.ID,
+		Username:           s.User.Username,
+		PlanID:             s.Plan.ID,
+		PlanName:           s.Plan.Name,
+		PlanVersionID:      s.PlanVersionID,
+		Status:             subscriptionStatus(s, now),
+		EffectiveStartDate: s.EffectiveStartDate,
+		EffectiveEndDate:   s.EffectiveEndDate,
+		Paid:               s.Paid,
+		ActivatedAt:        s.ActivatedAt,
+		CancelledAt:        s.CancelledAt,
+		CancelledBy:        s.CancelledBy,
+		CancellationReason: s.CancellationReason,
+		CreatedBy:          s.CreatedBy,
+		CreatedAt:          s.CreatedAt,
+	}
+}
+
+// periodEnd returns the end of the yearly subscription period that contains the given time. Subscription periods
+// start on the anniversaries of the subscription's start date. The subscription's end date is returned if it comes
+// first.
+func periodEnd(s *db.Subscription, now time.Time) time.Time {
+	end := s.EffectiveStartDate.AddDate(1, 0, 0)
+	for years := 2; !end.After(now); years++ {
+		end = s.EffectiveStartDate.AddDate(years, 0, 0)
+	}
+	if end.After(s.EffectiveEndDate) {
+		return s.EffectiveEndDate
+	}
+	return end
+}
+
+// validateCancellation checks the request and fills in the default add-on handling.
+func validateCancellation(request *CancellationRequest) error {
+	switch request.When {
+	case CancelNow, CancelAtPeriodEnd:
+	case "":
+		return errors.ErrMissingField.WithField("field", "when")
+	default:
+		return errors.BadRequest("the cancellation time must be %q or %q", CancelNow, CancelAtPeriodEnd).
+			WithField("when", request.When)
+	}
+
+	switch request.Addons {
+	case "":
+		request.Addons = KeepAddons
+	case KeepAddons, RemoveAddons:
+	default:
+		return errors.BadRequest("the add-on handling must be %q or %q", KeepAddons, RemoveAddons).
+			WithField("addons", request.Addons)
+	}
+
+	if request.Addons == RemoveAddons && request.When != CancelNow {
+		return errors.BadRequest("add-ons can only be removed from subscriptions that are cancelled immediately")
+	}
+
+	return nil
+}
+
+// CancelSubscription ends a subscription early, either immediately or at the end of its current period. A
+// subscription that hasn't started yet is cancelled immediately either way, and never takes effect. The
+// cancellation is recorded in the audit log along with any add-ons that are removed.
+func (a *App) CancelSubscription(
+	ctx context.Context, subscriptionID string, request *CancellationRequest,
+) (*SubscriptionRecord, error) {
+	if err := validateCancellation(request); err != nil {
+		return nil, err
+	}
+
+	var result *SubscriptionRecord
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		subscription, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if subscription == nil {
+			return errors.ErrSubscriptionNotFound.WithField("subscription_id", subscriptionID)
+		}
+		if subscription.Cancelled() {
+			return errors.ErrSubscriptionCancelled.WithField("subscription_id", subscriptionID)
+		}
+
+		now := time.Now()
+		if !subscription.EffectiveEndDate.After(now) {
+			return errors.ErrSubscriptionEnded.WithField("subscription_id", subscriptionID)
+		}
+
+		var endDate time.Time
+		switch {
+		case now.Before(subscription.EffectiveStartDate):
+			endDate = subscription.EffectiveStartDate
+		case request.When == CancelAtPeriodEnd:
+			endDate = periodEnd(subscription, now)
+		default:
+			endDate = now
+		}
+
+		if request.Addons == RemoveAddons {
+			subAddons, err := d.ListSubscriptionAddons(ctx, subscriptionID, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+			for i := range subAddons {
+				if err = a.removeSubscriptionAddon(ctx, d, tx, &subAddons[i]); err != nil {
+					return err
+				}
+			}
+		}
+
+		err = d.CancelSubscription(ctx, subscriptionID, endDate, request.Reason, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return err
+		}
+
+		after, err := d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		err = recordAudit(
+			ctx, d, tx, db.AuditEntitySubscription, subscriptionID, db.AuditActionCancel,
+			subscription.User.Username, subscription, after,
+		)
+		if err != nil {
+			return err
+		}
+
+		result = newSubscriptionRecord(after, now)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("cancelled subscription %s effective %s", subscriptionID, result.EffectiveEndDate)
+
+	return result, nil
+}
+
+// SubscriptionHistory lists all of a user's subscriptions, with the most recent start date first.
+func (a *App) SubscriptionHistory(ctx context.Context, username string) (*SubscriptionHistory, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	subscriptions, err := a.db.ListSubscriptions(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	records := make([]SubscriptionRecord, len(subscriptions))
+	for i := range subscriptions {
+		records[i] = *newSubscriptionRecord(&subscriptions[i], now)
+	}
+
+	return &SubscriptionHistory{Subscriptions: records}, nil
+}
+
+// CancelSubscriptionHTTPHandler cancels a subscription.
+func (a *App) CancelSubscriptionHTTPHandler(c echo.Context) error {
+	var request CancellationRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.CancelSubscription(c.Request().Context(), c.Param("sub_uuid"), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// SubscriptionHistoryHTTPHandler lists a user's subscriptions.
+func (a *App) SubscriptionHistoryHTTPHandler(c echo.Context) error {
+	response, err := a.SubscriptionHistory(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
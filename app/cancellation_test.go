@@ -0,0 +1,205 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+)
+
+func TestCancelSubscription(t *testing.T) {
+	tests := []struct {
+		name       string
+		scheduled  bool
+		request    CancellationRequest
+		withAddon  bool
+		wantErr    bool
+		wantCode   errors.Code
+		wantStatus string
+		wantEnd    func(s *db.Subscription, cancelled time.Time) time.Time
+		wantQuota  float64
+	}{
+		{
+			name:       "now",
+			request:    CancellationRequest{When: CancelNow, Reason: "moving on"},
+			withAddon:  true,
+			wantStatus: SubscriptionStatusEnded,
+			wantEnd:    func(_ *db.Subscription, cancelled time.Time) time.Time { return cancelled },
+			wantQuota:  180,
+		},
+		{
+			name:       "now removing add-ons",
+			request:    CancellationRequest{When: CancelNow, Addons: RemoveAddons},
+			withAddon:  true,
+			wantStatus: SubscriptionStatusEnded,
+			wantEnd:    func(_ *db.Subscription, cancelled time.Time) time.Time { return cancelled },
+			wantQuota:  80,
+		},
+		{
+			name:       "at the end of the period",
+			request:    CancellationRequest{When: CancelAtPeriodEnd},
+			wantStatus: SubscriptionStatusActive,
+			wantEnd:    func(s *db.Subscription, _ time.Time) time.Time { return s.EffectiveStartDate.AddDate(1, 0, 0) },
+		},
+		{
+			name:       "scheduled subscription",
+			scheduled:  true,
+			request:    CancellationRequest{When: CancelAtPeriodEnd},
+			wantStatus: SubscriptionStatusEnded,
+			wantEnd:    func(s *db.Subscription, _ time.Time) time.Time { return s.EffectiveStartDate },
+		},
+		{
+			name:     "missing time",
+			request:  CancellationRequest{},
+			wantErr:  true,
+			wantCode: errors.CodeBadRequest,
+		},
+		{
+			name:     "invalid add-on handling",
+			request:  CancellationRequest{When: CancelNow, Addons: "discard"},
+			wantErr:  true,
+			wantCode: errors.CodeBadRequest,
+		},
+		{
+			name:     "removing add-ons at the end of the period",
+			request:  CancellationRequest{When: CancelAtPeriodEnd, Addons: RemoveAddons},
+			wantErr:  true,
+			wantCode: errors.CodeBadRequest,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+
+			// Subscriptions that last two years have more than one period.
+			request := &qms.AddUserRequest{
+				Username: "sarahr",
+				PlanName: db.DefaultPlanName,
+				Periods:  2,
+				EndDate:  time.Now().AddDate(2, 0, 0).Format(utils.DateOnly),
+			}
+			var startDate string
+			if tt.scheduled {
+				subscribeTestUser(t, a, "sarahr")
+				startDate = time.Now().AddDate(0, 1, 0).Format(utils.RFC3339)
+				request.Force = true
+			}
+			if response := a.addUser(ctx, request, startDate); response.Error != nil {
+				t.Fatalf("unable to subscribe the user: %s", response.Error.Message)
+			}
+
+			var subscription *db.Subscription
+			if tt.scheduled {
+				pending, err := m.ListPendingSubscriptions(ctx, "sarahr")
+				if err != nil || len(pending) != 1 {
+					t.Fatalf("unable to look up the scheduled subscription: %v", err)
+				}
+				subscription = &pending[0]
+			} else {
+				subscription = subscribeTestUser(t, a, "sarahr")
+			}
+
+			if tt.withAddon {
+				if _, err := a.AttachAddon(ctx, "sarahr", addTestAddon(t, m, "cpu.hours", 100)); err != nil {
+					t.Fatalf("unable to attach the add-on: %s", err)
+				}
+			}
+
+			cancelled := time.Now()
+			record, err := a.CancelSubscription(ctx, subscription.ID, &tt.request)
+			if tt.wantErr {
+				if err == nil || errors.CodeOf(err) != tt.wantCode {
+					t.Fatalf("expected an error with code %v, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to cancel the subscription: %s", err)
+			}
+
+			if record.Status != tt.wantStatus {
+				t.Errorf("status = %s, want %s", record.Status, tt.wantStatus)
+			}
+			if record.CancelledAt == nil || record.CancellationReason != tt.request.Reason {
+				t.Errorf("cancellation wasn't recorded: %+v", record)
+			}
+			wantEnd := tt.wantEnd(subscription, cancelled)
+			if d := record.EffectiveEndDate.Sub(wantEnd); d < 0 || d > time.Second {
+				t.Errorf("end date = %s, want %s", record.EffectiveEndDate, wantEnd)
+			}
+
+			if tt.wantQuota != 0 {
+				quota, _, err := m.GetCurrentQuota(ctx, testResourceType(t, m, "cpu.hours").ID, subscription.ID)
+				if err != nil {
+					t.Fatalf("unable to look up the quota: %s", err)
+				}
+				if quota != tt.wantQuota {
+					t.Errorf("quota = %g, want %g", quota, tt.wantQuota)
+				}
+			}
+
+			// A subscription can only be cancelled once.
+			_, err = a.CancelSubscription(ctx, subscription.ID, &tt.request)
+			if !errors.Is(err, errors.ErrSubscriptionCancelled) {
+				t.Errorf("expected ErrSubscriptionCancelled, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCancelMissingSubscription(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+
+	request := &CancellationRequest{When: CancelNow}
+	_, err := a.CancelSubscription(context.Background(), "00000000-0000-0000-0000-000000000000", request)
+	if !errors.Is(err, errors.ErrSubscriptionNotFound) {
+		t.Errorf("expected ErrSubscriptionNotFound, got %v", err)
+	}
+}
+
+func TestSubscriptionHistory(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	addTestPlan(t, m, "Pro", 100, 5e10)
+
+	ended := subscribeTestUser(t, a, "sarahr")
+	if _, err := a.CancelSubscription(ctx, ended.ID, &CancellationRequest{When: CancelNow}); err != nil {
+		t.Fatalf("unable to cancel the subscription: %s", err)
+	}
+	if response := a.addUser(ctx, &qms.AddUserRequest{Username: "sarahr", PlanName: "Pro"}, ""); response.Error != nil {
+		t.Fatalf("unable to subscribe the user to the Pro plan: %s", response.Error.Message)
+	}
+	active := subscribeTestUser(t, a, "sarahr")
+	startDate := time.Now().AddDate(0, 1, 0).Format(utils.RFC3339)
+	request := &qms.AddUserRequest{Username: "sarahr", PlanName: db.DefaultPlanName}
+	if response := a.addUser(ctx, request, startDate); response.Error != nil {
+		t.Fatalf("unable to schedule a subscription: %s", response.Error.Message)
+	}
+
+	history, err := a.SubscriptionHistory(ctx, "sarahr")
+	if err != nil {
+		t.Fatalf("unable to list the subscription history: %s", err)
+	}
+
+	// The most recent start date comes first.
+	want := []struct{ id, plan, status string }{
+		{"", db.DefaultPlanName, SubscriptionStatusPending},
+		{active.ID, "Pro", SubscriptionStatusActive},
+		{ended.ID, db.DefaultPlanName, SubscriptionStatusEnded},
+	}
+	if len(history.Subscriptions) != len(want) {
+		t.Fatalf("found %d subscriptions, want %d", len(history.Subscriptions), len(want))
+	}
+	for i, w := range want {
+		got := history.Subscriptions[i]
+		if (w.id != "" && got.ID != w.id) || got.PlanName != w.plan || got.Status != w.status {
+			t.Errorf("subscription %d = %s %s %s, want %s %s %s", i, got.ID, got.PlanName, got.Status, w.id, w.plan, w.status)
+		}
+	}
+}
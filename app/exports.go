@@ -0,0 +1,282 @@
+package app
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/parquet-go/parquet-go"
+)
+
+// Supported export formats.
+const (
+	ExportFormatCSV     = "csv"
+	ExportFormatJSONL   = "jsonl"
+	ExportFormatParquet = "parquet"
+)
+
+// Datasets that can be exported.
+const (
+	ExportSubscriptions = "subscriptions"
+	ExportQuotas        = "quotas"
+	ExportUsages        = "usages"
+	ExportAddons        = "addons"
+	ExportUpdates       = "updates"
+)
+
+// ExportDatasets lists the datasets that can be exported.
+var ExportDatasets = []string{ExportSubscriptions, ExportQuotas, ExportUsages, ExportAddons, ExportUpdates}
+
+// exportContentTypes maps the export formats to the content types of the responses.
+var exportContentTypes = map[string]string{
+	ExportFormatCSV:     "text/csv",
+	ExportFormatJSONL:   "application/x-ndjson",
+	ExportFormatParquet: "application/vnd.apache.parquet",
+}
+
+// exportRowGroupSize is the maximum number of rows in each row group of a Parquet export. The rows of a row group are
+// buffered in memory until the group is complete.
+const exportRowGroupSize = 50000
+
+// ValidateExport returns an error if a dataset can't be exported or the export format isn't supported.
+func ValidateExport(dataset, format string) error {
+	if !slices.Contains(ExportDatasets, dataset) {
+		return errors.BadRequest("the dataset must be one of %s", strings.Join(ExportDatasets, ", ")).
+			WithField("dataset", dataset)
+	}
+
+	if _, ok := exportContentTypes[format]; !ok {
+		return invalidExportFormat(format)
+	}
+
+	return nil
+}
+
+// invalidExportFormat returns the error reported for unsupported export formats.
+func invalidExportFormat(format string) error {
+	return errors.BadRequest(
+		"the export format must be %q, %q or %q", ExportFormatCSV, ExportFormatJSONL, ExportFormatParquet,
+	).WithField("format", format)
+}
+
+// exportWriter writes the rows of an export one at a time. Close must be called once all of the rows have been
+// written; it doesn't close the underlying writer.
+type exportWriter[T any] interface {
+	Write(row *T) error
+	Close() error
+}
+
+// newExportWriter returns an exportWriter that writes rows in the given format.
+func newExportWriter[T any](w io.Writer, format string) (exportWriter[T], error) {
+	switch format {
+	case ExportFormatCSV:
+		return newCSVExportWriter[T](w)
+	case ExportFormatJSONL:
+		return &jsonlExportWriter[T]{encoder: json.NewEncoder(w)}, nil
+	case ExportFormatParquet:
+		return &parquetExportWriter[T]{
+			writer: parquet.NewGenericWriter[T](w, parquet.MaxRowsPerRowGroup(exportRowGroupSize)),
+		}, nil
+	default:
+		return nil, invalidExportFormat(format)
+	}
+}
+
+// csvExportWriter writes rows as CSV. The header contains the JSON field names of the row type, and the values are
+// formatted the same way as they are in JSON exports, except that timestamps aren't quoted and nil timestamps are
+// left blank.
+type csvExportWriter[T any] struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCSVExportWriter[T any](w io.Writer) (*csvExportWriter[T], error) {
+	rowType := reflect.TypeFor[T]()
+	header := make([]string, rowType.NumField())
+	for i := range header {
+		name, _, _ := strings.Cut(rowType.Field(i).Tag.Get("json"), ",")
+		header[i] = name
+	}
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(header); err != nil {
+		return nil, err
+	}
+	return &csvExportWriter[T]{writer: writer, record: make([]string, len(header))}, nil
+}
+
+// csvValue formats a field of a row for a CSV export.
+func csvValue(v reflect.Value) string {
+	switch value := v.Interface().(type) {
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case *time.Time:
+		if value == nil {
+			return ""
+		}
+		return value.Format(time.RFC3339Nano)
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64)
+	case bool:
+		return strconv.FormatBool(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func (w *csvExportWriter[T]) Write(row *T) error {
+	v := reflect.ValueOf(row).Elem()
+	for i := range w.record {
+		w.record[i] = csvValue(v.Field(i))
+	}
+	return w.writer.Write(w.record)
+}
+
+func (w *csvExportWriter[T]) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+// jsonlExportWriter writes rows as JSON Lines.
+type jsonlExportWriter[T any] struct {
+	encoder *json.Encoder
+}
+
+func (w *jsonlExportWriter[T]) Write(row *T) error {
+	return w.encoder.Encode(row)
+}
+
+func (w *jsonlExportWriter[T]) Close() error {
+	return nil
+}
+
+// parquetExportWriter writes rows as a Parquet file. The footer is written when the writer is closed.
+type parquetExportWriter[T any] struct {
+	writer *parquet.GenericWriter[T]
+}
+
+func (w *parquetExportWriter[T]) Write(row *T) error {
+	_, err := w.writer.Write([]T{*row})
+	return err
+}
+
+func (w *parquetExportWriter[T]) Close() error {
+	return w.writer.Close()
+}
+
+// exportRows streams the rows returned by one of the repository's export methods to a writer.
+func exportRows[T any](
+	ctx context.Context,
+	w io.Writer,
+	format string,
+	filter *db.ExportFilter,
+	export func(context.Context, *db.ExportFilter, func(*T) error, ...db.QueryOption) error,
+) (int, error) {
+	writer, err := newExportWriter[T](w, format)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	err = export(ctx, filter, func(row *T) error {
+		count++
+		return writer.Write(row)
+	})
+	if err != nil {
+		return count, err
+	}
+
+	return count, writer.Close()
+}
+
+// Export writes a dataset to w in the given format. The rows are streamed from the database as they're written, so
+// the dataset doesn't have to fit in memory. Subscriptions, quotas, usages and add-ons are exported for the
+// subscriptions that were in effect at any time in the filter's date range, and updates are exported if their
+// effective dates are in the range. The number of rows written is returned.
+func (a *App) Export(ctx context.Context, w io.Writer, dataset, format string, filter *db.ExportFilter) (int, error) {
+	if err := ValidateExport(dataset, format); err != nil {
+		return 0, err
+	}
+	if !filter.Start.IsZero() && !filter.End.IsZero() && !filter.Start.Before(filter.End) {
+		return 0, errors.BadRequest("the start of the date range must be before the end").
+			WithField("start", filter.Start).
+			WithField("end", filter.End)
+	}
+
+	d := a.db
+
+	switch dataset {
+	case ExportSubscriptions:
+		return exportRows(ctx, w, format, filter, d.ExportSubscriptions)
+	case ExportQuotas:
+		return exportRows(ctx, w, format, filter, d.ExportQuotas)
+	case ExportUsages:
+		return exportRows(ctx, w, format, filter, d.ExportUsages)
+	case ExportAddons:
+		return exportRows(ctx, w, format, filter, d.ExportSubscriptionAddons)
+	default:
+		return exportRows(ctx, w, format, filter, d.ExportUpdates)
+	}
+}
+
+// ExportHTTPHandler streams a dataset in the format given by the format query parameter, which defaults to CSV. The
+// start, end and plan query parameters filter the rows.
+func (a *App) ExportHTTPHandler(c echo.Context) error {
+	var err error
+
+	dataset := c.Param("dataset")
+	format := c.QueryParam("format")
+	if format == "" {
+		format = ExportFormatCSV
+	}
+	if err = ValidateExport(dataset, format); err != nil {
+		return err
+	}
+
+	filter := &db.ExportFilter{PlanName: c.QueryParam("plan")}
+	if v := c.QueryParam("start"); v != "" {
+		if filter.Start, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if v := c.QueryParam("end"); v != "" {
+		if filter.End, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	response := c.Response()
+	response.Header().Set(echo.HeaderContentType, exportContentTypes[format])
+	response.Header().Set(
+		echo.HeaderContentDisposition, fmt.Sprintf("attachment; filename=%q", dataset+"."+format),
+	)
+
+	count, err := a.Export(c.Request().Context(), response, dataset, format, filter)
+	if err != nil {
+		if !response.Committed {
+			response.Header().Del(echo.HeaderContentDisposition)
+			return err
+		}
+
+		// The status has already been sent, so the only way to tell the client that the export is incomplete is to
+		// abort the connection instead of ending the response normally.
+		log.Errorf("the export of %s failed after %d row(s): %s", dataset, count, err)
+		panic(http.ErrAbortHandler)
+	}
+
+	log.Infof("exported %d row(s) of %s as %s", count, dataset, format)
+
+	return nil
+}
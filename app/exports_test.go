@@ -0,0 +1,152 @@
+package app
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/parquet-go/parquet-go"
+)
+
+// exportedUsernames parses an export and returns the username of each row, in sorted order.
+func exportedUsernames(t *testing.T, format string, data []byte) []string {
+	t.Helper()
+	var usernames []string
+
+	switch format {
+	case ExportFormatCSV:
+		records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+		if err != nil || len(records) == 0 {
+			t.Fatalf("unable to parse the CSV export: %v", err)
+		}
+		column := slices.Index(records[0], "username")
+		if column < 0 {
+			t.Fatalf("the CSV header doesn't include the username: %v", records[0])
+		}
+		for _, record := range records[1:] {
+			usernames = append(usernames, record[column])
+		}
+	case ExportFormatJSONL:
+		scanner := bufio.NewScanner(bytes.NewReader(data))
+		for scanner.Scan() {
+			var row struct {
+				Username string `json:"username"`
+			}
+			if err := json.Unmarshal(scanner.Bytes(), &row); err != nil {
+				t.Fatalf("unable to parse the JSON Lines export: %s", err)
+			}
+			usernames = append(usernames, row.Username)
+		}
+	case ExportFormatParquet:
+		rows, err := parquet.Read[db.SubscriptionExport](bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			t.Fatalf("unable to parse the Parquet export: %s", err)
+		}
+		for _, row := range rows {
+			usernames = append(usernames, row.Username)
+		}
+	}
+
+	slices.Sort(usernames)
+	return usernames
+}
+
+func TestExport(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		name          string
+		dataset       string
+		format        string
+		filter        db.ExportFilter
+		wantErr       bool
+		wantUsernames []string
+	}{
+		{
+			name:          "subscriptions",
+			dataset:       ExportSubscriptions,
+			format:        ExportFormatCSV,
+			wantUsernames: []string{"jdoe", "sarahr"},
+		},
+		{
+			name:          "subscriptions to a plan",
+			dataset:       ExportSubscriptions,
+			format:        ExportFormatJSONL,
+			filter:        db.ExportFilter{PlanName: "Pro"},
+			wantUsernames: []string{"sarahr"},
+		},
+		{
+			name:          "subscriptions as parquet",
+			dataset:       ExportSubscriptions,
+			format:        ExportFormatParquet,
+			wantUsernames: []string{"jdoe", "sarahr"},
+		},
+		{
+			name:    "subscriptions outside the date range",
+			dataset: ExportSubscriptions,
+			format:  ExportFormatCSV,
+			filter:  db.ExportFilter{Start: now.AddDate(2, 0, 0)},
+		},
+		{
+			name:          "quotas",
+			dataset:       ExportQuotas,
+			format:        ExportFormatJSONL,
+			filter:        db.ExportFilter{PlanName: db.DefaultPlanName},
+			wantUsernames: []string{"jdoe", "jdoe"},
+		},
+		{name: "usages", dataset: ExportUsages, format: ExportFormatCSV, wantUsernames: []string{"jdoe"}},
+		{name: "add-ons", dataset: ExportAddons, format: ExportFormatCSV, wantUsernames: []string{"sarahr"}},
+		{name: "updates", dataset: ExportUpdates, format: ExportFormatJSONL, wantUsernames: []string{"jdoe"}},
+		{name: "unknown dataset", dataset: "plans", format: ExportFormatCSV, wantErr: true},
+		{name: "unknown format", dataset: ExportSubscriptions, format: "xlsx", wantErr: true},
+		{
+			name:    "empty date range",
+			dataset: ExportSubscriptions,
+			format:  ExportFormatCSV,
+			filter:  db.ExportFilter{Start: now, End: now.AddDate(0, 0, -1)},
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			addTestPlan(t, m, "Pro", 100, 5e10)
+
+			request := &qms.AddUserRequest{Username: "sarahr", PlanName: "Pro"}
+			if response := a.addUser(ctx, request, ""); response.Error != nil {
+				t.Fatalf("unable to subscribe the user: %s", response.Error.Message)
+			}
+			if _, err := a.AttachAddon(ctx, "sarahr", addTestAddon(t, m, "cpu.hours", 100)); err != nil {
+				t.Fatalf("unable to attach the add-on: %s", err)
+			}
+			addTestCPUUsage(t, a, "jdoe", 5)
+
+			var buf bytes.Buffer
+			count, err := a.Export(ctx, &buf, tt.dataset, tt.format, &tt.filter)
+			if tt.wantErr {
+				if errors.CodeOf(err) != errors.CodeBadRequest {
+					t.Fatalf("expected a bad request error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to export the %s: %s", tt.dataset, err)
+			}
+
+			usernames := exportedUsernames(t, tt.format, buf.Bytes())
+			if count != len(usernames) || !slices.Equal(usernames, tt.wantUsernames) {
+				t.Errorf("exported %d row(s) for %v, want %v", count, usernames, tt.wantUsernames)
+			}
+		})
+	}
+}
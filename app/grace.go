@@ -0,0 +1,170 @@
+package app
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+)
+
+// GracePeriodRequest is the request body for setting a plan's grace period.
+type GracePeriodRequest struct {
+	// Days is the number of days after a paid subscription to the plan ends during which its quotas still apply to
+	// overage checks.
+	Days int `json:"days"`
+}
+
+// PlanGracePeriod is the response body for plan grace period lookups and updates.
+type PlanGracePeriod struct {
+	PlanID   string `json:"plan_id"`
+	PlanName string `json:"plan_name"`
+	Days     int    `json:"days"`
+}
+
+// GracePeriod describes a paid subscription that has ended recently enough that its quotas still apply to overage
+// checks.
+type GracePeriod struct {
+	SubscriptionID string    `json:"subscription_id"`
+	PlanName       string    `json:"plan_name"`
+	EndedAt        time.Time `json:"ended_at"`
+	GraceEndsAt    time.Time `json:"grace_ends_at"`
+	RemainingDays  int       `json:"remaining_days"`
+	InGrace        bool      `json:"in_grace"`
+}
+
+// newPlanGracePeriod converts a plan to a PlanGracePeriod.
+func newPlanGracePeriod(plan *db.Plan) *PlanGracePeriod {
+	return &PlanGracePeriod{PlanID: plan.ID, PlanName: plan.Name, Days: plan.GracePeriodDays}
+}
+
+// newGracePeriod describes the grace period of a subscription that has ended. Partial days count as whole days
+// remaining.
+func newGracePeriod(s *db.Subscription, now time.Time) *GracePeriod {
+	graceEndsAt := s.EffectiveEndDate.AddDate(0, 0, s.Plan.GracePeriodDays)
+	return &GracePeriod{
+		SubscriptionID: s.ID,
+		PlanName:       s.Plan.Name,
+		EndedAt:        s.EffectiveEndDate,
+		GraceEndsAt:    graceEndsAt,
+		RemainingDays:  int(math.Ceil(graceEndsAt.Sub(now).Hours() / 24)),
+		InGrace:        now.Before(graceEndsAt),
+	}
+}
+
+// graceQuotas returns the quotas of the user's paid subscription that is in its grace period, indexed by resource
+// type ID, or nil if the user doesn't have a subscription in its grace period.
+func graceQuotas(ctx context.Context, d db.Repository, username string) (map[string]float64, error) {
+	subscription, err := d.GetGraceSubscription(ctx, username)
+	if err != nil || subscription == nil {
+		return nil, err
+	}
+
+	if err = d.LoadSubscriptionDetails(ctx, subscription); err != nil {
+		return nil, err
+	}
+
+	quotas := make(map[string]float64, len(subscription.Quotas))
+	for _, quota := range subscription.Quotas {
+		quotas[quota.ResourceType.ID] = quota.Quota
+	}
+
+	return quotas, nil
+}
+
+// UserGracePeriod returns the grace period of the user's most recent paid subscription, or nil if the user doesn't
+// have a subscription in its grace period.
+func (a *App) UserGracePeriod(ctx context.Context, username string) (*GracePeriod, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	subscription, err := a.db.GetGraceSubscription(ctx, username)
+	if err != nil || subscription == nil {
+		return nil, err
+	}
+
+	return newGracePeriod(subscription, time.Now()), nil
+}
+
+// PlanGracePeriod returns the grace period of a plan.
+func (a *App) PlanGracePeriod(ctx context.Context, planID string) (*PlanGracePeriod, error) {
+	plan, err := planByID(ctx, a.db, planID)
+	if err != nil {
+		return nil, err
+	}
+	return newPlanGracePeriod(plan), nil
+}
+
+// SetPlanGracePeriod sets the number of days after a paid subscription to a plan ends during which its quotas still
+// apply to overage checks. The change applies to subscriptions that have already ended as well as future ones.
+func (a *App) SetPlanGracePeriod(ctx context.Context, planID string, request *GracePeriodRequest) (*PlanGracePeriod, error) {
+	if request.Days < 0 {
+		return nil, errors.BadRequest("the grace period must not be negative").WithField("days", request.Days)
+	}
+
+	var result *PlanGracePeriod
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		before, err := planByID(ctx, d, planID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		if err = d.SetPlanGracePeriod(ctx, planID, request.Days, db.WithTX(tx)); err != nil {
+			return err
+		}
+
+		after, err := planByID(ctx, d, planID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		err = recordAudit(ctx, d, tx, db.AuditEntityPlan, planID, db.AuditActionUpdate, "", before, after)
+		if err != nil {
+			return err
+		}
+
+		result = newPlanGracePeriod(after)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("set the grace period for plan %s to %d days", result.PlanName, result.Days)
+
+	return result, nil
+}
+
+// PlanGracePeriodHTTPHandler returns the grace period of a plan.
+func (a *App) PlanGracePeriodHTTPHandler(c echo.Context) error {
+	response, err := a.PlanGracePeriod(c.Request().Context(), c.Param("plan_id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// SetPlanGracePeriodHTTPHandler sets the grace period of a plan.
+func (a *App) SetPlanGracePeriodHTTPHandler(c echo.Context) error {
+	var request GracePeriodRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.SetPlanGracePeriod(c.Request().Context(), c.Param("plan_id"), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,114 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestGracePeriod(t *testing.T) {
+	tests := []struct {
+		name          string
+		graceDays     int
+		paid          bool
+		endedDaysAgo  int
+		wantInGrace   bool
+		wantRemaining int
+	}{
+		{name: "in the grace period", graceDays: 30, paid: true, endedDaysAgo: 10, wantInGrace: true, wantRemaining: 20},
+		{name: "grace period over", graceDays: 30, paid: true, endedDaysAgo: 40},
+		{name: "no grace period", paid: true, endedDaysAgo: 1},
+		{name: "unpaid subscription", graceDays: 30, endedDaysAgo: 10},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			pro := addTestPlan(t, m, "Pro", 100, 5e10)
+
+			if _, err := a.SetPlanGracePeriod(ctx, pro.ID, &GracePeriodRequest{Days: tt.graceDays}); err != nil {
+				t.Fatalf("unable to set the grace period: %s", err)
+			}
+
+			// Subscribe the user to the Pro plan and end the subscription in the past.
+			request := &qms.AddUserRequest{Username: "sarahr", PlanName: "Pro", Paid: tt.paid}
+			if response := a.addUser(ctx, request, ""); response.Error != nil {
+				t.Fatalf("unable to subscribe the user: %s", response.Error.Message)
+			}
+			lapsed := subscribeTestUser(t, a, "sarahr")
+			endedAt := time.Now().AddDate(0, 0, -tt.endedDaysAgo)
+			if err := m.SetSubscriptionEndDate(ctx, lapsed.ID, endedAt); err != nil {
+				t.Fatalf("unable to end the subscription: %s", err)
+			}
+
+			// The user falls back to the default plan, whose CPU hours quota is 20, and uses 50 CPU hours.
+			subscribeTestUser(t, a, "sarahr")
+			usage := testUpdate("sarahr", db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, 50)
+			if response := a.addUserUpdate(ctx, usage); response.Error != nil {
+				t.Fatalf("unable to record the usage: %s", response.Error.Message)
+			}
+
+			grace, err := a.UserGracePeriod(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to look up the grace period: %s", err)
+			}
+			if (grace != nil) != tt.wantInGrace {
+				t.Fatalf("grace period = %+v, want one: %t", grace, tt.wantInGrace)
+			}
+			if grace != nil {
+				if grace.SubscriptionID != lapsed.ID || grace.RemainingDays != tt.wantRemaining {
+					t.Errorf("grace period = %+v, want %d days remaining of %s", grace, tt.wantRemaining, lapsed.ID)
+				}
+			}
+
+			// The Pro plan's quota applies during the grace period, so the usage isn't an overage.
+			overages, err := a.userOverages(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to look up the overages: %s", err)
+			}
+			if wantOverages := !tt.wantInGrace; (len(overages) > 0) != wantOverages {
+				t.Errorf("got %d overage(s), want overages: %t", len(overages), wantOverages)
+			}
+		})
+	}
+}
+
+func TestSetPlanGracePeriod(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+
+	plan, err := m.GetPlanByName(ctx, db.DefaultPlanName)
+	if err != nil {
+		t.Fatalf("unable to look up the default plan: %s", err)
+	}
+
+	result, err := a.SetPlanGracePeriod(ctx, plan.ID, &GracePeriodRequest{Days: 14})
+	if err != nil {
+		t.Fatalf("unable to set the grace period: %s", err)
+	}
+	if result.Days != 14 || result.PlanName != db.DefaultPlanName {
+		t.Errorf("unexpected grace period: %+v", result)
+	}
+
+	result, err = a.PlanGracePeriod(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to look up the grace period: %s", err)
+	}
+	if result.Days != 14 {
+		t.Errorf("grace period = %d days, want 14", result.Days)
+	}
+
+	if _, err = a.SetPlanGracePeriod(ctx, plan.ID, &GracePeriodRequest{Days: -1}); errors.CodeOf(err) != errors.CodeBadRequest {
+		t.Errorf("expected a bad request error for a negative grace period, got %v", err)
+	}
+
+	unknown := "00000000-0000-0000-0000-000000000000"
+	if _, err = a.SetPlanGracePeriod(ctx, unknown, &GracePeriodRequest{Days: 1}); !errors.Is(err, errors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound for an unknown plan, got %v", err)
+	}
+}
@@ -0,0 +1,561 @@
+package app
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// GroupRequest is the request body for adding a group.
+type GroupRequest struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// GroupSubscriptionRequest is the request body for subscribing a group to a plan.
+type GroupSubscriptionRequest struct {
+	PlanName string `json:"plan_name"`
+	Paid     bool   `json:"paid"`
+	Periods  int32  `json:"periods,omitempty"`
+	EndDate  string `json:"end_date,omitempty"`
+}
+
+// GroupQuotaRequest is the request body for setting a pooled quota in a group's active subscription.
+type GroupQuotaRequest struct {
+	Quota float64 `json:"quota"`
+}
+
+// GroupList is the response body for group listings.
+type GroupList struct {
+	Groups []db.Group `json:"groups"`
+}
+
+// GroupDetails describes a group along with its members, its active subscription and the pooled usage of each of
+// the subscription's quotas.
+type GroupDetails struct {
+	db.Group
+	Members      []string              `json:"members"`
+	Subscription *db.GroupSubscription `json:"subscription,omitempty"`
+	Allocations  []db.GroupAllocation  `json:"allocations"`
+}
+
+// UserGroups is the response body for listing the groups that a user belongs to.
+type UserGroups struct {
+	Groups      []db.Group           `json:"groups"`
+	Allocations []db.GroupAllocation `json:"allocations"`
+}
+
+// groupMember is the snapshot of a group membership that is recorded in the audit log.
+type groupMember struct {
+	GroupID   string `json:"group_id"`
+	GroupName string `json:"group_name"`
+	Username  string `json:"username"`
+}
+
+// groupByName returns the group with the given name, or an error if it doesn't exist.
+func groupByName(ctx context.Context, d db.Repository, name string, opts ...db.QueryOption) (*db.Group, error) {
+	group, err := d.GetGroupByName(ctx, name, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if group == nil {
+		return nil, errors.ErrGroupNotFound.WithField("name", name)
+	}
+	return group, nil
+}
+
+// groupDetails loads the members, active subscription and allocations of a group.
+func groupDetails(ctx context.Context, d db.Repository, group *db.Group, opts ...db.QueryOption) (*GroupDetails, error) {
+	members, err := d.ListGroupMembers(ctx, group.ID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	usernames := make([]string, len(members))
+	for i, member := range members {
+		usernames[i] = member.Username
+	}
+
+	subscription, err := d.GetActiveGroupSubscription(ctx, group.ID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := d.ListGroupAllocations(ctx, group.ID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if allocations == nil {
+		allocations = make([]db.GroupAllocation, 0)
+	}
+
+	return &GroupDetails{Group: *group, Members: usernames, Subscription: subscription, Allocations: allocations}, nil
+}
+
+// AddGroup adds a new group without any members or subscription.
+func (a *App) AddGroup(ctx context.Context, request *GroupRequest) (*db.Group, error) {
+	if request.Name == "" {
+		return nil, errors.ErrMissingField.WithField("field", "name")
+	}
+
+	group := &db.Group{Name: request.Name, Description: request.Description}
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		existing, err := d.GetGroupByName(ctx, request.Name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if existing != nil {
+			return errors.ErrGroupExists.WithField("name", request.Name)
+		}
+
+		if err = d.AddGroup(ctx, group, db.WithTX(tx), actorOpt(ctx)); err != nil {
+			return err
+		}
+		return recordAudit(ctx, d, tx, db.AuditEntityGroup, group.ID, db.AuditActionCreate, "", nil, group)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return group, nil
+}
+
+// ListGroups lists all of the groups.
+func (a *App) ListGroups(ctx context.Context) (*GroupList, error) {
+	groups, err := a.db.ListGroups(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if groups == nil {
+		groups = make([]db.Group, 0)
+	}
+	return &GroupList{Groups: groups}, nil
+}
+
+// GetGroup returns a group along with its members, its active subscription and its pooled usages.
+func (a *App) GetGroup(ctx context.Context, name string) (*GroupDetails, error) {
+	d := a.db
+
+	group, err := groupByName(ctx, d, name)
+	if err != nil {
+		return nil, err
+	}
+	return groupDetails(ctx, d, group)
+}
+
+// DeleteGroup removes a group along with its memberships and subscriptions, and returns the group as it was before it
+// was removed. The personal subscriptions of the members aren't affected.
+func (a *App) DeleteGroup(ctx context.Context, name string) (*GroupDetails, error) {
+	var result *GroupDetails
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		group, err := groupByName(ctx, d, name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		result, err = groupDetails(ctx, d, group, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		deleted, err := d.DeleteGroup(ctx, group.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if !deleted {
+			return errors.ErrGroupNotFound.WithField("name", name)
+		}
+
+		return recordAudit(ctx, d, tx, db.AuditEntityGroup, group.ID, db.AuditActionDelete, "", result, nil)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("deleted group %s", name)
+
+	return result, nil
+}
+
+// AddGroupMember adds a user to a group. Adding a user who already belongs to the group has no effect.
+func (a *App) AddGroupMember(ctx context.Context, name, username string) (*GroupDetails, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *GroupDetails
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		group, err := groupByName(ctx, d, name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		added, err := d.AddGroupMember(ctx, group.ID, user.ID, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return err
+		}
+		if added {
+			member := &groupMember{GroupID: group.ID, GroupName: group.Name, Username: username}
+			err = recordAudit(ctx, d, tx, db.AuditEntityGroupMember, group.ID, db.AuditActionCreate, username, nil, member)
+			if err != nil {
+				return err
+			}
+		}
+
+		result, err = groupDetails(ctx, d, group, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// RemoveGroupMember removes a user from a group.
+func (a *App) RemoveGroupMember(ctx context.Context, name, username string) (*GroupDetails, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var result *GroupDetails
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		group, err := groupByName(ctx, d, name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		notMember := errors.ErrGroupMemberNotFound.WithField("group", name).WithField("username", username)
+		exists, err := d.UserExists(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if !exists {
+			return notMember
+		}
+		userID, err := d.GetUserID(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		removed, err := d.RemoveGroupMember(ctx, group.ID, userID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if !removed {
+			return notMember
+		}
+
+		member := &groupMember{GroupID: group.ID, GroupName: group.Name, Username: username}
+		err = recordAudit(ctx, d, tx, db.AuditEntityGroupMember, group.ID, db.AuditActionDelete, username, member, nil)
+		if err != nil {
+			return err
+		}
+
+		result, err = groupDetails(ctx, d, group, db.WithTX(tx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// SubscribeGroup subscribes a group to a plan starting immediately. The group's current subscription, if it has one,
+// ends when the new subscription starts.
+func (a *App) SubscribeGroup(ctx context.Context, name string, request *GroupSubscriptionRequest) (*db.GroupSubscription, error) {
+	if request.PlanName == "" {
+		return nil, errors.ErrMissingField.WithField("field", "plan_name")
+	}
+
+	opts, err := utils.OptsForValues(request.Paid, request.Periods, request.EndDate)
+	if err != nil {
+		return nil, err
+	}
+
+	var subscription *db.GroupSubscription
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		group, err := groupByName(ctx, d, name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		plan, err := d.GetPlanByName(ctx, request.PlanName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if plan == nil {
+			return errors.ErrPlanNotFound.WithField("name", request.PlanName)
+		}
+
+		before, err := d.GetActiveGroupSubscription(ctx, group.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		subscriptionID, err := d.AddGroupSubscription(ctx, group.ID, plan, opts, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return err
+		}
+
+		subscription, err = d.GetActiveGroupSubscription(ctx, group.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		// The previous subscription ends when the new one starts.
+		if before != nil {
+			ended := *before
+			ended.EffectiveEndDate = subscription.EffectiveStartDate
+			err = recordAudit(
+				ctx, d, tx, db.AuditEntityGroupSubscription, before.ID, db.AuditActionUpdate, "", before, &ended,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return recordAudit(
+			ctx, d, tx, db.AuditEntityGroupSubscription, subscriptionID, db.AuditActionCreate, "", nil, subscription,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof("subscribed group %s to plan %s", name, request.PlanName)
+	metrics.SubscriptionsCreated.WithLabelValues(request.PlanName, metrics.SubscriptionKindGroup).Inc()
+
+	return subscription, nil
+}
+
+// SetGroupQuota sets a pooled quota in a group's active subscription.
+func (a *App) SetGroupQuota(
+	ctx context.Context, name, resourceTypeName string, request *GroupQuotaRequest,
+) (*db.GroupSubscription, error) {
+	if request.Quota < 0 {
+		return nil, errors.ErrInvalidValue.WithField("quota", request.Quota)
+	}
+
+	var subscription *db.GroupSubscription
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		group, err := groupByName(ctx, d, name, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		before, err := d.GetActiveGroupSubscription(ctx, group.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if before == nil {
+			return errors.ErrNoActiveSubscription.WithField("group", name)
+		}
+
+		resourceType, err := d.GetResourceTypeByName(ctx, resourceTypeName, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if resourceType == nil || resourceType.ID == "" {
+			return errors.ErrInvalidResourceName.WithField("resource_type", resourceTypeName)
+		}
+
+		err = d.UpsertGroupQuota(ctx, request.Quota, resourceType.ID, before.ID, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return err
+		}
+
+		subscription, err = d.GetActiveGroupSubscription(ctx, group.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		return recordAudit(
+			ctx, d, tx, db.AuditEntityGroupSubscription, before.ID, db.AuditActionUpdate, "", before, subscription,
+		)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return subscription, nil
+}
+
+// ListUserGroups lists the groups that a user belongs to along with the pooled usages of their active subscriptions.
+func (a *App) ListUserGroups(ctx context.Context, username string) (*UserGroups, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	d := a.db
+
+	groups, err := d.ListUserGroups(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if groups == nil {
+		groups = make([]db.Group, 0)
+	}
+
+	allocations, err := d.ListUserGroupAllocations(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	if allocations == nil {
+		allocations = make([]db.GroupAllocation, 0)
+	}
+
+	return &UserGroups{Groups: groups, Allocations: allocations}, nil
+}
+
+// AddGroupHTTPHandler adds a group.
+func (a *App) AddGroupHTTPHandler(c echo.Context) error {
+	var request GroupRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.AddGroup(c.Request().Context(), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// ListGroupsHTTPHandler lists the groups.
+func (a *App) ListGroupsHTTPHandler(c echo.Context) error {
+	response, err := a.ListGroups(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetGroupHTTPHandler returns a group.
+func (a *App) GetGroupHTTPHandler(c echo.Context) error {
+	response, err := a.GetGroup(c.Request().Context(), c.Param("group_name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// DeleteGroupHTTPHandler removes a group.
+func (a *App) DeleteGroupHTTPHandler(c echo.Context) error {
+	response, err := a.DeleteGroup(c.Request().Context(), c.Param("group_name"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// AddGroupMemberHTTPHandler adds a user to a group.
+func (a *App) AddGroupMemberHTTPHandler(c echo.Context) error {
+	response, err := a.AddGroupMember(c.Request().Context(), c.Param("group_name"), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// RemoveGroupMemberHTTPHandler removes a user from a group.
+func (a *App) RemoveGroupMemberHTTPHandler(c echo.Context) error {
+	response, err := a.RemoveGroupMember(c.Request().Context(), c.Param("group_name"), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// SubscribeGroupHTTPHandler subscribes a group to a plan.
+func (a *App) SubscribeGroupHTTPHandler(c echo.Context) error {
+	var request GroupSubscriptionRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.SubscribeGroup(c.Request().Context(), c.Param("group_name"), &request)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// SetGroupQuotaHTTPHandler sets a pooled quota in a group's active subscription.
+func (a *App) SetGroupQuotaHTTPHandler(c echo.Context) error {
+	var request GroupQuotaRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.SetGroupQuota(
+		c.Request().Context(), c.Param("group_name"), c.Param("resource_type"), &request,
+	)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// ListUserGroupsHTTPHandler lists the groups that a user belongs to.
+func (a *App) ListUserGroupsHTTPHandler(c echo.Context) error {
+	response, err := a.ListUserGroups(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
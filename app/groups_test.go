@@ -0,0 +1,250 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestGroup adds a group with the given members and subscribes it to the Team plan with the given pooled CPU
+// hours quota. The Team plan is added if it doesn't exist yet.
+func addTestGroup(t *testing.T, a *App, m *db.MemoryDatabase, name string, cpuHours float64, members ...string) {
+	t.Helper()
+	ctx := context.Background()
+
+	if plan, err := m.GetPlanByName(ctx, "Team"); err != nil || plan == nil {
+		addTestPlan(t, m, "Team", 1000, 5e12)
+	}
+	if _, err := a.AddGroup(ctx, &GroupRequest{Name: name}); err != nil {
+		t.Fatalf("unable to add group %s: %s", name, err)
+	}
+	if _, err := a.SubscribeGroup(ctx, name, &GroupSubscriptionRequest{PlanName: "Team"}); err != nil {
+		t.Fatalf("unable to subscribe group %s: %s", name, err)
+	}
+	if _, err := a.SetGroupQuota(ctx, name, "cpu.hours", &GroupQuotaRequest{Quota: cpuHours}); err != nil {
+		t.Fatalf("unable to set the quota of group %s: %s", name, err)
+	}
+	for _, member := range members {
+		if _, err := a.AddGroupMember(ctx, name, member); err != nil {
+			t.Fatalf("unable to add %s to group %s: %s", member, name, err)
+		}
+	}
+}
+
+// addTestCPUUsage subscribes a user to the default plan, whose CPU hours quota is 20, and records CPU hours usage.
+func addTestCPUUsage(t *testing.T, a *App, username string, usage float64) {
+	t.Helper()
+	subscribeTestUser(t, a, username)
+	request := testUpdate(username, db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, usage)
+	if response := a.addUserUpdate(context.Background(), request); response.Error != nil {
+		t.Fatalf("unable to record the usage of %s: %s", username, response.Error.Message)
+	}
+}
+
+func TestGroupPooling(t *testing.T) {
+	tests := []struct {
+		name          string
+		groupQuota    float64
+		members       []string
+		usages        map[string]float64
+		wantPooled    float64
+		wantOverusers []string
+	}{
+		{
+			name:       "pool not used up",
+			groupQuota: 30,
+			members:    []string{"sarahr", "jdoe"},
+			usages:     map[string]float64{"sarahr": 25, "jdoe": 10},
+			wantPooled: 5,
+		},
+		{
+			name:          "pool used up",
+			groupQuota:    30,
+			members:       []string{"sarahr", "jdoe"},
+			usages:        map[string]float64{"sarahr": 40, "jdoe": 35},
+			wantPooled:    35,
+			wantOverusers: []string{"jdoe", "sarahr"},
+		},
+		{
+			name:          "non-member",
+			groupQuota:    30,
+			members:       []string{"sarahr"},
+			usages:        map[string]float64{"sarahr": 25, "alice": 25},
+			wantPooled:    5,
+			wantOverusers: []string{"alice"},
+		},
+		{
+			name:          "empty pool",
+			members:       []string{"sarahr"},
+			usages:        map[string]float64{"sarahr": 25},
+			wantPooled:    5,
+			wantOverusers: []string{"sarahr"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+
+			for username, usage := range tt.usages {
+				addTestCPUUsage(t, a, username, usage)
+			}
+			addTestGroup(t, a, m, "lab", tt.groupQuota, tt.members...)
+
+			details, err := a.GetGroup(ctx, "lab")
+			if err != nil {
+				t.Fatalf("unable to look up the group: %s", err)
+			}
+			var pooled float64
+			for _, allocation := range details.Allocations {
+				if allocation.ResourceTypeName == "cpu.hours" {
+					pooled = allocation.UsageValue
+				}
+			}
+			if pooled != tt.wantPooled {
+				t.Errorf("pooled usage = %g, want %g", pooled, tt.wantPooled)
+			}
+
+			overusers := make(map[string]bool)
+			for _, username := range tt.wantOverusers {
+				overusers[username] = true
+			}
+			for username := range tt.usages {
+				overages, err := a.userOverages(ctx, username)
+				if err != nil {
+					t.Fatalf("unable to look up the overages of %s: %s", username, err)
+				}
+				if (len(overages) > 0) != overusers[username] {
+					t.Errorf("%s has %d overage(s), want overages: %t", username, len(overages), overusers[username])
+				}
+			}
+		})
+	}
+}
+
+func TestGroupMembership(t *testing.T) {
+	tests := []struct {
+		name        string
+		group       string
+		add         []string
+		remove      string
+		wantErr     error
+		wantMembers []string
+	}{
+		{name: "add members", group: "lab", add: []string{"sarahr", "jdoe"}, wantMembers: []string{"jdoe", "sarahr"}},
+		{name: "add a member twice", group: "lab", add: []string{"sarahr", "sarahr"}, wantMembers: []string{"sarahr"}},
+		{name: "remove a member", group: "lab", add: []string{"sarahr", "jdoe"}, remove: "jdoe", wantMembers: []string{"sarahr"}},
+		{name: "remove a non-member", group: "lab", add: []string{"sarahr"}, remove: "jdoe", wantErr: errors.ErrGroupMemberNotFound},
+		{name: "remove an unknown user", group: "lab", remove: "nobody", wantErr: errors.ErrGroupMemberNotFound},
+		{name: "unknown group", group: "missing", add: []string{"sarahr"}, wantErr: errors.ErrGroupNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			addTestGroup(t, a, m, "lab", 30)
+
+			var (
+				details *GroupDetails
+				err     error
+			)
+			for _, username := range tt.add {
+				if details, err = a.AddGroupMember(ctx, tt.group, username); err != nil {
+					break
+				}
+			}
+			if err == nil && tt.remove != "" {
+				details, err = a.RemoveGroupMember(ctx, tt.group, tt.remove)
+			}
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Fatalf("expected %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to change the group membership: %s", err)
+			}
+			if len(details.Members) != len(tt.wantMembers) {
+				t.Fatalf("members = %v, want %v", details.Members, tt.wantMembers)
+			}
+			for i, member := range tt.wantMembers {
+				if details.Members[i] != member {
+					t.Errorf("members = %v, want %v", details.Members, tt.wantMembers)
+					break
+				}
+			}
+
+			for _, username := range tt.wantMembers {
+				groups, err := a.ListUserGroups(ctx, username)
+				if err != nil {
+					t.Fatalf("unable to list the groups of %s: %s", username, err)
+				}
+				if len(groups.Groups) != 1 || groups.Groups[0].Name != "lab" {
+					t.Errorf("groups of %s = %v, want [lab]", username, groups.Groups)
+				}
+			}
+		})
+	}
+}
+
+func TestDeleteGroup(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+
+	addTestCPUUsage(t, a, "sarahr", 25)
+	addTestGroup(t, a, m, "lab", 30, "sarahr")
+	addTestGroup(t, a, m, "other", 30, "sarahr")
+
+	overages, err := a.userOverages(ctx, "sarahr")
+	if err != nil {
+		t.Fatalf("unable to look up the overages: %s", err)
+	}
+	if len(overages) != 0 {
+		t.Fatalf("got %d overage(s) while the pool is available", len(overages))
+	}
+
+	deleted, err := a.DeleteGroup(ctx, "lab")
+	if err != nil {
+		t.Fatalf("unable to delete the group: %s", err)
+	}
+	if deleted.Name != "lab" || len(deleted.Members) != 1 || deleted.Subscription == nil {
+		t.Errorf("unexpected deleted group: %+v", deleted)
+	}
+
+	if _, err = a.GetGroup(ctx, "lab"); !errors.Is(err, errors.ErrGroupNotFound) {
+		t.Errorf("expected ErrGroupNotFound after the group was deleted, got %v", err)
+	}
+	if _, err = a.DeleteGroup(ctx, "lab"); !errors.Is(err, errors.ErrGroupNotFound) {
+		t.Errorf("expected ErrGroupNotFound when deleting the group again, got %v", err)
+	}
+
+	// The other group and the member's personal subscription are unaffected.
+	groups, err := a.ListUserGroups(ctx, "sarahr")
+	if err != nil {
+		t.Fatalf("unable to list the groups: %s", err)
+	}
+	if len(groups.Groups) != 1 || groups.Groups[0].Name != "other" {
+		t.Errorf("groups = %v, want [other]", groups.Groups)
+	}
+	if _, err = m.GetActiveSubscription(ctx, "sarahr"); err != nil {
+		t.Errorf("unable to look up the personal subscription: %s", err)
+	}
+
+	// The member is in overage once the last group is deleted.
+	if _, err = a.DeleteGroup(ctx, "other"); err != nil {
+		t.Fatalf("unable to delete the group: %s", err)
+	}
+	overages, err = a.userOverages(ctx, "sarahr")
+	if err != nil {
+		t.Fatalf("unable to look up the overages: %s", err)
+	}
+	if len(overages) != 1 {
+		t.Errorf("got %d overage(s) after the groups were deleted, want 1", len(overages))
+	}
+}
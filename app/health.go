@@ -0,0 +1,91 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// Health statuses reported by the liveness and readiness endpoints.
+const (
+	HealthStatusOK          = "ok"
+	HealthStatusUnavailable = "unavailable"
+)
+
+// readinessTimeout is the maximum amount of time that the readiness checks are allowed to take.
+const readinessTimeout = 5 * time.Second
+
+// HealthCheck determines whether a dependency of the service is available. It returns an error describing the
+// problem if the dependency isn't available.
+type HealthCheck func(ctx context.Context) error
+
+// DependencyStatus is the status of a single dependency in a readiness response.
+type DependencyStatus struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// HealthStatus is the response body for the liveness and readiness endpoints.
+type HealthStatus struct {
+	Status       string                      `json:"status"`
+	Dependencies map[string]DependencyStatus `json:"dependencies,omitempty"`
+}
+
+// AddReadinessCheck registers a check that has to pass before the service is considered ready to handle requests.
+// Checks should be registered before the service starts handling requests.
+func (a *App) AddReadinessCheck(name string, check HealthCheck) {
+	a.readinessChecks[name] = check
+}
+
+// LivenessHTTPHandler reports that the service is running. It doesn't check any dependencies, so that the service
+// isn't restarted when a dependency is temporarily unavailable.
+func (a *App) LivenessHTTPHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, &HealthStatus{Status: HealthStatusOK})
+}
+
+// ReadinessHTTPHandler runs the readiness checks concurrently and reports the status of each dependency. The
+// response status is 503 if any of the checks fail.
+func (a *App) ReadinessHTTPHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessTimeout)
+	defer cancel()
+
+	response := &HealthStatus{
+		Status:       HealthStatusOK,
+		Dependencies: make(map[string]DependencyStatus, len(a.readinessChecks)),
+	}
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+	for name, check := range a.readinessChecks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			status := DependencyStatus{Status: HealthStatusOK}
+			if err := check(ctx); err != nil {
+				status = DependencyStatus{Status: HealthStatusUnavailable, Error: err.Error()}
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			response.Dependencies[name] = status
+			if status.Status != HealthStatusOK {
+				response.Status = HealthStatusUnavailable
+			}
+		}()
+	}
+	wg.Wait()
+
+	code := http.StatusOK
+	if response.Status != HealthStatusOK {
+		log.Warnf("readiness check failed: %+v", response.Dependencies)
+		code = http.StatusServiceUnavailable
+	}
+
+	return c.JSON(code, response)
+}
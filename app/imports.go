@@ -0,0 +1,429 @@
+package app
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// Supported user import formats.
+const (
+	ImportFormatCSV   = "csv"
+	ImportFormatJSONL = "jsonl"
+)
+
+// Results reported for the rows of a user import.
+const (
+	// ImportSubscribed indicates that a new subscription was created for the user.
+	ImportSubscribed = "subscribed"
+
+	// ImportUnchanged indicates that the user already had an active subscription to the plan.
+	ImportUnchanged = "unchanged"
+
+	// ImportFailed indicates that the row couldn't be imported. Nothing is changed for rows that fail.
+	ImportFailed = "failed"
+)
+
+// ImportRow is a single row of a user import. The fields have the same meaning as the fields of an AddUserRequest,
+// and StartDate schedules the subscription to start in the future. Addons lists the names or IDs of add-ons to
+// apply to the user's subscription.
+type ImportRow struct {
+	Username  string   `json:"username"`
+	PlanName  string   `json:"plan_name"`
+	Periods   int32    `json:"periods,omitempty"`
+	EndDate   string   `json:"end_date,omitempty"`
+	StartDate string   `json:"start_date,omitempty"`
+	Paid      bool     `json:"paid,omitempty"`
+	Force     bool     `json:"force,omitempty"`
+	Addons    []string `json:"addons,omitempty"`
+}
+
+// ImportRowResult reports the outcome of importing a single row. Row is the position of the row in the file, not
+// counting the CSV header. SubscriptionID and SubscriptionAddonIDs are only set for rows that were committed.
+type ImportRowResult struct {
+	Row                  int      `json:"row"`
+	Username             string   `json:"username"`
+	PlanName             string   `json:"plan_name"`
+	Result               string   `json:"result"`
+	SubscriptionID       string   `json:"subscription_id,omitempty"`
+	SubscriptionAddonIDs []string `json:"subscription_addon_ids,omitempty"`
+	Error                string   `json:"error,omitempty"`
+}
+
+// ImportReport is the response body for user imports.
+type ImportReport struct {
+	DryRun     bool              `json:"dry_run"`
+	Total      int               `json:"total"`
+	Subscribed int               `json:"subscribed"`
+	Unchanged  int               `json:"unchanged"`
+	Failed     int               `json:"failed"`
+	Rows       []ImportRowResult `json:"rows"`
+}
+
+// importColumns lists the columns that may appear in the header of a CSV import.
+var importColumns = []string{
+	"username", "plan_name", "periods", "end_date", "start_date", "paid", "force", "addons",
+}
+
+// importReader reads the rows of an import one at a time. Next returns io.EOF once all of the rows have been read.
+// Errors that only affect a single row are returned as rowErrors so that the import can continue.
+type importReader interface {
+	Next() (*ImportRow, error)
+}
+
+// rowError indicates that a single row of an import couldn't be parsed.
+type rowError struct {
+	err error
+}
+
+func (e rowError) Error() string {
+	return e.err.Error()
+}
+
+// csvImportReader reads import rows from CSV data with a header row. Add-ons are separated by semicolons.
+type csvImportReader struct {
+	reader  *csv.Reader
+	columns []string
+}
+
+func newCSVImportReader(r io.Reader) (*csvImportReader, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err == io.EOF {
+		return nil, errors.BadRequest("the CSV data must start with a header row")
+	}
+	if err != nil {
+		return nil, errors.BadRequest("unable to read the CSV header: %s", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, column := range header {
+		columns[i] = strings.ToLower(strings.TrimSpace(column))
+		known := false
+		for _, c := range importColumns {
+			known = known || c == columns[i]
+		}
+		if !known {
+			return nil, errors.BadRequest("unrecognized CSV column: %s", column)
+		}
+	}
+
+	// The number of fields is checked against the header for each row instead.
+	reader.FieldsPerRecord = -1
+
+	return &csvImportReader{reader: reader, columns: columns}, nil
+}
+
+func (r *csvImportReader) Next() (*ImportRow, error) {
+	record, err := r.reader.Read()
+	if err == io.EOF {
+		return nil, err
+	}
+	if err != nil {
+		// Quoting errors only affect the current record, so the reader can continue with the next one.
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			return nil, rowError{err}
+		}
+		return nil, err
+	}
+	if len(record) != len(r.columns) {
+		return nil, rowError{errors.BadRequest("expected %d fields but found %d", len(r.columns), len(record))}
+	}
+
+	var row ImportRow
+	for i, value := range record {
+		value = strings.TrimSpace(value)
+		switch r.columns[i] {
+		case "username":
+			row.Username = value
+		case "plan_name":
+			row.PlanName = value
+		case "periods":
+			if value != "" {
+				periods, err := strconv.ParseInt(value, 10, 32)
+				if err != nil {
+					return nil, rowError{errors.BadRequest("invalid periods: %s", value)}
+				}
+				row.Periods = int32(periods)
+			}
+		case "end_date":
+			row.EndDate = value
+		case "start_date":
+			row.StartDate = value
+		case "paid", "force":
+			var flag bool
+			if value != "" {
+				if flag, err = strconv.ParseBool(value); err != nil {
+					return nil, rowError{errors.BadRequest("invalid %s: %s", r.columns[i], value)}
+				}
+			}
+			if r.columns[i] == "paid" {
+				row.Paid = flag
+			} else {
+				row.Force = flag
+			}
+		case "addons":
+			for _, addon := range strings.Split(value, ";") {
+				if addon = strings.TrimSpace(addon); addon != "" {
+					row.Addons = append(row.Addons, addon)
+				}
+			}
+		}
+	}
+
+	return &row, nil
+}
+
+// jsonlImportReader reads import rows from JSON Lines data, with one JSON object per line. Blank lines are skipped.
+type jsonlImportReader struct {
+	scanner *bufio.Scanner
+}
+
+func newJSONLImportReader(r io.Reader) *jsonlImportReader {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	return &jsonlImportReader{scanner: scanner}
+}
+
+func (r *jsonlImportReader) Next() (*ImportRow, error) {
+	for r.scanner.Scan() {
+		line := strings.TrimSpace(r.scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		var row ImportRow
+		decoder := json.NewDecoder(strings.NewReader(line))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&row); err != nil {
+			return nil, rowError{errors.BadRequest("invalid JSON: %s", err)}
+		}
+		return &row, nil
+	}
+	if err := r.scanner.Err(); err != nil {
+		return nil, err
+	}
+	return nil, io.EOF
+}
+
+// newImportReader returns a reader for import rows in the given format.
+func newImportReader(r io.Reader, format string) (importReader, error) {
+	switch format {
+	case ImportFormatCSV:
+		return newCSVImportReader(r)
+	case ImportFormatJSONL:
+		return newJSONLImportReader(r), nil
+	case "":
+		return nil, errors.ErrMissingField.WithField("field", "format")
+	default:
+		return nil, errors.BadRequest("the import format must be %q or %q", ImportFormatCSV, ImportFormatJSONL).
+			WithField("format", format)
+	}
+}
+
+// importAddonIDs maps the names and IDs of the available add-ons to their IDs.
+func (a *App) importAddonIDs(ctx context.Context) (map[string]string, error) {
+	addons, err := a.db.ListAddons(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make(map[string]string, len(addons)*2)
+	for _, addon := range addons {
+		ids[addon.Name] = addon.ID
+		ids[addon.ID] = addon.ID
+	}
+	return ids, nil
+}
+
+// importRow subscribes the user in a single import row to a plan and applies the row's add-ons, using the same logic
+// as AddUser. The changes are rolled back instead of being committed in a dry run.
+func (a *App) importRow(
+	ctx context.Context, row *ImportRow, addonIDs map[string]string, dryRun bool, result *ImportRowResult,
+) error {
+	if row.Username == "" {
+		return errors.ErrMissingField.WithField("field", "username")
+	}
+	if row.PlanName == "" {
+		return errors.ErrMissingField.WithField("field", "plan_name")
+	}
+
+	username, err := a.FixUsername(row.Username)
+	if err != nil {
+		return err
+	}
+	result.Username = username
+
+	opts, err := utils.ScheduledOptsForValues(row.Paid, row.Periods, row.StartDate, row.EndDate)
+	if err != nil {
+		return err
+	}
+
+	// Resolve the add-ons before making any changes.
+	addons := make([]string, len(row.Addons))
+	for i, addon := range row.Addons {
+		id, ok := addonIDs[addon]
+		if !ok {
+			return errors.ErrAddonNotFound.WithField("addon", addon)
+		}
+		addons[i] = id
+	}
+
+	request := &qms.AddUserRequest{
+		Username: username,
+		PlanName: row.PlanName,
+		Paid:     row.Paid,
+		Periods:  row.Periods,
+		EndDate:  row.EndDate,
+		Force:    row.Force,
+	}
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	subscription, err := a.subscribeUserInTx(ctx, d, tx, username, request, opts)
+	if err != nil {
+		return err
+	}
+	result.PlanName = subscription.Plan.Name
+
+	// Add-ons are applied to the new subscription, or to the active one if the user was already on the plan.
+	subscriptionID := subscription.SubscriptionID
+	if subscriptionID == "" && len(addons) > 0 {
+		active, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		subscriptionID = active.ID
+	}
+
+	var subAddonIDs []string
+	for _, addonID := range addons {
+		subAddon, err := a.attachAddonInTx(ctx, d, tx, subscriptionID, addonID)
+		if err != nil {
+			return err
+		}
+		subAddonIDs = append(subAddonIDs, subAddon.ID)
+	}
+
+	result.Result = ImportUnchanged
+	if subscription.SubscriptionID != "" {
+		result.Result = ImportSubscribed
+	}
+	if dryRun {
+		return nil
+	}
+
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+	subscription.countNewSubscription()
+
+	result.SubscriptionID = subscription.SubscriptionID
+	result.SubscriptionAddonIDs = subAddonIDs
+	return nil
+}
+
+// ImportUsers subscribes the users listed in CSV or JSON Lines data to plans. Each row is applied in its own
+// transaction, so a row that fails doesn't affect the others. In a dry run every row is validated and applied, but
+// the changes are rolled back. The report lists the result for each row.
+func (a *App) ImportUsers(ctx context.Context, r io.Reader, format string, dryRun bool) (*ImportReport, error) {
+	reader, err := newImportReader(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	addonIDs, err := a.importAddonIDs(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ImportReport{DryRun: dryRun, Rows: make([]ImportRowResult, 0)}
+	for rowNumber := 1; ; rowNumber++ {
+		row, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+
+		result := ImportRowResult{Row: rowNumber}
+		var rowErr rowError
+		switch {
+		case errors.As(err, &rowErr):
+		case err != nil:
+			return nil, err
+		default:
+			result.Username, result.PlanName = row.Username, row.PlanName
+			err = a.importRow(ctx, row, addonIDs, dryRun, &result)
+		}
+
+		report.Total++
+		if err != nil {
+			result.Result = ImportFailed
+			result.Error = err.Error()
+			report.Failed++
+		} else if result.Result == ImportSubscribed {
+			report.Subscribed++
+		} else {
+			report.Unchanged++
+		}
+		report.Rows = append(report.Rows, result)
+	}
+
+	log.Infof("imported %d user(s): %d subscribed, %d unchanged, %d failed (dry run: %t)",
+		report.Total, report.Subscribed, report.Unchanged, report.Failed, dryRun)
+
+	return report, nil
+}
+
+// importFormat determines the format of an import from the format query parameter, falling back to the content type
+// of the request.
+func importFormat(c echo.Context) string {
+	if format := c.QueryParam("format"); format != "" {
+		return format
+	}
+
+	contentType := c.Request().Header.Get(echo.HeaderContentType)
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return ImportFormatCSV
+	case strings.HasPrefix(contentType, "application/x-ndjson"), strings.HasPrefix(contentType, "application/jsonl"):
+		return ImportFormatJSONL
+	default:
+		return ""
+	}
+}
+
+// ImportUsersHTTPHandler subscribes the users listed in the request body to plans.
+func (a *App) ImportUsersHTTPHandler(c echo.Context) error {
+	dryRun, err := boolQueryParam(c, "dry_run")
+	if err != nil {
+		return err
+	}
+
+	response, err := a.ImportUsers(c.Request().Context(), c.Request().Body, importFormat(c), dryRun != nil && *dryRun)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
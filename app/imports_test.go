@@ -0,0 +1,126 @@
+package app
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestImportUsers(t *testing.T) {
+	csvData := strings.Join([]string{
+		"username,plan_name,paid,addons",
+		"sarahr,Pro,true,extra cpu.hours",
+		"jdoe,Basic,,",
+		"alice,Missing,,",
+		"bob,Pro,maybe,",
+		"carol,Pro",
+	}, "\n")
+	jsonlData := strings.Join([]string{
+		`{"username": "sarahr", "plan_name": "Pro", "paid": true, "addons": ["extra cpu.hours"]}`,
+		`{"username": "jdoe", "plan_name": "Basic"}`,
+		``,
+		`{"username": "alice", "plan_name": "Missing"}`,
+		`{"username": "bob", "plan_name": "Pro", "paid": "maybe"}`,
+		`{"username": "carol", "plan": "Pro"}`,
+	}, "\n")
+	wantRows := []string{ImportSubscribed, ImportUnchanged, ImportFailed, ImportFailed, ImportFailed}
+
+	tests := []struct {
+		name      string
+		format    string
+		data      string
+		dryRun    bool
+		wantErr   bool
+		wantRows  []string
+		wantPlans map[string]string
+	}{
+		{
+			name:      "csv",
+			format:    ImportFormatCSV,
+			data:      csvData,
+			wantRows:  wantRows,
+			wantPlans: map[string]string{"sarahr": "Pro", "jdoe": "Basic", "alice": "", "bob": ""},
+		},
+		{
+			name:      "jsonl",
+			format:    ImportFormatJSONL,
+			data:      jsonlData,
+			wantRows:  wantRows,
+			wantPlans: map[string]string{"sarahr": "Pro", "jdoe": "Basic", "alice": "", "bob": ""},
+		},
+		{
+			name:      "dry run",
+			format:    ImportFormatCSV,
+			data:      csvData,
+			dryRun:    true,
+			wantRows:  wantRows,
+			wantPlans: map[string]string{"sarahr": "", "jdoe": "Basic"},
+		},
+		{name: "empty csv", format: ImportFormatCSV, wantErr: true},
+		{name: "unrecognized csv column", format: ImportFormatCSV, data: "username,plan\nsarahr,Pro", wantErr: true},
+		{name: "missing format", data: csvData, wantErr: true},
+		{name: "unsupported format", format: "xml", data: csvData, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			addTestPlan(t, m, "Pro", 100, 5e10)
+			addTestAddon(t, m, "cpu.hours", 100)
+			subscribeTestUser(t, a, "jdoe")
+
+			report, err := a.ImportUsers(ctx, strings.NewReader(tt.data), tt.format, tt.dryRun)
+			if tt.wantErr {
+				if errors.CodeOf(err) != errors.CodeBadRequest {
+					t.Fatalf("expected a bad request error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to import the users: %s", err)
+			}
+
+			if report.DryRun != tt.dryRun || report.Total != len(tt.wantRows) {
+				t.Errorf("dry run = %t, total = %d, want %t and %d", report.DryRun, report.Total, tt.dryRun, len(tt.wantRows))
+			}
+			if report.Subscribed != 1 || report.Unchanged != 1 || report.Failed != 3 {
+				t.Errorf("subscribed = %d, unchanged = %d, failed = %d, want 1, 1 and 3",
+					report.Subscribed, report.Unchanged, report.Failed)
+			}
+			for i, want := range tt.wantRows {
+				row := report.Rows[i]
+				if row.Row != i+1 || row.Result != want {
+					t.Errorf("row %d = %d %s (%s), want %d %s", i, row.Row, row.Result, row.Error, i+1, want)
+				}
+				if (row.Result == ImportFailed) != (row.Error != "") {
+					t.Errorf("row %d has result %s and error %q", row.Row, row.Result, row.Error)
+				}
+			}
+
+			// Only committed rows report the IDs of the subscription and add-ons that were created.
+			subscribed := report.Rows[0]
+			if committed := !tt.dryRun; (subscribed.SubscriptionID != "") != committed ||
+				(len(subscribed.SubscriptionAddonIDs) == 1) != committed {
+				t.Errorf("subscription = %q, add-ons = %v, want IDs: %t",
+					subscribed.SubscriptionID, subscribed.SubscriptionAddonIDs, committed)
+			}
+
+			for username, want := range tt.wantPlans {
+				var plan string
+				subscription, err := m.GetActiveSubscription(ctx, username)
+				switch {
+				case err == nil:
+					plan = subscription.Plan.Name
+				case !errors.Is(err, errors.ErrNoActiveSubscription):
+					t.Fatalf("unable to look up the subscription of %s: %s", username, err)
+				}
+				if plan != want {
+					t.Errorf("plan of %s = %q, want %q", username, plan, want)
+				}
+			}
+		})
+	}
+}
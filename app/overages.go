@@ -3,21 +3,136 @@ package app
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
 	"github.com/cyverse-de/subscriptions/db"
 	serrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
+// userOverages returns the quotas in the user's active subscription that have been reached or exceeded. While a paid
+// subscription is in its grace period, the larger of its quota and the active subscription's quota applies to each
+// resource type. A member of a group isn't in overage for a resource type as long as the pooled quota for it in one
+// of the group subscriptions hasn't been used up.
+func (a *App) userOverages(ctx context.Context, username string) ([]db.Overage, error) {
+	overages, err := a.db.GetUserOverages(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return a.applicableOverages(ctx, username, overages)
+}
+
+// applicableOverages applies the grace period and group quota rules described for userOverages to the quotas in a
+// user's active subscription that have been reached or exceeded, and returns the ones that still apply.
+func (a *App) applicableOverages(ctx context.Context, username string, overages []db.Overage) ([]db.Overage, error) {
+	if len(overages) == 0 {
+		return overages, nil
+	}
+
+	d := a.db
+
+	quotas, err := graceQuotas(ctx, d, username)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := d.ListUserGroupAllocations(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	pooled := make(map[string]bool)
+	for _, allocation := range allocations {
+		if allocation.Available() {
+			pooled[allocation.ResourceTypeID] = true
+		}
+	}
+
+	results := make([]db.Overage, 0, len(overages))
+	for _, overage := range overages {
+		if quota, ok := quotas[overage.ResourceType.ID]; ok && quota > overage.QuotaValue {
+			if overage.UsageValue < quota {
+				continue
+			}
+			overage.QuotaValue = quota
+		}
+		if pooled[overage.ResourceType.ID] {
+			continue
+		}
+		results = append(results, overage)
+	}
+
+	return results, nil
+}
+
+// usersInOverage returns the IDs of the users who are in overage for at least one resource type, according to the
+// same rules as userOverages. Only the users whose usage has reached a quota in their active subscription need to
+// be checked, because the grace period and group quota rules can only remove overages.
+func (a *App) usersInOverage(ctx context.Context) (map[string]bool, error) {
+	overages, err := a.db.ListOverages(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	byUser := make(map[string][]db.Overage)
+	for _, overage := range overages {
+		byUser[overage.User.Username] = append(byUser[overage.User.Username], overage)
+	}
+
+	results := make(map[string]bool)
+	for username, candidates := range byUser {
+		applicable, err := a.applicableOverages(ctx, username, candidates)
+		if err != nil {
+			return nil, err
+		}
+		if len(applicable) > 0 {
+			results[candidates[0].User.ID] = true
+		}
+	}
+
+	return results, nil
+}
+
+// RefreshOverageMetrics updates the metric that reports the number of users in overage.
+func (a *App) RefreshOverageMetrics(ctx context.Context) error {
+	users, err := a.usersInOverage(ctx)
+	if err != nil {
+		return err
+	}
+	metrics.UsersInOverage.Set(float64(len(users)))
+	return nil
+}
+
+// RunOverageMetricsWorker refreshes the metric that reports the number of users in overage at the given interval
+// until the context is cancelled.
+func (a *App) RunOverageMetricsWorker(ctx context.Context, interval time.Duration) {
+	log := log.WithField("context", "overage metrics")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := a.RefreshOverageMetrics(ctx); err != nil && ctx.Err() == nil {
+			log.Errorf("unable to count the users in overage: %s", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
 func (a *App) getUserOverages(ctx context.Context, request *qms.AllUserOveragesRequest) *qms.OverageList {
 	response := pbinit.NewOverageList()
 
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -26,11 +141,9 @@ func (a *App) getUserOverages(ctx context.Context, request *qms.AllUserOveragesR
 		return response
 	}
 
-	d := db.New(a.db)
-
-	results, err := d.GetUserOverages(ctx, username)
+	results, err := a.userOverages(ctx, username)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -95,17 +208,16 @@ func (a *App) checkUserOverages(ctx context.Context, request *qms.IsOverageReque
 
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	log = log.WithFields(logrus.Fields{"user": username})
 
-	d := db.New(a.db)
-
-	overages, err := d.GetUserOverages(ctx, username)
+	overages, err := a.userOverages(ctx, username)
 	if err != nil {
-		response.Error = serrors.NatsError(ctx, err)
+		metrics.OverageChecks.WithLabelValues(request.GetResourceName(), metrics.OverageResultError).Inc()
+		response.Error = serrors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	if len(overages) > 0 {
@@ -118,6 +230,12 @@ func (a *App) checkUserOverages(ctx context.Context, request *qms.IsOverageReque
 		response.IsOverage = false
 	}
 
+	result := metrics.OverageResultOK
+	if response.IsOverage {
+		result = metrics.OverageResultOverage
+	}
+	metrics.OverageChecks.WithLabelValues(request.GetResourceName(), result).Inc()
+
 	return response
 }
 
@@ -0,0 +1,66 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestUsersInOverage(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	addTestPlan(t, m, "Team", 1000, 5e12)
+
+	// Every user starts on the default plan, which has a CPU hours quota of 20.
+	usages := map[string]float64{"sarahr": 25, "jdoe": 25, "alice": 5}
+	for username, usage := range usages {
+		subscribeTestUser(t, a, username)
+		request := testUpdate(username, db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, usage)
+		if response := a.addUserUpdate(ctx, request); response.Error != nil {
+			t.Fatalf("unable to record the usage of %s: %s", username, response.Error.Message)
+		}
+	}
+
+	// The pooled quota of jdoe's group hasn't been used up, so jdoe isn't in overage.
+	if _, err := a.AddGroup(ctx, &GroupRequest{Name: "lab"}); err != nil {
+		t.Fatalf("unable to add the group: %s", err)
+	}
+	if _, err := a.SubscribeGroup(ctx, "lab", &GroupSubscriptionRequest{PlanName: "Team"}); err != nil {
+		t.Fatalf("unable to subscribe the group: %s", err)
+	}
+	if _, err := a.AddGroupMember(ctx, "lab", "jdoe"); err != nil {
+		t.Fatalf("unable to add the group member: %s", err)
+	}
+
+	users, err := a.usersInOverage(ctx)
+	if err != nil {
+		t.Fatalf("unable to list the users in overage: %s", err)
+	}
+
+	for username := range usages {
+		overages, err := a.userOverages(ctx, username)
+		if err != nil {
+			t.Fatalf("unable to look up the overages of %s: %s", username, err)
+		}
+		user, err := m.GetUserID(ctx, username)
+		if err != nil {
+			t.Fatalf("unable to look up the ID of %s: %s", username, err)
+		}
+		if users[user] != (len(overages) > 0) {
+			t.Errorf("%s in overage = %t, but has %d overage(s)", username, users[user], len(overages))
+		}
+	}
+	if len(users) != 1 {
+		t.Errorf("got %d users in overage, want 1", len(users))
+	}
+
+	if err = a.RefreshOverageMetrics(ctx); err != nil {
+		t.Fatalf("unable to refresh the overage metrics: %s", err)
+	}
+	if value := testutil.ToFloat64(metrics.UsersInOverage); value != 1 {
+		t.Errorf("users in overage metric = %g, want 1", value)
+	}
+}
@@ -2,11 +2,11 @@ package app
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/labstack/echo/v4"
@@ -15,10 +15,10 @@ import (
 func (a *App) listPlans(ctx context.Context) *qms.PlanList {
 	response := pbinit.NewPlanList()
 
-	d := db.New(a.db)
+	d := a.db
 	plans, err := d.ListPlans(ctx)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -63,11 +63,11 @@ func (a *App) ListPlansHTTPHandler(c echo.Context) error {
 func (a *App) addPlan(ctx context.Context, request *qms.AddPlanRequest) *qms.PlanResponse {
 	response := pbinit.NewPlanResponse()
 
-	d := db.New(a.db)
+	d := a.db
 
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
@@ -81,7 +81,7 @@ func (a *App) addPlan(ctx context.Context, request *qms.AddPlanRequest) *qms.Pla
 		if err != nil {
 			return err
 		} else if existingPlan != nil {
-			return fmt.Errorf("a plan named %s already exists", incomingPlan.Name)
+			return errors.ErrPlanExists.WithField("name", incomingPlan.Name)
 		}
 
 		for i, pqd := range incomingPlan.QuotaDefaults {
@@ -112,12 +112,20 @@ func (a *App) addPlan(ctx context.Context, request *qms.AddPlanRequest) *qms.Pla
 			return err
 		}
 
+		// Record the first version of the plan if it can be subscribed to already. Otherwise, the first version is
+		// recorded when the first subscription is created.
+		if plan.GetActiveRate() != nil {
+			if _, err = d.EnsurePlanVersion(ctx, plan, db.WithTX(tx), actorOpt(ctx)); err != nil {
+				return err
+			}
+		}
+
 		response.Plan = plan.ToQMSPlan()
-		return nil
+		return recordAudit(ctx, d, tx, db.AuditEntityPlan, plan.ID, db.AuditActionCreate, "", nil, plan)
 	})
 
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -130,6 +138,7 @@ func (a *App) AddPlanHandler(subject, reply string, request *qms.AddPlanRequest)
 
 	ctx, span := pbinit.InitQMSAddPlanRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.addPlan(ctx, request)
 
@@ -168,11 +177,15 @@ func (a *App) AddPlanHTTPHandler(c echo.Context) error {
 func (a *App) getPlan(ctx context.Context, request *qms.PlanRequest) *qms.PlanResponse {
 	response := pbinit.NewPlanResponse()
 
-	d := db.New(a.db)
+	d := a.db
 
 	plan, err := d.GetPlanByID(ctx, request.PlanId)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+	if plan == nil {
+		response.Error = errors.NatsError(ctx, response.Header, errors.ErrPlanNotFound.WithField("plan_id", request.PlanId))
 		return response
 	}
 
@@ -237,7 +250,7 @@ func (a *App) GetPlanHTTPHandler(c echo.Context) error {
 
 func (a *App) upsertQuotaDefault(ctx context.Context, _ *qms.AddPlanQuotaDefaultRequest) *qms.QuotaDefaultResponse {
 	response := pbinit.NewQuotaDefaultResponse()
-	response.Error = errors.NatsError(ctx, fmt.Errorf("not implemented"))
+	response.Error = errors.NatsError(ctx, response.Header, errors.ErrNotImplemented)
 	return response
 }
 
@@ -246,6 +259,7 @@ func (a *App) UpsertQuotaDefaultsHandler(subject, reply string, request *qms.Add
 
 	ctx, span := pbinit.InitQMSAddPlanQuotaDefaultRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.upsertQuotaDefault(ctx, request)
 	if response.Error != nil {
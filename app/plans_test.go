@@ -0,0 +1,25 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+)
+
+func TestUpsertQuotaDefault(t *testing.T) {
+	a, _ := newTestApp(t, nil)
+
+	response := a.upsertQuotaDefault(context.Background(), &qms.AddPlanQuotaDefaultRequest{})
+	if response.Error == nil {
+		t.Fatal("expected an error for an operation that isn't implemented")
+	}
+	if response.Error.StatusCode != http.StatusNotImplemented {
+		t.Errorf("status = %d, want %d", response.Error.StatusCode, http.StatusNotImplemented)
+	}
+	if response.Error.ErrorCode != svcerror.ErrorCode_UNIMPLEMENTED {
+		t.Errorf("error code = %s, want %s", response.Error.ErrorCode, svcerror.ErrorCode_UNIMPLEMENTED)
+	}
+}
@@ -0,0 +1,301 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/labstack/echo/v4"
+)
+
+// PlanVersionList is the response body for plan version listings.
+type PlanVersionList struct {
+	Versions []db.PlanVersion `json:"versions"`
+}
+
+// PlanVersionMigrationRequest is the request body for moving subscriptions from one version of a plan to another.
+type PlanVersionMigrationRequest struct {
+	FromVersion int `json:"from_version"`
+	ToVersion   int `json:"to_version"`
+}
+
+// PlanVersionMigration describes the subscriptions that were moved from one version of a plan to another.
+type PlanVersionMigration struct {
+	PlanID          string   `json:"plan_id"`
+	FromVersion     int      `json:"from_version"`
+	ToVersion       int      `json:"to_version"`
+	SubscriptionIDs []string `json:"subscription_ids"`
+}
+
+// planByID returns the plan with the given ID, or an error if it doesn't exist.
+func planByID(ctx context.Context, d db.Repository, planID string, opts ...db.QueryOption) (*db.Plan, error) {
+	plan, err := d.GetPlanByID(ctx, planID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if plan == nil {
+		return nil, errors.ErrPlanNotFound.WithField("plan_id", planID)
+	}
+	return plan, nil
+}
+
+// planVersion returns a version of a plan by number, or an error if the plan doesn't have that version.
+func planVersion(ctx context.Context, d db.Repository, planID string, version int, opts ...db.QueryOption) (*db.PlanVersion, error) {
+	v, err := d.GetPlanVersion(ctx, planID, version, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, errors.ErrPlanVersionNotFound.WithField("plan_id", planID).WithField("version", version)
+	}
+	return v, nil
+}
+
+// ListPlanVersions returns the versions of a plan, oldest first.
+func (a *App) ListPlanVersions(ctx context.Context, planID string) (*PlanVersionList, error) {
+	d := a.db
+
+	if _, err := planByID(ctx, d, planID); err != nil {
+		return nil, err
+	}
+
+	versions, err := d.ListPlanVersions(ctx, planID)
+	if err != nil {
+		return nil, err
+	}
+	if versions == nil {
+		versions = make([]db.PlanVersion, 0)
+	}
+
+	return &PlanVersionList{Versions: versions}, nil
+}
+
+// PublishPlanVersion records the rate and quota defaults currently in effect for a plan as a new version of the plan.
+// The latest version is returned instead if nothing has changed since it was recorded.
+func (a *App) PublishPlanVersion(ctx context.Context, planID string) (*db.PlanVersion, error) {
+	var version *db.PlanVersion
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		plan, err := planByID(ctx, d, planID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		version, err = d.EnsurePlanVersion(ctx, plan, db.WithTX(tx), actorOpt(ctx))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return version, nil
+}
+
+// SubscriptionPlanVersion returns the version of the plan that the user's active subscription was created under, or
+// has since been migrated to.
+func (a *App) SubscriptionPlanVersion(ctx context.Context, username string) (*db.PlanVersion, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	d := a.db
+
+	subscription, err := d.GetActiveSubscription(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	version, err := d.GetPlanVersionByID(ctx, subscription.PlanVersionID)
+	if err != nil {
+		return nil, err
+	}
+	if version == nil {
+		return nil, errors.ErrPlanVersionNotFound.WithField("plan_version_id", subscription.PlanVersionID)
+	}
+
+	return version, nil
+}
+
+// migrateSubscription moves a subscription from one plan version to another. Each quota of the subscription is
+// adjusted by the difference between the quota defaults of the two versions, so that add-ons and manual quota
+// changes are preserved. Quotas are never reduced below zero.
+func migrateSubscription(
+	ctx context.Context, d db.Repository, tx db.Tx, subscription *db.Subscription, from, to *db.PlanVersion,
+) error {
+	if err := d.SetSubscriptionPlanVersion(ctx, subscription.ID, to, db.WithTX(tx), actorOpt(ctx)); err != nil {
+		return err
+	}
+
+	resourceTypeIDs := make(map[string]bool)
+	for _, qd := range from.QuotaDefaults {
+		resourceTypeIDs[qd.ResourceTypeID] = true
+	}
+	for _, qd := range to.QuotaDefaults {
+		resourceTypeIDs[qd.ResourceTypeID] = true
+	}
+
+	for resourceTypeID := range resourceTypeIDs {
+		delta := to.QuotaDefault(resourceTypeID) - from.QuotaDefault(resourceTypeID)
+		if delta == 0 {
+			continue
+		}
+
+		current, _, err := d.GetCurrentQuota(ctx, resourceTypeID, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		if _, err = upsertQuota(ctx, d, tx, max(current+delta, 0), resourceTypeID, subscription.ID); err != nil {
+			return err
+		}
+	}
+
+	after, err := d.GetSubscriptionByID(ctx, subscription.ID, db.WithTX(tx))
+	if err != nil {
+		return err
+	}
+
+	return recordAudit(
+		ctx,
+		d,
+		tx,
+		db.AuditEntitySubscription,
+		subscription.ID,
+		db.AuditActionUpdate,
+		subscription.User.Username,
+		subscription,
+		after,
+	)
+}
+
+// MigratePlanVersion moves every active subscription on one version of a plan to another version of the same plan.
+// All of the subscriptions are moved in a single transaction.
+func (a *App) MigratePlanVersion(ctx context.Context, planID string, fromVersion, toVersion int) (*PlanVersionMigration, error) {
+	if fromVersion == toVersion {
+		return nil, errors.BadRequest("the source and target plan versions must be different")
+	}
+
+	result := &PlanVersionMigration{
+		PlanID:          planID,
+		FromVersion:     fromVersion,
+		ToVersion:       toVersion,
+		SubscriptionIDs: make([]string, 0),
+	}
+
+	var planName string
+
+	d := a.db
+
+	tx, err := d.Begin()
+	if err != nil {
+		return nil, err
+	}
+	err = tx.Wrap(func() error {
+		plan, err := planByID(ctx, d, planID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		planName = plan.Name
+
+		from, err := planVersion(ctx, d, planID, fromVersion, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		to, err := planVersion(ctx, d, planID, toVersion, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		subscriptions, err := d.ListActiveSubscriptionsByPlanVersion(ctx, from.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		for i := range subscriptions {
+			if err = migrateSubscription(ctx, d, tx, &subscriptions[i], from, to); err != nil {
+				return err
+			}
+			result.SubscriptionIDs = append(result.SubscriptionIDs, subscriptions[i].ID)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	log.Infof(
+		"moved %d subscription(s) from version %d to version %d of plan %s",
+		len(result.SubscriptionIDs), fromVersion, toVersion, planID,
+	)
+	metrics.SubscriptionsCreated.WithLabelValues(planName, metrics.SubscriptionKindMigration).
+		Add(float64(len(result.SubscriptionIDs)))
+
+	return result, nil
+}
+
+// ListPlanVersionsHTTPHandler lists the versions of a plan.
+func (a *App) ListPlanVersionsHTTPHandler(c echo.Context) error {
+	response, err := a.ListPlanVersions(c.Request().Context(), c.Param("plan_id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// PublishPlanVersionHTTPHandler records the current rate and quota defaults of a plan as a new version.
+func (a *App) PublishPlanVersionHTTPHandler(c echo.Context) error {
+	response, err := a.PublishPlanVersion(c.Request().Context(), c.Param("plan_id"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetPlanVersionHTTPHandler returns a version of a plan by number.
+func (a *App) GetPlanVersionHTTPHandler(c echo.Context) error {
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid plan version: "+c.Param("version"))
+	}
+
+	response, err := planVersion(c.Request().Context(), a.db, c.Param("plan_id"), version)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// GetSubscriptionPlanVersionHTTPHandler returns the version of the plan that a user's active subscription is on.
+func (a *App) GetSubscriptionPlanVersionHTTPHandler(c echo.Context) error {
+	response, err := a.SubscriptionPlanVersion(c.Request().Context(), c.Param("username"))
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// MigratePlanVersionHTTPHandler moves the active subscriptions on one version of a plan to another version.
+func (a *App) MigratePlanVersionHTTPHandler(c echo.Context) error {
+	var request PlanVersionMigrationRequest
+	if err := c.Bind(&request); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "bad request")
+	}
+
+	response, err := a.MigratePlanVersion(
+		c.Request().Context(), c.Param("plan_id"), request.FromVersion, request.ToVersion,
+	)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,165 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+// addTestPlanVersion records a new version of a plan with the given CPU hours quota default and returns it.
+func addTestPlanVersion(t *testing.T, m *db.MemoryDatabase, plan *db.Plan, number int, cpuHours float64) *db.PlanVersion {
+	t.Helper()
+	cpu := testResourceType(t, m, "cpu.hours")
+	version := &db.PlanVersion{
+		PlanID:        plan.ID,
+		Version:       number,
+		PlanRateID:    plan.Rates[0].ID,
+		QuotaDefaults: []db.PlanVersionQuotaDefault{{ResourceTypeID: cpu.ID, QuotaValue: cpuHours}},
+	}
+	if err := m.AddPlanVersion(context.Background(), version); err != nil {
+		t.Fatalf("unable to add version %d of the %s plan: %s", number, plan.Name, err)
+	}
+	return version
+}
+
+func TestPublishPlanVersion(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+
+	plan, err := m.GetPlanByName(ctx, db.DefaultPlanName)
+	if err != nil {
+		t.Fatalf("unable to look up the default plan: %s", err)
+	}
+
+	first, err := a.PublishPlanVersion(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to publish a plan version: %s", err)
+	}
+	if first.Version != 1 || first.QuotaDefault(testResourceType(t, m, "cpu.hours").ID) != 20 {
+		t.Errorf("unexpected plan version: %+v", first)
+	}
+
+	// Nothing has changed, so the same version is returned again.
+	second, err := a.PublishPlanVersion(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to publish a plan version: %s", err)
+	}
+	if second.ID != first.ID {
+		t.Errorf("version %d was published even though the plan didn't change", second.Version)
+	}
+
+	list, err := a.ListPlanVersions(ctx, plan.ID)
+	if err != nil {
+		t.Fatalf("unable to list the plan versions: %s", err)
+	}
+	if len(list.Versions) != 1 {
+		t.Errorf("found %d plan versions, want 1", len(list.Versions))
+	}
+
+	if _, err = a.PublishPlanVersion(ctx, "00000000-0000-0000-0000-000000000000"); !errors.Is(err, errors.ErrPlanNotFound) {
+		t.Errorf("expected ErrPlanNotFound for an unknown plan, got %v", err)
+	}
+}
+
+func TestMigratePlanVersion(t *testing.T) {
+	tests := []struct {
+		name        string
+		targetCPU   float64
+		quota       float64
+		fromVersion int
+		toVersion   int
+		wantErr     bool
+		wantCode    errors.Code
+		wantQuota   float64
+	}{
+		{
+			name:        "higher quota default",
+			targetCPU:   30,
+			quota:       20,
+			fromVersion: 1,
+			toVersion:   2,
+			wantQuota:   30,
+		},
+		{
+			name:        "manual quota change is preserved",
+			targetCPU:   30,
+			quota:       25,
+			fromVersion: 1,
+			toVersion:   2,
+			wantQuota:   35,
+		},
+		{
+			name:        "quota isn't reduced below zero",
+			targetCPU:   5,
+			quota:       10,
+			fromVersion: 1,
+			toVersion:   2,
+			wantQuota:   0,
+		},
+		{
+			name:        "same version",
+			fromVersion: 1,
+			toVersion:   1,
+			wantErr:     true,
+			wantCode:    errors.CodeBadRequest,
+		},
+		{
+			name:        "unknown version",
+			fromVersion: 1,
+			toVersion:   3,
+			wantErr:     true,
+			wantCode:    errors.CodeNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+
+			subscription := subscribeTestUser(t, a, "sarahr")
+			plan, err := m.GetPlanByName(ctx, db.DefaultPlanName)
+			if err != nil {
+				t.Fatalf("unable to look up the default plan: %s", err)
+			}
+			addTestPlanVersion(t, m, plan, 2, tt.targetCPU)
+			if tt.quota != 0 {
+				if _, err := a.SetQuota(ctx, "sarahr", "cpu.hours", tt.quota); err != nil {
+					t.Fatalf("unable to set the quota: %s", err)
+				}
+			}
+
+			result, err := a.MigratePlanVersion(ctx, plan.ID, tt.fromVersion, tt.toVersion)
+			if tt.wantErr {
+				if err == nil || errors.CodeOf(err) != tt.wantCode {
+					t.Fatalf("expected an error with code %v, got %v", tt.wantCode, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unable to migrate the subscriptions: %s", err)
+			}
+			if len(result.SubscriptionIDs) != 1 || result.SubscriptionIDs[0] != subscription.ID {
+				t.Errorf("migrated subscriptions = %v, want [%s]", result.SubscriptionIDs, subscription.ID)
+			}
+
+			version, err := a.SubscriptionPlanVersion(ctx, "sarahr")
+			if err != nil {
+				t.Fatalf("unable to look up the subscription's plan version: %s", err)
+			}
+			if version.Version != tt.toVersion {
+				t.Errorf("plan version = %d, want %d", version.Version, tt.toVersion)
+			}
+
+			quota, _, err := m.GetCurrentQuota(ctx, testResourceType(t, m, "cpu.hours").ID, subscription.ID)
+			if err != nil {
+				t.Fatalf("unable to look up the quota: %s", err)
+			}
+			if quota != tt.wantQuota {
+				t.Errorf("quota = %g, want %g", quota, tt.wantQuota)
+			}
+		})
+	}
+}
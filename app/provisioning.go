@@ -0,0 +1,88 @@
+package app
+
+import (
+	"context"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+// ProvisioningSettings determine what happens when a user who doesn't have an active subscription asks for their
+// subscription summary or reports resource usage.
+type ProvisioningSettings struct {
+	// Enabled indicates whether users without an active subscription are subscribed to the default plan. Requests
+	// from these users fail with a NOT_FOUND error if it's false.
+	Enabled bool
+
+	// PlanName is the name of the plan that users are subscribed to.
+	PlanName string
+
+	// Periods is the number of yearly subscription periods that the new subscription lasts for.
+	Periods int32
+}
+
+// DefaultProvisioningSettings returns the settings used when none are configured: users are subscribed to the Basic
+// plan for one year.
+func DefaultProvisioningSettings() *ProvisioningSettings {
+	return &ProvisioningSettings{
+		Enabled:  true,
+		PlanName: db.DefaultPlanName,
+		Periods:  1,
+	}
+}
+
+// subscriptionOptions returns the options for new subscriptions to the default plan.
+func (s *ProvisioningSettings) subscriptionOptions() *db.SubscriptionOptions {
+	return &db.SubscriptionOptions{
+		Paid:    false,
+		Periods: s.Periods,
+		EndDate: time.Now().AddDate(int(s.Periods), 0, 0),
+	}
+}
+
+// activeOrDefaultSubscription returns the user's active subscription. If the user doesn't have one and provisioning
+// is enabled, the user is added if necessary and subscribed to the default plan. The name of the plan is returned
+// if a subscription was created so that the caller can record it once the transaction is committed.
+func (a *App) activeOrDefaultSubscription(
+	ctx context.Context, d db.Repository, tx db.Tx, username string,
+) (*db.Subscription, string, error) {
+	subscription, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+	if err == nil || !errors.Is(err, errors.ErrNoActiveSubscription) || !a.Provisioning.Enabled {
+		return subscription, "", err
+	}
+
+	user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
+	if err != nil {
+		return nil, "", err
+	}
+
+	plan, err := d.GetPlanByName(ctx, a.Provisioning.PlanName, db.WithTX(tx))
+	if err != nil {
+		return nil, "", err
+	}
+	if plan == nil {
+		return nil, "", errors.ErrPlanNotFound.WithField("name", a.Provisioning.PlanName)
+	}
+
+	opts := a.Provisioning.subscriptionOptions()
+	subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, opts, db.WithTX(tx), actorOpt(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	if err = a.auditNewSubscription(ctx, d, tx, subscriptionID); err != nil {
+		return nil, "", err
+	}
+
+	subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
+	if err != nil {
+		return nil, "", err
+	}
+	if subscription == nil {
+		return nil, "", errors.New("the newly inserted user plan could not be found")
+	}
+
+	log.Infof("subscribed %s to the %s plan", username, plan.Name)
+
+	return subscription, plan.Name, nil
+}
@@ -6,7 +6,7 @@ import (
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
-	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/labstack/echo/v4"
 )
@@ -17,32 +17,21 @@ func (a *App) addQuota(ctx context.Context, request *qms.AddQuotaRequest) *qms.Q
 
 	subscriptionID := request.Quota.SubscriptionId
 
-	d := db.New(a.db)
+	d := a.db
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
-		var err error
-
 		// Store the quota in the database, overwriting the old quota if one exists for the resource type.
-		err = d.UpsertQuota(
+		quota, err := upsertQuota(
 			ctx,
+			d,
+			tx,
 			float64(request.Quota.Quota),
 			request.Quota.ResourceType.Uuid,
 			subscriptionID,
-			db.WithTX(tx),
-		)
-		if err != nil {
-			return err
-		}
-
-		// Load the quota from the database.
-		quota, err := d.LoadQuotaDetails(ctx,
-			request.Quota.ResourceType.Uuid,
-			subscriptionID,
-			db.WithTX(tx),
 		)
 		if err != nil {
 			return err
@@ -56,7 +45,7 @@ func (a *App) addQuota(ctx context.Context, request *qms.AddQuotaRequest) *qms.Q
 		return nil
 	})
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 	}
 
 	return response
@@ -69,6 +58,7 @@ func (a *App) AddQuotaHandler(subject, reply string, request *qms.AddQuotaReques
 
 	ctx, span := pbinit.InitQMSAddQuotaRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.addQuota(ctx, request)
 
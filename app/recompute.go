@@ -0,0 +1,137 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"sort"
+
+	"github.com/cyverse-de/go-mod/pbinit"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// recomputeUsages recalculates the usages in a user's active subscription by replaying the usage updates that took
+// effect during the subscription. Resource types that have a usage but no updates are reset to zero. This is used to
+// repair usages that have gotten out of sync with the updates.
+func (a *App) recomputeUsages(ctx context.Context, request *qms.GetUsages) *qms.UsageList {
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response := pbinit.NewUsageList()
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
+	log := log.WithFields(logrus.Fields{"context": "recompute usages", "user": username})
+
+	d := a.db
+	tx, err := d.Begin()
+	if err != nil {
+		response := pbinit.NewUsageList()
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+	err = tx.Wrap(func() error {
+		subscription, err := d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		updates, err := d.UserUpdates(ctx, username, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		// Only usage updates that took effect during the subscription count towards its usages.
+		updates = filterUsageUpdates(updates, subscription)
+		sort.SliceStable(updates, func(i, j int) bool {
+			return updates[i].EffectiveDate.Before(updates[j].EffectiveDate)
+		})
+
+		// Start from zero for every resource type that currently has a usage so that stale usages are cleared.
+		usages, err := d.SubscriptionUsages(ctx, subscription.ID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+		values := make(map[string]float64)
+		var resourceTypeIDs []string
+		for _, usage := range usages {
+			values[usage.ResourceType.ID] = 0
+			resourceTypeIDs = append(resourceTypeIDs, usage.ResourceType.ID)
+		}
+
+		for _, update := range updates {
+			id := update.ResourceType.ID
+			if _, ok := values[id]; !ok {
+				resourceTypeIDs = append(resourceTypeIDs, id)
+			}
+			switch update.UpdateOperation.Name {
+			case db.UpdateTypeSet:
+				values[id] = update.Value
+			case db.UpdateTypeAdd:
+				values[id] += update.Value
+			default:
+				return errors.ErrInvalidUpdateType.WithField("update_type", update.UpdateOperation.Name)
+			}
+		}
+
+		for _, id := range resourceTypeIDs {
+			log.Debugf("recomputed usage for resource type %s is %f", id, values[id])
+			usage := &db.Usage{
+				Usage:          values[id],
+				SubscriptionID: subscription.ID,
+				ResourceType:   db.ResourceType{ID: id},
+			}
+			err = d.CalculateUsage(ctx, db.UpdateTypeSet, usage, db.WithTX(tx), actorOpt(ctx))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		response := pbinit.NewUsageList()
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
+	// Return the usages in the same format as the endpoint that lists them.
+	return a.getUsages(ctx, &qms.GetUsages{Username: username})
+}
+
+// filterUsageUpdates returns the usage updates that took effect while the given subscription was active.
+func filterUsageUpdates(updates []db.Update, subscription *db.Subscription) []db.Update {
+	var filtered []db.Update
+	for _, update := range updates {
+		if update.ValueType != db.UsagesTrackedMetric {
+			continue
+		}
+		if update.EffectiveDate.Before(subscription.EffectiveStartDate) {
+			continue
+		}
+		if !subscription.EffectiveEndDate.IsZero() && !update.EffectiveDate.Before(subscription.EffectiveEndDate) {
+			continue
+		}
+		filtered = append(filtered, update)
+	}
+	return filtered
+}
+
+func (a *App) RecomputeUsagesHTTPHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	request := &qms.GetUsages{
+		Username: c.Param("username"),
+	}
+
+	response := a.recomputeUsages(ctx, request)
+
+	if response.Error != nil {
+		return c.JSON(int(response.Error.StatusCode), response)
+	}
+
+	return c.JSON(http.StatusOK, response)
+}
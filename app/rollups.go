@@ -0,0 +1,626 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+	"github.com/sirupsen/logrus"
+)
+
+// usageRollupOverlap is subtracted from the watermark when the rollups are refreshed. Updates are timestamped when
+// the transactions that record them start rather than when they commit, so an update can become visible after a
+// refresh has already moved the watermark past its timestamp.
+const usageRollupOverlap = 5 * time.Minute
+
+// maxUsageSeriesPoints is the maximum number of points in a usage time series.
+const maxUsageSeriesPoints = 1000
+
+// Default lengths of usage time series.
+const (
+	defaultDailySeriesDays     = 30
+	defaultMonthlySeriesMonths = 12
+)
+
+// UsageRollupRefresh is the result of refreshing or rebuilding the usage rollups. Rebuilt is the number of
+// combinations of user and resource type whose rollups were rebuilt, and Failed is the number that couldn't be.
+type UsageRollupRefresh struct {
+	RefreshedThrough time.Time `json:"refreshed_through"`
+	Rebuilt          int       `json:"rebuilt"`
+	Failed           int       `json:"failed"`
+}
+
+// UsageSeriesRange selects the periods covered by a usage time series. Start and End are rounded to the boundaries of
+// the periods, and the series includes the periods that start at or after Start and before End.
+type UsageSeriesRange struct {
+	Period string
+	Start  time.Time
+	End    time.Time
+}
+
+// UsageSeriesPoint is a point in a usage time series. Value is the usage at the end of the period, Added is the total
+// of the usage that was added during the period and Updates is the number of usage updates that took effect during
+// the period. Users is the number of users who were subscribed to the plan at some time during the period, and is
+// only set in series for plans.
+type UsageSeriesPoint struct {
+	PeriodStart time.Time `json:"period_start"`
+	Value       float64   `json:"value"`
+	Added       float64   `json:"added"`
+	Updates     int       `json:"updates"`
+	Users       int       `json:"users,omitempty"`
+}
+
+// UsageSeries is the response body for usage time series. There is a point for every period in the range, including
+// periods without any updates. RefreshedThrough is the time that the rollups the series is built from have been
+// refreshed through; updates recorded after it may not be included yet.
+type UsageSeries struct {
+	Username         string             `json:"username,omitempty"`
+	PlanID           string             `json:"plan_id,omitempty"`
+	PlanName         string             `json:"plan_name,omitempty"`
+	ResourceType     string             `json:"resource_type"`
+	Unit             string             `json:"unit"`
+	Period           string             `json:"period"`
+	Start            time.Time          `json:"start"`
+	End              time.Time          `json:"end"`
+	RefreshedThrough time.Time          `json:"refreshed_through"`
+	Points           []UsageSeriesPoint `json:"points"`
+}
+
+// rollupPeriodStart returns the start of the period that contains a time. Periods start at midnight UTC.
+func rollupPeriodStart(period string, t time.Time) time.Time {
+	year, month, day := t.UTC().Date()
+	if period == db.RollupPeriodMonth {
+		return time.Date(year, month, 1, 0, 0, 0, 0, time.UTC)
+	}
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// nextRollupPeriod returns the start of the period after the one that starts at the given time.
+func nextRollupPeriod(period string, start time.Time) time.Time {
+	if period == db.RollupPeriodMonth {
+		return start.AddDate(0, 1, 0)
+	}
+	return start.AddDate(0, 0, 1)
+}
+
+// rollupBuilder accumulates the rollups for one period from a user's usage updates for a resource type.
+type rollupBuilder struct {
+	period  string
+	from    time.Time
+	rollups []db.UsageRollup
+}
+
+// add records an update in the rollup for the period that it took effect in. The value is the usage after the update
+// was applied. Updates that took effect before the start of the rebuild are ignored.
+func (b *rollupBuilder) add(update *db.RollupUpdate, value float64) {
+	if update.EffectiveDate.Before(b.from) {
+		return
+	}
+
+	start := rollupPeriodStart(b.period, update.EffectiveDate)
+	if len(b.rollups) == 0 || !b.rollups[len(b.rollups)-1].PeriodStart.Equal(start) {
+		b.rollups = append(b.rollups, db.UsageRollup{Period: b.period, PeriodStart: start})
+	}
+
+	rollup := &b.rollups[len(b.rollups)-1]
+	if update.Operation == db.UpdateTypeAdd {
+		rollup.Added += update.Value
+	}
+	rollup.EndingValue = value
+	rollup.UpdateCount++
+}
+
+// rebuildUsageRollups rebuilds the daily and monthly rollups of a user and resource type, starting with the periods
+// that contain the earliest update that changed. The usage is replayed from the ending value of the latest monthly
+// rollup before that, so the updates before it don't have to be read again. The usage starts over from zero at the
+// start of each of the user's subscriptions, in the same way as when usages are recomputed, so the replay starts
+// from the latest subscription start instead if the usage started over after that rollup's period began.
+func (a *App) rebuildUsageRollups(ctx context.Context, key *db.UsageRollupKey) error {
+	d := a.db
+
+	days := &rollupBuilder{period: db.RollupPeriodDay, from: rollupPeriodStart(db.RollupPeriodDay, key.From)}
+	months := &rollupBuilder{period: db.RollupPeriodMonth, from: rollupPeriodStart(db.RollupPeriodMonth, key.From)}
+
+	tx, err := d.Begin()
+	if err != nil {
+		return err
+	}
+	return tx.Wrap(func() error {
+		starts, err := d.ListSubscriptionStartDates(ctx, key.UserID, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		// Find the latest subscription start before the rebuild.
+		var reset time.Time
+		for _, start := range starts {
+			if start.Before(months.from) {
+				reset = start
+			}
+		}
+
+		var value float64
+		replayFrom := months.from
+		previous, err := d.GetUsageRollupBefore(
+			ctx, key.UserID, key.ResourceTypeID, db.RollupPeriodMonth, months.from, db.WithTX(tx),
+		)
+		if err != nil {
+			return err
+		}
+		switch {
+		case previous != nil && !previous.PeriodStart.Before(reset):
+			value = previous.EndingValue
+		case !reset.IsZero():
+			replayFrom = reset
+		}
+
+		// The subscriptions that start during the replay.
+		starts = slices.DeleteFunc(starts, func(start time.Time) bool { return start.Before(replayFrom) })
+
+		err = d.StreamRollupUpdates(ctx, key.UserID, key.ResourceTypeID, replayFrom, func(update *db.RollupUpdate) error {
+			for len(starts) > 0 && !update.EffectiveDate.Before(starts[0]) {
+				value = 0
+				starts = starts[1:]
+			}
+			if update.Operation == db.UpdateTypeSet {
+				value = update.Value
+			} else {
+				value += update.Value
+			}
+			days.add(update, value)
+			months.add(update, value)
+			return nil
+		}, db.WithTX(tx))
+		if err != nil {
+			return err
+		}
+
+		for _, b := range []*rollupBuilder{days, months} {
+			err = d.ReplaceUsageRollups(ctx, key.UserID, key.ResourceTypeID, b.period, b.from, b.rollups, db.WithTX(tx))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+// rebuildUsageRollupKeys rebuilds the rollups for each of the keys. Each key is rebuilt in its own transaction, so a
+// failure to rebuild the rollups for one key is logged and doesn't prevent the others from being rebuilt.
+func (a *App) rebuildUsageRollupKeys(ctx context.Context, keys []db.UsageRollupKey, result *UsageRollupRefresh) {
+	log := log.WithField("context", "usage rollups")
+
+	for i := range keys {
+		if err := a.rebuildUsageRollups(ctx, &keys[i]); err != nil {
+			log.WithFields(logrus.Fields{
+				"user_id":          keys[i].UserID,
+				"resource_type_id": keys[i].ResourceTypeID,
+			}).Errorf("unable to rebuild the usage rollups: %s", err)
+			metrics.UsageRollupsRebuilt.WithLabelValues(metrics.RollupResultError).Inc()
+			result.Failed++
+			continue
+		}
+		metrics.UsageRollupsRebuilt.WithLabelValues(metrics.RollupResultOK).Inc()
+		result.Rebuilt++
+	}
+}
+
+// RefreshUsageRollups rebuilds the rollups for every user and resource type with usage updates that were recorded or
+// changed since the last refresh. The watermark only moves forward if all of the rollups were rebuilt, so that the
+// ones that failed are retried by the next refresh.
+func (a *App) RefreshUsageRollups(ctx context.Context) (*UsageRollupRefresh, error) {
+	d := a.db
+
+	watermark, err := d.GetUsageRollupWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	keys, err := d.ListUsageRollupKeys(ctx, watermark.Add(-usageRollupOverlap), "")
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsageRollupRefresh{RefreshedThrough: watermark}
+	a.rebuildUsageRollupKeys(ctx, keys, result)
+	if result.Failed > 0 {
+		return result, nil
+	}
+
+	if err = d.SetUsageRollupWatermark(ctx, now); err != nil {
+		return nil, err
+	}
+	result.RefreshedThrough = now
+
+	return result, nil
+}
+
+// RebuildUsageRollups rebuilds the rollups for a user from all of the user's usage updates, or for every user if the
+// username is blank. Rebuilding is only needed if the rollups have been lost or changed outside of the service.
+func (a *App) RebuildUsageRollups(ctx context.Context, username string) (*UsageRollupRefresh, error) {
+	d := a.db
+
+	var userID string
+	if username != "" {
+		username, err := a.FixUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		user, err := userAccount(ctx, d, nil, username)
+		if err != nil {
+			return nil, err
+		}
+		userID = user.ID
+	}
+
+	watermark, err := d.GetUsageRollupWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &UsageRollupRefresh{RefreshedThrough: watermark}
+	if err = a.rebuildUserUsageRollups(ctx, userID, result); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// rebuildUserUsageRollups rebuilds the rollups for a user from all of the user's usage updates, or for every user if
+// the user ID is blank, and adds the counts to the result.
+func (a *App) rebuildUserUsageRollups(ctx context.Context, userID string, result *UsageRollupRefresh) error {
+	keys, err := a.db.ListUsageRollupKeys(ctx, time.Time{}, userID)
+	if err != nil {
+		return err
+	}
+	a.rebuildUsageRollupKeys(ctx, keys, result)
+	return nil
+}
+
+// RunUsageRollupWorker refreshes the usage rollups at the given interval until the context is cancelled.
+func (a *App) RunUsageRollupWorker(ctx context.Context, interval time.Duration) {
+	log := log.WithField("context", "usage rollups")
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		result, err := a.RefreshUsageRollups(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Errorf("unable to refresh the usage rollups: %s", err)
+		}
+		if result != nil && result.Failed > 0 {
+			log.Warnf("unable to refresh the usage rollups for %d user(s) and resource type(s)", result.Failed)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// normalize fills in the defaults for a range and rounds it to the boundaries of the periods. The period defaults to
+// a day, the end defaults to the end of the current period and the start defaults to 30 days or 12 months before the
+// end.
+func (r *UsageSeriesRange) normalize(now time.Time) error {
+	if r.Period == "" {
+		r.Period = db.RollupPeriodDay
+	}
+	if r.Period != db.RollupPeriodDay && r.Period != db.RollupPeriodMonth {
+		return errors.BadRequest("the period must be %q or %q", db.RollupPeriodDay, db.RollupPeriodMonth).
+			WithField("period", r.Period)
+	}
+
+	if r.End.IsZero() {
+		r.End = now
+	}
+	if end := rollupPeriodStart(r.Period, r.End); end.Equal(r.End) {
+		r.End = end
+	} else {
+		r.End = nextRollupPeriod(r.Period, end)
+	}
+
+	if r.Start.IsZero() {
+		if r.Period == db.RollupPeriodMonth {
+			r.Start = r.End.AddDate(0, -defaultMonthlySeriesMonths, 0)
+		} else {
+			r.Start = r.End.AddDate(0, 0, -defaultDailySeriesDays)
+		}
+	}
+	r.Start = rollupPeriodStart(r.Period, r.Start)
+
+	if !r.Start.Before(r.End) {
+		return errors.BadRequest("the start of the date range must be before the end").
+			WithField("start", r.Start).
+			WithField("end", r.End)
+	}
+
+	count := 0
+	for start := r.Start; start.Before(r.End); start = nextRollupPeriod(r.Period, start) {
+		if count++; count > maxUsageSeriesPoints {
+			return errors.BadRequest("a usage time series can't have more than %d points", maxUsageSeriesPoints).
+				WithField("start", r.Start).
+				WithField("end", r.End)
+		}
+	}
+
+	return nil
+}
+
+// usageSeriesResourceType looks up the resource type of a usage time series by name.
+func usageSeriesResourceType(ctx context.Context, d db.Repository, name string) (*db.ResourceType, error) {
+	resourceType, err := d.GetResourceTypeByName(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if resourceType == nil || resourceType.ID == "" {
+		return nil, errors.ErrInvalidResourceName.WithField("resource_type", name)
+	}
+	return resourceType, nil
+}
+
+// newUsageSeries returns a usage time series for a range without any points.
+func newUsageSeries(
+	ctx context.Context, d db.Repository, resourceType *db.ResourceType, r *UsageSeriesRange,
+) (*UsageSeries, error) {
+	watermark, err := d.GetUsageRollupWatermark(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return &UsageSeries{
+		ResourceType:     resourceType.Name,
+		Unit:             resourceType.Unit,
+		Period:           r.Period,
+		Start:            r.Start,
+		End:              r.End,
+		RefreshedThrough: watermark,
+		Points:           make([]UsageSeriesPoint, 0),
+	}, nil
+}
+
+// UserUsageSeries returns a time series of a user's usage of a resource type, built from the usage rollups.
+func (a *App) UserUsageSeries(
+	ctx context.Context, username, resourceTypeName string, r *UsageSeriesRange,
+) (*UsageSeries, error) {
+	username, err := a.FixUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.normalize(time.Now()); err != nil {
+		return nil, err
+	}
+
+	d := a.db
+
+	user, err := userAccount(ctx, d, nil, username)
+	if err != nil {
+		return nil, err
+	}
+	resourceType, err := usageSeriesResourceType(ctx, d, resourceTypeName)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := newUsageSeries(ctx, d, resourceType, r)
+	if err != nil {
+		return nil, err
+	}
+	series.Username = username
+
+	filter := &db.UsageRollupFilter{
+		UserID:         user.ID,
+		ResourceTypeID: resourceType.ID,
+		Period:         r.Period,
+		Start:          r.Start,
+		End:            r.End,
+	}
+	rollups, err := d.ListUsageRollups(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := d.ListLatestUsageRollupsBefore(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The usage doesn't change in periods without updates, so it's carried forward from the previous period.
+	var value float64
+	if len(previous) > 0 {
+		value = previous[0].EndingValue
+	}
+
+	i := 0
+	for start := r.Start; start.Before(r.End); start = nextRollupPeriod(r.Period, start) {
+		point := UsageSeriesPoint{PeriodStart: start}
+		if i < len(rollups) && rollups[i].PeriodStart.Equal(start) {
+			value = rollups[i].EndingValue
+			point.Added = rollups[i].Added
+			point.Updates = rollups[i].UpdateCount
+			i++
+		}
+		point.Value = value
+		series.Points = append(series.Points, point)
+	}
+
+	return series, nil
+}
+
+// planMember tracks a member of a plan while a usage time series for the plan is built.
+type planMember struct {
+	value         float64
+	subscriptions []db.SubscriptionExport
+}
+
+// subscribedDuring returns true if one of the member's subscriptions to the plan was in effect at some time during
+// a period.
+func (m *planMember) subscribedDuring(start, end time.Time) bool {
+	for _, s := range m.subscriptions {
+		if s.EffectiveStartDate.Before(end) && (s.EffectiveEndDate == nil || s.EffectiveEndDate.After(start)) {
+			return true
+		}
+	}
+	return false
+}
+
+// PlanUsageSeries returns a time series of the total usage of a resource type by the users subscribed to a plan,
+// built from the usage rollups. A user's usage is included in a period if the user had a subscription to the plan in
+// effect at some time during the period.
+func (a *App) PlanUsageSeries(
+	ctx context.Context, planID, resourceTypeName string, r *UsageSeriesRange,
+) (*UsageSeries, error) {
+	if err := r.normalize(time.Now()); err != nil {
+		return nil, err
+	}
+
+	d := a.db
+
+	plan, err := planByID(ctx, d, planID)
+	if err != nil {
+		return nil, err
+	}
+	resourceType, err := usageSeriesResourceType(ctx, d, resourceTypeName)
+	if err != nil {
+		return nil, err
+	}
+
+	series, err := newUsageSeries(ctx, d, resourceType, r)
+	if err != nil {
+		return nil, err
+	}
+	series.PlanID = plan.ID
+	series.PlanName = plan.Name
+
+	members := make(map[string]*planMember)
+	subscriptionFilter := &db.ExportFilter{Start: r.Start, End: r.End, PlanName: plan.Name}
+	err = d.ExportSubscriptions(ctx, subscriptionFilter, func(s *db.SubscriptionExport) error {
+		member, ok := members[s.Username]
+		if !ok {
+			member = &planMember{}
+			members[s.Username] = member
+		}
+		member.subscriptions = append(member.subscriptions, *s)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	filter := &db.UsageRollupFilter{
+		PlanID:         plan.ID,
+		ResourceTypeID: resourceType.ID,
+		Period:         r.Period,
+		Start:          r.Start,
+		End:            r.End,
+	}
+	rollups, err := d.ListUsageRollups(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	previous, err := d.ListLatestUsageRollupsBefore(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+	for _, rollup := range previous {
+		if member, ok := members[rollup.Username]; ok {
+			member.value = rollup.EndingValue
+		}
+	}
+
+	i := 0
+	for start := r.Start; start.Before(r.End); start = nextRollupPeriod(r.Period, start) {
+		end := nextRollupPeriod(r.Period, start)
+
+		point := UsageSeriesPoint{PeriodStart: start}
+		added := make(map[string]db.UsageRollup)
+		for ; i < len(rollups) && rollups[i].PeriodStart.Equal(start); i++ {
+			if member, ok := members[rollups[i].Username]; ok {
+				member.value = rollups[i].EndingValue
+				added[rollups[i].Username] = rollups[i]
+			}
+		}
+
+		for username, member := range members {
+			if !member.subscribedDuring(start, end) {
+				continue
+			}
+			point.Users++
+			point.Value += member.value
+			if rollup, ok := added[username]; ok {
+				point.Added += rollup.Added
+				point.Updates += rollup.UpdateCount
+			}
+		}
+
+		series.Points = append(series.Points, point)
+	}
+
+	return series, nil
+}
+
+// usageSeriesRange parses the period, start and end query parameters of a usage time series request.
+func usageSeriesRange(c echo.Context) (*UsageSeriesRange, error) {
+	var err error
+
+	r := &UsageSeriesRange{Period: c.QueryParam("period")}
+	if v := c.QueryParam("start"); v != "" {
+		if r.Start, err = utils.ParseTimestamp(v); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if v := c.QueryParam("end"); v != "" {
+		if r.End, err = utils.ParseTimestamp(v); err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	return r, nil
+}
+
+// UserUsageSeriesHTTPHandler returns a daily or monthly time series of a user's usage of a resource type.
+func (a *App) UserUsageSeriesHTTPHandler(c echo.Context) error {
+	r, err := usageSeriesRange(c)
+	if err != nil {
+		return err
+	}
+
+	response, err := a.UserUsageSeries(c.Request().Context(), c.Param("username"), c.Param("resource_name"), r)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// PlanUsageSeriesHTTPHandler returns a daily or monthly time series of the total usage of a resource type by the
+// users subscribed to a plan.
+func (a *App) PlanUsageSeriesHTTPHandler(c echo.Context) error {
+	r, err := usageSeriesRange(c)
+	if err != nil {
+		return err
+	}
+
+	response, err := a.PlanUsageSeries(c.Request().Context(), c.Param("plan_id"), c.Param("resource_name"), r)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// RefreshUsageRollupsHTTPHandler refreshes the usage rollups without waiting for the next scheduled refresh.
+func (a *App) RefreshUsageRollupsHTTPHandler(c echo.Context) error {
+	response, err := a.RefreshUsageRollups(c.Request().Context())
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
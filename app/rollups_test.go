@@ -0,0 +1,100 @@
+package app
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+)
+
+// addTestUsage records an ADD usage update for CPU hours that takes effect at the given time.
+func addTestUsage(t *testing.T, m *db.MemoryDatabase, userID string, effective time.Time, value float64) {
+	t.Helper()
+	ctx := context.Background()
+	operationID, err := m.GetOperationID(ctx, db.UpdateTypeAdd)
+	if err != nil {
+		t.Fatalf("unable to look up the update operation: %s", err)
+	}
+	_, err = m.AddUserUpdate(ctx, &db.Update{
+		ValueType:       db.UsagesTrackedMetric,
+		Value:           value,
+		EffectiveDate:   effective,
+		ResourceType:    *testResourceType(t, m, "cpu.hours"),
+		User:            db.User{ID: userID},
+		UpdateOperation: db.UpdateOperation{ID: operationID},
+	})
+	if err != nil {
+		t.Fatalf("unable to add the usage update: %s", err)
+	}
+}
+
+// testRollupValue returns the ending value of the CPU hours rollup for the period that contains a time.
+func testRollupValue(t *testing.T, m *db.MemoryDatabase, userID, period string, at time.Time) float64 {
+	t.Helper()
+	start := rollupPeriodStart(period, at)
+	rollups, err := m.ListUsageRollups(context.Background(), &db.UsageRollupFilter{
+		UserID:         userID,
+		ResourceTypeID: testResourceType(t, m, "cpu.hours").ID,
+		Period:         period,
+		Start:          start,
+		End:            nextRollupPeriod(period, start),
+	})
+	if err != nil {
+		t.Fatalf("unable to list the usage rollups: %s", err)
+	}
+	if len(rollups) != 1 {
+		t.Fatalf("got %d %s rollups at %s, want 1", len(rollups), period, start)
+	}
+	return rollups[0].EndingValue
+}
+
+func TestRebuildUsageRollups(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	first := subscribeTestUser(t, a, "sarahr")
+	userID := first.User.ID
+
+	// The second subscription starts more than a month after the first one, so its usage is in a later month.
+	start := first.EffectiveStartDate
+	plan, err := m.GetPlanByName(ctx, db.DefaultPlanName)
+	if err != nil {
+		t.Fatalf("unable to look up the plan: %s", err)
+	}
+	second := start.AddDate(0, 0, 40)
+	opts := &db.SubscriptionOptions{StartDate: second, EndDate: second.AddDate(1, 0, 0)}
+	if _, err = m.SetActiveSubscription(ctx, userID, plan, opts); err != nil {
+		t.Fatalf("unable to schedule the second subscription: %s", err)
+	}
+
+	addTestUsage(t, m, userID, start.AddDate(0, 0, 1), 5)
+	addTestUsage(t, m, userID, start.AddDate(0, 0, 2), 3)
+	addTestUsage(t, m, userID, second.Add(time.Hour), 2)
+
+	key := &db.UsageRollupKey{
+		UserID:         userID,
+		ResourceTypeID: testResourceType(t, m, "cpu.hours").ID,
+		From:           start.AddDate(0, 0, 1),
+	}
+	if err = a.rebuildUsageRollups(ctx, key); err != nil {
+		t.Fatalf("unable to rebuild the usage rollups: %s", err)
+	}
+
+	if value := testRollupValue(t, m, userID, db.RollupPeriodDay, start.AddDate(0, 0, 2)); value != 8 {
+		t.Errorf("usage at the end of the first subscription = %g, want 8", value)
+	}
+	if value := testRollupValue(t, m, userID, db.RollupPeriodMonth, second.Add(time.Hour)); value != 2 {
+		t.Errorf("usage in the month of the second subscription = %g, want 2", value)
+	}
+
+	// Rebuilding only the later periods must start over at the second subscription as well.
+	later := second.Add(25 * time.Hour)
+	addTestUsage(t, m, userID, later, 1)
+	key.From = later
+	if err = a.rebuildUsageRollups(ctx, key); err != nil {
+		t.Fatalf("unable to rebuild the later usage rollups: %s", err)
+	}
+	if value := testRollupValue(t, m, userID, db.RollupPeriodDay, later); value != 3 {
+		t.Errorf("usage after the later update = %g, want 3", value)
+	}
+}
@@ -0,0 +1,829 @@
+package app
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/auth"
+	"github.com/cyverse-de/subscriptions/common"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/cyverse-de/subscriptions/openapi"
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Access levels for HTTP endpoints.
+const (
+	// publicAccess endpoints can be called without authentication.
+	publicAccess = iota
+
+	// userAccess endpoints can be called by any authenticated user.
+	userAccess
+
+	// ownerAccess endpoints expose information about a single user, so they can only be called by that user or by
+	// administrators. The user is identified by the username path parameter or by the owner of the subscription in
+	// the sub_uuid path parameter.
+	ownerAccess
+
+	// adminAccess endpoints can only be called by administrators.
+	adminAccess
+)
+
+// route describes an HTTP endpoint provided by the service.
+type route struct {
+	method string
+	path   string
+
+	// Deprecated paths that lead to the same endpoint. These are the paths that were used before the versioned
+	// routes were introduced.
+	aliases []string
+
+	summary string
+	tag     string
+	handler echo.HandlerFunc
+	access  int
+
+	// The query parameters accepted by the endpoint.
+	query []openapi.Parameter
+
+	// Values of the types accepted in the request body and returned in the response body. Endpoints without a
+	// request value don't accept a request body, and endpoints without a response value return plain text.
+	request  any
+	response any
+}
+
+// routes returns the list of HTTP endpoints provided by the service.
+func (a *App) routes() []route {
+	return []route{
+		{
+			method:  http.MethodGet,
+			path:    "/",
+			summary: "Returns a greeting",
+			tag:     "status",
+			handler: a.GreetingHTTPHandler,
+			access:  publicAccess,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/healthz",
+			summary:  "Reports whether the service is running",
+			tag:      "status",
+			handler:  a.LivenessHTTPHandler,
+			access:   publicAccess,
+			response: &HealthStatus{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/readyz",
+			summary:  "Reports whether the service and its dependencies are ready to handle requests",
+			tag:      "status",
+			handler:  a.ReadinessHTTPHandler,
+			access:   publicAccess,
+			response: &HealthStatus{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/metrics",
+			summary: "Returns the Prometheus metrics for the service",
+			tag:     "status",
+			handler: echo.WrapHandler(metrics.Handler()),
+			access:  publicAccess,
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/openapi.json",
+			summary:  "Returns the OpenAPI document describing this API",
+			tag:      "status",
+			handler:  a.OpenAPIHTTPHandler,
+			access:   publicAccess,
+			response: map[string]any{},
+		},
+
+		// Endpoints that only read information.
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/summary",
+			aliases:  []string{"/summary/:username"},
+			summary:  "Returns a summary of a user's subscription",
+			tag:      "subscriptions",
+			handler:  a.GetUserSummaryHTTPHandler,
+			access:   ownerAccess,
+			response: &UserSummaryResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/subscriptions",
+			summary:  "Lists a user's past, current and scheduled subscriptions",
+			tag:      "subscriptions",
+			handler:  a.SubscriptionHistoryHTTPHandler,
+			access:   ownerAccess,
+			response: &SubscriptionHistory{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/plan-version",
+			summary:  "Returns the version of the plan that a user's active subscription is on",
+			tag:      "subscriptions",
+			handler:  a.GetSubscriptionPlanVersionHTTPHandler,
+			access:   ownerAccess,
+			response: &db.PlanVersion{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/groups",
+			summary:  "Lists the groups that a user belongs to and the pooled usages of their subscriptions",
+			tag:      "groups",
+			handler:  a.ListUserGroupsHTTPHandler,
+			access:   ownerAccess,
+			response: &UserGroups{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/addons",
+			aliases:  []string{"/addons"},
+			summary:  "Lists the available add-ons",
+			tag:      "addons",
+			handler:  a.ListAddonsHTTPHandler,
+			access:   userAccess,
+			response: &qms.AddonListResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/subscriptions/:sub_uuid/addons",
+			aliases:  []string{"/subscriptions/:sub_uuid/addons"},
+			summary:  "Lists the add-ons applied to a subscription",
+			tag:      "subscriptions",
+			handler:  a.ListSubscriptionAddonsHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.SubscriptionAddonListResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/subscriptions/:sub_uuid/addons/:addon_uuid",
+			aliases:  []string{"/subscriptions/:sub_uuid/addons/:addon_uuid"},
+			summary:  "Returns an add-on applied to a subscription",
+			tag:      "subscriptions",
+			handler:  a.GetSubscriptionAddonHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.SubscriptionAddonResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/updates",
+			aliases:  []string{"/users/:username/updates"},
+			summary:  "Lists the usage updates recorded for a user",
+			tag:      "users",
+			handler:  a.GetUserUpdatesHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.UpdateListResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/overages",
+			aliases:  []string{"/users/:username/overages"},
+			summary:  "Lists the resources for which a user has exceeded their quota",
+			tag:      "users",
+			handler:  a.GetUserOveragesHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.OverageList{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/overages/:resource_name",
+			aliases:  []string{"/users/:username/overages/:resource_name"},
+			summary:  "Determines whether a user has exceeded their quota for a resource",
+			tag:      "users",
+			handler:  a.CheckUserOveragesHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.IsOverage{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/users/:username/usages",
+			aliases:  []string{"/users/:username/usages"},
+			summary:  "Lists a user's resource usages",
+			tag:      "users",
+			handler:  a.GetUsagesHTTPHandler,
+			access:   ownerAccess,
+			response: &qms.UsageList{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/users/:username/usages/:resource_name/series",
+			summary: "Returns a daily or monthly time series of a user's usage of a resource",
+			tag:     "users",
+			handler: a.UserUsageSeriesHTTPHandler,
+			access:  ownerAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter("period", "string", "", "Either day or month. Defaults to day."),
+				openapi.QueryParameter(
+					"start", "string", "", "The start of the series. Defaults to 30 days or 12 months before the end.",
+				),
+				openapi.QueryParameter("end", "string", "", "The end of the series. Defaults to the end of the current period."),
+			},
+			response: &UsageSeries{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/plans",
+			aliases:  []string{"/plans"},
+			summary:  "Lists the subscription plans",
+			tag:      "plans",
+			handler:  a.ListPlansHTTPHandler,
+			access:   userAccess,
+			response: &qms.PlanList{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/plans/:plan_id",
+			aliases:  []string{"/plans/:plan_id"},
+			summary:  "Returns a subscription plan",
+			tag:      "plans",
+			handler:  a.GetPlanHTTPHandler,
+			access:   userAccess,
+			response: &qms.PlanResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/plans/:plan_id/versions",
+			summary:  "Lists the versions of a subscription plan",
+			tag:      "plans",
+			handler:  a.ListPlanVersionsHTTPHandler,
+			access:   userAccess,
+			response: &PlanVersionList{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/plans/:plan_id/versions/:version",
+			summary:  "Returns a version of a subscription plan",
+			tag:      "plans",
+			handler:  a.GetPlanVersionHTTPHandler,
+			access:   userAccess,
+			response: &db.PlanVersion{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/plans/:plan_id/grace-period",
+			summary:  "Returns the grace period of a subscription plan",
+			tag:      "plans",
+			handler:  a.PlanGracePeriodHTTPHandler,
+			access:   userAccess,
+			response: &PlanGracePeriod{},
+		},
+
+		// Endpoints that modify information or expose information about other users.
+		{
+			method:   http.MethodPut,
+			path:     "/v1/addons",
+			aliases:  []string{"/addons"},
+			summary:  "Adds an add-on",
+			tag:      "addons",
+			handler:  a.AddAddonHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddAddonRequest{},
+			response: &qms.AddonResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/addons/:uuid",
+			aliases:  []string{"/addons/:uuid"},
+			summary:  "Updates an add-on",
+			tag:      "addons",
+			handler:  a.UpdateAddonHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.UpdateAddonRequest{},
+			response: &qms.AddonResponse{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v1/addons/:uuid",
+			aliases:  []string{"/addons/:uuid"},
+			summary:  "Deletes an add-on",
+			tag:      "addons",
+			handler:  a.DeleteAddonHTTPHandler,
+			access:   adminAccess,
+			response: &qms.AddonResponse{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/subscriptions/:sub_uuid/addons/:addon_uuid",
+			aliases:  []string{"/subscriptions/:sub_uuid/addons/:addon_uuid"},
+			summary:  "Applies an add-on to a subscription",
+			tag:      "subscriptions",
+			handler:  a.AddSubscriptionAddonHTTPHandler,
+			access:   adminAccess,
+			response: &qms.SubscriptionAddonResponse{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v1/subscriptions/:sub_uuid/addons/:addon_uuid",
+			aliases:  []string{"/subscriptions/:sub_uuid/addons/:addon_uuid"},
+			summary:  "Removes an add-on from a subscription",
+			tag:      "subscriptions",
+			handler:  a.DeleteSubscriptionAddonHTTPHandler,
+			access:   adminAccess,
+			response: &qms.SubscriptionAddonResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/subscriptions/:sub_uuid/addons/:addon_uuid",
+			aliases:  []string{"/subscriptions/:sub_uuid/addons/:addon_uuid"},
+			summary:  "Updates an add-on applied to a subscription",
+			tag:      "subscriptions",
+			handler:  a.UpdateSubscriptionAddonHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.UpdateSubscriptionAddonRequest{},
+			response: &qms.SubscriptionAddonResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/subscriptions/:sub_uuid/cancellation",
+			summary:  "Cancels a subscription immediately or at the end of its current period",
+			tag:      "subscriptions",
+			handler:  a.CancelSubscriptionHTTPHandler,
+			access:   adminAccess,
+			request:  &CancellationRequest{},
+			response: &SubscriptionRecord{},
+		},
+		{
+			method:  http.MethodPut,
+			path:    "/v1/users/:username",
+			aliases: []string{"/users"},
+			summary: "Adds a user and subscribes them to a plan",
+			tag:     "users",
+			handler: a.AddUserHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter(
+					"start_date", "string", "", "Schedules the subscription to start at this time instead of now.",
+				),
+			},
+			request:  &qms.AddUserRequest{},
+			response: &qms.AddUserResponse{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/users",
+			summary: "Lists users along with their active subscriptions",
+			tag:     "users",
+			handler: a.ListUsersHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter("prefix", "string", "", "Only include users whose usernames start with this prefix."),
+				openapi.QueryParameter("plan", "string", "", "Only include users whose active subscription is to this plan."),
+				openapi.QueryParameter("paid", "boolean", "", "Only include users whose active subscription is or isn't paid."),
+				openapi.QueryParameter(
+					"expires_after", "string", "", "Only include users whose active subscription ends at or after this time.",
+				),
+				openapi.QueryParameter(
+					"expires_before", "string", "", "Only include users whose active subscription ends before this time.",
+				),
+				openapi.QueryParameter("in_overage", "boolean", "", "Only include users who are or aren't in overage."),
+				openapi.QueryParameter("limit", "integer", "int32", "The maximum number of users to list."),
+				openapi.QueryParameter("offset", "integer", "int32", "The number of users to skip."),
+			},
+			response: &UserList{},
+		},
+		{
+			method:  http.MethodPost,
+			path:    "/v1/users/import",
+			summary: "Subscribes the users listed in a CSV or JSON Lines request body to plans",
+			tag:     "users",
+			handler: a.ImportUsersHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter(
+					"format", "string", "", "Either csv or jsonl. Taken from the content type if it's not specified.",
+				),
+				openapi.QueryParameter("dry_run", "boolean", "", "Validates and reports on the rows without saving them."),
+			},
+			response: &ImportReport{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/exports/:dataset",
+			summary: "Streams subscriptions, quotas, usages, add-ons or updates as CSV, JSON Lines or Parquet",
+			tag:     "exports",
+			handler: a.ExportHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter("format", "string", "", "Either csv, jsonl or parquet. Defaults to csv."),
+				openapi.QueryParameter("start", "string", "", "Only include rows in effect at or after this time."),
+				openapi.QueryParameter("end", "string", "", "Only include rows in effect before this time."),
+				openapi.QueryParameter("plan", "string", "", "Only include rows for subscriptions to this plan."),
+			},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/plans/:plan_id/usages/:resource_name/series",
+			summary: "Returns a daily or monthly time series of the total usage of a resource by a plan's subscribers",
+			tag:     "plans",
+			handler: a.PlanUsageSeriesHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter("period", "string", "", "Either day or month. Defaults to day."),
+				openapi.QueryParameter(
+					"start", "string", "", "The start of the series. Defaults to 30 days or 12 months before the end.",
+				),
+				openapi.QueryParameter("end", "string", "", "The end of the series. Defaults to the end of the current period."),
+			},
+			response: &UsageSeries{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/usages/rollups/refresh",
+			summary:  "Refreshes the daily and monthly usage rollups without waiting for the next scheduled refresh",
+			tag:      "users",
+			handler:  a.RefreshUsageRollupsHTTPHandler,
+			access:   adminAccess,
+			response: &UsageRollupRefresh{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/users/:username/rename",
+			summary:  "Changes a user's username",
+			tag:      "users",
+			handler:  a.RenameUserHTTPHandler,
+			access:   adminAccess,
+			request:  &RenameUserRequest{},
+			response: &RenamedUser{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/users/:username/merge",
+			summary:  "Moves another user's subscriptions, updates and group memberships to a user and removes them",
+			tag:      "users",
+			handler:  a.MergeUsersHTTPHandler,
+			access:   adminAccess,
+			request:  &MergeUsersRequest{},
+			response: &UserMergeResult{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/users/:username/updates",
+			aliases:  []string{"/user/:username/updates"},
+			summary:  "Records a usage update for a user",
+			tag:      "users",
+			handler:  a.AddUserUpdateHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddUpdateRequest{},
+			response: &qms.AddUpdateResponse{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/users/:username/usages",
+			aliases:  []string{"/users/:username/usages"},
+			summary:  "Sets a user's usage of a resource, bypassing the usage updates",
+			tag:      "users",
+			handler:  a.AddUsageHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddUsage{},
+			response: &qms.UsageResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/users/:username/usages/recompute",
+			summary:  "Recalculates a user's usages from the usage updates in the active subscription",
+			tag:      "users",
+			handler:  a.RecomputeUsagesHTTPHandler,
+			access:   adminAccess,
+			response: &qms.UsageList{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/plans",
+			aliases:  []string{"/plans"},
+			summary:  "Adds a subscription plan",
+			tag:      "plans",
+			handler:  a.AddPlanHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddPlanRequest{},
+			response: &qms.PlanResponse{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/plans/:plan_id/versions",
+			summary:  "Records the current rate and quota defaults of a subscription plan as a new version",
+			tag:      "plans",
+			handler:  a.PublishPlanVersionHTTPHandler,
+			access:   adminAccess,
+			response: &db.PlanVersion{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/plans/:plan_id/versions/migrations",
+			summary:  "Moves the active subscriptions on one version of a subscription plan to another version",
+			tag:      "plans",
+			handler:  a.MigratePlanVersionHTTPHandler,
+			access:   adminAccess,
+			request:  &PlanVersionMigrationRequest{},
+			response: &PlanVersionMigration{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/plans/:plan_id/grace-period",
+			summary:  "Sets the number of days that the quotas of an expired paid subscription to a plan still apply",
+			tag:      "plans",
+			handler:  a.SetPlanGracePeriodHTTPHandler,
+			access:   adminAccess,
+			request:  &GracePeriodRequest{},
+			response: &PlanGracePeriod{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/quotas/defaults",
+			aliases:  []string{"/quotas/defaults"},
+			summary:  "Sets the default quota for a resource in a plan",
+			tag:      "plans",
+			handler:  a.UpsertQuotaDefaultsHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddPlanQuotaDefaultRequest{},
+			response: &qms.QuotaDefaultResponse{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/quotas",
+			aliases:  []string{"/quotas"},
+			summary:  "Sets a quota in a subscription",
+			tag:      "subscriptions",
+			handler:  a.AddQuotaHTTPHandler,
+			access:   adminAccess,
+			request:  &qms.AddQuotaRequest{},
+			response: &qms.QuotaResponse{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/groups",
+			summary:  "Lists the groups",
+			tag:      "groups",
+			handler:  a.ListGroupsHTTPHandler,
+			access:   adminAccess,
+			response: &GroupList{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/groups",
+			summary:  "Adds a group",
+			tag:      "groups",
+			handler:  a.AddGroupHTTPHandler,
+			access:   adminAccess,
+			request:  &GroupRequest{},
+			response: &db.Group{},
+		},
+		{
+			method:   http.MethodGet,
+			path:     "/v1/groups/:group_name",
+			summary:  "Returns a group along with its members, its active subscription and its pooled usages",
+			tag:      "groups",
+			handler:  a.GetGroupHTTPHandler,
+			access:   adminAccess,
+			response: &GroupDetails{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v1/groups/:group_name",
+			summary:  "Removes a group along with its memberships and subscriptions",
+			tag:      "groups",
+			handler:  a.DeleteGroupHTTPHandler,
+			access:   adminAccess,
+			response: &GroupDetails{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/groups/:group_name/members/:username",
+			summary:  "Adds a user to a group",
+			tag:      "groups",
+			handler:  a.AddGroupMemberHTTPHandler,
+			access:   adminAccess,
+			response: &GroupDetails{},
+		},
+		{
+			method:   http.MethodDelete,
+			path:     "/v1/groups/:group_name/members/:username",
+			summary:  "Removes a user from a group",
+			tag:      "groups",
+			handler:  a.RemoveGroupMemberHTTPHandler,
+			access:   adminAccess,
+			response: &GroupDetails{},
+		},
+		{
+			method:   http.MethodPost,
+			path:     "/v1/groups/:group_name/subscriptions",
+			summary:  "Subscribes a group to a plan, ending the group's current subscription",
+			tag:      "groups",
+			handler:  a.SubscribeGroupHTTPHandler,
+			access:   adminAccess,
+			request:  &GroupSubscriptionRequest{},
+			response: &db.GroupSubscription{},
+		},
+		{
+			method:   http.MethodPut,
+			path:     "/v1/groups/:group_name/quotas/:resource_type",
+			summary:  "Sets a pooled quota in a group's active subscription",
+			tag:      "groups",
+			handler:  a.SetGroupQuotaHTTPHandler,
+			access:   adminAccess,
+			request:  &GroupQuotaRequest{},
+			response: &db.GroupSubscription{},
+		},
+		{
+			method:  http.MethodGet,
+			path:    "/v1/audit",
+			aliases: []string{"/audit"},
+			summary: "Lists changes recorded in the audit log",
+			tag:     "audit",
+			handler: a.ListAuditRecordsHTTPHandler,
+			access:  adminAccess,
+			query: []openapi.Parameter{
+				openapi.QueryParameter("username", "string", "", "Only include changes to this user's subscriptions."),
+				openapi.QueryParameter("actor", "string", "", "Only include changes made by this user."),
+				openapi.QueryParameter("entity_type", "string", "", "Only include changes to this type of entity."),
+				openapi.QueryParameter("start", "string", "", "Only include changes made at or after this time."),
+				openapi.QueryParameter("end", "string", "", "Only include changes made before this time."),
+				openapi.QueryParameter("limit", "integer", "int32", "The maximum number of changes to list."),
+				openapi.QueryParameter("offset", "integer", "int32", "The number of changes to skip."),
+			},
+			response: &AuditRecordList{},
+		},
+	}
+}
+
+// middlewareFor returns the middleware that enforces the access level of an endpoint.
+func (a *App) middlewareFor(access int) []echo.MiddlewareFunc {
+	if a.auth == nil {
+		return nil
+	}
+	switch access {
+	case userAccess:
+		return []echo.MiddlewareFunc{a.auth.UserMiddleware()}
+	case ownerAccess:
+		return []echo.MiddlewareFunc{a.auth.UserMiddleware(), a.requireOwner()}
+	case adminAccess:
+		return []echo.MiddlewareFunc{a.auth.AdminMiddleware()}
+	default:
+		return nil
+	}
+}
+
+// requireOwner returns middleware that only allows administrators and the user that a request refers to. It must run
+// after the middleware that authenticates the caller.
+func (a *App) requireOwner() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			identity := auth.IdentityFromContext(c)
+			if identity == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "a bearer token is required")
+			}
+			if a.auth.IsAdmin(identity) {
+				return next(c)
+			}
+
+			caller, err := a.FixUsername(identity.Username)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusForbidden, "insufficient privileges")
+			}
+			owner, err := a.requestOwner(c)
+			if err != nil {
+				return err
+			}
+			if owner == "" || owner != caller {
+				return echo.NewHTTPError(http.StatusForbidden, "insufficient privileges")
+			}
+
+			return next(c)
+		}
+	}
+}
+
+// requestOwner returns the normalized username of the user that a request refers to, or an empty string if the
+// request doesn't refer to a user that exists.
+func (a *App) requestOwner(c echo.Context) (string, error) {
+	if username := c.Param("username"); username != "" {
+		owner, err := a.FixUsername(username)
+		if err != nil {
+			return "", nil
+		}
+		return owner, nil
+	}
+
+	subscriptionID := c.Param("sub_uuid")
+	if err := uuid.Validate(subscriptionID); err != nil {
+		return "", nil
+	}
+	subscription, err := a.db.GetSubscriptionByID(c.Request().Context(), subscriptionID)
+	if err != nil || subscription == nil {
+		return "", err
+	}
+	return subscription.User.Username, nil
+}
+
+// validationError converts a request body validation error to the error response returned to the caller.
+func validationError(err *openapi.ValidationError) error {
+	response := common.ErrorResponse{Message: err.Message}
+	if len(err.Fields) > 0 {
+		details := map[string]interface{}{"fields": err.Fields}
+		response.Details = &details
+	}
+	return response
+}
+
+// deprecated returns middleware that marks responses from a deprecated route. The Link header refers to the route
+// that replaces it, with the path parameters filled in from the current request.
+func deprecated(successor string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// Parameters that aren't in the deprecated path are left as URI template variables.
+			segments := strings.Split(successor, "/")
+			for i, segment := range segments {
+				if name, found := strings.CutPrefix(segment, ":"); found {
+					if value := c.Param(name); value != "" {
+						segments[i] = url.PathEscape(value)
+					} else {
+						segments[i] = "{" + name + "}"
+					}
+				}
+			}
+			location := strings.Join(segments, "/")
+
+			c.Response().Header().Set("Deprecation", "true")
+			c.Response().Header().Set("Link", fmt.Sprintf("<%s>; rel=\"successor-version\"", location))
+
+			return next(c)
+		}
+	}
+}
+
+// buildOpenAPIDocument describes the HTTP endpoints in an OpenAPI document.
+func (a *App) buildOpenAPIDocument(routes []route) *openapi.Document {
+	doc := openapi.NewDocument(openapi.Info{
+		Title:       "Subscriptions",
+		Description: "Manages subscription plans, add-ons, quotas and resource usages.",
+		Version:     "1.0.0",
+	})
+
+	for _, r := range routes {
+		endpoint := &openapi.Endpoint{
+			Method:          r.method,
+			Path:            r.path,
+			Summary:         r.summary,
+			Tags:            []string{r.tag},
+			QueryParameters: r.query,
+			Request:         r.request,
+			Response:        r.response,
+			Secured:         r.access != publicAccess,
+		}
+
+		description := ""
+		switch r.access {
+		case adminAccess:
+			description = "Requires the administrator role."
+		case ownerAccess:
+			description = "Can only be called by the user that the request refers to or by an administrator."
+		}
+
+		op := doc.AddEndpoint(endpoint, common.ErrorResponse{})
+		op.Description = description
+
+		for _, alias := range r.aliases {
+			aliasEndpoint := *endpoint
+			aliasEndpoint.Path = alias
+			aliasEndpoint.Deprecated = true
+
+			op = doc.AddEndpoint(&aliasEndpoint, common.ErrorResponse{})
+			op.Description = strings.TrimSpace(fmt.Sprintf("Deprecated; use %s %s instead. %s", r.method, r.path, description))
+		}
+	}
+
+	return doc
+}
+
+// registerRoutes adds the HTTP endpoints to the router. Request bodies are validated against the OpenAPI document
+// before they're passed to the handlers.
+func (a *App) registerRoutes() {
+	routes := a.routes()
+	a.openAPI = a.buildOpenAPIDocument(routes)
+
+	a.Router.Use(metrics.HTTPMiddleware())
+
+	for _, r := range routes {
+		middleware := a.middlewareFor(r.access)
+		if schema := a.openAPI.RequestSchema(r.method, r.path); schema != nil {
+			middleware = append(middleware, a.openAPI.ValidationMiddleware(schema, validationError))
+		}
+		a.Router.Add(r.method, r.path, r.handler, middleware...)
+
+		for _, alias := range r.aliases {
+			aliasMiddleware := append([]echo.MiddlewareFunc{deprecated(r.path)}, middleware...)
+			a.Router.Add(r.method, alias, r.handler, aliasMiddleware...)
+		}
+	}
+}
+
+// OpenAPIHTTPHandler returns the OpenAPI document describing the HTTP API.
+func (a *App) OpenAPIHTTPHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, a.openAPI)
+}
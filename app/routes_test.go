@@ -0,0 +1,183 @@
+package app
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/auth"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+// newTestAuthenticator returns an Authenticator that trusts a locally generated key, along with a function that
+// signs tokens for a user with the given roles.
+func newTestAuthenticator(t *testing.T) (*auth.Authenticator, func(username string, roles ...string) string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate a key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("unable to encode the public key: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unable to write the key file: %s", err)
+	}
+
+	authenticator, err := auth.New(&auth.Settings{KeyPath: path, UserRole: "de-users", AdminRole: "de-admins"})
+	if err != nil {
+		t.Fatalf("unable to create the authenticator: %s", err)
+	}
+
+	sign := func(username string, roles ...string) string {
+		roleValues := make([]any, len(roles))
+		for i, role := range roles {
+			roleValues[i] = role
+		}
+		token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+			"exp":                time.Now().Add(time.Hour).Unix(),
+			"preferred_username": username,
+			"realm_access":       map[string]any{"roles": roleValues},
+		})
+		signed, err := token.SignedString(key)
+		if err != nil {
+			t.Fatalf("unable to sign the token: %s", err)
+		}
+		return signed
+	}
+
+	return authenticator, sign
+}
+
+func TestRouteAccess(t *testing.T) {
+	authenticator, sign := newTestAuthenticator(t)
+	a, m := newTestApp(t, authenticator)
+
+	sarah := subscribeTestUser(t, a, "sarahr")
+	other := subscribeTestUser(t, a, "jdoe")
+
+	userToken := sign("sarahr", "de-users")
+	adminToken := sign("admin", "de-admins")
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		token  string
+		want   int
+	}{
+		{name: "no token", method: http.MethodGet, path: "/v1/users/sarahr/usages", want: http.StatusUnauthorized},
+		{name: "public route", method: http.MethodGet, path: "/healthz", want: http.StatusOK},
+		{name: "shared route", method: http.MethodGet, path: "/v1/plans", token: userToken, want: http.StatusOK},
+		{name: "own usages", method: http.MethodGet, path: "/v1/users/sarahr/usages", token: userToken, want: http.StatusOK},
+		{
+			name:   "own usages with a qualified username",
+			method: http.MethodGet,
+			path:   "/v1/users/sarahr@" + testUserDomain + "/usages",
+			token:  userToken,
+			want:   http.StatusOK,
+		},
+		{name: "own summary", method: http.MethodGet, path: "/v1/users/sarahr/summary", token: userToken, want: http.StatusOK},
+		{name: "own groups", method: http.MethodGet, path: "/v1/users/sarahr/groups", token: userToken, want: http.StatusOK},
+		{
+			name:   "own usage series",
+			method: http.MethodGet,
+			path:   "/v1/users/sarahr/usages/cpu.hours/series",
+			token:  userToken,
+			want:   http.StatusOK,
+		},
+		{
+			name:   "own subscription add-ons",
+			method: http.MethodGet,
+			path:   "/v1/subscriptions/" + sarah.ID + "/addons",
+			token:  userToken,
+			want:   http.StatusOK,
+		},
+		{name: "another user's usages", method: http.MethodGet, path: "/v1/users/jdoe/usages", token: userToken, want: http.StatusForbidden},
+		{name: "another user's updates", method: http.MethodGet, path: "/v1/users/jdoe/updates", token: userToken, want: http.StatusForbidden},
+		{name: "another user's overages", method: http.MethodGet, path: "/v1/users/jdoe/overages", token: userToken, want: http.StatusForbidden},
+		{
+			name:   "another user's subscription history",
+			method: http.MethodGet,
+			path:   "/v1/users/jdoe/subscriptions",
+			token:  userToken,
+			want:   http.StatusForbidden,
+		},
+		{name: "another user's groups", method: http.MethodGet, path: "/v1/users/jdoe/groups", token: userToken, want: http.StatusForbidden},
+		{
+			name:   "another user's usage series",
+			method: http.MethodGet,
+			path:   "/v1/users/jdoe/usages/cpu.hours/series",
+			token:  userToken,
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "another user's subscription add-ons",
+			method: http.MethodGet,
+			path:   "/v1/subscriptions/" + other.ID + "/addons",
+			token:  userToken,
+			want:   http.StatusForbidden,
+		},
+		{
+			name:   "an invalid subscription ID",
+			method: http.MethodGet,
+			path:   "/v1/subscriptions/not-a-uuid/addons",
+			token:  userToken,
+			want:   http.StatusForbidden,
+		},
+		{name: "admin route", method: http.MethodGet, path: "/v1/users", token: userToken, want: http.StatusForbidden},
+		{name: "admin reading a user's usages", method: http.MethodGet, path: "/v1/users/jdoe/usages", token: adminToken, want: http.StatusOK},
+		{
+			name:   "admin reading a user's subscription add-ons",
+			method: http.MethodGet,
+			path:   "/v1/subscriptions/" + sarah.ID + "/addons",
+			token:  adminToken,
+			want:   http.StatusOK,
+		},
+		{name: "admin route as an admin", method: http.MethodGet, path: "/v1/users", token: adminToken, want: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.token != "" {
+				req.Header.Set(echo.HeaderAuthorization, "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			a.Router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+		})
+	}
+
+	// A user's summary subscribes them to the default plan, so asking for someone else's summary mustn't create them.
+	req := httptest.NewRequest(http.MethodGet, "/v1/users/newuser/summary", nil)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+userToken)
+	rec := httptest.NewRecorder()
+	a.Router.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status = %d, want %d: %s", rec.Code, http.StatusForbidden, rec.Body.String())
+	}
+	exists, err := m.UserExists(context.Background(), "newuser")
+	if err != nil {
+		t.Fatalf("unable to check whether the user exists: %s", err)
+	}
+	if exists {
+		t.Error("the user was created by another user's summary request")
+	}
+}
@@ -2,17 +2,27 @@ package app
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
+// UserSummaryResponse is the HTTP response body for user summaries. It contains the same fields as the NATS
+// response, along with the user's subscriptions that are scheduled to start in the future and the grace period of
+// a paid subscription that has recently ended, if the user's active subscription isn't paid.
+type UserSummaryResponse struct {
+	*qms.SubscriptionResponse
+	PendingSubscriptions []*qms.Subscription `json:"pending_subscriptions"`
+	GracePeriod          *GracePeriod        `json:"grace_period,omitempty"`
+}
+
 func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscription, error) {
 	// Set up the log context.
 	log := log.WithFields(
@@ -23,9 +33,12 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 	)
 
 	// Get the user summary.
-	d := db.New(a.db)
+	d := a.db
 
-	var subscription *db.Subscription
+	var (
+		subscription *db.Subscription
+		newPlanName  string
+	)
 	tx, err := d.Begin()
 	if err != nil {
 		return nil, err
@@ -33,45 +46,15 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 	err = tx.Wrap(func() error {
 		log.Debugf("before getting the active user plan: %s", username)
 
-		subscription, err = d.GetActiveSubscription(ctx, username, db.WithTX(tx))
+		// Users who don't have an active subscription are subscribed to the default plan when their summary is
+		// requested, if provisioning is enabled.
+		subscription, newPlanName, err = a.activeOrDefaultSubscription(ctx, d, tx, username)
 		if err != nil {
 			log.Errorf("unable to get the active user plan: %s", err)
 			return err
 		}
 		log.Debugf("after getting the active user plan: %s", username)
 
-		if subscription == nil || subscription.ID == "" {
-			user, err := d.EnsureUser(ctx, username, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to ensure that the user exists in the database: %s", err)
-				return err
-			}
-
-			plan, err := d.GetPlanByName(ctx, db.DefaultPlanName, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the default plan: %s", err)
-				return err
-			}
-
-			opts := db.DefaultSubscriptionOptions()
-			subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, opts, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to subscribe the user to the default plan: %s", err)
-				return err
-			}
-
-			subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, db.WithTX(tx))
-			if err != nil {
-				log.Errorf("unable to look up the new user plan: %s", err)
-				return err
-			}
-			if subscription == nil {
-				err = fmt.Errorf("the newly inserted user plan could not be found")
-				log.Error(err)
-				return err
-			}
-		}
-
 		log.Debug("before getting the user plan details")
 		err = d.LoadSubscriptionDetails(ctx, subscription, db.WithTX(tx))
 		if err != nil {
@@ -85,6 +68,10 @@ func (a *App) GetUserSummary(ctx context.Context, username string) (*qms.Subscri
 		return nil, err
 	}
 
+	if newPlanName != "" {
+		metrics.SubscriptionsCreated.WithLabelValues(newPlanName, metrics.SubscriptionKindUser).Inc()
+	}
+
 	return subscription.ToQMSSubscription(), nil
 }
 
@@ -93,13 +80,13 @@ func (a *App) getUserSummary(ctx context.Context, request *qms.RequestByUsername
 
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	subscription, err := a.GetUserSummary(ctx, username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -115,6 +102,7 @@ func (a *App) GetUserSummaryHandler(subject, reply string, request *qms.RequestB
 
 	ctx, span := pbinit.InitQMSRequestByUsername(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.getUserSummary(ctx, request)
 
@@ -127,7 +115,7 @@ func (a *App) GetUserSummaryHTTPHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	request := &qms.RequestByUsername{
-		Username: c.Param("user"),
+		Username: c.Param("username"),
 	}
 
 	response := a.getUserSummary(ctx, request)
@@ -136,5 +124,17 @@ func (a *App) GetUserSummaryHTTPHandler(c echo.Context) error {
 		return c.JSON(int(response.Error.StatusCode), response)
 	}
 
-	return c.JSON(http.StatusOK, response)
+	pending, err := a.PendingSubscriptions(ctx, request.Username)
+	if err != nil {
+		return err
+	}
+
+	summary := &UserSummaryResponse{SubscriptionResponse: response, PendingSubscriptions: pending}
+	if !response.Subscription.GetPaid() {
+		if summary.GracePeriod, err = a.UserGracePeriod(ctx, request.Username); err != nil {
+			return err
+		}
+	}
+
+	return c.JSON(http.StatusOK, summary)
 }
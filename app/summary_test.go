@@ -0,0 +1,107 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestGetUserSummary(t *testing.T) {
+	tests := []struct {
+		name         string
+		subscribeTo  string
+		provisioning ProvisioningSettings
+		wantPlan     string
+		wantErr      error
+		wantUser     bool
+	}{
+		{
+			name:         "new user subscribed to the default plan",
+			provisioning: *DefaultProvisioningSettings(),
+			wantPlan:     db.DefaultPlanName,
+			wantUser:     true,
+		},
+		{
+			name:         "new user subscribed to a configured plan",
+			provisioning: ProvisioningSettings{Enabled: true, PlanName: "Pro", Periods: 1},
+			wantPlan:     "Pro",
+			wantUser:     true,
+		},
+		{
+			name:         "existing subscription",
+			subscribeTo:  "Pro",
+			provisioning: *DefaultProvisioningSettings(),
+			wantPlan:     "Pro",
+			wantUser:     true,
+		},
+		{
+			name:         "existing subscription without provisioning",
+			subscribeTo:  "Pro",
+			provisioning: ProvisioningSettings{},
+			wantPlan:     "Pro",
+			wantUser:     true,
+		},
+		{
+			name:         "new user without provisioning",
+			provisioning: ProvisioningSettings{},
+			wantErr:      errors.ErrNoActiveSubscription,
+		},
+		{
+			name:         "provisioning plan that doesn't exist",
+			provisioning: ProvisioningSettings{Enabled: true, PlanName: "Missing", Periods: 1},
+			wantErr:      errors.ErrPlanNotFound,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, m := newTestApp(t, nil)
+			pro := addTestPlan(t, m, "Pro", 200, 5e10)
+
+			if tt.subscribeTo != "" {
+				user, err := m.EnsureUser(ctx, "sarahr")
+				if err != nil {
+					t.Fatalf("unable to add the user: %s", err)
+				}
+				_, err = m.SetActiveSubscription(ctx, user.ID, pro, &db.SubscriptionOptions{})
+				if err != nil {
+					t.Fatalf("unable to subscribe the user: %s", err)
+				}
+			}
+
+			a.Provisioning = &tt.provisioning
+			subscription, err := a.GetUserSummary(ctx, "sarahr")
+
+			exists, existsErr := m.UserExists(ctx, "sarahr")
+			if existsErr != nil {
+				t.Fatalf("unable to check whether the user exists: %s", existsErr)
+			}
+			if exists != tt.wantUser {
+				t.Errorf("user exists = %t, want %t", exists, tt.wantUser)
+			}
+
+			if tt.wantErr != nil {
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("error = %v, want %v", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if subscription.GetPlan().GetName() != tt.wantPlan {
+				t.Errorf("plan = %q, want %q", subscription.GetPlan().GetName(), tt.wantPlan)
+			}
+			if subscription.GetUser().GetUsername() != "sarahr" {
+				t.Errorf("username = %q, want %q", subscription.GetUser().GetUsername(), "sarahr")
+			}
+			if len(subscription.GetQuotas()) != 2 {
+				t.Errorf("got %d quotas, want 2", len(subscription.GetQuotas()))
+			}
+		})
+	}
+}
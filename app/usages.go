@@ -6,6 +6,7 @@ import (
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
 	"github.com/labstack/echo/v4"
@@ -18,21 +19,21 @@ func (a *App) getUsages(ctx context.Context, request *qms.GetUsages) *qms.UsageL
 
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
-	d := db.New(a.db)
+	d := a.db
 
 	subscription, err := d.GetActiveSubscription(ctx, username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
 	usages, err := d.SubscriptionUsages(ctx, subscription.ID)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -101,16 +102,16 @@ func (a *App) addUsage(ctx context.Context, request *qms.AddUsage) *qms.UsageRes
 	response := pbinit.NewUsageResponse()
 	username, err := a.FixUsername(request.Username)
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
-	d := db.New(a.db)
+	d := a.db
 
 	// Do most of the work in a transaction.
 	tx, err := d.Begin()
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 	err = tx.Wrap(func() error {
@@ -139,7 +140,7 @@ func (a *App) addUsage(ctx context.Context, request *qms.AddUsage) *qms.UsageRes
 		}
 
 		// Calculate the updated usage.
-		if err = d.CalculateUsage(ctx, request.UpdateType, &usage, db.WithTX(tx)); err != nil {
+		if err = d.CalculateUsage(ctx, request.UpdateType, &usage, db.WithTX(tx), actorOpt(ctx)); err != nil {
 			return err
 		}
 
@@ -164,7 +165,7 @@ func (a *App) addUsage(ctx context.Context, request *qms.AddUsage) *qms.UsageRes
 		return nil
 	})
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
 
@@ -176,6 +177,7 @@ func (a *App) AddUsageHandler(subject, reply string, request *qms.AddUsage) {
 
 	ctx, span := pbinit.InitAddUsage(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
 	response := a.addUsage(ctx, request)
 
@@ -0,0 +1,117 @@
+package app
+
+import (
+	"context"
+	"maps"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/utils"
+	"github.com/labstack/echo/v4"
+)
+
+// UserListEntry describes a user in a user listing along with their active subscription, if they have one.
+type UserListEntry struct {
+	ID           string              `json:"id"`
+	Username     string              `json:"username"`
+	Subscription *SubscriptionRecord `json:"subscription,omitempty"`
+	InOverage    bool                `json:"in_overage"`
+}
+
+// UserList is the response body for user listings. Total is the number of users who match the filters, regardless
+// of the limit and offset.
+type UserList struct {
+	Users  []UserListEntry `json:"users"`
+	Total  int             `json:"total"`
+	Limit  uint            `json:"limit"`
+	Offset uint            `json:"offset"`
+}
+
+// maxUserListLimit is the maximum number of users in a user listing.
+const maxUserListLimit = 1000
+
+// ListUsers lists the users who match a filter, ordered by username, along with a summary of each user's active
+// subscription. Whether a user is in overage is determined in the same way as for the overages endpoints, so grace
+// periods and group quotas are taken into account. The limit is capped at maxUserListLimit, and a limit of zero
+// selects the maximum.
+func (a *App) ListUsers(ctx context.Context, filter *db.UserFilter, limit, offset uint) (*UserList, error) {
+	d := a.db
+
+	if limit == 0 || limit > maxUserListLimit {
+		limit = maxUserListLimit
+	}
+
+	// Usernames are stored in their normalized form, so the prefix has to be normalized in the same way.
+	filter.UsernamePrefix = a.Usernames.fold(filter.UsernamePrefix)
+
+	overaged, err := a.usersInOverage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	filter.InOverageUserIDs = slices.Sorted(maps.Keys(overaged))
+
+	users, err := d.ListUsers(ctx, filter, db.WithQueryLimit(limit), db.WithQueryOffset(offset))
+	if err != nil {
+		return nil, err
+	}
+	total, err := d.CountUsers(ctx, filter)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	entries := make([]UserListEntry, len(users))
+	for i, user := range users {
+		entries[i] = UserListEntry{ID: user.ID, Username: user.Username, InOverage: overaged[user.ID]}
+		if user.Subscription != nil {
+			entries[i].Subscription = newSubscriptionRecord(user.Subscription, now)
+		}
+	}
+
+	return &UserList{Users: entries, Total: total, Limit: limit, Offset: offset}, nil
+}
+
+// ListUsersHTTPHandler lists users. The results can be filtered by username prefix, plan name, whether the active
+// subscription was paid for, when it expires and whether the user is in overage.
+func (a *App) ListUsersHTTPHandler(c echo.Context) error {
+	var err error
+
+	filter := &db.UserFilter{
+		UsernamePrefix: c.QueryParam("prefix"),
+		PlanName:       c.QueryParam("plan"),
+	}
+
+	if filter.Paid, err = boolQueryParam(c, "paid"); err != nil {
+		return err
+	}
+	if filter.InOverage, err = boolQueryParam(c, "in_overage"); err != nil {
+		return err
+	}
+	if v := c.QueryParam("expires_after"); v != "" {
+		if filter.ExpiresAfter, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+	if v := c.QueryParam("expires_before"); v != "" {
+		if filter.ExpiresBefore, err = utils.ParseTimestamp(v); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+	}
+
+	limit, err := uintQueryParam(c, "limit", 100)
+	if err != nil {
+		return err
+	}
+	offset, err := uintQueryParam(c, "offset", 0)
+	if err != nil {
+		return err
+	}
+
+	response, err := a.ListUsers(c.Request().Context(), filter, limit, offset)
+	if err != nil {
+		return err
+	}
+	return c.JSON(http.StatusOK, response)
+}
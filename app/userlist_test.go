@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/db"
+)
+
+func TestListUsers(t *testing.T) {
+	ctx := context.Background()
+	a, m := newTestApp(t, nil)
+	addTestPlan(t, m, "Team", 1000, 5e12)
+
+	// Every user starts on the default plan, which has a CPU hours quota of 20.
+	usages := map[string]float64{"sarahr": 25, "jdoe": 25, "alice": 5}
+	for username, usage := range usages {
+		subscribeTestUser(t, a, username)
+		request := testUpdate(username, db.UsagesTrackedMetric, "cpu.hours", db.UpdateTypeAdd, usage)
+		if response := a.addUserUpdate(ctx, request); response.Error != nil {
+			t.Fatalf("unable to record the usage of %s: %s", username, response.Error.Message)
+		}
+	}
+	if _, err := m.EnsureUser(ctx, "bob"); err != nil {
+		t.Fatalf("unable to add a user without a subscription: %s", err)
+	}
+
+	// The pooled quota of jdoe's group hasn't been used up, so jdoe isn't in overage.
+	if _, err := a.AddGroup(ctx, &GroupRequest{Name: "lab"}); err != nil {
+		t.Fatalf("unable to add the group: %s", err)
+	}
+	if _, err := a.SubscribeGroup(ctx, "lab", &GroupSubscriptionRequest{PlanName: "Team"}); err != nil {
+		t.Fatalf("unable to subscribe the group: %s", err)
+	}
+	if _, err := a.AddGroupMember(ctx, "lab", "jdoe"); err != nil {
+		t.Fatalf("unable to add the group member: %s", err)
+	}
+
+	inOverage, notInOverage := true, false
+	tests := []struct {
+		name      string
+		filter    db.UserFilter
+		limit     uint
+		want      []string
+		wantLimit uint
+	}{
+		{name: "all users", limit: 10, want: []string{"alice", "bob", "jdoe", "sarahr"}, wantLimit: 10},
+		{name: "limit", limit: 2, want: []string{"alice", "bob"}, wantLimit: 2},
+		{name: "no limit", want: []string{"alice", "bob", "jdoe", "sarahr"}, wantLimit: maxUserListLimit},
+		{
+			name:      "limit above the maximum",
+			limit:     maxUserListLimit + 1,
+			want:      []string{"alice", "bob", "jdoe", "sarahr"},
+			wantLimit: maxUserListLimit,
+		},
+		{name: "in overage", filter: db.UserFilter{InOverage: &inOverage}, want: []string{"sarahr"}},
+		{
+			name:   "not in overage",
+			filter: db.UserFilter{InOverage: &notInOverage},
+			want:   []string{"alice", "bob", "jdoe"},
+		},
+		{name: "plan", filter: db.UserFilter{PlanName: db.DefaultPlanName}, want: []string{"alice", "jdoe", "sarahr"}},
+		{name: "prefix", filter: db.UserFilter{UsernamePrefix: "SA"}, want: []string{"sarahr"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			filter := tt.filter
+			list, err := a.ListUsers(ctx, &filter, tt.limit, 0)
+			if err != nil {
+				t.Fatalf("unable to list the users: %s", err)
+			}
+
+			if tt.wantLimit != 0 && list.Limit != tt.wantLimit {
+				t.Errorf("limit = %d, want %d", list.Limit, tt.wantLimit)
+			}
+			if len(list.Users) != len(tt.want) {
+				t.Fatalf("got %d users, want %d", len(list.Users), len(tt.want))
+			}
+			for i, user := range list.Users {
+				if user.Username != tt.want[i] {
+					t.Errorf("user %d = %q, want %q", i, user.Username, tt.want[i])
+				}
+				if user.InOverage != (user.Username == "sarahr") {
+					t.Errorf("%s in overage = %t", user.Username, user.InOverage)
+				}
+				if hasSubscription := user.Subscription != nil; hasSubscription != (user.Username != "bob") {
+					t.Errorf("%s has a subscription = %t", user.Username, hasSubscription)
+				} else if hasSubscription && user.Subscription.PlanName != db.DefaultPlanName {
+					t.Errorf("%s plan = %q, want %q", user.Username, user.Subscription.PlanName, db.DefaultPlanName)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package app
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+// UsernameSettings determine how the usernames in requests are normalized before they're used to look up users, so
+// that different spellings of the same username resolve to the same user.
+type UsernameSettings struct {
+	// Domain is the domain that usernames may be qualified with, for example iplantcollaborative.org. The domain is
+	// removed from usernames that include it, and usernames qualified with any other domain are rejected. Any domain
+	// is removed if this is blank.
+	Domain string
+
+	// CaseFold indicates whether usernames are converted to lower case.
+	CaseFold bool
+
+	// Allowed matches the usernames that are accepted once the domain has been removed, the case has been folded
+	// and aliases have been resolved. All usernames are accepted if it's nil.
+	Allowed *regexp.Regexp
+
+	// Aliases maps alternative usernames to the usernames that they stand for. The keys are compared after the
+	// domain has been removed and the case has been folded.
+	Aliases map[string]string
+}
+
+// DefaultUsernameSettings returns the settings used when no pattern or aliases are configured: usernames qualified
+// with the given domain are accepted and folded to lower case if caseFold is true. No pattern is set, so any
+// username that isn't blank is accepted, as it was before usernames were validated. Deployments that need stricter
+// rules can set Allowed.
+func DefaultUsernameSettings(domain string, caseFold bool) *UsernameSettings {
+	return &UsernameSettings{
+		Domain:   strings.Trim(domain, "@"),
+		CaseFold: caseFold,
+		Aliases:  make(map[string]string),
+	}
+}
+
+// AddAlias records an alias for a username. Both usernames are folded to lower case if case folding is enabled.
+func (s *UsernameSettings) AddAlias(alias, username string) {
+	if s.Aliases == nil {
+		s.Aliases = make(map[string]string)
+	}
+	s.Aliases[s.fold(strings.TrimSpace(alias))] = s.fold(strings.TrimSpace(username))
+}
+
+// fold converts a username to lower case if case folding is enabled.
+func (s *UsernameSettings) fold(username string) string {
+	if s.CaseFold {
+		return strings.ToLower(username)
+	}
+	return username
+}
+
+// Normalize returns the canonical form of a username. An ErrInvalidUsername error is returned if the username is
+// blank, is qualified with a domain other than the configured one or contains characters that aren't allowed.
+func (s *UsernameSettings) Normalize(username string) (string, error) {
+	name := strings.TrimSpace(username)
+
+	if i := strings.Index(name, "@"); i >= 0 {
+		domain := name[i+1:]
+		if s.Domain != "" && !strings.EqualFold(domain, s.Domain) {
+			return "", errors.ErrInvalidUsername.WithField("username", username).WithField("domain", domain)
+		}
+		name = name[:i]
+	}
+
+	name = s.fold(name)
+	if canonical, ok := s.Aliases[name]; ok {
+		name = canonical
+	}
+
+	if name == "" || (s.Allowed != nil && !s.Allowed.MatchString(name)) {
+		return "", errors.ErrInvalidUsername.WithField("username", username)
+	}
+
+	return name, nil
+}
@@ -0,0 +1,55 @@
+package app
+
+import (
+	"regexp"
+	"testing"
+
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestNormalizeUsername(t *testing.T) {
+	tests := []struct {
+		name     string
+		caseFold bool
+		allowed  string
+		username string
+		want     string
+		wantErr  bool
+	}{
+		{name: "plain username", caseFold: true, username: "sarahr", want: "sarahr"},
+		{name: "qualified username", caseFold: true, username: "sarahr@" + testUserDomain, want: "sarahr"},
+		{name: "folded username", caseFold: true, username: "SarahR", want: "sarahr"},
+		{name: "username without folding", username: "SarahR", want: "SarahR"},
+		{name: "qualified username without folding", username: "SarahR@" + testUserDomain, want: "SarahR"},
+		{name: "other domain", caseFold: true, username: "sarahr@example.org", wantErr: true},
+		{name: "plus sign", caseFold: true, username: "sarah+test", want: "sarah+test"},
+		{name: "leading underscore", caseFold: true, username: "_sarahr", want: "_sarahr"},
+		{name: "allowed characters", caseFold: true, allowed: `^[a-z0-9][a-z0-9._-]*$`, username: "Sarah.R", want: "sarah.r"},
+		{name: "invalid characters", caseFold: true, allowed: `^[a-z0-9][a-z0-9._-]*$`, username: "sarah r", wantErr: true},
+		{name: "leading underscore not allowed", caseFold: true, allowed: `^[a-z0-9][a-z0-9._-]*$`, username: "_sarahr", wantErr: true},
+		{name: "invalid characters without folding", allowed: `^[A-Za-z0-9]+$`, username: "Sarah!", wantErr: true},
+		{name: "blank username", caseFold: true, username: " ", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := DefaultUsernameSettings(testUserDomain, tt.caseFold)
+			if tt.allowed != "" {
+				settings.Allowed = regexp.MustCompile(tt.allowed)
+			}
+			got, err := settings.Normalize(tt.username)
+			if tt.wantErr {
+				if !errors.Is(err, errors.ErrInvalidUsername) {
+					t.Errorf("error = %v, want %v", err, errors.ErrInvalidUsername)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got != tt.want {
+				t.Errorf("username = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
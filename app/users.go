@@ -3,64 +3,65 @@ package app
 import (
 	"context"
 	"net/http"
+	"time"
 
 	"github.com/cyverse-de/go-mod/pbinit"
 	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/subscriptions/common"
 	"github.com/cyverse-de/subscriptions/db"
 	"github.com/cyverse-de/subscriptions/errors"
+	"github.com/cyverse-de/subscriptions/metrics"
 	"github.com/cyverse-de/subscriptions/utils"
 	"github.com/labstack/echo/v4"
 	"github.com/sirupsen/logrus"
 )
 
-func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.AddUserResponse {
-	response := pbinit.NewQMSAddUserResponse()
-	username, err := a.FixUsername(request.Username)
-	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
-	}
+// userSubscription describes the outcome of subscribing a user to a plan.
+type userSubscription struct {
+	UserID string
+	Plan   *db.Plan
 
-	d := db.New(a.db)
+	// SubscriptionID is the ID of the new subscription. It's blank if the user was already subscribed to the plan.
+	SubscriptionID string
 
-	opts, err := utils.OptsForValues(request.Paid, request.Periods, request.EndDate)
-	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
-	}
-	log = log.WithFields(
-		logrus.Fields{
-			"user":     username,
-			"plan":     request.PlanName,
-			"paid":     opts.Paid,
-			"periods":  opts.Periods,
-			"end_date": opts.EndDate,
-		},
-	)
+	// Scheduled is true if the new subscription starts in the future.
+	Scheduled bool
+}
 
-	tx, err := d.Begin()
-	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
+// countNewSubscription records a new subscription in the metrics. Scheduled subscriptions are counted when they're
+// activated instead.
+func (s *userSubscription) countNewSubscription() {
+	if s.SubscriptionID != "" && !s.Scheduled {
+		metrics.SubscriptionsCreated.WithLabelValues(s.Plan.Name, metrics.SubscriptionKindUser).Inc()
 	}
-	defer func() {
-		_ = tx.Rollback()
-	}()
+}
 
+// subscribeUserInTx adds a user if necessary and subscribes the user to a plan within the given transaction. A new
+// subscription is only created if the caller forces it, schedules it to start later, or if the user doesn't already
+// have an active subscription to the plan. The transaction isn't committed.
+func (a *App) subscribeUserInTx(
+	ctx context.Context,
+	d db.Repository,
+	tx db.Tx,
+	username string,
+	request *qms.AddUserRequest,
+	opts *db.SubscriptionOptions,
+) (*userSubscription, error) {
 	// extract information about the subscription from the request
 	planName := request.PlanName
 
 	plan, err := d.GetPlanByName(ctx, planName, db.WithTX(tx))
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
+		return nil, err
+	}
+	if plan == nil {
+		return nil, errors.ErrPlanNotFound.WithField("name", planName)
 	}
 
 	// look for an existing user.
 	userExists, err := d.UserExists(ctx, username, db.WithTX(tx))
 	if err != nil {
-		response.Error = errors.NatsError(ctx, err)
-		return response
+		return nil, err
 	}
 
 	var userID string
@@ -69,26 +70,25 @@ func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.Add
 	if !userExists {
 		userID, err = d.AddUser(ctx, username, db.WithTX(tx))
 		if err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+			return nil, err
 		}
 	} else {
 		userID, err = d.GetUserID(ctx, username, db.WithTX(tx))
 		if err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+			return nil, err
 		}
 	}
 
-	// Create a new subscription if the caller requested it.
-	createSubscription := request.Force
+	result := &userSubscription{UserID: userID, Plan: plan}
+
+	// Create a new subscription if the caller requested it or scheduled the subscription to start later.
+	createSubscription := request.Force || !opts.StartDate.IsZero()
 
 	// Also create a new subscription if the user doesn't have one yet.
 	if !createSubscription {
 		hasPlan, err := d.UserHasActivePlan(ctx, username, db.WithTX(tx))
 		if err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+			return nil, err
 		}
 		createSubscription = !hasPlan
 	}
@@ -97,30 +97,81 @@ func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest) *qms.Add
 	if !createSubscription {
 		onPlan, err := d.UserOnPlan(ctx, username, plan.Name, db.WithTX(tx))
 		if err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+			return nil, err
 		}
 		createSubscription = !onPlan
 	}
 
 	// Create the subscription if we're supposed to.
 	if createSubscription {
-		if _, err = d.SetActiveSubscription(ctx, userID, plan, opts, db.WithTX(tx)); err != nil {
-			response.Error = errors.NatsError(ctx, err)
-			return response
+		result.SubscriptionID, err = d.SetActiveSubscription(ctx, userID, plan, opts, db.WithTX(tx), actorOpt(ctx))
+		if err != nil {
+			return nil, err
 		}
+		result.Scheduled = opts.Scheduled(time.Now())
+		if err = a.auditNewSubscription(ctx, d, tx, result.SubscriptionID); err != nil {
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+// addUser adds a user if necessary and subscribes the user to a plan. The subscription starts immediately unless a
+// start date is given, in which case it's scheduled to start on that date and the user's current subscription
+// remains in effect until then.
+func (a *App) addUser(ctx context.Context, request *qms.AddUserRequest, startDate string) *qms.AddUserResponse {
+	response := pbinit.NewQMSAddUserResponse()
+	username, err := a.FixUsername(request.Username)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+
+	d := a.db
+
+	opts, err := utils.ScheduledOptsForValues(request.Paid, request.Periods, startDate, request.EndDate)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+	log = log.WithFields(
+		logrus.Fields{
+			"user":       username,
+			"plan":       request.PlanName,
+			"paid":       opts.Paid,
+			"periods":    opts.Periods,
+			"start_date": opts.StartDate,
+			"end_date":   opts.EndDate,
+		},
+	)
+
+	tx, err := d.Begin()
+	if err != nil {
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	result, err := a.subscribeUserInTx(ctx, d, tx, username, request, opts)
+	if err != nil {
+		response.Error = errors.NatsError(ctx, response.Header, err)
+		return response
 	}
 
 	// Commit all of the changes
 	if err = tx.Commit(); err != nil {
-		response.Error = errors.NatsError(ctx, err)
+		response.Error = errors.NatsError(ctx, response.Header, err)
 		return response
 	}
+	result.countNewSubscription()
 
-	response.PlanName = plan.Name
-	response.PlanUuid = plan.ID
+	response.PlanName = result.Plan.Name
+	response.PlanUuid = result.Plan.ID
 	response.Username = username
-	response.Uuid = userID
+	response.Uuid = result.UserID
 
 	return response
 }
@@ -132,8 +183,10 @@ func (a *App) AddUserHandler(subject, reply string, request *qms.AddUserRequest)
 
 	ctx, span := pbinit.InitQMSAddUserRequest(request, subject)
 	defer span.End()
+	ctx = common.WithActor(ctx, common.ActorFromHeader(request.Header))
 
-	response := a.addUser(ctx, request)
+	// The request type doesn't have a start date field, so scheduled subscriptions pass it in the header.
+	response := a.addUser(ctx, request, common.HeaderValue(request.Header, common.StartDateHeaderKey))
 
 	if response.Error != nil {
 		log.Error(response.Error.Message)
@@ -158,9 +211,12 @@ func (a *App) AddUserHTTPHandler(c echo.Context) error {
 		})
 	}
 
-	request.Username = c.Param("username")
+	// The legacy route doesn't include the username in the path, so it has to come from the request body.
+	if username := c.Param("username"); username != "" {
+		request.Username = username
+	}
 
-	response := a.addUser(ctx, &request)
+	response := a.addUser(ctx, &request, c.QueryParam("start_date"))
 
 	if response.Error != nil {
 		return c.JSON(int(response.Error.StatusCode), response)
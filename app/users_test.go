@@ -0,0 +1,95 @@
+package app
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
+)
+
+func TestAddUser(t *testing.T) {
+	tests := []struct {
+		name       string
+		request    *qms.AddUserRequest
+		wantStatus int32
+		wantCode   svcerror.ErrorCode
+		wantFields map[string]string
+	}{
+		{
+			name:    "default plan",
+			request: &qms.AddUserRequest{Username: "sarahr", PlanName: db.DefaultPlanName},
+		},
+		{
+			name:       "unknown plan",
+			request:    &qms.AddUserRequest{Username: "sarahr", PlanName: "Missing"},
+			wantStatus: http.StatusNotFound,
+			wantCode:   svcerror.ErrorCode_NOT_FOUND,
+			wantFields: map[string]string{"name": "Missing"},
+		},
+		{
+			name:       "invalid username",
+			request:    &qms.AddUserRequest{PlanName: db.DefaultPlanName},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   svcerror.ErrorCode_BAD_REQUEST,
+		},
+		{
+			name:       "unparseable end date",
+			request:    &qms.AddUserRequest{Username: "sarahr", PlanName: db.DefaultPlanName, EndDate: "next year"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   svcerror.ErrorCode_BAD_REQUEST,
+			wantFields: map[string]string{"end_date": "next year"},
+		},
+		{
+			name:       "past end date",
+			request:    &qms.AddUserRequest{Username: "sarahr", PlanName: db.DefaultPlanName, EndDate: "2020-01-01"},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   svcerror.ErrorCode_BAD_REQUEST,
+			wantFields: map[string]string{"end_date": "2020-01-01"},
+		},
+		{
+			name:       "negative periods",
+			request:    &qms.AddUserRequest{Username: "sarahr", PlanName: db.DefaultPlanName, Periods: -1},
+			wantStatus: http.StatusBadRequest,
+			wantCode:   svcerror.ErrorCode_BAD_REQUEST,
+			wantFields: map[string]string{"periods": "-1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			a, _ := newTestApp(t, nil)
+
+			response := a.addUser(ctx, tt.request, "")
+			if tt.wantStatus == 0 {
+				if response.Error != nil {
+					t.Fatalf("unexpected error: %s", response.Error.Message)
+				}
+				if response.PlanName != tt.request.PlanName {
+					t.Errorf("plan = %q, want %q", response.PlanName, tt.request.PlanName)
+				}
+				return
+			}
+
+			if response.Error == nil {
+				t.Fatalf("expected an error with status %d", tt.wantStatus)
+			}
+			if response.Error.StatusCode != tt.wantStatus {
+				t.Errorf("status = %d, want %d", response.Error.StatusCode, tt.wantStatus)
+			}
+			if response.Error.ErrorCode != tt.wantCode {
+				t.Errorf("error code = %s, want %s", response.Error.ErrorCode, tt.wantCode)
+			}
+			for key, want := range tt.wantFields {
+				value := response.Header.GetMap()[errors.NatsErrorFieldPrefix+key].GetValue()
+				if len(value) != 1 || value[0] != want {
+					t.Errorf("header %s%s = %v, want %q", errors.NatsErrorFieldPrefix, key, value, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,272 @@
+package auth
+
+import (
+	"crypto"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/cyverse-de/subscriptions/common"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "auth"})
+
+const (
+	// DefaultUsernameClaim is the name of the token claim that contains the username if none is configured.
+	DefaultUsernameClaim = "preferred_username"
+
+	// DefaultRoleClaim is the path to the token claim that contains the user's roles if none is configured.
+	DefaultRoleClaim = "realm_access.roles"
+
+	// IdentityContextKey is the key used to store the caller's Identity in the echo context.
+	IdentityContextKey = "identity"
+)
+
+// Settings contains the configuration for token validation.
+type Settings struct {
+	// The path to a JWKS file containing the keys used to verify token signatures.
+	JWKSPath string
+
+	// The path to a PEM file containing a single key used to verify token signatures. This is only used if JWKSPath
+	// is empty.
+	KeyPath string
+
+	// The expected token issuer. The issuer isn't checked if this is empty.
+	Issuer string
+
+	// The expected token audience. The audience isn't checked if this is empty.
+	Audience string
+
+	// The name of the claim containing the username.
+	UsernameClaim string
+
+	// The dot-separated path to the claim containing the list of roles assigned to the user.
+	RoleClaim string
+
+	// The role required to call user-readable endpoints. Any authenticated user may call them if this is empty.
+	UserRole string
+
+	// The role required to call administrative endpoints.
+	AdminRole string
+}
+
+// Identity describes the caller identified by a validated token.
+type Identity struct {
+	Username string
+	Roles    []string
+}
+
+// HasRole returns true if the identity has been assigned the given role. Every identity has the empty role.
+func (i *Identity) HasRole(role string) bool {
+	if role == "" {
+		return true
+	}
+	for _, r := range i.Roles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator validates bearer tokens and determines whether the caller has the roles required by an endpoint.
+type Authenticator struct {
+	settings Settings
+	keys     map[string]crypto.PublicKey
+	parser   *jwt.Parser
+}
+
+// New creates an Authenticator using the given settings. The signature verification keys are loaded from either
+// the JWKS file or the PEM file named in the settings.
+func New(settings *Settings) (*Authenticator, error) {
+	var (
+		err  error
+		keys map[string]crypto.PublicKey
+	)
+
+	switch {
+	case settings.JWKSPath != "":
+		keys, err = loadJWKS(settings.JWKSPath)
+		if err != nil {
+			return nil, err
+		}
+	case settings.KeyPath != "":
+		key, err := loadPEMKey(settings.KeyPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = map[string]crypto.PublicKey{"": key}
+	default:
+		return nil, fmt.Errorf("either a JWKS file or a key file must be configured")
+	}
+
+	if settings.AdminRole == "" {
+		return nil, fmt.Errorf("the administrator role must be configured")
+	}
+
+	s := *settings
+	if s.UsernameClaim == "" {
+		s.UsernameClaim = DefaultUsernameClaim
+	}
+	if s.RoleClaim == "" {
+		s.RoleClaim = DefaultRoleClaim
+	}
+
+	parserOpts := []jwt.ParserOption{
+		jwt.WithValidMethods([]string{"RS256", "RS384", "RS512", "PS256", "PS384", "PS512", "ES256", "ES384", "ES512", "EdDSA"}),
+		jwt.WithExpirationRequired(),
+	}
+	if s.Issuer != "" {
+		parserOpts = append(parserOpts, jwt.WithIssuer(s.Issuer))
+	}
+	if s.Audience != "" {
+		parserOpts = append(parserOpts, jwt.WithAudience(s.Audience))
+	}
+
+	return &Authenticator{
+		settings: s,
+		keys:     keys,
+		parser:   jwt.NewParser(parserOpts...),
+	}, nil
+}
+
+// keyFunc selects the key used to verify the signature of a token.
+func (a *Authenticator) keyFunc(token *jwt.Token) (any, error) {
+	kid, _ := token.Header["kid"].(string)
+	if key, ok := a.keys[kid]; ok {
+		return key, nil
+	}
+
+	// A key loaded from a PEM file has no ID, so it's used regardless of the key ID in the token.
+	if key, ok := a.keys[""]; ok {
+		return key, nil
+	}
+
+	return nil, fmt.Errorf("unknown signing key: %q", kid)
+}
+
+// claimAtPath returns the value of a claim identified by a dot-separated path.
+func claimAtPath(claims jwt.MapClaims, path string) (any, bool) {
+	var current any = map[string]any(claims)
+	for _, component := range strings.Split(path, ".") {
+		m, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = m[component]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+// Authenticate validates a token and returns the identity of the caller.
+func (a *Authenticator) Authenticate(tokenString string) (*Identity, error) {
+	claims := jwt.MapClaims{}
+	if _, err := a.parser.ParseWithClaims(tokenString, claims, a.keyFunc); err != nil {
+		return nil, errors.Wrap(err, "invalid token")
+	}
+
+	value, _ := claimAtPath(claims, a.settings.UsernameClaim)
+	username, _ := value.(string)
+	if username == "" {
+		return nil, fmt.Errorf("the token does not contain the %s claim", a.settings.UsernameClaim)
+	}
+
+	var roles []string
+	if value, ok := claimAtPath(claims, a.settings.RoleClaim); ok {
+		switch v := value.(type) {
+		case []any:
+			for _, role := range v {
+				if s, ok := role.(string); ok {
+					roles = append(roles, s)
+				}
+			}
+		case string:
+			roles = strings.Fields(v)
+		}
+	}
+
+	return &Identity{Username: username, Roles: roles}, nil
+}
+
+// bearerToken extracts the bearer token from the Authorization header of a request.
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, found := strings.Cut(r.Header.Get(echo.HeaderAuthorization), " ")
+	if !found || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	token = strings.TrimSpace(token)
+	return token, token != ""
+}
+
+// hasAnyRole returns true if the identity has been assigned at least one of the given roles.
+func (i *Identity) hasAnyRole(roles ...string) bool {
+	for _, role := range roles {
+		if i.HasRole(role) {
+			return true
+		}
+	}
+	return false
+}
+
+// requireRole returns echo middleware that only allows requests containing a valid token for a user with at least
+// one of the given roles. The caller's identity is stored in the echo context and recorded as the actor in the
+// request context.
+func (a *Authenticator) requireRole(roles ...string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			token, found := bearerToken(c.Request())
+			if !found {
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer`)
+				return echo.NewHTTPError(http.StatusUnauthorized, "a bearer token is required")
+			}
+
+			identity, err := a.Authenticate(token)
+			if err != nil {
+				log.Debugf("rejected token: %s", err)
+				c.Response().Header().Set(echo.HeaderWWWAuthenticate, `Bearer error="invalid_token"`)
+				return echo.NewHTTPError(http.StatusUnauthorized, "invalid bearer token")
+			}
+
+			if !identity.hasAnyRole(roles...) {
+				return echo.NewHTTPError(http.StatusForbidden, "insufficient privileges")
+			}
+
+			c.Set(IdentityContextKey, identity)
+			r := c.Request()
+			c.SetRequest(r.WithContext(common.WithActor(r.Context(), identity.Username)))
+
+			return next(c)
+		}
+	}
+}
+
+// IsAdmin returns true if the identity has been assigned the administrator role.
+func (a *Authenticator) IsAdmin(identity *Identity) bool {
+	return identity.HasRole(a.settings.AdminRole)
+}
+
+// IdentityFromContext returns the identity of the caller stored in the echo context by the authentication middleware,
+// or nil if the request wasn't authenticated.
+func IdentityFromContext(c echo.Context) *Identity {
+	identity, _ := c.Get(IdentityContextKey).(*Identity)
+	return identity
+}
+
+// UserMiddleware returns echo middleware for endpoints that may be called by any user. Administrators may call
+// these endpoints even if they haven't been assigned the user role.
+func (a *Authenticator) UserMiddleware() echo.MiddlewareFunc {
+	return a.requireRole(a.settings.UserRole, a.settings.AdminRole)
+}
+
+// AdminMiddleware returns echo middleware for endpoints that may only be called by administrators.
+func (a *Authenticator) AdminMiddleware() echo.MiddlewareFunc {
+	return a.requireRole(a.settings.AdminRole)
+}
@@ -0,0 +1,344 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	testIssuer    = "https://keycloak.example.org/realms/test"
+	testAudience  = "subscriptions"
+	testUserRole  = "de-users"
+	testAdminRole = "de-admins"
+)
+
+// testSigner signs tokens with a locally generated key.
+type testSigner struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.Signer
+}
+
+func newRSASigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("unable to generate an RSA key: %s", err)
+	}
+	return &testSigner{kid: kid, method: jwt.SigningMethodRS256, key: key}
+}
+
+func newECSigner(t *testing.T, kid string) *testSigner {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("unable to generate an EC key: %s", err)
+	}
+	return &testSigner{kid: kid, method: jwt.SigningMethodES256, key: key}
+}
+
+// encodeBigInt encodes an integer as a base64url encoded big-endian value padded to the given number of bytes.
+func encodeBigInt(value *big.Int, size int) string {
+	return base64.RawURLEncoding.EncodeToString(value.FillBytes(make([]byte, size)))
+}
+
+// jwk returns the JSON Web Key describing the public half of the signer's key.
+func (s *testSigner) jwk() map[string]string {
+	switch key := s.key.Public().(type) {
+	case *rsa.PublicKey:
+		return map[string]string{
+			"kid": s.kid,
+			"kty": "RSA",
+			"use": "sig",
+			"n":   encodeBigInt(key.N, (key.N.BitLen()+7)/8),
+			"e":   encodeBigInt(big.NewInt(int64(key.E)), 3),
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		return map[string]string{
+			"kid": s.kid,
+			"kty": "EC",
+			"crv": key.Curve.Params().Name,
+			"x":   encodeBigInt(key.X, size),
+			"y":   encodeBigInt(key.Y, size),
+		}
+	default:
+		panic("unsupported key type")
+	}
+}
+
+// sign returns a signed token containing the given claims.
+func (s *testSigner) sign(t *testing.T, claims jwt.MapClaims) string {
+	t.Helper()
+	token := jwt.NewWithClaims(s.method, claims)
+	token.Header["kid"] = s.kid
+	signed, err := token.SignedString(s.key)
+	if err != nil {
+		t.Fatalf("unable to sign the token: %s", err)
+	}
+	return signed
+}
+
+// writeJWKS writes a JWKS file containing the public keys of the signers and returns its path.
+func writeJWKS(t *testing.T, signers ...*testSigner) string {
+	t.Helper()
+	keys := make([]map[string]string, len(signers))
+	for i, s := range signers {
+		keys[i] = s.jwk()
+	}
+	contents, err := json.Marshal(map[string]any{"keys": keys})
+	if err != nil {
+		t.Fatalf("unable to encode the JWKS: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err = os.WriteFile(path, contents, 0o600); err != nil {
+		t.Fatalf("unable to write the JWKS file: %s", err)
+	}
+	return path
+}
+
+// claims returns valid claims for a user with the given roles. Each modifier can change the claims before they're
+// returned.
+func claims(username string, roles []string, modifiers ...func(jwt.MapClaims)) jwt.MapClaims {
+	roleValues := make([]any, len(roles))
+	for i, role := range roles {
+		roleValues[i] = role
+	}
+	c := jwt.MapClaims{
+		"iss":                testIssuer,
+		"aud":                testAudience,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"preferred_username": username,
+		"realm_access":       map[string]any{"roles": roleValues},
+	}
+	for _, modify := range modifiers {
+		modify(c)
+	}
+	return c
+}
+
+func newTestAuthenticator(t *testing.T, settings Settings) *Authenticator {
+	t.Helper()
+	authenticator, err := New(&settings)
+	if err != nil {
+		t.Fatalf("unable to create the authenticator: %s", err)
+	}
+	return authenticator
+}
+
+func TestAuthenticate(t *testing.T) {
+	rsaSigner := newRSASigner(t, "rsa-key")
+	ecSigner := newECSigner(t, "ec-key")
+	unknownSigner := newRSASigner(t, "rsa-key")
+
+	authenticator := newTestAuthenticator(t, Settings{
+		JWKSPath:  writeJWKS(t, rsaSigner, ecSigner),
+		Issuer:    testIssuer,
+		Audience:  testAudience,
+		UserRole:  testUserRole,
+		AdminRole: testAdminRole,
+	})
+
+	tests := []struct {
+		name     string
+		token    string
+		wantErr  bool
+		username string
+		roles    []string
+	}{
+		{
+			name:     "valid RSA token",
+			token:    rsaSigner.sign(t, claims("sarahr", []string{testUserRole})),
+			username: "sarahr",
+			roles:    []string{testUserRole},
+		},
+		{
+			name:     "valid EC token",
+			token:    ecSigner.sign(t, claims("admin", []string{testUserRole, testAdminRole})),
+			username: "admin",
+			roles:    []string{testUserRole, testAdminRole},
+		},
+		{
+			name:     "token without roles",
+			token:    rsaSigner.sign(t, claims("sarahr", nil)),
+			username: "sarahr",
+		},
+		{
+			name: "expired token",
+			token: rsaSigner.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+				c["exp"] = time.Now().Add(-time.Minute).Unix()
+			})),
+			wantErr: true,
+		},
+		{
+			name: "token without an expiration time",
+			token: rsaSigner.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+				delete(c, "exp")
+			})),
+			wantErr: true,
+		},
+		{
+			name: "wrong issuer",
+			token: rsaSigner.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+				c["iss"] = "https://keycloak.example.org/realms/other"
+			})),
+			wantErr: true,
+		},
+		{
+			name: "wrong audience",
+			token: ecSigner.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+				c["aud"] = "another-service"
+			})),
+			wantErr: true,
+		},
+		{
+			name: "missing username",
+			token: rsaSigner.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+				delete(c, "preferred_username")
+			})),
+			wantErr: true,
+		},
+		{
+			name:    "signed by an untrusted key",
+			token:   unknownSigner.sign(t, claims("sarahr", []string{testUserRole})),
+			wantErr: true,
+		},
+		{
+			name:    "malformed token",
+			token:   "not-a-token",
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			identity, err := authenticator.Authenticate(tt.token)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got identity %+v", identity)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if identity.Username != tt.username {
+				t.Errorf("username = %q, want %q", identity.Username, tt.username)
+			}
+			if len(identity.Roles) != len(tt.roles) {
+				t.Fatalf("roles = %v, want %v", identity.Roles, tt.roles)
+			}
+			for i := range tt.roles {
+				if identity.Roles[i] != tt.roles[i] {
+					t.Errorf("roles = %v, want %v", identity.Roles, tt.roles)
+				}
+			}
+		})
+	}
+}
+
+func TestAuthenticateWithPEMKey(t *testing.T) {
+	signer := newECSigner(t, "")
+
+	der, err := x509.MarshalPKIXPublicKey(signer.key.Public())
+	if err != nil {
+		t.Fatalf("unable to encode the public key: %s", err)
+	}
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err = os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatalf("unable to write the key file: %s", err)
+	}
+
+	authenticator := newTestAuthenticator(t, Settings{KeyPath: path, AdminRole: testAdminRole})
+
+	identity, err := authenticator.Authenticate(signer.sign(t, claims("sarahr", []string{testUserRole})))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if identity.Username != "sarahr" {
+		t.Errorf("username = %q, want %q", identity.Username, "sarahr")
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	signer := newRSASigner(t, "rsa-key")
+	authenticator := newTestAuthenticator(t, Settings{
+		JWKSPath:  writeJWKS(t, signer),
+		Issuer:    testIssuer,
+		Audience:  testAudience,
+		UserRole:  testUserRole,
+		AdminRole: testAdminRole,
+	})
+
+	e := echo.New()
+	handler := func(c echo.Context) error {
+		identity := IdentityFromContext(c)
+		if identity == nil {
+			return c.String(http.StatusInternalServerError, "no identity")
+		}
+		return c.String(http.StatusOK, identity.Username)
+	}
+	e.GET("/user", handler, authenticator.UserMiddleware())
+	e.GET("/admin", handler, authenticator.AdminMiddleware())
+
+	userToken := signer.sign(t, claims("sarahr", []string{testUserRole}))
+	adminToken := signer.sign(t, claims("admin", []string{testAdminRole}))
+	noRoleToken := signer.sign(t, claims("guest", nil))
+	expiredToken := signer.sign(t, claims("sarahr", []string{testUserRole}, func(c jwt.MapClaims) {
+		c["exp"] = time.Now().Add(-time.Minute).Unix()
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{name: "user route without a token", path: "/user", want: http.StatusUnauthorized},
+		{name: "user route with another scheme", path: "/user", header: "Basic " + userToken, want: http.StatusUnauthorized},
+		{name: "user route with an expired token", path: "/user", header: "Bearer " + expiredToken, want: http.StatusUnauthorized},
+		{name: "user route with the user role", path: "/user", header: "Bearer " + userToken, want: http.StatusOK},
+		{name: "user route with the admin role", path: "/user", header: "Bearer " + adminToken, want: http.StatusOK},
+		{name: "user route without a role", path: "/user", header: "Bearer " + noRoleToken, want: http.StatusForbidden},
+		{name: "admin route without a token", path: "/admin", want: http.StatusUnauthorized},
+		{name: "admin route with the user role", path: "/admin", header: "Bearer " + userToken, want: http.StatusForbidden},
+		{name: "admin route with the admin role", path: "/admin", header: "Bearer " + adminToken, want: http.StatusOK},
+		{name: "admin route without a role", path: "/admin", header: "Bearer " + noRoleToken, want: http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set(echo.HeaderAuthorization, tt.header)
+			}
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			if rec.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.want, rec.Body.String())
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get(echo.HeaderWWWAuthenticate) == "" {
+				t.Error("the WWW-Authenticate header wasn't set")
+			}
+		})
+	}
+}
@@ -0,0 +1,169 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// jsonWebKey contains the fields of a JSON Web Key that are needed to verify token signatures.
+type jsonWebKey struct {
+	KeyID string `json:"kid"`
+	Type  string `json:"kty"`
+	Use   string `json:"use"`
+	Curve string `json:"crv"`
+	N     string `json:"n"`
+	E     string `json:"e"`
+	X     string `json:"x"`
+	Y     string `json:"y"`
+}
+
+// jsonWebKeySet is a set of JSON Web Keys as described in RFC 7517.
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// decodeSegment decodes a base64url encoded value from a JSON Web Key.
+func decodeSegment(value string) ([]byte, error) {
+	return base64.RawURLEncoding.DecodeString(value)
+}
+
+// decodeBigInt decodes a base64url encoded big-endian integer from a JSON Web Key.
+func decodeBigInt(value string) (*big.Int, error) {
+	bytes, err := decodeSegment(value)
+	if err != nil {
+		return nil, err
+	}
+	return new(big.Int).SetBytes(bytes), nil
+}
+
+// publicKey converts a JSON Web Key to a public key that can be used to verify token signatures.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Type {
+	case "RSA":
+		n, err := decodeBigInt(k.N)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid modulus in key %s", k.KeyID)
+		}
+		e, err := decodeBigInt(k.E)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid exponent in key %s", k.KeyID)
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Curve {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		case "P-521":
+			curve = elliptic.P521()
+		default:
+			return nil, fmt.Errorf("unsupported curve in key %s: %s", k.KeyID, k.Curve)
+		}
+		x, err := decodeBigInt(k.X)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid x coordinate in key %s", k.KeyID)
+		}
+		y, err := decodeBigInt(k.Y)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid y coordinate in key %s", k.KeyID)
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+
+	case "OKP":
+		if k.Curve != "Ed25519" {
+			return nil, fmt.Errorf("unsupported curve in key %s: %s", k.KeyID, k.Curve)
+		}
+		x, err := decodeSegment(k.X)
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid public key in key %s", k.KeyID)
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return nil, fmt.Errorf("invalid public key size in key %s", k.KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+
+	default:
+		return nil, fmt.Errorf("unsupported key type in key %s: %s", k.KeyID, k.Type)
+	}
+}
+
+// loadJWKS loads the signature verification keys from a JWKS file. Keys that are marked for uses other than
+// signature verification are skipped.
+func loadJWKS(path string) (map[string]crypto.PublicKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the JWKS file %s", path)
+	}
+
+	var keySet jsonWebKeySet
+	if err = json.Unmarshal(contents, &keySet); err != nil {
+		return nil, errors.Wrapf(err, "unable to parse the JWKS file %s", path)
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range keySet.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.publicKey()
+		if err != nil {
+			return nil, err
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no signature verification keys found in %s", path)
+	}
+
+	return keys, nil
+}
+
+// loadPEMKey loads a signature verification key from a PEM file containing either a public key or a certificate.
+func loadPEMKey(path string) (crypto.PublicKey, error) {
+	contents, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to read the key file %s", path)
+	}
+
+	block, _ := pem.Decode(contents)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM data found in %s", path)
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse the certificate in %s", path)
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse the public key in %s", path)
+		}
+		return key, nil
+	default:
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to parse the public key in %s", path)
+		}
+		return key, nil
+	}
+}
@@ -0,0 +1,174 @@
+package auth
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/common"
+	"github.com/nats-io/nats.go"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Responder sends responses to NATS requests.
+type Responder interface {
+	Respond(ctx context.Context, replySubject string, response gotelnats.DEResponse) error
+}
+
+// ResponseFactory returns an empty instance of the response type used by the handler for a subject.
+type ResponseFactory func() gotelnats.DEResponse
+
+// SubjectPolicy determines which callers may send requests to each NATS subject. Callers are identified by the
+// username in the request header, and each restricted subject lists the roles that may call it. Subjects without
+// any listed roles may be called by anyone.
+type SubjectPolicy struct {
+	subjectRoles map[string][]string
+	roleMembers  map[string]map[string]bool
+}
+
+// NewSubjectPolicy returns a policy that doesn't restrict any subjects.
+func NewSubjectPolicy() *SubjectPolicy {
+	return &SubjectPolicy{
+		subjectRoles: make(map[string][]string),
+		roleMembers:  make(map[string]map[string]bool),
+	}
+}
+
+// AddRoleMembers assigns a role to each of the given users.
+func (p *SubjectPolicy) AddRoleMembers(role string, usernames ...string) {
+	members, ok := p.roleMembers[role]
+	if !ok {
+		members = make(map[string]bool)
+		p.roleMembers[role] = members
+	}
+	for _, username := range usernames {
+		members[username] = true
+	}
+}
+
+// RequireRoles restricts a subject to callers with at least one of the given roles, replacing any roles that were
+// previously required for the subject. Passing no roles removes the restriction.
+func (p *SubjectPolicy) RequireRoles(subject string, roles ...string) {
+	if len(roles) == 0 {
+		delete(p.subjectRoles, subject)
+		return
+	}
+	p.subjectRoles[subject] = roles
+}
+
+// Allowed returns true if the given user may send requests to a subject.
+func (p *SubjectPolicy) Allowed(subject, username string) bool {
+	roles, restricted := p.subjectRoles[subject]
+	if !restricted {
+		return true
+	}
+	if username == "" {
+		return false
+	}
+	for _, role := range roles {
+		if p.roleMembers[role][username] {
+			return true
+		}
+	}
+	return false
+}
+
+// Wrap returns a NATS handler that only passes requests to the given handler if the caller is allowed to send
+// requests to the subject. Rejected requests receive a FORBIDDEN error in a response created by newResponse, so that
+// callers can decode it the same way as any other response from the subject. The handler must have the signature
+// func(subject, reply string, request R), where R implements gotelnats.DERequest.
+//
+//nolint:staticcheck
+func (p *SubjectPolicy) Wrap(
+	subject string,
+	handler nats.Handler,
+	newResponse ResponseFactory,
+	responder Responder,
+) (nats.Handler, error) {
+	handlerValue := reflect.ValueOf(handler)
+	handlerType := handlerValue.Type()
+
+	requestType := reflect.TypeOf((*gotelnats.DERequest)(nil)).Elem()
+	if handlerType.Kind() != reflect.Func || handlerType.NumIn() != 3 || !handlerType.In(2).Implements(requestType) {
+		return nil, fmt.Errorf("unsupported handler type for subject %s: %s", subject, handlerType)
+	}
+	if newResponse == nil {
+		return nil, fmt.Errorf("no response type was provided for subject %s", subject)
+	}
+
+	// Subjects without restrictions don't need to be wrapped.
+	if _, restricted := p.subjectRoles[subject]; !restricted {
+		return handler, nil
+	}
+
+	wrapped := reflect.MakeFunc(handlerType, func(args []reflect.Value) []reflect.Value {
+		msgSubject := args[0].String()
+		reply := args[1].String()
+
+		var requestHeader *header.Header
+		if args[2].Kind() != reflect.Pointer || !args[2].IsNil() {
+			requestHeader = args[2].Interface().(gotelnats.DERequest).GetHeader()
+		}
+		if requestHeader == nil {
+			requestHeader = gotelnats.NewHeader()
+		}
+
+		username := common.ActorFromHeader(requestHeader)
+		if p.Allowed(subject, username) {
+			return handlerValue.Call(args)
+		}
+
+		ctx, span := gotelnats.StartSpan(&gotelnats.PBTextMapCarrier{Header: requestHeader}, msgSubject, gotelnats.Process)
+		defer span.End()
+
+		rejectRequest(ctx, responder, newResponse(), msgSubject, reply, username)
+		return nil
+	})
+
+	return wrapped.Interface(), nil
+}
+
+// rejectRequest sends a FORBIDDEN error response to a caller who isn't allowed to send requests to a subject.
+func rejectRequest(
+	ctx context.Context,
+	responder Responder,
+	response gotelnats.DEResponse,
+	subject, reply, username string,
+) {
+	caller := username
+	if caller == "" {
+		caller = "anonymous caller"
+	}
+	log.Warnf("rejected request from %s to %s", caller, subject)
+
+	err := fmt.Errorf("%s is not allowed to send requests to %s", caller, subject)
+	serviceError := gotelnats.InitServiceError(ctx, err, &gotelnats.ErrorOptions{
+		ErrorCode:  svcerror.ErrorCode_FORBIDDEN,
+		StatusCode: http.StatusForbidden,
+	})
+
+	if err = setResponseError(response, serviceError); err != nil {
+		log.Error(err)
+		return
+	}
+	if err = responder.Respond(ctx, reply, response); err != nil {
+		log.Error(err)
+	}
+}
+
+// setResponseError stores a service error in the error field of a response. The generated response types don't share
+// a setter for the field, so it has to be set using protobuf reflection.
+func setResponseError(response gotelnats.DEResponse, serviceError *svcerror.ServiceError) error {
+	message := response.ProtoReflect()
+	field := message.Descriptor().Fields().ByName("error")
+	errorType := serviceError.ProtoReflect().Descriptor().FullName()
+	if field == nil || field.Message() == nil || field.Message().FullName() != errorType {
+		return fmt.Errorf("response type %s has no service error field", message.Descriptor().FullName())
+	}
+	message.Set(field, protoreflect.ValueOfMessage(serviceError.ProtoReflect()))
+	return nil
+}
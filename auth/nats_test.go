@@ -0,0 +1,103 @@
+package auth
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/cyverse-de/go-mod/gotelnats"
+	qmsinit "github.com/cyverse-de/go-mod/pbinit/qms"
+	"github.com/cyverse-de/p/go/header"
+	"github.com/cyverse-de/p/go/qms"
+	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/cyverse-de/subscriptions/common"
+)
+
+// recordingResponder keeps the responses that would have been sent to callers.
+type recordingResponder struct {
+	responses []gotelnats.DEResponse
+}
+
+func (r *recordingResponder) Respond(_ context.Context, _ string, response gotelnats.DEResponse) error {
+	r.responses = append(r.responses, response)
+	return nil
+}
+
+func addUserRequest(username string) *qms.AddUserRequest {
+	request := qmsinit.NewAddUserRequest()
+	if username != "" {
+		request.Header = &header.Header{
+			Map: map[string]*header.Header_Value{common.ActorHeaderKey: {Value: []string{username}}},
+		}
+	}
+	return request
+}
+
+func TestSubjectPolicyWrap(t *testing.T) {
+	const subject = "cyverse.qms.user.add"
+
+	policy := NewSubjectPolicy()
+	policy.RequireRoles(subject, "admin")
+	policy.AddRoleMembers("admin", "ipcdev")
+
+	tests := []struct {
+		name     string
+		username string
+		allowed  bool
+	}{
+		{name: "member of the required role", username: "ipcdev", allowed: true},
+		{name: "user without the required role", username: "sarahr"},
+		{name: "anonymous caller", username: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			called := false
+			handler := func(_, _ string, _ *qms.AddUserRequest) { called = true }
+
+			responder := &recordingResponder{}
+			wrapped, err := policy.Wrap(
+				subject,
+				handler,
+				func() gotelnats.DEResponse { return qmsinit.NewAddUserResponse() },
+				responder,
+			)
+			if err != nil {
+				t.Fatalf("unable to wrap the handler: %s", err)
+			}
+
+			wrapped.(func(string, string, *qms.AddUserRequest))(subject, "reply", addUserRequest(tt.username))
+
+			if called != tt.allowed {
+				t.Errorf("handler called = %t, want %t", called, tt.allowed)
+			}
+			if tt.allowed {
+				if len(responder.responses) != 0 {
+					t.Errorf("unexpected error responses: %v", responder.responses)
+				}
+				return
+			}
+
+			if len(responder.responses) != 1 {
+				t.Fatalf("got %d error responses, want 1", len(responder.responses))
+			}
+			response, ok := responder.responses[0].(*qms.AddUserResponse)
+			if !ok {
+				t.Fatalf("response type = %T, want *qms.AddUserResponse", responder.responses[0])
+			}
+			if response.Error.GetErrorCode() != svcerror.ErrorCode_FORBIDDEN {
+				t.Errorf("error code = %s, want %s", response.Error.GetErrorCode(), svcerror.ErrorCode_FORBIDDEN)
+			}
+			if response.Error.GetStatusCode() != http.StatusForbidden {
+				t.Errorf("status code = %d, want %d", response.Error.GetStatusCode(), http.StatusForbidden)
+			}
+		})
+	}
+}
+
+func TestSubjectPolicyWrapWithoutResponseType(t *testing.T) {
+	handler := func(_, _ string, _ *qms.AddUserRequest) {}
+	if _, err := NewSubjectPolicy().Wrap("cyverse.qms.user.add", handler, nil, &recordingResponder{}); err == nil {
+		t.Error("expected an error for a handler without a response type")
+	}
+}
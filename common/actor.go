@@ -0,0 +1,47 @@
+package common
+
+import (
+	"context"
+
+	"github.com/cyverse-de/p/go/header"
+)
+
+// ActorHeaderKey is the key in a NATS request header that contains the username of the user who sent the request.
+const ActorHeaderKey = "user"
+
+// StartDateHeaderKey is the key in a NATS request header that contains the date that a new subscription should start
+// on. The NATS request types don't have a start date field, so the start date is passed in the header instead.
+const StartDateHeaderKey = "start_date"
+
+type actorKey struct{}
+
+// WithActor returns a copy of the context that records the username of the user responsible for the current request.
+func WithActor(ctx context.Context, actor string) context.Context {
+	return context.WithValue(ctx, actorKey{}, actor)
+}
+
+// ActorFromContext returns the username of the user responsible for the current request, or an empty string if the
+// context doesn't identify a user.
+func ActorFromContext(ctx context.Context) string {
+	actor, _ := ctx.Value(actorKey{}).(string)
+	return actor
+}
+
+// ActorFromHeader extracts the username of the user who sent a NATS request from the request header. An empty string
+// is returned if the header doesn't identify a user.
+func ActorFromHeader(h *header.Header) string {
+	return HeaderValue(h, ActorHeaderKey)
+}
+
+// HeaderValue returns the first value stored under a key in a NATS request header, or an empty string if the header
+// doesn't contain the key.
+func HeaderValue(h *header.Header, key string) string {
+	if h == nil {
+		return ""
+	}
+	value, ok := h.GetMap()[key]
+	if !ok || len(value.GetValue()) == 0 {
+		return ""
+	}
+	return value.GetValue()[0]
+}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"context"
-	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
 	suberrors "github.com/cyverse-de/subscriptions/errors"
@@ -11,7 +10,10 @@ import (
 )
 
 func (d *Database) AddAddon(ctx context.Context, addon *Addon, opts ...QueryOption) (string, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	ds := db.Insert(t.Addons).Rows(
 		goqu.Record{
@@ -70,7 +72,10 @@ func (d *Database) GetAddonByID(ctx context.Context, addonID string, opts ...Que
 	var err error
 	var addonFound bool
 
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	addon := &Addon{}
 	addonInfo := addonDS(db).
@@ -81,7 +86,7 @@ func (d *Database) GetAddonByID(ctx context.Context, addonID string, opts ...Que
 	if err != nil {
 		return nil, errors.Wrap(err, "unable to get add-on info")
 	} else if !addonFound {
-		return nil, fmt.Errorf("addon ID %s not found", addonID)
+		return nil, suberrors.ErrAddonNotFound.WithField("addon_id", addonID)
 	}
 
 	addonRates, err := d.ListRatesForAddon(ctx, addonID, opts...)
@@ -95,7 +100,10 @@ func (d *Database) GetAddonByID(ctx context.Context, addonID string, opts ...Que
 
 func (d *Database) ListAddons(ctx context.Context, opts ...QueryOption) ([]Addon, error) {
 	wrapMsg := "unable to list addons"
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := db.From(t.Addons).
 		Select(
@@ -130,7 +138,10 @@ func (d *Database) ListAddons(ctx context.Context, opts ...QueryOption) ([]Addon
 }
 
 func (d *Database) ListRatesForAddon(ctx context.Context, addonID string, opts ...QueryOption) ([]AddonRate, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := db.From(t.AddonRates).
 		Select(
@@ -162,7 +173,10 @@ func (d *Database) ToggleAddonPaid(ctx context.Context, addonID string, opts ...
 
 	opts = append(opts, WithTX(tx))
 
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds1 := db.Update(t.Addons).
 		Set(goqu.Record{"default_paid": goqu.L("NOT default_paid")}).
@@ -207,7 +221,10 @@ func (d *Database) ToggleAddonPaid(ctx context.Context, addonID string, opts ...
 }
 
 func (d *Database) UpsertAddonRate(ctx context.Context, r AddonRate, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	// Create the addon record.
 	rec := r.ToRec()
@@ -224,7 +241,10 @@ func (d *Database) UpsertAddonRate(ctx context.Context, r AddonRate, opts ...Que
 }
 
 func (d *Database) UpdateAddonRates(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	// Delete any existing addon rates that aren't mentioned in the incoming request.
 	var addonRateIDs []string
@@ -257,7 +277,10 @@ func (d *Database) UpdateAddonRates(ctx context.Context, addonUpdateRecord *Upda
 }
 
 func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	rec := goqu.Record{}
 
@@ -315,14 +338,17 @@ func (d *Database) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAdd
 }
 
 func (d *Database) DeleteAddon(ctx context.Context, addonID string, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	ds := db.From(t.Addons).
 		Delete().
 		Where(t.Addons.Col("id").Eq(addonID)).
 		Executor()
 
-	_, err := ds.ExecContext(ctx)
+	_, err = ds.ExecContext(ctx)
 	return err
 }
 
@@ -355,7 +381,10 @@ func subAddonDS(db GoquDatabase) *goqu.SelectDataset {
 }
 
 func (d *Database) GetSubscriptionAddonByID(ctx context.Context, subAddonID string, opts ...QueryOption) (*SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := subAddonDS(db).
 		Where(t.SubscriptionAddons.Col("id").Eq(subAddonID)).
@@ -380,7 +409,10 @@ func (d *Database) ListSubscriptionAddons(
 	subscriptionID string,
 	opts ...QueryOption,
 ) ([]SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := subAddonDS(db).
 		Where(t.SubscriptionAddons.Col("subscription_id").Eq(subscriptionID)).
@@ -419,7 +451,7 @@ func (d *Database) AddSubscriptionAddon(
 	}
 	addonRate := addon.GetCurrentRate()
 	if addonRate == nil {
-		return nil, fmt.Errorf("no active rate found for addon %s", addon.ID)
+		return nil, suberrors.Conflict("no active rate found for addon %s", addon.ID)
 	}
 
 	ds := db.Insert(t.SubscriptionAddons).
@@ -457,14 +489,17 @@ func (d *Database) AddSubscriptionAddon(
 }
 
 func (d *Database) DeleteSubscriptionAddon(ctx context.Context, subAddonID string, opts ...QueryOption) error {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	ds := db.From(t.SubscriptionAddons).
 		Delete().
 		Where(t.SubscriptionAddons.Col("id").Eq(subAddonID)).
 		Executor()
 
-	_, err := ds.ExecContext(ctx)
+	_, err = ds.ExecContext(ctx)
 	return err
 }
 
@@ -521,7 +556,10 @@ func (d *Database) UpdateSubscriptionAddon(ctx context.Context, updated *UpdateS
 }
 
 func (d *Database) ListSubscriptionAddonsByAddonID(ctx context.Context, addonID string, opts ...QueryOption) ([]SubscriptionAddon, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := subAddonDS(db).
 		Where(t.Addons.Col("id").Eq(addonID)).
@@ -0,0 +1,216 @@
+package db
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// Entity types recorded in the audit log.
+const (
+	AuditEntityUser              = "user"
+	AuditEntityPlan              = "plan"
+	AuditEntityAddon             = "addon"
+	AuditEntityQuota             = "quota"
+	AuditEntitySubscription      = "subscription"
+	AuditEntitySubscriptionAddon = "subscription_addon"
+	AuditEntityGroup             = "group"
+	AuditEntityGroupMember       = "group_member"
+	AuditEntityGroupSubscription = "group_subscription"
+)
+
+// Actions recorded in the audit log.
+const (
+	AuditActionCreate = "create"
+	AuditActionUpdate = "update"
+	AuditActionDelete = "delete"
+	AuditActionCancel = "cancel"
+	AuditActionMerge  = "merge"
+)
+
+// AuditValue contains a JSON snapshot of an entity that is stored in the audit log. A nil AuditValue is stored as
+// NULL, which indicates that the entity didn't exist before or after the change.
+type AuditValue json.RawMessage
+
+// NewAuditValue returns the JSON snapshot of the given value. A nil value produces a nil AuditValue.
+func NewAuditValue(value any) (AuditValue, error) {
+	if value == nil {
+		return nil, nil
+	}
+	bytes, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	if string(bytes) == "null" {
+		return nil, nil
+	}
+	return AuditValue(bytes), nil
+}
+
+// Value implements the driver.Valuer interface.
+func (v AuditValue) Value() (driver.Value, error) {
+	if v == nil {
+		return nil, nil
+	}
+	return string(v), nil
+}
+
+// Scan implements the sql.Scanner interface.
+func (v *AuditValue) Scan(src any) error {
+	switch s := src.(type) {
+	case nil:
+		*v = nil
+	case []byte:
+		*v = append(AuditValue(nil), s...)
+	case string:
+		*v = AuditValue(s)
+	default:
+		return fmt.Errorf("unsupported audit value type: %T", src)
+	}
+	return nil
+}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (v AuditValue) MarshalJSON() ([]byte, error) {
+	if v == nil {
+		return []byte("null"), nil
+	}
+	return json.RawMessage(v).MarshalJSON()
+}
+
+// AuditRecord describes a single change to a plan, add-on, quota or subscription. The before and after values
+// contain snapshots of the entity on either side of the change.
+type AuditRecord struct {
+	ID         string     `db:"id" goqu:"defaultifempty" json:"id"`
+	EntityType string     `db:"entity_type" json:"entity_type"`
+	EntityID   string     `db:"entity_id" json:"entity_id"`
+	Action     string     `db:"action" json:"action"`
+	Username   string     `db:"username" json:"username,omitempty"`
+	Actor      string     `db:"actor" json:"actor"`
+	Before     AuditValue `db:"before_value" json:"before"`
+	After      AuditValue `db:"after_value" json:"after"`
+	CreatedAt  time.Time  `db:"created_at" goqu:"defaultifempty" json:"created_at"`
+}
+
+// NewAuditRecord builds an audit record for a change to an entity. The username identifies the user whose
+// subscription the change applies to, if there is one. The actor is filled in when the record is stored.
+func NewAuditRecord(entityType, entityID, action, username string, before, after any) (*AuditRecord, error) {
+	beforeValue, err := NewAuditValue(before)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode the audit snapshot")
+	}
+	afterValue, err := NewAuditValue(after)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to encode the audit snapshot")
+	}
+	return &AuditRecord{
+		EntityType: entityType,
+		EntityID:   entityID,
+		Action:     action,
+		Username:   username,
+		Before:     beforeValue,
+		After:      afterValue,
+	}, nil
+}
+
+// AuditFilter contains the criteria used to select records from the audit log. Empty fields are ignored.
+type AuditFilter struct {
+	Username   string
+	Actor      string
+	EntityType string
+	Start      time.Time
+	End        time.Time
+}
+
+// AddAuditRecord appends a record to the audit log. The actor is taken from the query settings. Accepts a variable
+// number of QueryOptions, though only WithTX and WithActor are currently supported.
+func (d *Database) AddAuditRecord(ctx context.Context, record *AuditRecord, opts ...QueryOption) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	record.Actor = qs.Actor()
+
+	rec := goqu.Record{
+		"entity_type":  record.EntityType,
+		"entity_id":    record.EntityID,
+		"action":       record.Action,
+		"actor":        record.Actor,
+		"before_value": record.Before,
+		"after_value":  record.After,
+	}
+	if record.Username != "" {
+		rec["username"] = record.Username
+	}
+
+	ds := db.Insert(t.AuditLog).
+		Rows(rec).
+		Returning(t.AuditLog.Col("id"), t.AuditLog.Col("created_at"))
+	d.LogSQL(ds)
+
+	if _, err := ds.Executor().ScanStructContext(ctx, record); err != nil {
+		return errors.Wrap(err, "unable to add the audit record")
+	}
+
+	return nil
+}
+
+// ListAuditRecords returns the records in the audit log that match the filter, most recent first. Accepts a variable
+// number of QueryOptions, including WithTX, WithQueryLimit and WithQueryOffset.
+func (d *Database) ListAuditRecords(ctx context.Context, filter *AuditFilter, opts ...QueryOption) ([]AuditRecord, error) {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	ds := db.From(t.AuditLog).
+		Select(
+			t.AuditLog.Col("id"),
+			t.AuditLog.Col("entity_type"),
+			t.AuditLog.Col("entity_id"),
+			t.AuditLog.Col("action"),
+			goqu.COALESCE(t.AuditLog.Col("username"), "").As("username"),
+			t.AuditLog.Col("actor"),
+			t.AuditLog.Col("before_value"),
+			t.AuditLog.Col("after_value"),
+			t.AuditLog.Col("created_at"),
+		).
+		Order(t.AuditLog.Col("created_at").Desc())
+
+	if filter.Username != "" {
+		ds = ds.Where(t.AuditLog.Col("username").Eq(filter.Username))
+	}
+	if filter.Actor != "" {
+		ds = ds.Where(t.AuditLog.Col("actor").Eq(filter.Actor))
+	}
+	if filter.EntityType != "" {
+		ds = ds.Where(t.AuditLog.Col("entity_type").Eq(filter.EntityType))
+	}
+	if !filter.Start.IsZero() {
+		ds = ds.Where(t.AuditLog.Col("created_at").Gte(filter.Start))
+	}
+	if !filter.End.IsZero() {
+		ds = ds.Where(t.AuditLog.Col("created_at").Lt(filter.End))
+	}
+	if qs.hasLimit {
+		ds = ds.Limit(qs.limit)
+	}
+	if qs.hasOffset {
+		ds = ds.Offset(qs.offset)
+	}
+	d.LogSQL(ds)
+
+	var records []AuditRecord
+	if err := ds.ScanStructsContext(ctx, &records); err != nil {
+		return nil, errors.Wrap(err, "unable to list the audit records")
+	}
+
+	return records, nil
+}
@@ -1,6 +1,8 @@
 package db
 
 import (
+	"fmt"
+
 	"github.com/cyverse-de/go-mod/logging"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/sirupsen/logrus"
@@ -44,25 +46,34 @@ func (d *Database) LogSQL(statement SQLStatement) {
 	}
 }
 
-func (d *Database) Begin() (*goqu.TxDatabase, error) {
+// Begin starts a new transaction.
+func (d *Database) Begin() (Tx, error) {
 	return d.fullDB.Begin()
 }
 
-func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatabase) {
-	var db GoquDatabase
+// goquTX returns the goqu transaction underlying a Tx. Transactions started by other repositories can't be used with
+// the database, so an error is returned for them.
+func goquTX(tx Tx) (*goqu.TxDatabase, error) {
+	goquTx, ok := tx.(*goqu.TxDatabase)
+	if !ok {
+		return nil, fmt.Errorf("unsupported transaction type for the database: %T", tx)
+	}
+	return goquTx, nil
+}
 
-	querySettings := &QuerySettings{}
-	for _, opt := range opts {
-		opt(querySettings)
+func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatabase, error) {
+	querySettings := newQuerySettings(opts...)
+
+	if querySettings.tx == nil {
+		return querySettings, d.goquDB, nil
 	}
 
-	if querySettings.tx != nil {
-		db = querySettings.tx
-	} else {
-		db = d.goquDB
+	db, err := goquTX(querySettings.tx)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	return querySettings, db
+	return querySettings, db, nil
 }
 
 // querySettingsWithTX is the same as querySettings(), except it will return a
@@ -71,15 +82,15 @@ func (d *Database) querySettings(opts ...QueryOption) (*QuerySettings, GoquDatab
 func (d *Database) querySettingsWithTX(opts ...QueryOption) (*QuerySettings, *goqu.TxDatabase, error) {
 	var db *goqu.TxDatabase
 
-	querySettings := &QuerySettings{}
-	for _, opt := range opts {
-		opt(querySettings)
-	}
+	querySettings := newQuerySettings(opts...)
 
 	if querySettings.tx != nil {
-		db = querySettings.tx
+		var err error
+		if db, err = goquTX(querySettings.tx); err != nil {
+			return nil, nil, err
+		}
 	} else {
-		tx, err := d.Begin()
+		tx, err := d.fullDB.Begin()
 		if err != nil {
 			return nil, nil, err
 		}
@@ -92,6 +103,10 @@ func (d *Database) querySettingsWithTX(opts ...QueryOption) (*QuerySettings, *go
 	return querySettings, db, nil
 }
 
+// DefaultActor is the name recorded in the created_by and last_modified_by columns when the caller doesn't
+// identify the user responsible for a change.
+const DefaultActor = "de"
+
 // QuerySettings provides configuration for queries, such as including a limit
 // statement, an offset statement, or running the query as part of a transaction.
 type QuerySettings struct {
@@ -99,9 +114,28 @@ type QuerySettings struct {
 	limit      uint
 	hasOffset  bool
 	offset     uint
-	tx         *goqu.TxDatabase
+	tx         Tx
 	doRollback bool
 	doCommit   bool
+	actor      string
+}
+
+// newQuerySettings returns the query settings produced by applying the given options.
+func newQuerySettings(opts ...QueryOption) *QuerySettings {
+	querySettings := &QuerySettings{}
+	for _, opt := range opts {
+		opt(querySettings)
+	}
+	return querySettings
+}
+
+// Actor returns the name of the user responsible for changes made by a query. DefaultActor is returned if no actor
+// was specified.
+func (s *QuerySettings) Actor() string {
+	if s.actor == "" {
+		return DefaultActor
+	}
+	return s.actor
 }
 
 // QueryOption defines the signature for functions that can modify a QuerySettings
@@ -125,7 +159,7 @@ func WithQueryOffset(offset uint) QueryOption {
 }
 
 // WithTX allows callers to use a query as part of a transaction.
-func WithTX(tx *goqu.TxDatabase) QueryOption {
+func WithTX(tx Tx) QueryOption {
 	return func(s *QuerySettings) {
 		s.tx = tx
 	}
@@ -134,10 +168,20 @@ func WithTX(tx *goqu.TxDatabase) QueryOption {
 // WithTXRollbackCommit allows callers to control whether a function can call
 // Rollback() and Commit() on the transaction, or if that should be left up to
 // the caller to manage.
-func WithTXRollbackCommit(tx *goqu.TxDatabase, doRollback, doCommit bool) QueryOption {
+func WithTXRollbackCommit(tx Tx, doRollback, doCommit bool) QueryOption {
 	return func(s *QuerySettings) {
 		s.tx = tx
 		s.doRollback = doRollback
 		s.doCommit = doCommit
 	}
 }
+
+// WithActor allows callers to specify the name of the user responsible for changes made by a query. The name is
+// recorded in audit columns such as created_by and last_modified_by. An empty name leaves the default in place.
+func WithActor(actor string) QueryOption {
+	return func(s *QuerySettings) {
+		if actor != "" {
+			s.actor = actor
+		}
+	}
+}
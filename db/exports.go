@@ -0,0 +1,337 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exp"
+	"github.com/pkg/errors"
+)
+
+// ExportFilter narrows down the rows returned by the export methods. Subscriptions, along with their quotas, usages
+// and add-ons, match if the subscription was in effect at any time between Start and End and is for the named plan.
+// Updates match if their effective date is between Start and End and the user was subscribed to the named plan at
+// that time. Start is inclusive and End is exclusive. Fields that are blank or zero aren't used.
+type ExportFilter struct {
+	Start    time.Time
+	End      time.Time
+	PlanName string
+}
+
+// SubscriptionExport is a row in an export of subscriptions.
+type SubscriptionExport struct {
+	ID                 string     `db:"id" json:"id" parquet:"id"`
+	Username           string     `db:"username" json:"username" parquet:"username"`
+	PlanName           string     `db:"plan_name" json:"plan_name" parquet:"plan_name"`
+	Rate               float64    `db:"rate" json:"rate" parquet:"rate"`
+	Paid               bool       `db:"paid" json:"paid" parquet:"paid"`
+	EffectiveStartDate time.Time  `db:"effective_start_date" json:"effective_start_date" parquet:"effective_start_date,timestamp(millisecond)"`
+	EffectiveEndDate   *time.Time `db:"effective_end_date" json:"effective_end_date" parquet:"effective_end_date,optional,timestamp(millisecond)"`
+	ActivatedAt        *time.Time `db:"activated_at" json:"activated_at" parquet:"activated_at,optional,timestamp(millisecond)"`
+	CancelledAt        *time.Time `db:"cancelled_at" json:"cancelled_at" parquet:"cancelled_at,optional,timestamp(millisecond)"`
+	CancelledBy        string     `db:"cancelled_by" json:"cancelled_by" parquet:"cancelled_by"`
+	CancellationReason string     `db:"cancellation_reason" json:"cancellation_reason" parquet:"cancellation_reason"`
+	CreatedBy          string     `db:"created_by" json:"created_by" parquet:"created_by"`
+	CreatedAt          time.Time  `db:"created_at" json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	LastModifiedBy     string     `db:"last_modified_by" json:"last_modified_by" parquet:"last_modified_by"`
+	LastModifiedAt     time.Time  `db:"last_modified_at" json:"last_modified_at" parquet:"last_modified_at,timestamp(millisecond)"`
+}
+
+// AmountExport is a row in an export of quotas or usages. Value is the quota or the usage, depending on the export.
+type AmountExport struct {
+	ID             string    `db:"id" json:"id" parquet:"id"`
+	SubscriptionID string    `db:"subscription_id" json:"subscription_id" parquet:"subscription_id"`
+	Username       string    `db:"username" json:"username" parquet:"username"`
+	PlanName       string    `db:"plan_name" json:"plan_name" parquet:"plan_name"`
+	ResourceType   string    `db:"resource_type" json:"resource_type" parquet:"resource_type"`
+	Unit           string    `db:"unit" json:"unit" parquet:"unit"`
+	Value          float64   `db:"value" json:"value" parquet:"value"`
+	CreatedBy      string    `db:"created_by" json:"created_by" parquet:"created_by"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	LastModifiedBy string    `db:"last_modified_by" json:"last_modified_by" parquet:"last_modified_by"`
+	LastModifiedAt time.Time `db:"last_modified_at" json:"last_modified_at" parquet:"last_modified_at,timestamp(millisecond)"`
+}
+
+// SubscriptionAddonExport is a row in an export of the add-ons applied to subscriptions.
+type SubscriptionAddonExport struct {
+	ID             string  `db:"id" json:"id" parquet:"id"`
+	SubscriptionID string  `db:"subscription_id" json:"subscription_id" parquet:"subscription_id"`
+	Username       string  `db:"username" json:"username" parquet:"username"`
+	PlanName       string  `db:"plan_name" json:"plan_name" parquet:"plan_name"`
+	AddonName      string  `db:"addon_name" json:"addon_name" parquet:"addon_name"`
+	ResourceType   string  `db:"resource_type" json:"resource_type" parquet:"resource_type"`
+	Unit           string  `db:"unit" json:"unit" parquet:"unit"`
+	Amount         float64 `db:"amount" json:"amount" parquet:"amount"`
+	Paid           bool    `db:"paid" json:"paid" parquet:"paid"`
+	Rate           float64 `db:"rate" json:"rate" parquet:"rate"`
+}
+
+// UpdateExport is a row in an export of the updates ledger.
+type UpdateExport struct {
+	ID             string    `db:"id" json:"id" parquet:"id"`
+	Username       string    `db:"username" json:"username" parquet:"username"`
+	ValueType      string    `db:"value_type" json:"value_type" parquet:"value_type"`
+	Operation      string    `db:"operation" json:"operation" parquet:"operation"`
+	ResourceType   string    `db:"resource_type" json:"resource_type" parquet:"resource_type"`
+	Unit           string    `db:"unit" json:"unit" parquet:"unit"`
+	Value          float64   `db:"value" json:"value" parquet:"value"`
+	EffectiveDate  time.Time `db:"effective_date" json:"effective_date" parquet:"effective_date,timestamp(millisecond)"`
+	Metadata       string    `db:"metadata" json:"metadata" parquet:"metadata"`
+	CreatedBy      string    `db:"created_by" json:"created_by" parquet:"created_by"`
+	CreatedAt      time.Time `db:"created_at" json:"created_at" parquet:"created_at,timestamp(millisecond)"`
+	LastModifiedBy string    `db:"last_modified_by" json:"last_modified_by" parquet:"last_modified_by"`
+	LastModifiedAt time.Time `db:"last_modified_at" json:"last_modified_at" parquet:"last_modified_at,timestamp(millisecond)"`
+}
+
+// exportSubscriptionsQuery returns a query that lists the subscriptions that match a filter, joined to their users
+// and plans.
+func exportSubscriptionsQuery(db GoquDatabase, filter *ExportFilter) *goqu.SelectDataset {
+	ds := db.From(t.Subscriptions).
+		Join(t.Users, goqu.On(t.Subscriptions.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id"))))
+
+	if !filter.Start.IsZero() {
+		ds = ds.Where(
+			goqu.Or(
+				t.Subscriptions.Col("effective_end_date").IsNull(),
+				t.Subscriptions.Col("effective_end_date").Gte(filter.Start),
+			),
+		)
+	}
+	if !filter.End.IsZero() {
+		ds = ds.Where(t.Subscriptions.Col("effective_start_date").Lt(filter.End))
+	}
+	if filter.PlanName != "" {
+		ds = ds.Where(t.Plans.Col("name").Eq(filter.PlanName))
+	}
+
+	return ds
+}
+
+// streamRows executes a query and calls fn with each row in turn, without loading all of the rows into memory.
+func streamRows[T any](ctx context.Context, query *goqu.SelectDataset, fn func(*T) error) error {
+	scanner, err := query.Executor().ScannerContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer scanner.Close()
+
+	for scanner.Next() {
+		var row T
+		if err = scanner.ScanStruct(&row); err != nil {
+			return err
+		}
+		if err = fn(&row); err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+// ExportSubscriptions calls fn with each subscription that matches a filter, ordered by start date. Accepts a
+// variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ExportSubscriptions(
+	ctx context.Context, filter *ExportFilter, fn func(*SubscriptionExport) error, opts ...QueryOption,
+) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := exportSubscriptionsQuery(db, filter).
+		Join(t.PlanRates, goqu.On(t.Subscriptions.Col("plan_rate_id").Eq(t.PlanRates.Col("id")))).
+		Select(
+			t.Subscriptions.Col("id"),
+			t.Users.Col("username"),
+			t.Plans.Col("name").As("plan_name"),
+			t.PlanRates.Col("rate"),
+			t.Subscriptions.Col("paid"),
+			t.Subscriptions.Col("effective_start_date"),
+			t.Subscriptions.Col("effective_end_date"),
+			t.Subscriptions.Col("activated_at"),
+			t.Subscriptions.Col("cancelled_at"),
+			goqu.COALESCE(t.Subscriptions.Col("cancelled_by"), "").As("cancelled_by"),
+			goqu.COALESCE(t.Subscriptions.Col("cancellation_reason"), "").As("cancellation_reason"),
+			t.Subscriptions.Col("created_by"),
+			t.Subscriptions.Col("created_at"),
+			t.Subscriptions.Col("last_modified_by"),
+			t.Subscriptions.Col("last_modified_at"),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Asc(), t.Subscriptions.Col("id").Asc())
+	d.LogSQL(query)
+
+	if err := streamRows(ctx, query, fn); err != nil {
+		return errors.Wrap(err, "unable to export subscriptions")
+	}
+
+	return nil
+}
+
+// exportAmounts streams the quotas or usages of the subscriptions that match a filter.
+func (d *Database) exportAmounts(
+	ctx context.Context, table exp.IdentifierExpression, column string, filter *ExportFilter,
+	fn func(*AmountExport) error, opts ...QueryOption,
+) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := exportSubscriptionsQuery(db, filter).
+		Join(table, goqu.On(table.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.ResourceTypes, goqu.On(table.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+		Select(
+			table.Col("id"),
+			table.Col("subscription_id"),
+			t.Users.Col("username"),
+			t.Plans.Col("name").As("plan_name"),
+			t.ResourceTypes.Col("name").As("resource_type"),
+			t.ResourceTypes.Col("unit"),
+			table.Col(column).As("value"),
+			table.Col("created_by"),
+			table.Col("created_at"),
+			table.Col("last_modified_by"),
+			table.Col("last_modified_at"),
+		).
+		Order(
+			t.Subscriptions.Col("effective_start_date").Asc(),
+			t.Subscriptions.Col("id").Asc(),
+			t.ResourceTypes.Col("name").Asc(),
+		)
+	d.LogSQL(query)
+
+	return streamRows(ctx, query, fn)
+}
+
+// ExportQuotas calls fn with each quota of the subscriptions that match a filter, ordered by the start date of the
+// subscription. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ExportQuotas(
+	ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption,
+) error {
+	if err := d.exportAmounts(ctx, t.Quotas, "quota", filter, fn, opts...); err != nil {
+		return errors.Wrap(err, "unable to export quotas")
+	}
+	return nil
+}
+
+// ExportUsages calls fn with each usage of the subscriptions that match a filter, ordered by the start date of the
+// subscription. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ExportUsages(
+	ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption,
+) error {
+	if err := d.exportAmounts(ctx, t.Usages, "usage", filter, fn, opts...); err != nil {
+		return errors.Wrap(err, "unable to export usages")
+	}
+	return nil
+}
+
+// ExportSubscriptionAddons calls fn with each add-on applied to the subscriptions that match a filter, ordered by the
+// start date of the subscription. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ExportSubscriptionAddons(
+	ctx context.Context, filter *ExportFilter, fn func(*SubscriptionAddonExport) error, opts ...QueryOption,
+) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := exportSubscriptionsQuery(db, filter).
+		Join(t.SubscriptionAddons, goqu.On(t.SubscriptionAddons.Col("subscription_id").Eq(t.Subscriptions.Col("id")))).
+		Join(t.Addons, goqu.On(t.SubscriptionAddons.Col("addon_id").Eq(t.Addons.Col("id")))).
+		Join(t.AddonRates, goqu.On(t.SubscriptionAddons.Col("addon_rate_id").Eq(t.AddonRates.Col("id")))).
+		Join(t.ResourceTypes, goqu.On(t.Addons.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+		Select(
+			t.SubscriptionAddons.Col("id"),
+			t.SubscriptionAddons.Col("subscription_id"),
+			t.Users.Col("username"),
+			t.Plans.Col("name").As("plan_name"),
+			t.Addons.Col("name").As("addon_name"),
+			t.ResourceTypes.Col("name").As("resource_type"),
+			t.ResourceTypes.Col("unit"),
+			t.SubscriptionAddons.Col("amount"),
+			t.SubscriptionAddons.Col("paid"),
+			t.AddonRates.Col("rate"),
+		).
+		Order(
+			t.Subscriptions.Col("effective_start_date").Asc(),
+			t.Subscriptions.Col("id").Asc(),
+			t.Addons.Col("name").Asc(),
+		)
+	d.LogSQL(query)
+
+	if err := streamRows(ctx, query, fn); err != nil {
+		return errors.Wrap(err, "unable to export subscription add-ons")
+	}
+
+	return nil
+}
+
+// ExportUpdates calls fn with each update that matches a filter, ordered by effective date. Accepts a variable number
+// of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ExportUpdates(
+	ctx context.Context, filter *ExportFilter, fn func(*UpdateExport) error, opts ...QueryOption,
+) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.From(t.Updates).
+		Join(t.Users, goqu.On(t.Updates.Col("user_id").Eq(t.Users.Col("id")))).
+		Join(t.UpdateOperations, goqu.On(t.Updates.Col("update_operation_id").Eq(t.UpdateOperations.Col("id")))).
+		Join(t.ResourceTypes, goqu.On(t.Updates.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
+		Select(
+			t.Updates.Col("id"),
+			t.Users.Col("username"),
+			t.Updates.Col("value_type"),
+			t.UpdateOperations.Col("name").As("operation"),
+			t.ResourceTypes.Col("name").As("resource_type"),
+			t.ResourceTypes.Col("unit"),
+			t.Updates.Col("value"),
+			t.Updates.Col("effective_date"),
+			goqu.COALESCE(t.Updates.Col("metadata"), "").As("metadata"),
+			t.Updates.Col("created_by"),
+			t.Updates.Col("created_at"),
+			t.Updates.Col("last_modified_by"),
+			t.Updates.Col("last_modified_at"),
+		).
+		Order(t.Updates.Col("effective_date").Asc(), t.Updates.Col("id").Asc())
+
+	if !filter.Start.IsZero() {
+		query = query.Where(t.Updates.Col("effective_date").Gte(filter.Start))
+	}
+	if !filter.End.IsZero() {
+		query = query.Where(t.Updates.Col("effective_date").Lt(filter.End))
+	}
+	if filter.PlanName != "" {
+		s := goqu.T("s")
+		p := goqu.T("p")
+
+		// Comparing with a dataset produces IN (subquery).
+		query = query.Where(
+			t.Updates.Col("user_id").Eq(
+				db.From(t.Subscriptions.As("s")).
+					Join(t.Plans.As("p"), goqu.On(s.Col("plan_id").Eq(p.Col("id")))).
+					Select(s.Col("user_id")).
+					Where(
+						p.Col("name").Eq(filter.PlanName),
+						s.Col("effective_start_date").Lte(t.Updates.Col("effective_date")),
+						goqu.Or(
+							s.Col("effective_end_date").IsNull(),
+							s.Col("effective_end_date").Gt(t.Updates.Col("effective_date")),
+						),
+					),
+			),
+		)
+	}
+	d.LogSQL(query)
+
+	if err := streamRows(ctx, query, fn); err != nil {
+		return errors.Wrap(err, "unable to export updates")
+	}
+
+	return nil
+}
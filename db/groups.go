@@ -0,0 +1,495 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// Group is a set of users, such as a lab, that share a subscription.
+type Group struct {
+	ID             string    `db:"id" goqu:"defaultifempty" json:"id"`
+	Name           string    `db:"name" json:"name"`
+	Description    string    `db:"description" json:"description"`
+	CreatedBy      string    `db:"created_by" json:"created_by"`
+	CreatedAt      time.Time `db:"created_at" goqu:"defaultifempty" json:"created_at"`
+	LastModifiedBy string    `db:"last_modified_by" json:"last_modified_by"`
+	LastModifiedAt time.Time `db:"last_modified_at" goqu:"defaultifempty" json:"last_modified_at"`
+}
+
+// GroupSubscription is a subscription owned by a group. Its quotas are pooled among the members of the group.
+type GroupSubscription struct {
+	ID                 string       `db:"id" goqu:"defaultifempty" json:"id"`
+	GroupID            string       `db:"group_id" json:"group_id"`
+	PlanID             string       `db:"plan_id" json:"plan_id"`
+	PlanName           string       `db:"plan_name" json:"plan_name"`
+	EffectiveStartDate time.Time    `db:"effective_start_date" json:"effective_start_date"`
+	EffectiveEndDate   time.Time    `db:"effective_end_date" json:"effective_end_date"`
+	Paid               bool         `db:"paid" json:"paid"`
+	Quotas             []GroupQuota `db:"-" json:"quotas"`
+	CreatedBy          string       `db:"created_by" json:"created_by"`
+	CreatedAt          time.Time    `db:"created_at" json:"created_at"`
+	LastModifiedBy     string       `db:"last_modified_by" json:"last_modified_by"`
+	LastModifiedAt     time.Time    `db:"last_modified_at" json:"last_modified_at"`
+}
+
+// GroupQuota is the pooled quota for a resource type in a group subscription.
+type GroupQuota struct {
+	ID               string  `db:"id" json:"id"`
+	ResourceTypeID   string  `db:"resource_type_id" json:"resource_type_id"`
+	ResourceTypeName string  `db:"resource_type_name" json:"resource_type_name"`
+	ResourceTypeUnit string  `db:"resource_type_unit" json:"resource_type_unit"`
+	Quota            float64 `db:"quota" json:"quota"`
+}
+
+// GroupAllocation describes how much of a pooled quota in a group's active subscription has been used. The pooled
+// usage is the sum of the usage of each member of the group beyond the member's personal quota.
+type GroupAllocation struct {
+	GroupID             string  `db:"group_id" json:"group_id"`
+	GroupName           string  `db:"group_name" json:"group_name"`
+	GroupSubscriptionID string  `db:"group_subscription_id" json:"group_subscription_id"`
+	ResourceTypeID      string  `db:"resource_type_id" json:"resource_type_id"`
+	ResourceTypeName    string  `db:"resource_type_name" json:"resource_type_name"`
+	ResourceTypeUnit    string  `db:"resource_type_unit" json:"resource_type_unit"`
+	QuotaValue          float64 `db:"quota_value" json:"quota_value"`
+	UsageValue          float64 `db:"usage_value" json:"usage_value"`
+}
+
+// Available returns true if the members of the group haven't used up the pooled quota yet.
+func (a GroupAllocation) Available() bool {
+	return a.UsageValue < a.QuotaValue
+}
+
+// activeGroupSubscription returns an expression that matches group subscriptions that are currently in effect.
+func activeGroupSubscription() goqu.Expression {
+	return CurrentTimestamp.Between(goqu.Range(
+		t.GroupSubscriptions.Col("effective_start_date"),
+		t.GroupSubscriptions.Col("effective_end_date"),
+	))
+}
+
+// AddGroup adds a new group. The ID and the creation and modification details of the group are filled in. Accepts a
+// variable number of QueryOptions, including WithTX and WithActor.
+func (d *Database) AddGroup(ctx context.Context, group *Group, opts ...QueryOption) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Insert(t.Groups).
+		Rows(
+			goqu.Record{
+				"name":             group.Name,
+				"description":      group.Description,
+				"created_by":       qs.Actor(),
+				"last_modified_by": qs.Actor(),
+			},
+		).
+		Returning(t.Groups.All())
+	d.LogSQL(query)
+
+	if _, err := query.Executor().ScanStructContext(ctx, group); err != nil {
+		return errors.Wrapf(err, "unable to add group %s", group.Name)
+	}
+
+	return nil
+}
+
+// GetGroupByName returns the group with the given name, or nil if it doesn't exist. Accepts a variable number of
+// QueryOptions, but only WithTX is currently supported.
+func (d *Database) GetGroupByName(ctx context.Context, name string, opts ...QueryOption) (*Group, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Groups).Where(t.Groups.Col("name").Eq(name))
+	d.LogSQL(query)
+
+	var group Group
+	found, err := query.ScanStructContext(ctx, &group)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up group %s", name)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &group, nil
+}
+
+// ListGroups returns all of the groups, ordered by name. Accepts a variable number of QueryOptions, but only WithTX
+// is currently supported.
+func (d *Database) ListGroups(ctx context.Context, opts ...QueryOption) ([]Group, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Groups).Order(t.Groups.Col("name").Asc())
+	d.LogSQL(query)
+
+	var groups []Group
+	if err := query.ScanStructsContext(ctx, &groups); err != nil {
+		return nil, errors.Wrap(err, "unable to list groups")
+	}
+
+	return groups, nil
+}
+
+// ListUserGroups returns the groups that a user belongs to, ordered by name. Accepts a variable number of
+// QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListUserGroups(ctx context.Context, username string, opts ...QueryOption) ([]Group, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Groups).
+		Select(t.Groups.All()).
+		Join(t.GroupMembers, goqu.On(t.Groups.Col("id").Eq(t.GroupMembers.Col("group_id")))).
+		Join(t.Users, goqu.On(t.GroupMembers.Col("user_id").Eq(t.Users.Col("id")))).
+		Where(t.Users.Col("username").Eq(username)).
+		Order(t.Groups.Col("name").Asc())
+	d.LogSQL(query)
+
+	var groups []Group
+	if err := query.ScanStructsContext(ctx, &groups); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the groups of %s", username)
+	}
+
+	return groups, nil
+}
+
+// DeleteGroup removes a group along with its memberships, subscriptions and pooled quotas. Returns false if the group
+// didn't exist. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) DeleteGroup(ctx context.Context, groupID string, opts ...QueryOption) (bool, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
+
+	// The memberships, subscriptions and quotas are removed by the foreign key constraints.
+	query := db.From(t.Groups).Where(t.Groups.Col("id").Eq(groupID)).Delete()
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to delete group %s", groupID)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to delete group %s", groupID)
+	}
+
+	return rows > 0, nil
+}
+
+// AddGroupMember adds a user to a group. Returns false if the user already belongs to the group. Accepts a variable
+// number of QueryOptions, including WithTX and WithActor.
+func (d *Database) AddGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error) {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
+
+	query := db.Insert(t.GroupMembers).
+		Rows(
+			goqu.Record{
+				"group_id":   groupID,
+				"user_id":    userID,
+				"created_by": qs.Actor(),
+			},
+		).
+		OnConflict(goqu.DoNothing())
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to add user %s to group %s", userID, groupID)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to add user %s to group %s", userID, groupID)
+	}
+
+	return rows > 0, nil
+}
+
+// RemoveGroupMember removes a user from a group. Returns false if the user didn't belong to the group. Accepts a
+// variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) RemoveGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
+
+	query := db.From(t.GroupMembers).
+		Where(
+			t.GroupMembers.Col("group_id").Eq(groupID),
+			t.GroupMembers.Col("user_id").Eq(userID),
+		).
+		Delete()
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove user %s from group %s", userID, groupID)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove user %s from group %s", userID, groupID)
+	}
+
+	return rows > 0, nil
+}
+
+// ListGroupMembers returns the members of a group, ordered by username. Accepts a variable number of QueryOptions,
+// but only WithTX is currently supported.
+func (d *Database) ListGroupMembers(ctx context.Context, groupID string, opts ...QueryOption) ([]User, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Users).
+		Select(t.Users.Col("id"), t.Users.Col("username")).
+		Join(t.GroupMembers, goqu.On(t.Users.Col("id").Eq(t.GroupMembers.Col("user_id")))).
+		Where(t.GroupMembers.Col("group_id").Eq(groupID)).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(query)
+
+	var members []User
+	if err := query.ScanStructsContext(ctx, &members); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the members of group %s", groupID)
+	}
+
+	return members, nil
+}
+
+// AddGroupSubscription subscribes a group to a plan starting now, ends the group's current subscription and sets
+// the quotas of the new subscription from the plan's quota defaults. Returns the ID of the new subscription. The start
+// date in the subscription options is ignored, because group subscriptions can't be scheduled. Accepts a variable
+// number of QueryOptions, including WithTX and WithActor.
+func (d *Database) AddGroupSubscription(
+	ctx context.Context, groupID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
+) (string, error) {
+	wrapMsg := "unable to subscribe group " + groupID + " to plan " + plan.Name
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
+
+	endQuery := db.Update(t.GroupSubscriptions).
+		Set(goqu.Record{
+			"effective_end_date": CurrentTimestamp,
+			"last_modified_by":   qs.Actor(),
+			"last_modified_at":   CurrentTimestamp,
+		}).
+		Where(t.GroupSubscriptions.Col("group_id").Eq(groupID), activeGroupSubscription())
+	d.LogSQL(endQuery)
+
+	if _, err := endQuery.Executor().ExecContext(ctx); err != nil {
+		return "", errors.Wrap(err, wrapMsg)
+	}
+
+	query := db.Insert(t.GroupSubscriptions).
+		Rows(
+			goqu.Record{
+				"group_id":             groupID,
+				"plan_id":              plan.ID,
+				"effective_start_date": CurrentTimestamp,
+				"effective_end_date":   subscriptionOpts.EndDate,
+				"paid":                 subscriptionOpts.Paid,
+				"created_by":           qs.Actor(),
+				"last_modified_by":     qs.Actor(),
+			},
+		).
+		Returning(t.GroupSubscriptions.Col("id"))
+	d.LogSQL(query)
+
+	var subscriptionID string
+	if _, err := query.Executor().ScanValContext(ctx, &subscriptionID); err != nil {
+		return "", errors.Wrap(err, wrapMsg)
+	}
+
+	// Consumable quotas cover every period of the subscription. Other quotas are limits on the amount of the resource
+	// that can be in use at any one time, so they don't depend on the number of periods.
+	for _, quotaDefault := range plan.GetActiveQuotaDefaults() {
+		quotaValue := quotaDefault.QuotaValue
+		if quotaDefault.ResourceType.Consumable {
+			quotaValue *= float64(subscriptionOpts.Periods)
+		}
+		if err := d.UpsertGroupQuota(ctx, quotaValue, quotaDefault.ResourceType.ID, subscriptionID, opts...); err != nil {
+			return "", errors.Wrap(err, wrapMsg)
+		}
+	}
+
+	return subscriptionID, nil
+}
+
+// GetActiveGroupSubscription returns the group's subscription that is currently in effect along with its quotas, or
+// nil if the group doesn't have one. Accepts a variable number of QueryOptions, but only WithTX is currently
+// supported.
+func (d *Database) GetActiveGroupSubscription(ctx context.Context, groupID string, opts ...QueryOption) (*GroupSubscription, error) {
+	wrapMsg := "unable to look up the active subscription of group " + groupID
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.GroupSubscriptions).
+		Select(
+			t.GroupSubscriptions.All(),
+			t.Plans.Col("name").As("plan_name"),
+		).
+		Join(t.Plans, goqu.On(t.GroupSubscriptions.Col("plan_id").Eq(t.Plans.Col("id")))).
+		Where(t.GroupSubscriptions.Col("group_id").Eq(groupID), activeGroupSubscription()).
+		Order(t.GroupSubscriptions.Col("effective_start_date").Desc()).
+		Limit(1)
+	d.LogSQL(query)
+
+	var subscription GroupSubscription
+	found, err := query.ScanStructContext(ctx, &subscription)
+	if err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	quotasQuery := db.From(t.GroupQuotas).
+		Select(
+			t.GroupQuotas.Col("id"),
+			t.GroupQuotas.Col("resource_type_id"),
+			t.RT.Col("name").As("resource_type_name"),
+			t.RT.Col("unit").As("resource_type_unit"),
+			t.GroupQuotas.Col("quota"),
+		).
+		Join(t.RT, goqu.On(t.GroupQuotas.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Where(t.GroupQuotas.Col("group_subscription_id").Eq(subscription.ID)).
+		Order(t.RT.Col("name").Asc())
+	d.LogSQL(quotasQuery)
+
+	if err = quotasQuery.ScanStructsContext(ctx, &subscription.Quotas); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+
+	return &subscription, nil
+}
+
+// UpsertGroupQuota sets the pooled quota for a resource type in a group subscription. Accepts a variable number of
+// QueryOptions, including WithTX and WithActor.
+func (d *Database) UpsertGroupQuota(
+	ctx context.Context, value float64, resourceTypeID, groupSubscriptionID string, opts ...QueryOption,
+) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Insert(t.GroupQuotas).
+		Rows(
+			goqu.Record{
+				"quota":                 value,
+				"resource_type_id":      resourceTypeID,
+				"group_subscription_id": groupSubscriptionID,
+				"created_by":            qs.Actor(),
+				"last_modified_by":      qs.Actor(),
+			},
+		).
+		OnConflict(
+			goqu.DoUpdate(
+				"resource_type_id, group_subscription_id",
+				goqu.Record{
+					"quota":            goqu.I("excluded.quota"),
+					"last_modified_by": goqu.I("excluded.last_modified_by"),
+					"last_modified_at": CurrentTimestamp,
+				},
+			),
+		)
+	d.LogSQL(query)
+
+	if _, err := query.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrapf(err, "unable to set the group quota for resource type %s", resourceTypeID)
+	}
+
+	return nil
+}
+
+// pooledUsage is the usage of a resource type by the members of a group beyond their personal quotas, counting only
+// the members' subscriptions that are currently in effect.
+var pooledUsage = goqu.L(`COALESCE((
+	SELECT sum(GREATEST(u.usage - COALESCE(q.quota, 0), 0))
+	FROM group_members gm
+	JOIN subscriptions s ON s.user_id = gm.user_id
+	JOIN usages u ON u.subscription_id = s.id AND u.resource_type_id = group_quotas.resource_type_id
+	LEFT JOIN quotas q ON q.subscription_id = s.id AND q.resource_type_id = group_quotas.resource_type_id
+	WHERE gm.group_id = groups.id
+	AND CURRENT_TIMESTAMP BETWEEN s.effective_start_date AND s.effective_end_date
+), 0)`)
+
+// groupAllocationsDS returns a query that lists the pooled quotas in active group subscriptions along with the
+// pooled usage of each one.
+func groupAllocationsDS(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.GroupSubscriptions).
+		Select(
+			t.Groups.Col("id").As("group_id"),
+			t.Groups.Col("name").As("group_name"),
+			t.GroupSubscriptions.Col("id").As("group_subscription_id"),
+			t.RT.Col("id").As("resource_type_id"),
+			t.RT.Col("name").As("resource_type_name"),
+			t.RT.Col("unit").As("resource_type_unit"),
+			t.GroupQuotas.Col("quota").As("quota_value"),
+			pooledUsage.As("usage_value"),
+		).
+		Join(t.Groups, goqu.On(t.GroupSubscriptions.Col("group_id").Eq(t.Groups.Col("id")))).
+		Join(t.GroupQuotas, goqu.On(t.GroupSubscriptions.Col("id").Eq(t.GroupQuotas.Col("group_subscription_id")))).
+		Join(t.RT, goqu.On(t.GroupQuotas.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Where(activeGroupSubscription()).
+		Order(t.Groups.Col("name").Asc(), t.RT.Col("name").Asc())
+}
+
+// ListGroupAllocations returns the pooled quotas and usages in the group's active subscription. Accepts a variable
+// number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListGroupAllocations(ctx context.Context, groupID string, opts ...QueryOption) ([]GroupAllocation, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := groupAllocationsDS(db).Where(t.Groups.Col("id").Eq(groupID))
+	d.LogSQL(query)
+
+	var allocations []GroupAllocation
+	if err := query.ScanStructsContext(ctx, &allocations); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the allocations of group %s", groupID)
+	}
+
+	return allocations, nil
+}
+
+// ListUserGroupAllocations returns the pooled quotas and usages in the active subscriptions of every group that the
+// user belongs to. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListUserGroupAllocations(ctx context.Context, username string, opts ...QueryOption) ([]GroupAllocation, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := groupAllocationsDS(db).
+		Join(t.GroupMembers, goqu.On(t.Groups.Col("id").Eq(t.GroupMembers.Col("group_id")))).
+		Join(t.Users, goqu.On(t.GroupMembers.Col("user_id").Eq(t.Users.Col("id")))).
+		Where(t.Users.Col("username").Eq(username))
+	d.LogSQL(query)
+
+	var allocations []GroupAllocation
+	if err := query.ScanStructsContext(ctx, &allocations); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the group allocations of %s", username)
+	}
+
+	return allocations, nil
+}
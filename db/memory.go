@@ -0,0 +1,499 @@
+package db
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// ErrSerializationFailure is returned when a MemoryDatabase transaction can't be committed because another change
+// was committed after the transaction began. See MemoryDatabase for the isolation level that this implies.
+var ErrSerializationFailure = errors.New("could not serialize access due to concurrent update")
+
+// ErrTxAborted is returned by MemoryDatabase queries run in a transaction after an earlier query in the same
+// transaction violated a constraint.
+var ErrTxAborted = errors.New("current transaction is aborted, commands ignored until end of transaction block")
+
+// SQLSTATE codes of the constraint violations reported by a MemoryDatabase.
+const (
+	checkViolation      pq.ErrorCode = "23514"
+	notNullViolation    pq.ErrorCode = "23502"
+	foreignKeyViolation pq.ErrorCode = "23503"
+	uniqueViolation     pq.ErrorCode = "23505"
+)
+
+// integrityConstraintViolation is the SQLSTATE class of constraint violations.
+const integrityConstraintViolation pq.ErrorClass = "23"
+
+// violation returns an error indicating that a statement would violate a constraint in the database schema. The error
+// has the same type and code that PostgreSQL would report, so that callers handle both repositories the same way.
+// Like PostgreSQL, a MemoryDatabase aborts the transaction that a constraint violation occurs in.
+func violation(code pq.ErrorCode, format string, args ...any) error {
+	return &pq.Error{Severity: pq.Efatal, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// Rows in the tables of a MemoryDatabase that aren't described by one of the types returned by the repository.
+type (
+	memoryPlan struct {
+		ID              string
+		Name            string
+		Description     string
+		GracePeriodDays int
+	}
+
+	memoryPlanQuotaDefault struct {
+		ID             string
+		PlanID         string
+		ResourceTypeID string
+		QuotaValue     float64
+		EffectiveDate  time.Time
+	}
+
+	memorySubscription struct {
+		ID                 string
+		UserID             string
+		PlanID             string
+		PlanRateID         string
+		PlanVersionID      string
+		ActivatedAt        time.Time
+		CancelledAt        time.Time
+		CancelledBy        string
+		CancellationReason string
+		EffectiveStartDate time.Time
+		EffectiveEndDate   time.Time
+		Paid               bool
+		CreatedBy          string
+		CreatedAt          time.Time
+		LastModifiedBy     string
+		LastModifiedAt     time.Time
+	}
+
+	memoryAmount struct {
+		ID             string
+		SubscriptionID string
+		ResourceTypeID string
+		Value          float64
+		CreatedBy      string
+		CreatedAt      time.Time
+		LastModifiedBy string
+		LastModifiedAt time.Time
+	}
+
+	memoryUpdate struct {
+		ID             string
+		ValueType      string
+		Value          float64
+		EffectiveDate  time.Time
+		OperationID    string
+		ResourceTypeID string
+		UserID         string
+		Metadata       string
+		CreatedBy      string
+		CreatedAt      time.Time
+		LastModifiedBy string
+		LastModifiedAt time.Time
+	}
+
+	memoryAddon struct {
+		ID             string
+		Name           string
+		Description    string
+		ResourceTypeID string
+		DefaultAmount  float64
+		DefaultPaid    bool
+	}
+
+	memorySubscriptionAddon struct {
+		ID             string
+		SubscriptionID string
+		AddonID        string
+		AddonRateID    string
+		Amount         float64
+		Paid           bool
+	}
+
+	memoryGroupMember struct {
+		GroupID   string
+		UserID    string
+		CreatedBy string
+		CreatedAt time.Time
+	}
+
+	memoryGroupSubscription struct {
+		ID                 string
+		GroupID            string
+		PlanID             string
+		EffectiveStartDate time.Time
+		EffectiveEndDate   time.Time
+		Paid               bool
+		CreatedBy          string
+		CreatedAt          time.Time
+		LastModifiedBy     string
+		LastModifiedAt     time.Time
+	}
+)
+
+// memoryState contains the tables of a MemoryDatabase. Rows are kept in insertion order, which is the order that
+// PostgreSQL usually returns rows in when a query doesn't specify one. None of the row types contain references to
+// mutable data, so copying the slices is enough to take a snapshot of the database.
+type memoryState struct {
+	users              []User
+	resourceTypes      []ResourceType
+	operations         []UpdateOperation
+	plans              []memoryPlan
+	planQuotaDefaults  []memoryPlanQuotaDefault
+	planRates          []PlanRate
+	planVersions       []PlanVersion
+	subscriptions      []memorySubscription
+	quotas             []memoryAmount
+	usages             []memoryAmount
+	updates            []memoryUpdate
+	addons             []memoryAddon
+	addonRates         []AddonRate
+	subscriptionAddons []memorySubscriptionAddon
+	auditLog           []AuditRecord
+	groups             []Group
+	groupMembers       []memoryGroupMember
+	groupSubscriptions []memoryGroupSubscription
+	groupQuotas        []memoryAmount
+	usageRollups       []UsageRollup
+	rollupWatermark    time.Time
+}
+
+// clone returns a snapshot of the state.
+func (s *memoryState) clone() *memoryState {
+	return &memoryState{
+		users:              slices.Clone(s.users),
+		resourceTypes:      slices.Clone(s.resourceTypes),
+		operations:         slices.Clone(s.operations),
+		plans:              slices.Clone(s.plans),
+		planQuotaDefaults:  slices.Clone(s.planQuotaDefaults),
+		planRates:          slices.Clone(s.planRates),
+		planVersions:       slices.Clone(s.planVersions),
+		subscriptions:      slices.Clone(s.subscriptions),
+		quotas:             slices.Clone(s.quotas),
+		usages:             slices.Clone(s.usages),
+		updates:            slices.Clone(s.updates),
+		addons:             slices.Clone(s.addons),
+		addonRates:         slices.Clone(s.addonRates),
+		subscriptionAddons: slices.Clone(s.subscriptionAddons),
+		auditLog:           slices.Clone(s.auditLog),
+		groups:             slices.Clone(s.groups),
+		groupMembers:       slices.Clone(s.groupMembers),
+		groupSubscriptions: slices.Clone(s.groupSubscriptions),
+		groupQuotas:        slices.Clone(s.groupQuotas),
+		usageRollups:       slices.Clone(s.usageRollups),
+		rollupWatermark:    s.rollupWatermark,
+	}
+}
+
+// find returns the first row that matches a predicate along with its index. The index is -1 if no row matches.
+func find[T any](rows []T, match func(T) bool) (T, int) {
+	for i, row := range rows {
+		if match(row) {
+			return row, i
+		}
+	}
+	var zero T
+	return zero, -1
+}
+
+// MemoryDatabase is a Repository that keeps its data in memory. It's intended for testing code that uses the
+// database without PostgreSQL, so it enforces the same constraints and returns the same results as Database.
+//
+// Each method call that isn't part of a transaction is applied atomically. Transactions are serializable, and
+// stricter than PostgreSQL's SERIALIZABLE isolation level: they work on a snapshot of the data taken when they begin,
+// and committing a transaction that has made changes fails with ErrSerializationFailure if any other change was
+// committed in the meantime, even if the two transactions didn't touch the same rows. The service runs its
+// transactions at PostgreSQL's default READ COMMITTED level, where most of those commits would succeed, so tests
+// that interleave transactions should only expect a conflict from this database. As in PostgreSQL, a constraint
+// violation aborts the transaction that it occurs in.
+type MemoryDatabase struct {
+	mu      sync.Mutex
+	state   *memoryState
+	version uint64
+}
+
+// NewMemoryDatabase returns a MemoryDatabase containing the resource types, update operations and usage rollup
+// watermark that are added to the database when the schema is created.
+func NewMemoryDatabase() *MemoryDatabase {
+	return &MemoryDatabase{
+		state: &memoryState{
+			resourceTypes: []ResourceType{
+				{ID: uuid.NewString(), Name: "cpu.hours", Unit: "cpu hours", Consumable: true},
+				{ID: uuid.NewString(), Name: "data.size", Unit: "bytes", Consumable: false},
+			},
+			operations: []UpdateOperation{
+				{ID: uuid.NewString(), Name: UpdateTypeAdd},
+				{ID: uuid.NewString(), Name: UpdateTypeSet},
+			},
+			rollupWatermark: time.Unix(0, 0),
+		},
+	}
+}
+
+// memoryTx is a transaction started by a MemoryDatabase.
+type memoryTx struct {
+	mu      sync.Mutex
+	db      *MemoryDatabase
+	state   *memoryState
+	version uint64
+	dirty   bool
+	aborted bool
+	done    bool
+}
+
+// Begin starts a new transaction.
+func (m *MemoryDatabase) Begin() (Tx, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return &memoryTx{db: m, state: m.state.clone(), version: m.version}, nil
+}
+
+// Commit makes the changes made in the transaction visible outside of it. Committing an aborted transaction rolls it
+// back instead. Conflicts are detected for the database as a whole rather than for individual rows, so the commit
+// fails with ErrSerializationFailure if the transaction made changes and any other change was committed after it
+// began.
+func (tx *memoryTx) Commit() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	if tx.aborted {
+		return ErrTxAborted
+	}
+	if !tx.dirty {
+		return nil
+	}
+
+	tx.db.mu.Lock()
+	defer tx.db.mu.Unlock()
+
+	if tx.db.version != tx.version {
+		return ErrSerializationFailure
+	}
+	tx.db.state = tx.state
+	tx.db.version++
+
+	return nil
+}
+
+// Rollback discards the changes made in the transaction.
+func (tx *memoryTx) Rollback() error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	tx.done = true
+
+	return nil
+}
+
+// Wrap calls the function and commits the transaction if it succeeds or rolls the transaction back if it fails.
+func (tx *memoryTx) Wrap(fn func() error) (err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			panic(p)
+		}
+		if err != nil {
+			if rollbackErr := tx.Rollback(); rollbackErr != nil {
+				err = rollbackErr
+			}
+		} else {
+			err = tx.Commit()
+		}
+	}()
+	return fn()
+}
+
+// memoryTX returns the MemoryDatabase transaction that the query settings refer to, or nil if the query isn't part
+// of a transaction.
+func (m *MemoryDatabase) memoryTX(qs *QuerySettings) (*memoryTx, error) {
+	if qs.tx == nil {
+		return nil, nil
+	}
+	tx, ok := qs.tx.(*memoryTx)
+	if !ok || tx.db != m {
+		return nil, fmt.Errorf("unsupported transaction type for the in-memory database: %T", qs.tx)
+	}
+	return tx, nil
+}
+
+// run executes a statement against the data visible to a query. Statements that change data are applied to a copy
+// of the data, which replaces the original if the statement succeeds.
+func (m *MemoryDatabase) run(qs *QuerySettings, modify bool, statement func(s *memoryState) error) error {
+	tx, err := m.memoryTX(qs)
+	if err != nil {
+		return err
+	}
+
+	// Statements that aren't part of a transaction are applied directly to the committed data.
+	if tx == nil {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		if !modify {
+			return statement(m.state)
+		}
+
+		state := m.state.clone()
+		if err = statement(state); err != nil {
+			return err
+		}
+		m.state = state
+		m.version++
+		return nil
+	}
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	if tx.done {
+		return sql.ErrTxDone
+	}
+	if tx.aborted {
+		return ErrTxAborted
+	}
+
+	if !modify {
+		return statement(tx.state)
+	}
+
+	state := tx.state.clone()
+	if err = statement(state); err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code.Class() == integrityConstraintViolation {
+			tx.aborted = true
+		}
+		return err
+	}
+	tx.state = state
+	tx.dirty = true
+	return nil
+}
+
+// query runs a statement that only reads data.
+func (m *MemoryDatabase) query(opts []QueryOption, statement func(qs *QuerySettings, s *memoryState) error) error {
+	qs := newQuerySettings(opts...)
+	return m.run(qs, false, func(s *memoryState) error {
+		return statement(qs, s)
+	})
+}
+
+// exec runs a statement that changes data.
+func (m *MemoryDatabase) exec(opts []QueryOption, statement func(qs *QuerySettings, s *memoryState) error) error {
+	qs := newQuerySettings(opts...)
+	return m.run(qs, true, func(s *memoryState) error {
+		return statement(qs, s)
+	})
+}
+
+// withTransaction calls a function with a transaction, starting a new one if the options don't include one. As
+// with Database methods that use querySettingsWithTX, the transaction is committed if the function succeeds and
+// rolled back if it fails, unless the options say otherwise.
+func (m *MemoryDatabase) withTransaction(opts []QueryOption, fn func(tx Tx) error) error {
+	qs := newQuerySettings(opts...)
+
+	tx, doRollback, doCommit := qs.tx, qs.doRollback, qs.doCommit
+	if tx == nil {
+		var err error
+		if tx, err = m.Begin(); err != nil {
+			return err
+		}
+		doRollback, doCommit = true, true
+	}
+
+	if doRollback {
+		defer func() {
+			_ = tx.Rollback()
+		}()
+	}
+
+	if err := fn(tx); err != nil {
+		return err
+	}
+
+	if doCommit {
+		return tx.Commit()
+	}
+	return nil
+}
+
+// limitRows applies the limit and offset in the query settings to a list of rows.
+func limitRows[T any](qs *QuerySettings, rows []T) []T {
+	if qs.hasOffset {
+		if qs.offset >= uint(len(rows)) {
+			return nil
+		}
+		rows = rows[qs.offset:]
+	}
+	if qs.hasLimit && qs.limit < uint(len(rows)) {
+		rows = rows[:qs.limit]
+	}
+	return rows
+}
+
+// isActive returns true if a subscription is in effect at the given time. Subscriptions without an end date never
+// expire.
+func (r memorySubscription) isActive(now time.Time) bool {
+	if r.EffectiveEndDate.IsZero() {
+		return now.After(r.EffectiveStartDate)
+	}
+	return !now.Before(r.EffectiveStartDate) && !now.After(r.EffectiveEndDate)
+}
+
+// resourceType looks up a resource type by ID.
+func (s *memoryState) resourceType(id string) (ResourceType, bool) {
+	rt, i := find(s.resourceTypes, func(rt ResourceType) bool { return rt.ID == id })
+	return rt, i >= 0
+}
+
+// user looks up a user by ID.
+func (s *memoryState) user(id string) (User, bool) {
+	user, i := find(s.users, func(u User) bool { return u.ID == id })
+	return user, i >= 0
+}
+
+// userByName looks up a user by username.
+func (s *memoryState) userByName(username string) (User, bool) {
+	user, i := find(s.users, func(u User) bool { return u.Username == username })
+	return user, i >= 0
+}
+
+// requireResourceType returns a foreign key violation if a resource type doesn't exist.
+func (s *memoryState) requireResourceType(table, id string) error {
+	if _, ok := s.resourceType(id); !ok {
+		return violation(foreignKeyViolation, "insert or update on table %q violates foreign key constraint: resource type %q not found", table, id)
+	}
+	return nil
+}
+
+// requirePlanVersion returns a foreign key violation if a plan version doesn't exist.
+func (s *memoryState) requirePlanVersion(table, id string) error {
+	if _, i := find(s.planVersions, func(v PlanVersion) bool { return v.ID == id }); i < 0 {
+		return violation(foreignKeyViolation, "insert or update on table %q violates foreign key constraint: plan version %q not found", table, id)
+	}
+	return nil
+}
+
+// requireSubscription returns a foreign key violation if a subscription doesn't exist.
+func (s *memoryState) requireSubscription(table, id string) error {
+	if _, i := find(s.subscriptions, func(r memorySubscription) bool { return r.ID == id }); i < 0 {
+		return violation(foreignKeyViolation, "insert or update on table %q violates foreign key constraint: subscription %q not found", table, id)
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package db
+
+import (
+	"context"
+	"errors"
+	"slices"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/google/uuid"
+	pkgerrors "github.com/pkg/errors"
+)
+
+// addon joins an add-on to its resource type. The add-on rates aren't included.
+func (s *memoryState) addon(r memoryAddon) (Addon, bool) {
+	rt, ok := s.resourceType(r.ResourceTypeID)
+	if !ok {
+		return Addon{}, false
+	}
+	return Addon{
+		ID:            r.ID,
+		Name:          r.Name,
+		Description:   r.Description,
+		ResourceType:  rt,
+		DefaultAmount: r.DefaultAmount,
+		DefaultPaid:   r.DefaultPaid,
+	}, true
+}
+
+// addonRatesFor returns the rates of an add-on, oldest first.
+func (s *memoryState) addonRatesFor(addonID string) []AddonRate {
+	var rates []AddonRate
+	for _, r := range s.addonRates {
+		if r.AddonID == addonID {
+			rates = append(rates, r)
+		}
+	}
+	slices.SortStableFunc(rates, func(a, b AddonRate) int {
+		return a.EffectiveDate.Compare(b.EffectiveDate)
+	})
+	return rates
+}
+
+// addonDetails looks up an add-on along with its rates.
+func (s *memoryState) addonDetails(addonID string) (Addon, bool) {
+	r, i := find(s.addons, func(r memoryAddon) bool { return r.ID == addonID })
+	if i < 0 {
+		return Addon{}, false
+	}
+	addon, ok := s.addon(r)
+	if !ok {
+		return Addon{}, false
+	}
+	addon.AddonRates = s.addonRatesFor(addonID)
+	return addon, true
+}
+
+// AddAddon adds an add-on along with its rates and returns the ID of the new add-on.
+func (m *MemoryDatabase) AddAddon(ctx context.Context, addon *Addon, opts ...QueryOption) (string, error) {
+	var newAddonID string
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		if err := s.requireResourceType("addons", addon.ResourceType.ID); err != nil {
+			return err
+		}
+		newAddonID = uuid.NewString()
+		s.addons = append(s.addons, memoryAddon{
+			ID:             newAddonID,
+			Name:           addon.Name,
+			Description:    addon.Description,
+			ResourceTypeID: addon.ResourceType.ID,
+			DefaultAmount:  addon.DefaultAmount,
+			DefaultPaid:    addon.DefaultPaid,
+		})
+
+		// Database inserts the rates in a single statement, which inserts a row of default values if there are no rates.
+		if len(addon.AddonRates) == 0 {
+			return violation(notNullViolation, "null value in column \"addon_id\" of relation \"addon_rates\" violates not-null constraint")
+		}
+		for _, r := range addon.AddonRates {
+			s.addonRates = append(s.addonRates, AddonRate{
+				ID:            uuid.NewString(),
+				AddonID:       newAddonID,
+				EffectiveDate: r.EffectiveDate,
+				Rate:          r.Rate,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return newAddonID, nil
+}
+
+// GetAddonByID returns the add-on with the given ID along with its rates.
+func (m *MemoryDatabase) GetAddonByID(ctx context.Context, addonID string, opts ...QueryOption) (*Addon, error) {
+	var (
+		addon Addon
+		found bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		addon, found = s.addonDetails(addonID)
+		return nil
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to get add-on info")
+	} else if !found {
+		return nil, suberrors.ErrAddonNotFound.WithField("addon_id", addonID)
+	}
+	return &addon, nil
+}
+
+// ListAddons returns all of the add-ons along with their rates.
+func (m *MemoryDatabase) ListAddons(ctx context.Context, opts ...QueryOption) ([]Addon, error) {
+	var addons []Addon
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.addons {
+			if addon, ok := s.addonDetails(r.ID); ok {
+				addons = append(addons, addon)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to list addons")
+	}
+	return addons, nil
+}
+
+// ListRatesForAddon returns the rates of an add-on, oldest first.
+func (m *MemoryDatabase) ListRatesForAddon(ctx context.Context, addonID string, opts ...QueryOption) ([]AddonRate, error) {
+	var rates []AddonRate
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		rates = s.addonRatesFor(addonID)
+		return nil
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrapf(err, "unable to list rates for addon ID %s", addonID)
+	}
+	return rates, nil
+}
+
+// ToggleAddonPaid flips the default paid flag of an add-on and returns the updated add-on without its rates. Like
+// Database, the change is always made in a transaction of its own. The fields of the add-on are empty if it
+// doesn't exist.
+func (m *MemoryDatabase) ToggleAddonPaid(ctx context.Context, addonID string, opts ...QueryOption) (*Addon, error) {
+	var retval Addon
+	err := m.exec(nil, func(_ *QuerySettings, s *memoryState) error {
+		if _, i := find(s.addons, func(r memoryAddon) bool { return r.ID == addonID }); i >= 0 {
+			s.addons[i].DefaultPaid = !s.addons[i].DefaultPaid
+			retval, _ = s.addon(s.addons[i])
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &retval, nil
+}
+
+// UpsertAddonRate inserts an add-on rate, or updates the existing rate with the same ID.
+func (m *MemoryDatabase) UpsertAddonRate(ctx context.Context, r AddonRate, opts ...QueryOption) error {
+	return m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		if _, i := find(s.addons, func(a memoryAddon) bool { return a.ID == r.AddonID }); i < 0 {
+			return violation(foreignKeyViolation, "insert or update on table \"addon_rates\" violates foreign key constraint: add-on %q not found", r.AddonID)
+		}
+		if r.ID != "" {
+			if _, i := find(s.addonRates, func(ar AddonRate) bool { return ar.ID == r.ID }); i >= 0 {
+				s.addonRates[i] = r
+				return nil
+			}
+		} else {
+			r.ID = uuid.NewString()
+		}
+		s.addonRates = append(s.addonRates, r)
+		return nil
+	})
+}
+
+// UpdateAddonRates replaces the rates of an add-on with the rates in the update record. Existing rates that aren't
+// mentioned in the update record are deleted, but only if the record refers to at least one existing rate.
+func (m *MemoryDatabase) UpdateAddonRates(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error {
+	var addonRateIDs []string
+	for _, r := range addonUpdateRecord.AddonRates {
+		if r.ID != "" {
+			addonRateIDs = append(addonRateIDs, r.ID)
+		}
+	}
+	if len(addonRateIDs) != 0 {
+		err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+			var remaining []AddonRate
+			for _, r := range s.addonRates {
+				if r.AddonID != addonUpdateRecord.ID || slices.Contains(addonRateIDs, r.ID) {
+					remaining = append(remaining, r)
+					continue
+				}
+				if _, i := find(s.subscriptionAddons, func(sa memorySubscriptionAddon) bool { return sa.AddonRateID == r.ID }); i >= 0 {
+					return violation(
+						foreignKeyViolation,
+						"update or delete on table \"addon_rates\" violates foreign key constraint: add-on rate %q is still in use",
+						r.ID,
+					)
+				}
+			}
+			s.addonRates = remaining
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, r := range addonUpdateRecord.AddonRates {
+		if err := m.UpsertAddonRate(ctx, r, opts...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// UpdateAddon updates the fields of an add-on that are flagged for update in the update record.
+func (m *MemoryDatabase) UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error {
+	u := addonUpdateRecord
+
+	// Update the top-level add-on record if requested.
+	if u.UpdateName || u.UpdateDescription || u.UpdateResourceType || u.UpdateDefaultAmount || u.UpdateDefaultPaid {
+		err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+			_, i := find(s.addons, func(r memoryAddon) bool { return r.ID == u.ID })
+			if i < 0 {
+				return suberrors.ErrAddonNotFound
+			}
+			if u.UpdateName {
+				s.addons[i].Name = u.Name
+			}
+			if u.UpdateDescription {
+				s.addons[i].Description = u.Description
+			}
+			if u.UpdateResourceType {
+				if err := s.requireResourceType("addons", u.ResourceTypeID); err != nil {
+					return err
+				}
+				s.addons[i].ResourceTypeID = u.ResourceTypeID
+			}
+			if u.UpdateDefaultAmount {
+				s.addons[i].DefaultAmount = u.DefaultAmount
+			}
+			if u.UpdateDefaultPaid {
+				s.addons[i].DefaultPaid = u.DefaultPaid
+			}
+			return nil
+		})
+		if errors.Is(err, suberrors.ErrAddonNotFound) {
+			return err
+		} else if err != nil {
+			return pkgerrors.Wrap(err, "unable to execute the update")
+		}
+	}
+
+	// Update existing add-on rates.
+	if u.UpdateAddonRates {
+		if err := m.UpdateAddonRates(ctx, u, opts...); err != nil {
+			return pkgerrors.Wrap(err, "unable to update the addon rates for the addon")
+		}
+	}
+
+	return nil
+}
+
+// DeleteAddon deletes an add-on along with its rates. Add-ons that have been applied to subscriptions can't be
+// deleted.
+func (m *MemoryDatabase) DeleteAddon(ctx context.Context, addonID string, opts ...QueryOption) error {
+	return m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		if _, i := find(s.subscriptionAddons, func(sa memorySubscriptionAddon) bool { return sa.AddonID == addonID }); i >= 0 {
+			return violation(foreignKeyViolation, "update or delete on table \"addons\" violates foreign key constraint: add-on %q is still in use", addonID)
+		}
+		s.addons = slices.DeleteFunc(s.addons, func(r memoryAddon) bool { return r.ID == addonID })
+		s.addonRates = slices.DeleteFunc(s.addonRates, func(r AddonRate) bool { return r.AddonID == addonID })
+		return nil
+	})
+}
+
+// subscriptionAddon joins a subscription add-on to its add-on and add-on rate. The rates of the add-on aren't
+// included.
+func (s *memoryState) subscriptionAddon(r memorySubscriptionAddon) (SubscriptionAddon, bool) {
+	addonRow, addonIndex := find(s.addons, func(a memoryAddon) bool { return a.ID == r.AddonID })
+	rate, rateIndex := find(s.addonRates, func(ar AddonRate) bool { return ar.ID == r.AddonRateID })
+	if addonIndex < 0 || rateIndex < 0 {
+		return SubscriptionAddon{}, false
+	}
+	addon, ok := s.addon(addonRow)
+	if !ok {
+		return SubscriptionAddon{}, false
+	}
+
+	// Database doesn't select the add-on ID of the rate.
+	rate.AddonID = ""
+	return SubscriptionAddon{
+		ID:             r.ID,
+		Addon:          addon,
+		SubscriptionID: r.SubscriptionID,
+		Amount:         r.Amount,
+		Paid:           r.Paid,
+		Rate:           rate,
+	}, true
+}
+
+// listSubscriptionAddons returns the subscription add-ons that match a predicate.
+func (m *MemoryDatabase) listSubscriptionAddons(
+	opts []QueryOption, match func(memorySubscriptionAddon) bool,
+) ([]SubscriptionAddon, error) {
+	var addons []SubscriptionAddon
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.subscriptionAddons {
+			if !match(r) {
+				continue
+			}
+			if subAddon, ok := s.subscriptionAddon(r); ok {
+				addons = append(addons, subAddon)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, pkgerrors.Wrap(err, "unable to list addons")
+	}
+	return addons, nil
+}
+
+// GetSubscriptionAddonByID returns the subscription add-on with the given ID.
+func (m *MemoryDatabase) GetSubscriptionAddonByID(ctx context.Context, subAddonID string, opts ...QueryOption) (*SubscriptionAddon, error) {
+	addons, err := m.listSubscriptionAddons(opts, func(r memorySubscriptionAddon) bool { return r.ID == subAddonID })
+	if err != nil {
+		return nil, err
+	}
+	if len(addons) == 0 {
+		return nil, suberrors.ErrSubAddonNotFound
+	}
+	return &addons[0], nil
+}
+
+// ListSubscriptionAddons returns the add-ons applied to a subscription.
+func (m *MemoryDatabase) ListSubscriptionAddons(
+	ctx context.Context,
+	subscriptionID string,
+	opts ...QueryOption,
+) ([]SubscriptionAddon, error) {
+	return m.listSubscriptionAddons(opts, func(r memorySubscriptionAddon) bool { return r.SubscriptionID == subscriptionID })
+}
+
+// ListSubscriptionAddonsByAddonID returns the subscription add-ons that refer to an add-on.
+func (m *MemoryDatabase) ListSubscriptionAddonsByAddonID(ctx context.Context, addonID string, opts ...QueryOption) ([]SubscriptionAddon, error) {
+	return m.listSubscriptionAddons(opts, func(r memorySubscriptionAddon) bool { return r.AddonID == addonID })
+}
+
+// AddSubscriptionAddon applies an add-on to a subscription using the add-on's default amount and paid flag and its
+// current rate.
+func (m *MemoryDatabase) AddSubscriptionAddon(
+	ctx context.Context,
+	subscriptionID, addonID string,
+	opts ...QueryOption,
+) (*SubscriptionAddon, error) {
+	var retval *SubscriptionAddon
+	err := m.withTransaction(opts, func(tx Tx) error {
+		addon, err := m.GetAddonByID(ctx, addonID, WithTXRollbackCommit(tx, false, false))
+		if err != nil {
+			return err
+		}
+		addonRate := addon.GetCurrentRate()
+		if addonRate == nil {
+			return suberrors.Conflict("no active rate found for addon %s", addon.ID)
+		}
+
+		newAddonID := uuid.NewString()
+		err = m.exec([]QueryOption{WithTX(tx)}, func(_ *QuerySettings, s *memoryState) error {
+			if err := s.requireSubscription("subscription_addons", subscriptionID); err != nil {
+				return err
+			}
+			s.subscriptionAddons = append(s.subscriptionAddons, memorySubscriptionAddon{
+				ID:             newAddonID,
+				SubscriptionID: subscriptionID,
+				AddonID:        addonID,
+				AddonRateID:    addonRate.ID,
+				Amount:         addon.DefaultAmount,
+				Paid:           addon.DefaultPaid,
+			})
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		retval = &SubscriptionAddon{
+			ID:             newAddonID,
+			Addon:          *addon,
+			SubscriptionID: subscriptionID,
+			Amount:         addon.DefaultAmount,
+			Paid:           addon.DefaultPaid,
+			Rate:           *addonRate,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
+
+// DeleteSubscriptionAddon removes an add-on from a subscription.
+func (m *MemoryDatabase) DeleteSubscriptionAddon(ctx context.Context, subAddonID string, opts ...QueryOption) error {
+	return m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		s.subscriptionAddons = slices.DeleteFunc(s.subscriptionAddons, func(r memorySubscriptionAddon) bool {
+			return r.ID == subAddonID
+		})
+		return nil
+	})
+}
+
+// UpdateSubscriptionAddon updates the amount or paid flag of a subscription add-on, and returns the updated
+// subscription add-on.
+func (m *MemoryDatabase) UpdateSubscriptionAddon(ctx context.Context, updated *UpdateSubscriptionAddon, opts ...QueryOption) (*SubscriptionAddon, error) {
+	if !updated.UpdateAmount && !updated.UpdatePaid {
+		return nil, errors.New("goqu: no update values provided")
+	}
+
+	var retval *SubscriptionAddon
+	err := m.withTransaction(opts, func(tx Tx) error {
+		err := m.exec([]QueryOption{WithTX(tx)}, func(_ *QuerySettings, s *memoryState) error {
+			_, i := find(s.subscriptionAddons, func(r memorySubscriptionAddon) bool { return r.ID == updated.ID })
+			if i < 0 {
+				return suberrors.ErrSubAddonNotFound
+			}
+			if updated.UpdateAmount {
+				s.subscriptionAddons[i].Amount = updated.Amount
+			}
+			if updated.UpdatePaid {
+				s.subscriptionAddons[i].Paid = updated.Paid
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		retval, err = m.GetSubscriptionAddonByID(ctx, updated.ID, WithTXRollbackCommit(tx, false, false))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return retval, nil
+}
@@ -0,0 +1,275 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// exportedSubscription is a subscription that matches an export filter, along with its user and plan.
+type exportedSubscription struct {
+	row      memorySubscription
+	username string
+	planName string
+}
+
+// matchesTime returns true if a subscription was in effect at any time in the range of an export filter.
+func (f *ExportFilter) matchesTime(r memorySubscription) bool {
+	if !f.Start.IsZero() && !r.EffectiveEndDate.IsZero() && r.EffectiveEndDate.Before(f.Start) {
+		return false
+	}
+	if !f.End.IsZero() && !r.EffectiveStartDate.Before(f.End) {
+		return false
+	}
+	return true
+}
+
+// exportedSubscriptions returns the subscriptions that match an export filter, ordered by start date.
+func (s *memoryState) exportedSubscriptions(filter *ExportFilter) []exportedSubscription {
+	var results []exportedSubscription
+	for _, r := range s.subscriptions {
+		user, userFound := s.user(r.UserID)
+		plan, planIndex := find(s.plans, func(p memoryPlan) bool { return p.ID == r.PlanID })
+		if !userFound || planIndex < 0 || !filter.matchesTime(r) {
+			continue
+		}
+		if filter.PlanName != "" && plan.Name != filter.PlanName {
+			continue
+		}
+		results = append(results, exportedSubscription{row: r, username: user.Username, planName: plan.Name})
+	}
+	slices.SortStableFunc(results, func(a, b exportedSubscription) int {
+		return cmp.Or(
+			a.row.EffectiveStartDate.Compare(b.row.EffectiveStartDate),
+			cmp.Compare(a.row.ID, b.row.ID),
+		)
+	})
+	return results
+}
+
+// optionalTime returns nil for the zero time, which is how a MemoryDatabase stores NULL timestamps.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+// emitRows calls fn with each row. A MemoryDatabase collects the rows of an export while it holds the lock on the
+// database and calls fn after releasing it.
+func emitRows[T any](rows []T, fn func(*T) error) error {
+	for i := range rows {
+		if err := fn(&rows[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExportSubscriptions calls fn with each subscription that matches a filter, ordered by start date.
+func (m *MemoryDatabase) ExportSubscriptions(
+	ctx context.Context, filter *ExportFilter, fn func(*SubscriptionExport) error, opts ...QueryOption,
+) error {
+	var results []SubscriptionExport
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		for _, sub := range s.exportedSubscriptions(filter) {
+			r := sub.row
+			rate, _ := find(s.planRates, func(pr PlanRate) bool { return pr.ID == r.PlanRateID })
+			results = append(results, SubscriptionExport{
+				ID:                 r.ID,
+				Username:           sub.username,
+				PlanName:           sub.planName,
+				Rate:               rate.Rate,
+				Paid:               r.Paid,
+				EffectiveStartDate: r.EffectiveStartDate,
+				EffectiveEndDate:   optionalTime(r.EffectiveEndDate),
+				ActivatedAt:        optionalTime(r.ActivatedAt),
+				CancelledAt:        optionalTime(r.CancelledAt),
+				CancelledBy:        r.CancelledBy,
+				CancellationReason: r.CancellationReason,
+				CreatedBy:          r.CreatedBy,
+				CreatedAt:          r.CreatedAt,
+				LastModifiedBy:     r.LastModifiedBy,
+				LastModifiedAt:     r.LastModifiedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to export subscriptions")
+	}
+	return emitRows(results, fn)
+}
+
+// exportAmounts collects the quotas or usages of the subscriptions that match a filter.
+func (s *memoryState) exportAmounts(amounts []memoryAmount, filter *ExportFilter) []AmountExport {
+	var results []AmountExport
+	for _, sub := range s.exportedSubscriptions(filter) {
+		var rows []AmountExport
+		for _, a := range amounts {
+			rt, ok := s.resourceType(a.ResourceTypeID)
+			if a.SubscriptionID != sub.row.ID || !ok {
+				continue
+			}
+			rows = append(rows, AmountExport{
+				ID:             a.ID,
+				SubscriptionID: a.SubscriptionID,
+				Username:       sub.username,
+				PlanName:       sub.planName,
+				ResourceType:   rt.Name,
+				Unit:           rt.Unit,
+				Value:          a.Value,
+				CreatedBy:      a.CreatedBy,
+				CreatedAt:      a.CreatedAt,
+				LastModifiedBy: a.LastModifiedBy,
+				LastModifiedAt: a.LastModifiedAt,
+			})
+		}
+		slices.SortStableFunc(rows, func(a, b AmountExport) int { return cmp.Compare(a.ResourceType, b.ResourceType) })
+		results = append(results, rows...)
+	}
+	return results
+}
+
+// ExportQuotas calls fn with each quota of the subscriptions that match a filter.
+func (m *MemoryDatabase) ExportQuotas(
+	ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption,
+) error {
+	var results []AmountExport
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		results = s.exportAmounts(s.quotas, filter)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to export quotas")
+	}
+	return emitRows(results, fn)
+}
+
+// ExportUsages calls fn with each usage of the subscriptions that match a filter.
+func (m *MemoryDatabase) ExportUsages(
+	ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption,
+) error {
+	var results []AmountExport
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		results = s.exportAmounts(s.usages, filter)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to export usages")
+	}
+	return emitRows(results, fn)
+}
+
+// ExportSubscriptionAddons calls fn with each add-on applied to the subscriptions that match a filter.
+func (m *MemoryDatabase) ExportSubscriptionAddons(
+	ctx context.Context, filter *ExportFilter, fn func(*SubscriptionAddonExport) error, opts ...QueryOption,
+) error {
+	var results []SubscriptionAddonExport
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		for _, sub := range s.exportedSubscriptions(filter) {
+			var rows []SubscriptionAddonExport
+			for _, sa := range s.subscriptionAddons {
+				if sa.SubscriptionID != sub.row.ID {
+					continue
+				}
+				addon, addonIndex := find(s.addons, func(a memoryAddon) bool { return a.ID == sa.AddonID })
+				rate, rateIndex := find(s.addonRates, func(ar AddonRate) bool { return ar.ID == sa.AddonRateID })
+				if addonIndex < 0 || rateIndex < 0 {
+					continue
+				}
+				rt, ok := s.resourceType(addon.ResourceTypeID)
+				if !ok {
+					continue
+				}
+				rows = append(rows, SubscriptionAddonExport{
+					ID:             sa.ID,
+					SubscriptionID: sa.SubscriptionID,
+					Username:       sub.username,
+					PlanName:       sub.planName,
+					AddonName:      addon.Name,
+					ResourceType:   rt.Name,
+					Unit:           rt.Unit,
+					Amount:         sa.Amount,
+					Paid:           sa.Paid,
+					Rate:           rate.Rate,
+				})
+			}
+			slices.SortStableFunc(rows, func(a, b SubscriptionAddonExport) int {
+				return cmp.Compare(a.AddonName, b.AddonName)
+			})
+			results = append(results, rows...)
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to export subscription add-ons")
+	}
+	return emitRows(results, fn)
+}
+
+// subscribedToPlanAt returns true if a user had a subscription to the named plan in effect at the given time.
+func (s *memoryState) subscribedToPlanAt(userID, planName string, at time.Time) bool {
+	for _, r := range s.subscriptions {
+		if r.UserID != userID || r.EffectiveStartDate.After(at) {
+			continue
+		}
+		if !r.EffectiveEndDate.IsZero() && !r.EffectiveEndDate.After(at) {
+			continue
+		}
+		if _, i := find(s.plans, func(p memoryPlan) bool { return p.ID == r.PlanID && p.Name == planName }); i >= 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ExportUpdates calls fn with each update that matches a filter, ordered by effective date.
+func (m *MemoryDatabase) ExportUpdates(
+	ctx context.Context, filter *ExportFilter, fn func(*UpdateExport) error, opts ...QueryOption,
+) error {
+	var results []UpdateExport
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		for _, r := range s.updates {
+			if !filter.Start.IsZero() && r.EffectiveDate.Before(filter.Start) {
+				continue
+			}
+			if !filter.End.IsZero() && !r.EffectiveDate.Before(filter.End) {
+				continue
+			}
+			if filter.PlanName != "" && !s.subscribedToPlanAt(r.UserID, filter.PlanName, r.EffectiveDate) {
+				continue
+			}
+			update, ok := s.update(r)
+			if !ok {
+				continue
+			}
+			results = append(results, UpdateExport{
+				ID:             r.ID,
+				Username:       update.User.Username,
+				ValueType:      r.ValueType,
+				Operation:      update.UpdateOperation.Name,
+				ResourceType:   update.ResourceType.Name,
+				Unit:           update.ResourceType.Unit,
+				Value:          r.Value,
+				EffectiveDate:  r.EffectiveDate,
+				Metadata:       r.Metadata,
+				CreatedBy:      r.CreatedBy,
+				CreatedAt:      r.CreatedAt,
+				LastModifiedBy: r.LastModifiedBy,
+				LastModifiedAt: r.LastModifiedAt,
+			})
+		}
+		slices.SortStableFunc(results, func(a, b UpdateExport) int {
+			return cmp.Or(a.EffectiveDate.Compare(b.EffectiveDate), cmp.Compare(a.ID, b.ID))
+		})
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to export updates")
+	}
+	return emitRows(results, fn)
+}
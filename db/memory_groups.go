@@ -0,0 +1,479 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// group looks up a group by ID.
+func (s *memoryState) group(id string) (Group, bool) {
+	group, i := find(s.groups, func(g Group) bool { return g.ID == id })
+	return group, i >= 0
+}
+
+// requireGroup returns a foreign key violation if a group doesn't exist.
+func (s *memoryState) requireGroup(table, id string) error {
+	if _, ok := s.group(id); !ok {
+		return violation(foreignKeyViolation, "insert or update on table %q violates foreign key constraint: group %q not found", table, id)
+	}
+	return nil
+}
+
+// isActive returns true if a group subscription is in effect at the given time.
+func (r memoryGroupSubscription) isActive(now time.Time) bool {
+	return !now.Before(r.EffectiveStartDate) && !now.After(r.EffectiveEndDate)
+}
+
+// activeGroupSubscription returns the group's subscription that is in effect at the given time. If more than one
+// subscription is in effect, the one that started most recently is returned.
+func (s *memoryState) activeGroupSubscription(groupID string, now time.Time) (memoryGroupSubscription, bool) {
+	var (
+		result memoryGroupSubscription
+		found  bool
+	)
+	for _, r := range s.groupSubscriptions {
+		if r.GroupID != groupID || !r.isActive(now) {
+			continue
+		}
+		if !found || r.EffectiveStartDate.After(result.EffectiveStartDate) {
+			result, found = r, true
+		}
+	}
+	return result, found
+}
+
+// sortGroups sorts groups by name.
+func sortGroups(groups []Group) {
+	slices.SortFunc(groups, func(a, b Group) int { return cmp.Compare(a.Name, b.Name) })
+}
+
+// AddGroup adds a new group. The ID and the creation and modification details of the group are filled in.
+func (m *MemoryDatabase) AddGroup(ctx context.Context, group *Group, opts ...QueryOption) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if _, i := find(s.groups, func(g Group) bool { return g.Name == group.Name }); i >= 0 {
+			return violation(uniqueViolation, "duplicate key value violates unique constraint: group name %q already exists", group.Name)
+		}
+
+		now := time.Now()
+		group.ID = uuid.NewString()
+		group.CreatedBy = qs.Actor()
+		group.CreatedAt = now
+		group.LastModifiedBy = qs.Actor()
+		group.LastModifiedAt = now
+		s.groups = append(s.groups, *group)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to add group %s", group.Name)
+	}
+	return nil
+}
+
+// GetGroupByName returns the group with the given name, or nil if it doesn't exist.
+func (m *MemoryDatabase) GetGroupByName(ctx context.Context, name string, opts ...QueryOption) (*Group, error) {
+	var result *Group
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if group, i := find(s.groups, func(g Group) bool { return g.Name == name }); i >= 0 {
+			result = &group
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up group %s", name)
+	}
+	return result, nil
+}
+
+// ListGroups returns all of the groups, ordered by name.
+func (m *MemoryDatabase) ListGroups(ctx context.Context, opts ...QueryOption) ([]Group, error) {
+	var results []Group
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		results = slices.Clone(s.groups)
+		sortGroups(results)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list groups")
+	}
+	return results, nil
+}
+
+// ListUserGroups returns the groups that a user belongs to, ordered by name.
+func (m *MemoryDatabase) ListUserGroups(ctx context.Context, username string, opts ...QueryOption) ([]Group, error) {
+	var results []Group
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		user, found := s.userByName(username)
+		if !found {
+			return nil
+		}
+		for _, member := range s.groupMembers {
+			if member.UserID != user.ID {
+				continue
+			}
+			if group, ok := s.group(member.GroupID); ok {
+				results = append(results, group)
+			}
+		}
+		sortGroups(results)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the groups of %s", username)
+	}
+	return results, nil
+}
+
+// DeleteGroup removes a group along with its memberships, subscriptions and pooled quotas. Returns false if the group
+// didn't exist.
+func (m *MemoryDatabase) DeleteGroup(ctx context.Context, groupID string, opts ...QueryOption) (bool, error) {
+	var deleted bool
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		count := len(s.groups)
+		s.groups = slices.DeleteFunc(s.groups, func(g Group) bool { return g.ID == groupID })
+		if deleted = len(s.groups) < count; !deleted {
+			return nil
+		}
+
+		s.groupMembers = slices.DeleteFunc(s.groupMembers, func(r memoryGroupMember) bool { return r.GroupID == groupID })
+		subscriptionIDs := make(map[string]bool)
+		s.groupSubscriptions = slices.DeleteFunc(s.groupSubscriptions, func(r memoryGroupSubscription) bool {
+			if r.GroupID == groupID {
+				subscriptionIDs[r.ID] = true
+			}
+			return r.GroupID == groupID
+		})
+		s.groupQuotas = slices.DeleteFunc(s.groupQuotas, func(r memoryAmount) bool { return subscriptionIDs[r.SubscriptionID] })
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to delete group %s", groupID)
+	}
+	return deleted, nil
+}
+
+// AddGroupMember adds a user to a group. Returns false if the user already belongs to the group.
+func (m *MemoryDatabase) AddGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error) {
+	var added bool
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if err := s.requireGroup("group_members", groupID); err != nil {
+			return err
+		}
+		if _, ok := s.user(userID); !ok {
+			return violation(foreignKeyViolation, "insert or update on table \"group_members\" violates foreign key constraint: user %q not found", userID)
+		}
+		if _, i := find(s.groupMembers, func(r memoryGroupMember) bool {
+			return r.GroupID == groupID && r.UserID == userID
+		}); i >= 0 {
+			return nil
+		}
+
+		s.groupMembers = append(s.groupMembers, memoryGroupMember{
+			GroupID:   groupID,
+			UserID:    userID,
+			CreatedBy: qs.Actor(),
+			CreatedAt: time.Now(),
+		})
+		added = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to add user %s to group %s", userID, groupID)
+	}
+	return added, nil
+}
+
+// RemoveGroupMember removes a user from a group. Returns false if the user didn't belong to the group.
+func (m *MemoryDatabase) RemoveGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error) {
+	var removed bool
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		count := len(s.groupMembers)
+		s.groupMembers = slices.DeleteFunc(s.groupMembers, func(r memoryGroupMember) bool {
+			return r.GroupID == groupID && r.UserID == userID
+		})
+		removed = len(s.groupMembers) < count
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to remove user %s from group %s", userID, groupID)
+	}
+	return removed, nil
+}
+
+// ListGroupMembers returns the members of a group, ordered by username.
+func (m *MemoryDatabase) ListGroupMembers(ctx context.Context, groupID string, opts ...QueryOption) ([]User, error) {
+	var results []User
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, member := range s.groupMembers {
+			if member.GroupID != groupID {
+				continue
+			}
+			if user, ok := s.user(member.UserID); ok {
+				results = append(results, user)
+			}
+		}
+		slices.SortFunc(results, func(a, b User) int { return cmp.Compare(a.Username, b.Username) })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the members of group %s", groupID)
+	}
+	return results, nil
+}
+
+// AddGroupSubscription subscribes a group to a plan starting now, ends the group's current subscription and sets
+// the quotas of the new subscription from the plan's quota defaults. Returns the ID of the new subscription. The
+// start date in the subscription options is ignored, because group subscriptions can't be scheduled.
+func (m *MemoryDatabase) AddGroupSubscription(
+	ctx context.Context, groupID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
+) (string, error) {
+	var subscriptionID string
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if err := s.requireGroup("group_subscriptions", groupID); err != nil {
+			return err
+		}
+		if _, i := find(s.plans, func(p memoryPlan) bool { return p.ID == plan.ID }); i < 0 {
+			return violation(foreignKeyViolation, "insert or update on table \"group_subscriptions\" violates foreign key constraint: plan %q not found", plan.ID)
+		}
+
+		now := time.Now()
+		actor := qs.Actor()
+		if subscriptionOpts.EndDate.Before(now) {
+			return violation(checkViolation, "new row for relation \"group_subscriptions\" violates check constraint: the end date is before the start date")
+		}
+
+		for i := range s.groupSubscriptions {
+			if r := &s.groupSubscriptions[i]; r.GroupID == groupID && r.isActive(now) {
+				r.EffectiveEndDate = now
+				r.LastModifiedBy = actor
+				r.LastModifiedAt = now
+			}
+		}
+
+		subscriptionID = uuid.NewString()
+		s.groupSubscriptions = append(s.groupSubscriptions, memoryGroupSubscription{
+			ID:                 subscriptionID,
+			GroupID:            groupID,
+			PlanID:             plan.ID,
+			EffectiveStartDate: now,
+			EffectiveEndDate:   subscriptionOpts.EndDate,
+			Paid:               subscriptionOpts.Paid,
+			CreatedBy:          actor,
+			CreatedAt:          now,
+			LastModifiedBy:     actor,
+			LastModifiedAt:     now,
+		})
+
+		// Consumable quotas cover every period of the subscription. Other quotas are limits on the amount of the
+		// resource that can be in use at any one time, so they don't depend on the number of periods.
+		for _, quotaDefault := range plan.GetActiveQuotaDefaults() {
+			quotaValue := quotaDefault.QuotaValue
+			if quotaDefault.ResourceType.Consumable {
+				quotaValue *= float64(subscriptionOpts.Periods)
+			}
+			if err := s.upsertGroupQuota(quotaValue, quotaDefault.ResourceType.ID, subscriptionID, actor); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", errors.Wrapf(err, "unable to subscribe group %s to plan %s", groupID, plan.Name)
+	}
+	return subscriptionID, nil
+}
+
+// upsertGroupQuota sets the pooled quota for a resource type in a group subscription.
+func (s *memoryState) upsertGroupQuota(value float64, resourceTypeID, groupSubscriptionID, actor string) error {
+	now := time.Now()
+	if i := findAmount(s.groupQuotas, resourceTypeID, groupSubscriptionID); i >= 0 {
+		s.groupQuotas[i].Value = value
+		s.groupQuotas[i].LastModifiedBy = actor
+		s.groupQuotas[i].LastModifiedAt = now
+		return nil
+	}
+
+	if err := s.requireResourceType("group_quotas", resourceTypeID); err != nil {
+		return err
+	}
+	if _, i := find(s.groupSubscriptions, func(r memoryGroupSubscription) bool { return r.ID == groupSubscriptionID }); i < 0 {
+		return violation(foreignKeyViolation, "insert or update on table \"group_quotas\" violates foreign key constraint: group subscription %q not found", groupSubscriptionID)
+	}
+
+	s.groupQuotas = append(s.groupQuotas, memoryAmount{
+		ID:             uuid.NewString(),
+		SubscriptionID: groupSubscriptionID,
+		ResourceTypeID: resourceTypeID,
+		Value:          value,
+		CreatedBy:      actor,
+		CreatedAt:      now,
+		LastModifiedBy: actor,
+		LastModifiedAt: now,
+	})
+	return nil
+}
+
+// GetActiveGroupSubscription returns the group's subscription that is currently in effect along with its quotas, or
+// nil if the group doesn't have one.
+func (m *MemoryDatabase) GetActiveGroupSubscription(ctx context.Context, groupID string, opts ...QueryOption) (*GroupSubscription, error) {
+	var result *GroupSubscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		r, found := s.activeGroupSubscription(groupID, time.Now())
+		if !found {
+			return nil
+		}
+		plan, _ := find(s.plans, func(p memoryPlan) bool { return p.ID == r.PlanID })
+
+		quotas := make([]GroupQuota, 0)
+		for _, q := range s.groupQuotas {
+			if q.SubscriptionID != r.ID {
+				continue
+			}
+			rt, _ := s.resourceType(q.ResourceTypeID)
+			quotas = append(quotas, GroupQuota{
+				ID:               q.ID,
+				ResourceTypeID:   rt.ID,
+				ResourceTypeName: rt.Name,
+				ResourceTypeUnit: rt.Unit,
+				Quota:            q.Value,
+			})
+		}
+		slices.SortFunc(quotas, func(a, b GroupQuota) int { return cmp.Compare(a.ResourceTypeName, b.ResourceTypeName) })
+
+		result = &GroupSubscription{
+			ID:                 r.ID,
+			GroupID:            r.GroupID,
+			PlanID:             r.PlanID,
+			PlanName:           plan.Name,
+			EffectiveStartDate: r.EffectiveStartDate,
+			EffectiveEndDate:   r.EffectiveEndDate,
+			Paid:               r.Paid,
+			Quotas:             quotas,
+			CreatedBy:          r.CreatedBy,
+			CreatedAt:          r.CreatedAt,
+			LastModifiedBy:     r.LastModifiedBy,
+			LastModifiedAt:     r.LastModifiedAt,
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the active subscription of group %s", groupID)
+	}
+	return result, nil
+}
+
+// UpsertGroupQuota sets the pooled quota for a resource type in a group subscription.
+func (m *MemoryDatabase) UpsertGroupQuota(
+	ctx context.Context, value float64, resourceTypeID, groupSubscriptionID string, opts ...QueryOption,
+) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		return s.upsertGroupQuota(value, resourceTypeID, groupSubscriptionID, qs.Actor())
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the group quota for resource type %s", resourceTypeID)
+	}
+	return nil
+}
+
+// pooledUsage returns the usage of a resource type by the members of a group beyond their personal quotas, counting
+// only the members' subscriptions that are in effect at the given time.
+func (s *memoryState) pooledUsage(groupID, resourceTypeID string, now time.Time) float64 {
+	var total float64
+	for _, member := range s.groupMembers {
+		if member.GroupID != groupID {
+			continue
+		}
+		for _, r := range s.subscriptions {
+			if r.UserID != member.UserID || !r.isActive(now) {
+				continue
+			}
+			i := findAmount(s.usages, resourceTypeID, r.ID)
+			if i < 0 {
+				continue
+			}
+			overflow := s.usages[i].Value
+			if j := findAmount(s.quotas, resourceTypeID, r.ID); j >= 0 {
+				overflow -= s.quotas[j].Value
+			}
+			total += max(overflow, 0)
+		}
+	}
+	return total
+}
+
+// groupAllocations lists the pooled quotas and usages in the active subscriptions of the groups that match a
+// predicate, ordered by group name and resource type name.
+func (s *memoryState) groupAllocations(match func(Group) bool) []GroupAllocation {
+	var results []GroupAllocation
+	now := time.Now()
+	for _, group := range s.groups {
+		if !match(group) {
+			continue
+		}
+		r, found := s.activeGroupSubscription(group.ID, now)
+		if !found {
+			continue
+		}
+		for _, q := range s.groupQuotas {
+			if q.SubscriptionID != r.ID {
+				continue
+			}
+			rt, _ := s.resourceType(q.ResourceTypeID)
+			results = append(results, GroupAllocation{
+				GroupID:             group.ID,
+				GroupName:           group.Name,
+				GroupSubscriptionID: r.ID,
+				ResourceTypeID:      rt.ID,
+				ResourceTypeName:    rt.Name,
+				ResourceTypeUnit:    rt.Unit,
+				QuotaValue:          q.Value,
+				UsageValue:          s.pooledUsage(group.ID, rt.ID, now),
+			})
+		}
+	}
+	slices.SortFunc(results, func(a, b GroupAllocation) int {
+		return cmp.Or(cmp.Compare(a.GroupName, b.GroupName), cmp.Compare(a.ResourceTypeName, b.ResourceTypeName))
+	})
+	return results
+}
+
+// ListGroupAllocations returns the pooled quotas and usages in the group's active subscription.
+func (m *MemoryDatabase) ListGroupAllocations(ctx context.Context, groupID string, opts ...QueryOption) ([]GroupAllocation, error) {
+	var results []GroupAllocation
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		results = s.groupAllocations(func(g Group) bool { return g.ID == groupID })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the allocations of group %s", groupID)
+	}
+	return results, nil
+}
+
+// ListUserGroupAllocations returns the pooled quotas and usages in the active subscriptions of every group that the
+// user belongs to.
+func (m *MemoryDatabase) ListUserGroupAllocations(ctx context.Context, username string, opts ...QueryOption) ([]GroupAllocation, error) {
+	var results []GroupAllocation
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		user, found := s.userByName(username)
+		if !found {
+			return nil
+		}
+		results = s.groupAllocations(func(g Group) bool {
+			_, i := find(s.groupMembers, func(r memoryGroupMember) bool {
+				return r.GroupID == g.ID && r.UserID == user.ID
+			})
+			return i >= 0
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the group allocations of %s", username)
+	}
+	return results, nil
+}
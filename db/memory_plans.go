@@ -0,0 +1,804 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// planDetails joins a plan to its quota defaults and rates, which are sorted in the same order used by Database.
+func (s *memoryState) planDetails(r memoryPlan) Plan {
+	plan := Plan{ID: r.ID, Name: r.Name, Description: r.Description, GracePeriodDays: r.GracePeriodDays}
+
+	for _, pqd := range s.planQuotaDefaults {
+		if pqd.PlanID != r.ID {
+			continue
+		}
+		if quotaDefault, ok := s.planQuotaDefault(pqd); ok {
+			plan.QuotaDefaults = append(plan.QuotaDefaults, quotaDefault)
+		}
+	}
+	slices.SortStableFunc(plan.QuotaDefaults, func(a, b PlanQuotaDefault) int {
+		return cmp.Or(a.EffectiveDate.Compare(b.EffectiveDate), cmp.Compare(a.ResourceType.Name, b.ResourceType.Name))
+	})
+
+	// Database doesn't select the plan ID when it loads the rates for a plan.
+	for _, rate := range s.planRates {
+		if rate.PlanID == r.ID {
+			rate.PlanID = ""
+			plan.Rates = append(plan.Rates, rate)
+		}
+	}
+	slices.SortStableFunc(plan.Rates, func(a, b PlanRate) int {
+		return a.EffectiveDate.Compare(b.EffectiveDate)
+	})
+
+	return plan
+}
+
+// planQuotaDefault joins a plan quota default to its resource type.
+func (s *memoryState) planQuotaDefault(r memoryPlanQuotaDefault) (PlanQuotaDefault, bool) {
+	rt, ok := s.resourceType(r.ResourceTypeID)
+	if !ok {
+		return PlanQuotaDefault{}, false
+	}
+	return PlanQuotaDefault{
+		ID:            r.ID,
+		PlanID:        r.PlanID,
+		QuotaValue:    r.QuotaValue,
+		ResourceType:  rt,
+		EffectiveDate: r.EffectiveDate,
+	}, true
+}
+
+// ListPlans returns all of the plans along with their quota defaults and rates.
+func (m *MemoryDatabase) ListPlans(ctx context.Context, opts ...QueryOption) ([]Plan, error) {
+	var plans []Plan
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.plans {
+			plans = append(plans, s.planDetails(r))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the plans")
+	}
+	return plans, nil
+}
+
+// getPlan returns the first plan that matches a predicate, or nil if there isn't one.
+func (m *MemoryDatabase) getPlan(opts []QueryOption, match func(memoryPlan) bool) (*Plan, error) {
+	var plan *Plan
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if r, i := find(s.plans, match); i >= 0 {
+			details := s.planDetails(r)
+			plan = &details
+		}
+		return nil
+	})
+	return plan, err
+}
+
+// GetPlanByID returns the plan with the given ID, or nil if it doesn't exist.
+func (m *MemoryDatabase) GetPlanByID(ctx context.Context, planID string, opts ...QueryOption) (*Plan, error) {
+	plan, err := m.getPlan(opts, func(p memoryPlan) bool { return p.ID == planID })
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up plan %s", planID)
+	}
+	return plan, nil
+}
+
+// GetPlanByName returns the plan with the given name, or nil if it doesn't exist.
+func (m *MemoryDatabase) GetPlanByName(ctx context.Context, name string, opts ...QueryOption) (*Plan, error) {
+	plan, err := m.getPlan(opts, func(p memoryPlan) bool { return p.Name == name })
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up plan %s", name)
+	}
+	return plan, nil
+}
+
+// AddPlan adds a plan along with its quota defaults and rates, and returns the ID of the new plan.
+func (m *MemoryDatabase) AddPlan(ctx context.Context, plan *Plan, opts ...QueryOption) (string, error) {
+	var newPlanID string
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		if _, i := find(s.plans, func(p memoryPlan) bool { return p.Name == plan.Name }); i >= 0 {
+			return violation(uniqueViolation, "duplicate key value violates unique constraint: plan name %q already exists", plan.Name)
+		}
+		newPlanID = uuid.NewString()
+		s.plans = append(s.plans, memoryPlan{ID: newPlanID, Name: plan.Name, Description: plan.Description})
+
+		for _, pqd := range plan.QuotaDefaults {
+			if err := s.requireResourceType("plan_quota_defaults", pqd.ResourceType.ID); err != nil {
+				return errors.Wrap(err, "unable to add plan quota defaults")
+			}
+			s.planQuotaDefaults = append(s.planQuotaDefaults, memoryPlanQuotaDefault{
+				ID:             uuid.NewString(),
+				PlanID:         newPlanID,
+				ResourceTypeID: pqd.ResourceType.ID,
+				QuotaValue:     pqd.QuotaValue,
+				EffectiveDate:  pqd.EffectiveDate,
+			})
+		}
+
+		for _, pr := range plan.Rates {
+			s.planRates = append(s.planRates, PlanRate{
+				ID:            uuid.NewString(),
+				PlanID:        newPlanID,
+				EffectiveDate: pr.EffectiveDate,
+				Rate:          pr.Rate,
+			})
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return newPlanID, nil
+}
+
+// subscription joins a subscription to its user, plan and plan rate. The plan's quota defaults and rates aren't
+// included.
+func (s *memoryState) subscription(r memorySubscription) (Subscription, bool) {
+	user, userFound := s.user(r.UserID)
+	plan, planIndex := find(s.plans, func(p memoryPlan) bool { return p.ID == r.PlanID })
+	rate, rateIndex := find(s.planRates, func(pr PlanRate) bool { return pr.ID == r.PlanRateID })
+	if !userFound || planIndex < 0 || rateIndex < 0 {
+		return Subscription{}, false
+	}
+
+	// Database doesn't select the plan ID of the rate, and scans the last modified timestamp into a string.
+	rate.PlanID = ""
+
+	var activatedAt, cancelledAt *time.Time
+	if !r.ActivatedAt.IsZero() {
+		activatedAt = &r.ActivatedAt
+	}
+	if !r.CancelledAt.IsZero() {
+		cancelledAt = &r.CancelledAt
+	}
+
+	return Subscription{
+		ID:                 r.ID,
+		EffectiveStartDate: r.EffectiveStartDate,
+		EffectiveEndDate:   r.EffectiveEndDate,
+		User:               user,
+		Plan:               Plan{ID: plan.ID, Name: plan.Name, Description: plan.Description, GracePeriodDays: plan.GracePeriodDays},
+		CreatedBy:          r.CreatedBy,
+		CreatedAt:          r.CreatedAt,
+		LastModifiedBy:     r.LastModifiedBy,
+		LastModifiedAt:     r.LastModifiedAt.Format(time.RFC3339Nano),
+		Paid:               r.Paid,
+		Rate:               rate,
+		PlanVersionID:      r.PlanVersionID,
+		ActivatedAt:        activatedAt,
+		CancelledAt:        cancelledAt,
+		CancelledBy:        r.CancelledBy,
+		CancellationReason: r.CancellationReason,
+	}, true
+}
+
+// activeSubscriptions returns the subscriptions of a user that are currently in effect.
+func (s *memoryState) activeSubscriptions(username string) []Subscription {
+	var results []Subscription
+	now := time.Now()
+	for _, r := range s.subscriptions {
+		if !r.isActive(now) {
+			continue
+		}
+		if sub, ok := s.subscription(r); ok && sub.User.Username == username {
+			results = append(results, sub)
+		}
+	}
+	return results
+}
+
+// activeSubscription returns the active subscription that GetActiveSubscription would return for a user.
+func (s *memoryState) activeSubscription(username string) (Subscription, bool) {
+	active := s.activeSubscriptions(username)
+	if len(active) == 0 {
+		return Subscription{}, false
+	}
+	slices.SortStableFunc(active, func(a, b Subscription) int {
+		return b.EffectiveStartDate.Compare(a.EffectiveStartDate)
+	})
+	return active[0], true
+}
+
+// GetSubscriptionByID returns the subscription with the given ID, or nil if it doesn't exist.
+func (m *MemoryDatabase) GetSubscriptionByID(ctx context.Context, subscriptionID string, opts ...QueryOption) (*Subscription, error) {
+	var (
+		result Subscription
+		found  bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if r, i := find(s.subscriptions, func(r memorySubscription) bool { return r.ID == subscriptionID }); i >= 0 {
+			result, found = s.subscription(r)
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetActiveSubscription returns the active subscription for the username passed in. Returns an error matching
+// ErrNoActiveSubscription if the user doesn't have an active subscription.
+func (m *MemoryDatabase) GetActiveSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
+	var result Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		var ok bool
+		if result, ok = s.activeSubscription(username); !ok {
+			return suberrors.ErrNoActiveSubscription.WithField("username", username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// SetActiveSubscription subscribes a user to a plan starting now, or at the start date in the options if it's in the
+// future, and sets the quotas of the new subscription to
+// the plan's quota defaults. Returns the ID of the new subscription.
+func (m *MemoryDatabase) SetActiveSubscription(
+	ctx context.Context, userID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
+) (string, error) {
+	activePlanRate := plan.GetActiveRate()
+	if activePlanRate == nil {
+		return "", suberrors.Conflict("the %s subscription plan has no effective rate", plan.Name)
+	}
+
+	planVersion, err := m.EnsurePlanVersion(ctx, plan, opts...)
+	if err != nil {
+		return "", err
+	}
+
+	var subscriptionID string
+	err = m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		actor := qs.Actor()
+
+		if _, ok := s.user(userID); !ok {
+			return violation(foreignKeyViolation, "insert or update on table \"subscriptions\" violates foreign key constraint: user %q not found", userID)
+		}
+		if _, i := find(s.plans, func(p memoryPlan) bool { return p.ID == plan.ID }); i < 0 {
+			return violation(foreignKeyViolation, "insert or update on table \"subscriptions\" violates foreign key constraint: plan %q not found", plan.ID)
+		}
+		if _, i := find(s.planRates, func(pr PlanRate) bool { return pr.ID == activePlanRate.ID }); i < 0 {
+			return violation(
+				foreignKeyViolation,
+				"insert or update on table \"subscriptions\" violates foreign key constraint: plan rate %q not found",
+				activePlanRate.ID,
+			)
+		}
+		if err := s.requirePlanVersion("subscriptions", planVersion.ID); err != nil {
+			return err
+		}
+
+		now := time.Now()
+		start, activatedAt := now, now
+		if subscriptionOpts.Scheduled(now) {
+			start, activatedAt = subscriptionOpts.StartDate, time.Time{}
+		}
+
+		subscriptionID = uuid.NewString()
+		s.subscriptions = append(s.subscriptions, memorySubscription{
+			ID:                 subscriptionID,
+			UserID:             userID,
+			PlanID:             plan.ID,
+			PlanRateID:         activePlanRate.ID,
+			PlanVersionID:      planVersion.ID,
+			ActivatedAt:        activatedAt,
+			EffectiveStartDate: start,
+			EffectiveEndDate:   subscriptionOpts.EndDate,
+			Paid:               subscriptionOpts.Paid,
+			CreatedBy:          actor,
+			CreatedAt:          now,
+			LastModifiedBy:     actor,
+			LastModifiedAt:     now,
+		})
+
+		// Add the quota defaults as the quotas for the subscription.
+		for _, quotaDefault := range plan.GetActiveQuotaDefaults() {
+			quotaValue := quotaDefault.QuotaValue * float64(subscriptionOpts.Periods)
+			if quotaDefault.ResourceType.Consumable {
+				quotaValue *= float64(subscriptionOpts.Periods)
+			}
+
+			var err error
+			s.quotas, err = s.insertAmount(
+				"quotas", s.quotas, quotaValue, quotaDefault.ResourceType.ID, subscriptionID, actor,
+			)
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return subscriptionID, nil
+}
+
+// UserHasActivePlan returns true if the user has a subscription that is currently in effect.
+func (m *MemoryDatabase) UserHasActivePlan(ctx context.Context, username string, opts ...QueryOption) (bool, error) {
+	var found bool
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		found = len(s.activeSubscriptions(username)) > 0
+		return nil
+	})
+	return found, err
+}
+
+// UserOnPlan returns true if the user has a subscription to the named plan that is currently in effect.
+func (m *MemoryDatabase) UserOnPlan(ctx context.Context, username, planName string, opts ...QueryOption) (bool, error) {
+	var found bool
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		found = slices.ContainsFunc(s.activeSubscriptions(username), func(sub Subscription) bool {
+			return sub.Plan.Name == planName
+		})
+		return nil
+	})
+	return found, err
+}
+
+// SubscriptionUsages returns the usages associated with a subscription.
+func (m *MemoryDatabase) SubscriptionUsages(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Usage, error) {
+	var usages []Usage
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.usages {
+			if r.SubscriptionID != subscriptionID {
+				continue
+			}
+			rt, ok := s.resourceType(r.ResourceTypeID)
+			if !ok {
+				continue
+			}
+			usages = append(usages, Usage{
+				ID:             r.ID,
+				Usage:          r.Value,
+				SubscriptionID: r.SubscriptionID,
+				ResourceType:   rt,
+				CreatedBy:      r.CreatedBy,
+				CreatedAt:      r.CreatedAt,
+				LastModifiedBy: r.LastModifiedBy,
+				LastModifiedAt: r.LastModifiedAt,
+			})
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usages, nil
+}
+
+// SubscriptionPlanRates returns the rates associated with a plan.
+func (m *MemoryDatabase) SubscriptionPlanRates(ctx context.Context, planID string, opts ...QueryOption) ([]PlanRate, error) {
+	var rates []PlanRate
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.planRates {
+			if r.PlanID == planID {
+				rates = append(rates, r)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return rates, nil
+}
+
+// SubscriptionQuotas returns the quotas associated with a subscription.
+func (m *MemoryDatabase) SubscriptionQuotas(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Quota, error) {
+	var quotas []Quota
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.quotas {
+			if r.SubscriptionID != subscriptionID {
+				continue
+			}
+			if quota, ok := s.quota(r); ok {
+				quotas = append(quotas, quota)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return quotas, nil
+}
+
+// SubscriptionQuotaDefaults returns the quota defaults associated with a plan.
+func (m *MemoryDatabase) SubscriptionQuotaDefaults(ctx context.Context, planID string, opts ...QueryOption) ([]PlanQuotaDefault, error) {
+	var defaults []PlanQuotaDefault
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.planQuotaDefaults {
+			if r.PlanID != planID {
+				continue
+			}
+			if quotaDefault, ok := s.planQuotaDefault(r); ok {
+				defaults = append(defaults, quotaDefault)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return defaults, nil
+}
+
+// LoadSubscriptionDetails adds the plan quota defaults and rates, quotas, usages and add-ons to a subscription.
+func (m *MemoryDatabase) LoadSubscriptionDetails(ctx context.Context, subscription *Subscription, opts ...QueryOption) error {
+	return loadSubscriptionDetails(ctx, m, subscription, opts...)
+}
+
+// clonePlanVersion returns a copy of a plan version that doesn't share its quota defaults with the original.
+func clonePlanVersion(v PlanVersion) PlanVersion {
+	v.QuotaDefaults = slices.Clone(v.QuotaDefaults)
+	return v
+}
+
+// ListPlanVersions returns the versions of a plan, oldest first.
+func (m *MemoryDatabase) ListPlanVersions(ctx context.Context, planID string, opts ...QueryOption) ([]PlanVersion, error) {
+	var versions []PlanVersion
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, v := range s.planVersions {
+			if v.PlanID == planID {
+				versions = append(versions, clonePlanVersion(v))
+			}
+		}
+		slices.SortFunc(versions, func(a, b PlanVersion) int { return cmp.Compare(a.Version, b.Version) })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the versions of plan %s", planID)
+	}
+	return versions, nil
+}
+
+// findPlanVersion returns a copy of the first plan version that matches a predicate, or nil if none match.
+func (m *MemoryDatabase) findPlanVersion(opts []QueryOption, match func(PlanVersion) bool) (*PlanVersion, error) {
+	var result *PlanVersion
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if v, i := find(s.planVersions, match); i >= 0 {
+			v = clonePlanVersion(v)
+			result = &v
+		}
+		return nil
+	})
+	return result, err
+}
+
+// GetPlanVersion returns a version of a plan by number, or nil if the plan doesn't have that version.
+func (m *MemoryDatabase) GetPlanVersion(ctx context.Context, planID string, version int, opts ...QueryOption) (*PlanVersion, error) {
+	result, err := m.findPlanVersion(opts, func(v PlanVersion) bool { return v.PlanID == planID && v.Version == version })
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up version %d of plan %s", version, planID)
+	}
+	return result, nil
+}
+
+// GetPlanVersionByID returns the plan version with the given ID, or nil if it doesn't exist.
+func (m *MemoryDatabase) GetPlanVersionByID(ctx context.Context, planVersionID string, opts ...QueryOption) (*PlanVersion, error) {
+	result, err := m.findPlanVersion(opts, func(v PlanVersion) bool { return v.ID == planVersionID })
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up plan version %s", planVersionID)
+	}
+	return result, nil
+}
+
+// AddPlanVersion stores a new plan version along with its quota defaults. The ID, creator and creation time of the
+// version are filled in.
+func (m *MemoryDatabase) AddPlanVersion(ctx context.Context, version *PlanVersion, opts ...QueryOption) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if _, i := find(s.plans, func(p memoryPlan) bool { return p.ID == version.PlanID }); i < 0 {
+			return violation(foreignKeyViolation, "insert or update on table \"plan_versions\" violates foreign key constraint: plan %q not found", version.PlanID)
+		}
+		if _, i := find(s.planRates, func(pr PlanRate) bool { return pr.ID == version.PlanRateID }); i < 0 {
+			return violation(foreignKeyViolation, "insert or update on table \"plan_versions\" violates foreign key constraint: plan rate %q not found", version.PlanRateID)
+		}
+		if _, i := find(s.planVersions, func(v PlanVersion) bool {
+			return v.PlanID == version.PlanID && v.Version == version.Version
+		}); i >= 0 {
+			return violation(uniqueViolation, "duplicate key value violates unique constraint: version %d of plan %q already exists", version.Version, version.PlanID)
+		}
+		for _, qd := range version.QuotaDefaults {
+			if err := s.requireResourceType("plan_version_quota_defaults", qd.ResourceTypeID); err != nil {
+				return err
+			}
+		}
+
+		version.ID = uuid.NewString()
+		version.CreatedBy = qs.Actor()
+		version.CreatedAt = time.Now()
+		s.planVersions = append(s.planVersions, clonePlanVersion(*version))
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to add version %d of plan %s", version.Version, version.PlanID)
+	}
+	return nil
+}
+
+// EnsurePlanVersion returns the latest version of a plan if it matches the rate and quota defaults that are currently
+// in effect for the plan. Otherwise, a new version is recorded and returned.
+func (m *MemoryDatabase) EnsurePlanVersion(ctx context.Context, plan *Plan, opts ...QueryOption) (*PlanVersion, error) {
+	return ensurePlanVersion(ctx, m, plan, opts...)
+}
+
+// ListActiveSubscriptionsByPlanVersion returns the subscriptions that are currently in effect and were created under,
+// or have been migrated to, the given plan version.
+func (m *MemoryDatabase) ListActiveSubscriptionsByPlanVersion(
+	ctx context.Context, planVersionID string, opts ...QueryOption,
+) ([]Subscription, error) {
+	var results []Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		now := time.Now()
+		for _, r := range s.subscriptions {
+			if r.PlanVersionID != planVersionID || !r.isActive(now) {
+				continue
+			}
+			if sub, ok := s.subscription(r); ok {
+				results = append(results, sub)
+			}
+		}
+		slices.SortFunc(results, func(a, b Subscription) int { return cmp.Compare(a.ID, b.ID) })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the active subscriptions for plan version %s", planVersionID)
+	}
+	return results, nil
+}
+
+// SetSubscriptionPlanVersion moves a subscription to a different version of its plan, along with the rate recorded
+// in that version. The quotas of the subscription aren't changed.
+func (m *MemoryDatabase) SetSubscriptionPlanVersion(
+	ctx context.Context, subscriptionID string, version *PlanVersion, opts ...QueryOption,
+) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		_, i := find(s.subscriptions, func(r memorySubscription) bool { return r.ID == subscriptionID })
+		if i < 0 {
+			return suberrors.ErrSubscriptionNotFound.WithField("subscription_id", subscriptionID)
+		}
+		if err := s.requirePlanVersion("subscriptions", version.ID); err != nil {
+			return err
+		}
+
+		s.subscriptions[i].PlanVersionID = version.ID
+		s.subscriptions[i].PlanRateID = version.PlanRateID
+		s.subscriptions[i].LastModifiedBy = qs.Actor()
+		s.subscriptions[i].LastModifiedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to move subscription %s to plan version %s", subscriptionID, version.ID)
+	}
+	return nil
+}
+
+// sortedSubscriptions returns the subscriptions matching a predicate, ordered by start date.
+func (s *memoryState) sortedSubscriptions(match func(r memorySubscription) bool) []Subscription {
+	var results []Subscription
+	for _, r := range s.subscriptions {
+		if !match(r) {
+			continue
+		}
+		if sub, ok := s.subscription(r); ok {
+			results = append(results, sub)
+		}
+	}
+	slices.SortStableFunc(results, func(a, b Subscription) int {
+		return a.EffectiveStartDate.Compare(b.EffectiveStartDate)
+	})
+	return results
+}
+
+// ListPendingSubscriptions returns the user's subscriptions that were scheduled to start in the future and haven't
+// been activated or cancelled yet, ordered by start date.
+func (m *MemoryDatabase) ListPendingSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error) {
+	var results []Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		user, found := s.userByName(username)
+		results = s.sortedSubscriptions(func(r memorySubscription) bool {
+			return found && r.UserID == user.ID && r.ActivatedAt.IsZero() && r.CancelledAt.IsZero()
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the pending subscriptions for %s", username)
+	}
+	return results, nil
+}
+
+// ListDueSubscriptions returns the pending subscriptions of all users whose start dates have passed, ordered by start
+// date. Cancelled subscriptions are never activated, so they aren't included.
+func (m *MemoryDatabase) ListDueSubscriptions(ctx context.Context, opts ...QueryOption) ([]Subscription, error) {
+	var results []Subscription
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		now := time.Now()
+		results = limitRows(qs, s.sortedSubscriptions(func(r memorySubscription) bool {
+			return r.ActivatedAt.IsZero() && r.CancelledAt.IsZero() && !r.EffectiveStartDate.After(now)
+		}))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the subscriptions that are due to be activated")
+	}
+	return results, nil
+}
+
+// ListSubscriptionsInEffectAt returns the user's activated subscriptions that started before the given time and end
+// after it.
+func (m *MemoryDatabase) ListSubscriptionsInEffectAt(
+	ctx context.Context, userID string, at time.Time, opts ...QueryOption,
+) ([]Subscription, error) {
+	var results []Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		results = s.sortedSubscriptions(func(r memorySubscription) bool {
+			return r.UserID == userID &&
+				!r.ActivatedAt.IsZero() &&
+				r.EffectiveStartDate.Before(at) &&
+				(r.EffectiveEndDate.IsZero() || r.EffectiveEndDate.After(at))
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions in effect for user %s", userID)
+	}
+	return results, nil
+}
+
+// SetSubscriptionEndDate changes the time that a subscription ends.
+func (m *MemoryDatabase) SetSubscriptionEndDate(
+	ctx context.Context, subscriptionID string, endDate time.Time, opts ...QueryOption,
+) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		_, i := find(s.subscriptions, func(r memorySubscription) bool { return r.ID == subscriptionID })
+		if i < 0 {
+			return suberrors.ErrSubscriptionNotFound.WithField("subscription_id", subscriptionID)
+		}
+
+		s.subscriptions[i].EffectiveEndDate = endDate
+		s.subscriptions[i].LastModifiedBy = qs.Actor()
+		s.subscriptions[i].LastModifiedAt = time.Now()
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the end date of subscription %s", subscriptionID)
+	}
+	return nil
+}
+
+// ActivateSubscription records that a pending subscription has been activated. Returns false if the subscription
+// isn't pending.
+func (m *MemoryDatabase) ActivateSubscription(ctx context.Context, subscriptionID string, opts ...QueryOption) (bool, error) {
+	var activated bool
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		_, i := find(s.subscriptions, func(r memorySubscription) bool {
+			return r.ID == subscriptionID && r.ActivatedAt.IsZero()
+		})
+		if i < 0 {
+			return nil
+		}
+
+		now := time.Now()
+		s.subscriptions[i].ActivatedAt = now
+		s.subscriptions[i].LastModifiedBy = qs.Actor()
+		s.subscriptions[i].LastModifiedAt = now
+		activated = true
+		return nil
+	})
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to activate subscription %s", subscriptionID)
+	}
+	return activated, nil
+}
+
+// ListSubscriptions returns all of the user's subscriptions, including subscriptions that have ended and
+// subscriptions that haven't started yet, with the most recent start date first.
+func (m *MemoryDatabase) ListSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error) {
+	var results []Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		user, found := s.userByName(username)
+		results = s.sortedSubscriptions(func(r memorySubscription) bool {
+			return found && r.UserID == user.ID
+		})
+		slices.Reverse(results)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions for %s", username)
+	}
+	return results, nil
+}
+
+// CancelSubscription ends a subscription at the given time and records who cancelled it and why. The reason may be
+// empty. The caller is expected to have checked that the subscription exists; an error matching
+// ErrSubscriptionCancelled is returned if it was already cancelled.
+func (m *MemoryDatabase) CancelSubscription(
+	ctx context.Context, subscriptionID string, endDate time.Time, reason string, opts ...QueryOption,
+) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		_, i := find(s.subscriptions, func(r memorySubscription) bool {
+			return r.ID == subscriptionID && r.CancelledAt.IsZero()
+		})
+		if i < 0 {
+			return suberrors.ErrSubscriptionCancelled.WithField("subscription_id", subscriptionID)
+		}
+
+		now := time.Now()
+		s.subscriptions[i].EffectiveEndDate = endDate
+		s.subscriptions[i].CancelledAt = now
+		s.subscriptions[i].CancelledBy = qs.Actor()
+		s.subscriptions[i].CancellationReason = reason
+		s.subscriptions[i].LastModifiedBy = qs.Actor()
+		s.subscriptions[i].LastModifiedAt = now
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to cancel subscription %s", subscriptionID)
+	}
+	return nil
+}
+
+// SetPlanGracePeriod sets the number of days after a paid subscription to a plan ends during which its quotas still
+// apply.
+func (m *MemoryDatabase) SetPlanGracePeriod(ctx context.Context, planID string, days int, opts ...QueryOption) error {
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		_, i := find(s.plans, func(p memoryPlan) bool { return p.ID == planID })
+		if i < 0 {
+			return suberrors.ErrPlanNotFound.WithField("plan_id", planID)
+		}
+		if days < 0 {
+			return violation(checkViolation, "new row for relation \"plans\" violates check constraint: grace_period_days must not be negative")
+		}
+
+		s.plans[i].GracePeriodDays = days
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the grace period for plan %s", planID)
+	}
+	return nil
+}
+
+// GetGraceSubscription returns the user's most recent paid subscription that ended without being cancelled less than
+// its plan's grace period ago, or nil if there isn't one.
+func (m *MemoryDatabase) GetGraceSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
+	var result *Subscription
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		now := time.Now()
+		user, found := s.userByName(username)
+		candidates := s.sortedSubscriptions(func(r memorySubscription) bool {
+			if !found || r.UserID != user.ID || !r.Paid || !r.CancelledAt.IsZero() || r.EffectiveEndDate.After(now) {
+				return false
+			}
+			plan, i := find(s.plans, func(p memoryPlan) bool { return p.ID == r.PlanID })
+			return i >= 0 && r.EffectiveEndDate.AddDate(0, 0, plan.GracePeriodDays).After(now)
+		})
+		slices.SortStableFunc(candidates, func(a, b Subscription) int {
+			return b.EffectiveEndDate.Compare(a.EffectiveEndDate)
+		})
+		if len(candidates) > 0 {
+			result = &candidates[0]
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the subscription in its grace period for %s", username)
+	}
+	return result, nil
+}
@@ -0,0 +1,295 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// matchesRollup returns true if a rollup matches a filter, ignoring the dates of the periods.
+func (s *memoryState) matchesRollup(filter *UsageRollupFilter, r UsageRollup) bool {
+	if r.ResourceTypeID != filter.ResourceTypeID || r.Period != filter.Period {
+		return false
+	}
+	if filter.UserID != "" && r.UserID != filter.UserID {
+		return false
+	}
+	if filter.PlanID != "" {
+		_, i := find(s.subscriptions, func(sub memorySubscription) bool {
+			if sub.UserID != r.UserID || sub.PlanID != filter.PlanID {
+				return false
+			}
+			if !filter.Start.IsZero() && !sub.EffectiveEndDate.IsZero() && sub.EffectiveEndDate.Before(filter.Start) {
+				return false
+			}
+			return filter.End.IsZero() || sub.EffectiveStartDate.Before(filter.End)
+		})
+		if i < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// listedRollups returns the rollups that match a filter and a predicate on the start of the period, along with the
+// usernames of their users.
+func (s *memoryState) listedRollups(filter *UsageRollupFilter, match func(time.Time) bool) []UsageRollup {
+	var results []UsageRollup
+	for _, r := range s.usageRollups {
+		user, found := s.user(r.UserID)
+		if !found || !s.matchesRollup(filter, r) || !match(r.PeriodStart) {
+			continue
+		}
+		r.Username = user.Username
+		results = append(results, r)
+	}
+	return results
+}
+
+// ListUsageRollups returns the rollups that match a filter, ordered by the start of the period and then by
+// username.
+func (m *MemoryDatabase) ListUsageRollups(
+	ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption,
+) ([]UsageRollup, error) {
+	var results []UsageRollup
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		results = s.listedRollups(filter, func(start time.Time) bool {
+			if !filter.Start.IsZero() && start.Before(filter.Start) {
+				return false
+			}
+			return filter.End.IsZero() || start.Before(filter.End)
+		})
+		slices.SortStableFunc(results, func(a, b UsageRollup) int {
+			return cmp.Or(a.PeriodStart.Compare(b.PeriodStart), cmp.Compare(a.Username, b.Username))
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list usage rollups")
+	}
+	return results, nil
+}
+
+// ListLatestUsageRollupsBefore returns the latest rollup for each user that matches a filter whose period starts
+// before the start of the filter, ordered by user ID.
+func (m *MemoryDatabase) ListLatestUsageRollupsBefore(
+	ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption,
+) ([]UsageRollup, error) {
+	var results []UsageRollup
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		latest := make(map[string]UsageRollup)
+		for _, r := range s.listedRollups(filter, func(start time.Time) bool { return start.Before(filter.Start) }) {
+			if previous, ok := latest[r.UserID]; !ok || r.PeriodStart.After(previous.PeriodStart) {
+				latest[r.UserID] = r
+			}
+		}
+		for _, r := range latest {
+			results = append(results, r)
+		}
+		slices.SortFunc(results, func(a, b UsageRollup) int { return cmp.Compare(a.UserID, b.UserID) })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to look up the latest usage rollups")
+	}
+	return results, nil
+}
+
+// GetUsageRollupBefore returns the latest rollup for a user and resource type whose period starts before the given
+// time, or nil if there isn't one.
+func (m *MemoryDatabase) GetUsageRollupBefore(
+	ctx context.Context, userID, resourceTypeID, period string, before time.Time, opts ...QueryOption,
+) (*UsageRollup, error) {
+	var result *UsageRollup
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		filter := &UsageRollupFilter{UserID: userID, ResourceTypeID: resourceTypeID, Period: period}
+		for _, r := range s.listedRollups(filter, func(start time.Time) bool { return start.Before(before) }) {
+			if result == nil || r.PeriodStart.After(result.PeriodStart) {
+				result = &r
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the usage rollup for user %s before %s", userID, before)
+	}
+	return result, nil
+}
+
+// ListUsageRollupKeys returns the users and resource types whose usage updates were recorded or changed at or after
+// the given time, along with the earliest effective date of those updates. All of the users and resource types that
+// have usage updates are returned if the time is zero, and only those of one user if the user ID isn't blank.
+func (m *MemoryDatabase) ListUsageRollupKeys(
+	ctx context.Context, since time.Time, userID string, opts ...QueryOption,
+) ([]UsageRollupKey, error) {
+	var results []UsageRollupKey
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		for _, r := range s.updates {
+			if r.ValueType != UsagesTrackedMetric || r.LastModifiedAt.Before(since) {
+				continue
+			}
+			if userID != "" && r.UserID != userID {
+				continue
+			}
+			key, i := find(results, func(k UsageRollupKey) bool {
+				return k.UserID == r.UserID && k.ResourceTypeID == r.ResourceTypeID
+			})
+			if i < 0 {
+				results = append(results, UsageRollupKey{
+					UserID: r.UserID, ResourceTypeID: r.ResourceTypeID, From: r.EffectiveDate,
+				})
+			} else if r.EffectiveDate.Before(key.From) {
+				results[i].From = r.EffectiveDate
+			}
+		}
+		slices.SortFunc(results, func(a, b UsageRollupKey) int {
+			return cmp.Or(cmp.Compare(a.UserID, b.UserID), cmp.Compare(a.ResourceTypeID, b.ResourceTypeID))
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the usage rollups to refresh")
+	}
+	return results, nil
+}
+
+// StreamRollupUpdates calls fn with each of a user's usage updates for a resource type that took effect at or after
+// the given time, ordered by effective date. Updates with the same effective date are ordered by the time they were
+// recorded.
+func (m *MemoryDatabase) StreamRollupUpdates(
+	ctx context.Context, userID, resourceTypeID string, from time.Time, fn func(*RollupUpdate) error,
+	opts ...QueryOption,
+) error {
+	var results []RollupUpdate
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		var rows []memoryUpdate
+		for _, r := range s.updates {
+			if r.UserID != userID || r.ResourceTypeID != resourceTypeID || r.ValueType != UsagesTrackedMetric {
+				continue
+			}
+			if r.EffectiveDate.Before(from) {
+				continue
+			}
+			rows = append(rows, r)
+		}
+		slices.SortStableFunc(rows, func(a, b memoryUpdate) int {
+			return cmp.Or(a.EffectiveDate.Compare(b.EffectiveDate), a.CreatedAt.Compare(b.CreatedAt))
+		})
+		for _, r := range rows {
+			op, i := find(s.operations, func(op UpdateOperation) bool { return op.ID == r.OperationID })
+			if i < 0 {
+				continue
+			}
+			results = append(results, RollupUpdate{Operation: op.Name, Value: r.Value, EffectiveDate: r.EffectiveDate})
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to list the usage updates for user %s", userID)
+	}
+	return emitRows(results, fn)
+}
+
+// ListSubscriptionStartDates returns the start dates of a user's subscriptions that took effect, in ascending order.
+func (m *MemoryDatabase) ListSubscriptionStartDates(
+	ctx context.Context, userID string, opts ...QueryOption,
+) ([]time.Time, error) {
+	var dates []time.Time
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, r := range s.subscriptions {
+			if r.UserID != userID {
+				continue
+			}
+			if !r.EffectiveEndDate.IsZero() && !r.EffectiveEndDate.After(r.EffectiveStartDate) {
+				continue
+			}
+			dates = append(dates, r.EffectiveStartDate)
+		}
+		slices.SortFunc(dates, time.Time.Compare)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscription start dates for user %s", userID)
+	}
+	return dates, nil
+}
+
+// ReplaceUsageRollups replaces the rollups for a user and resource type whose periods start at or after the given
+// time.
+func (m *MemoryDatabase) ReplaceUsageRollups(
+	ctx context.Context, userID, resourceTypeID, period string, from time.Time, rollups []UsageRollup,
+	opts ...QueryOption,
+) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		s.usageRollups = slices.DeleteFunc(s.usageRollups, func(r UsageRollup) bool {
+			return r.UserID == userID && r.ResourceTypeID == resourceTypeID && r.Period == period &&
+				!r.PeriodStart.Before(from)
+		})
+		if len(rollups) == 0 {
+			return nil
+		}
+
+		if _, ok := s.user(userID); !ok {
+			return violation(foreignKeyViolation, "insert or update on table \"usage_rollups\" violates foreign key constraint: user %q not found", userID)
+		}
+		if err := s.requireResourceType("usage_rollups", resourceTypeID); err != nil {
+			return err
+		}
+		if period != RollupPeriodDay && period != RollupPeriodMonth {
+			return violation(checkViolation, "new row for relation \"usage_rollups\" violates check constraint: invalid period %q", period)
+		}
+		for _, r := range rollups {
+			row := UsageRollup{
+				UserID:         userID,
+				ResourceTypeID: resourceTypeID,
+				Period:         period,
+				PeriodStart:    r.PeriodStart,
+				Added:          r.Added,
+				EndingValue:    r.EndingValue,
+				UpdateCount:    r.UpdateCount,
+			}
+			_, i := find(s.usageRollups, func(existing UsageRollup) bool {
+				return existing.UserID == userID && existing.ResourceTypeID == resourceTypeID &&
+					existing.Period == period && existing.PeriodStart.Equal(r.PeriodStart)
+			})
+			if i >= 0 {
+				s.usageRollups[i] = row
+			} else {
+				s.usageRollups = append(s.usageRollups, row)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return errors.Wrapf(err, "unable to replace the usage rollups for user %s", userID)
+	}
+	return nil
+}
+
+// GetUsageRollupWatermark returns the time that the usage rollups have been refreshed through.
+func (m *MemoryDatabase) GetUsageRollupWatermark(ctx context.Context, opts ...QueryOption) (time.Time, error) {
+	var result time.Time
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		result = s.rollupWatermark
+		return nil
+	})
+	if err != nil {
+		return result, errors.Wrap(err, "unable to look up when the usage rollups were last refreshed")
+	}
+	return result, nil
+}
+
+// SetUsageRollupWatermark records the time that the usage rollups have been refreshed through.
+func (m *MemoryDatabase) SetUsageRollupWatermark(ctx context.Context, watermark time.Time, opts ...QueryOption) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		s.rollupWatermark = watermark
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to record when the usage rollups were last refreshed")
+	}
+	return nil
+}
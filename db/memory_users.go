@@ -0,0 +1,708 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/google/uuid"
+	"github.com/pkg/errors"
+)
+
+// GetUserID returns a user's UUID associated with their username. An empty string is returned if the user doesn't
+// exist.
+func (m *MemoryDatabase) GetUserID(ctx context.Context, username string, opts ...QueryOption) (string, error) {
+	var result string
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		user, _ := s.userByName(username)
+		result = user.ID
+		return nil
+	})
+	return result, err
+}
+
+// GetUser returns a *User associated with the UUID passed in. The fields of the user are empty if the user doesn't
+// exist.
+func (m *MemoryDatabase) GetUser(ctx context.Context, id string, opts ...QueryOption) (*User, error) {
+	var result User
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		result, _ = s.user(id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UserExists returns true if a user with the given username exists.
+func (m *MemoryDatabase) UserExists(ctx context.Context, username string, opts ...QueryOption) (bool, error) {
+	var exists bool
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		_, exists = s.userByName(username)
+		return nil
+	})
+	return exists, err
+}
+
+// AddUser adds a user and returns the user's UUID.
+func (m *MemoryDatabase) AddUser(ctx context.Context, username string, opts ...QueryOption) (string, error) {
+	var id string
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		if _, exists := s.userByName(username); exists {
+			return violation(uniqueViolation, "duplicate key value violates unique constraint: username %q already exists", username)
+		}
+		id = uuid.NewString()
+		s.users = append(s.users, User{ID: id, Username: username})
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// EnsureUser ensures that a user with the given username exists then returns the user information.
+func (m *MemoryDatabase) EnsureUser(ctx context.Context, username string, opts ...QueryOption) (*User, error) {
+	var result User
+	err := m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		var exists bool
+		if result, exists = s.userByName(username); !exists {
+			result = User{ID: uuid.NewString(), Username: username}
+			s.users = append(s.users, result)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to ensure that the user exists in the database")
+	}
+	return &result, nil
+}
+
+// RenameUser changes a user's username.
+func (m *MemoryDatabase) RenameUser(ctx context.Context, userID, username string, opts ...QueryOption) error {
+	return m.exec(opts, func(_ *QuerySettings, s *memoryState) error {
+		_, i := find(s.users, func(u User) bool { return u.ID == userID })
+		if i < 0 {
+			return suberrors.ErrUserNotFound.WithField("user_id", userID)
+		}
+		if other, exists := s.userByName(username); exists && other.ID != userID {
+			return violation(uniqueViolation, "duplicate key value violates unique constraint: username %q already exists", username)
+		}
+		s.users[i].Username = username
+		return nil
+	})
+}
+
+// ListUnfoldedUsers returns the users whose stored usernames contain upper case letters, ordered by username.
+func (m *MemoryDatabase) ListUnfoldedUsers(ctx context.Context, opts ...QueryOption) ([]User, error) {
+	var results []User
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		for _, user := range s.users {
+			if user.Username != strings.ToLower(user.Username) {
+				results = append(results, user)
+			}
+		}
+		slices.SortFunc(results, func(a, b User) int { return cmp.Compare(a.Username, b.Username) })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the users whose usernames contain upper case letters")
+	}
+	return results, nil
+}
+
+// MergeUsers moves the subscriptions, usage updates and group memberships of the source user to the target user,
+// then deletes the source user. Group memberships that the target user already has are dropped.
+func (m *MemoryDatabase) MergeUsers(ctx context.Context, sourceID, targetID string, opts ...QueryOption) (*UserMerge, error) {
+	var result UserMerge
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if _, ok := s.user(sourceID); !ok {
+			return suberrors.ErrUserNotFound.WithField("user_id", sourceID)
+		}
+		if _, ok := s.user(targetID); !ok {
+			return violation(foreignKeyViolation, "insert or update on table \"subscriptions\" violates foreign key constraint: user %q not found", targetID)
+		}
+
+		now := time.Now()
+		for i := range s.subscriptions {
+			if s.subscriptions[i].UserID == sourceID {
+				s.subscriptions[i].UserID = targetID
+				s.subscriptions[i].LastModifiedBy = qs.Actor()
+				s.subscriptions[i].LastModifiedAt = now
+				result.Subscriptions++
+			}
+		}
+		for i := range s.updates {
+			if s.updates[i].UserID == sourceID {
+				s.updates[i].UserID = targetID
+				s.updates[i].LastModifiedBy = qs.Actor()
+				s.updates[i].LastModifiedAt = now
+				result.Updates++
+			}
+		}
+
+		members := make([]memoryGroupMember, 0, len(s.groupMembers))
+		for _, member := range s.groupMembers {
+			if member.UserID == sourceID {
+				_, i := find(s.groupMembers, func(r memoryGroupMember) bool {
+					return r.GroupID == member.GroupID && r.UserID == targetID
+				})
+				if i >= 0 {
+					continue
+				}
+				member.UserID = targetID
+				result.GroupMemberships++
+			}
+			members = append(members, member)
+		}
+		s.groupMembers = members
+
+		s.users = slices.DeleteFunc(s.users, func(u User) bool { return u.ID == sourceID })
+		s.usageRollups = slices.DeleteFunc(s.usageRollups, func(r UsageRollup) bool { return r.UserID == sourceID })
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to merge user %s into user %s", sourceID, targetID)
+	}
+	return &result, nil
+}
+
+// matchingUsers returns the users who match a filter, ordered by username, along with their active subscriptions.
+func (s *memoryState) matchingUsers(filter *UserFilter) []UserListing {
+	overaged := make(map[string]bool)
+	for _, id := range filter.InOverageUserIDs {
+		overaged[id] = true
+	}
+
+	var matches []UserListing
+	for _, user := range s.users {
+		if !strings.HasPrefix(user.Username, filter.UsernamePrefix) {
+			continue
+		}
+		if filter.InOverage != nil && overaged[user.ID] != *filter.InOverage {
+			continue
+		}
+
+		listing := UserListing{User: user}
+		if sub, ok := s.activeSubscription(user.Username); ok {
+			// Database only selects these columns of the subscription and its plan.
+			listing.Subscription = &Subscription{
+				ID:                 sub.ID,
+				EffectiveStartDate: sub.EffectiveStartDate,
+				EffectiveEndDate:   sub.EffectiveEndDate,
+				User:               user,
+				Plan:               Plan{ID: sub.Plan.ID, Name: sub.Plan.Name},
+				CreatedBy:          sub.CreatedBy,
+				CreatedAt:          sub.CreatedAt,
+				Paid:               sub.Paid,
+				PlanVersionID:      sub.PlanVersionID,
+				ActivatedAt:        sub.ActivatedAt,
+				CancelledAt:        sub.CancelledAt,
+				CancelledBy:        sub.CancelledBy,
+				CancellationReason: sub.CancellationReason,
+			}
+		}
+
+		if filter.filtersSubscriptions() {
+			sub := listing.Subscription
+			switch {
+			case sub == nil:
+				continue
+			case filter.PlanName != "" && sub.Plan.Name != filter.PlanName:
+				continue
+			case filter.Paid != nil && sub.Paid != *filter.Paid:
+				continue
+			case !filter.ExpiresAfter.IsZero() && sub.EffectiveEndDate.Before(filter.ExpiresAfter):
+				continue
+			case !filter.ExpiresBefore.IsZero() && !sub.EffectiveEndDate.Before(filter.ExpiresBefore):
+				continue
+			}
+		}
+		matches = append(matches, listing)
+	}
+
+	slices.SortStableFunc(matches, func(a, b UserListing) int { return strings.Compare(a.Username, b.Username) })
+	return matches
+}
+
+// ListUsers returns the users who match a filter, ordered by username, along with their active subscriptions.
+func (m *MemoryDatabase) ListUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) ([]UserListing, error) {
+	var users []UserListing
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		users = limitRows(qs, s.matchingUsers(filter))
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list users")
+	}
+	return users, nil
+}
+
+// CountUsers returns the number of users who match a filter.
+func (m *MemoryDatabase) CountUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) (int, error) {
+	var count int
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		count = len(s.matchingUsers(filter))
+		return nil
+	})
+	if err != nil {
+		return 0, errors.Wrap(err, "unable to count users")
+	}
+	return count, nil
+}
+
+// GetResourceTypeID returns the UUID associated with the name and unit passed in. An empty string is returned if the
+// resource type doesn't exist.
+func (m *MemoryDatabase) GetResourceTypeID(ctx context.Context, name, unit string, opts ...QueryOption) (string, error) {
+	var result string
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		rt, _ := find(s.resourceTypes, func(rt ResourceType) bool { return rt.Name == name && rt.Unit == unit })
+		result = rt.ID
+		return nil
+	})
+	return result, err
+}
+
+// GetResourceType returns a *ResourceType associated with the UUID passed in. The fields of the resource type are
+// empty if it doesn't exist.
+func (m *MemoryDatabase) GetResourceType(ctx context.Context, id string, opts ...QueryOption) (*ResourceType, error) {
+	var result ResourceType
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		result, _ = s.resourceType(id)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// GetResourceTypeByName returns a *ResourceType associated with the name passed in. The fields of the resource type
+// are empty if it doesn't exist.
+func (m *MemoryDatabase) GetResourceTypeByName(ctx context.Context, name string, opts ...QueryOption) (*ResourceType, error) {
+	var result ResourceType
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		result, _ = find(s.resourceTypes, func(rt ResourceType) bool { return rt.Name == name })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// LookupResoureType attempts to look up a resource type using either its ID or name in that order.
+func (m *MemoryDatabase) LookupResoureType(
+	ctx context.Context,
+	lookup *ResourceType,
+	opts ...QueryOption,
+) (*ResourceType, error) {
+	return lookupResourceType(ctx, m, lookup, opts...)
+}
+
+// GetOperationID returns the UUID associated with the operation name passed in. An empty string is returned if the
+// operation doesn't exist.
+func (m *MemoryDatabase) GetOperationID(ctx context.Context, name string, opts ...QueryOption) (string, error) {
+	var result string
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		op, _ := find(s.operations, func(op UpdateOperation) bool { return op.Name == name })
+		result = op.ID
+		return nil
+	})
+	return result, err
+}
+
+// GetOperation returns a *UpdateOperation associated with the UUID passed in. The fields of the operation are empty
+// if it doesn't exist.
+func (m *MemoryDatabase) GetOperation(ctx context.Context, id string, opts ...QueryOption) (*UpdateOperation, error) {
+	var result UpdateOperation
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		result, _ = find(s.operations, func(op UpdateOperation) bool { return op.ID == id })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// update joins an update to the tables that it refers to. The metadata isn't included because Database doesn't
+// select it when it looks up updates.
+func (s *memoryState) update(r memoryUpdate) (Update, bool) {
+	user, userFound := s.user(r.UserID)
+	rt, rtFound := s.resourceType(r.ResourceTypeID)
+	op, opIndex := find(s.operations, func(op UpdateOperation) bool { return op.ID == r.OperationID })
+	if !userFound || !rtFound || opIndex < 0 {
+		return Update{}, false
+	}
+	return Update{
+		ID:              r.ID,
+		ValueType:       r.ValueType,
+		Value:           r.Value,
+		EffectiveDate:   r.EffectiveDate,
+		CreatedBy:       r.CreatedBy,
+		CreatedAt:       r.CreatedAt,
+		LastModifiedBy:  r.LastModifiedBy,
+		LastModifiedAt:  r.LastModifiedAt,
+		ResourceType:    rt,
+		User:            user,
+		UpdateOperation: op,
+	}, true
+}
+
+// UserUpdates returns a list of updates associated with a user. Accepts a variable number of QueryOptions,
+// including WithTX, WithQueryLimit, and WithQueryOffset.
+func (m *MemoryDatabase) UserUpdates(ctx context.Context, username string, opts ...QueryOption) ([]Update, error) {
+	var results []Update
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		var updates []Update
+		for _, r := range s.updates {
+			if update, ok := s.update(r); ok && update.User.Username == username {
+				updates = append(updates, update)
+			}
+		}
+		results = limitRows(qs, updates)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// AddUserUpdate inserts the passed in update. Returns the Update with the UUID filled in.
+func (m *MemoryDatabase) AddUserUpdate(ctx context.Context, update *Update, opts ...QueryOption) (*Update, error) {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if _, ok := s.user(update.User.ID); !ok {
+			return violation(foreignKeyViolation, "insert or update on table \"updates\" violates foreign key constraint: user %q not found", update.User.ID)
+		}
+		if err := s.requireResourceType("updates", update.ResourceType.ID); err != nil {
+			return err
+		}
+		if _, i := find(s.operations, func(op UpdateOperation) bool { return op.ID == update.UpdateOperation.ID }); i < 0 {
+			return violation(
+				foreignKeyViolation,
+				"insert or update on table \"updates\" violates foreign key constraint: update operation %q not found",
+				update.UpdateOperation.ID,
+			)
+		}
+
+		now := time.Now()
+		id := uuid.NewString()
+		s.updates = append(s.updates, memoryUpdate{
+			ID:             id,
+			ValueType:      update.ValueType,
+			Value:          update.Value,
+			EffectiveDate:  update.EffectiveDate,
+			OperationID:    update.UpdateOperation.ID,
+			ResourceTypeID: update.ResourceType.ID,
+			UserID:         update.User.ID,
+			Metadata:       update.Metadata,
+			CreatedBy:      qs.Actor(),
+			CreatedAt:      now,
+			LastModifiedBy: qs.Actor(),
+			LastModifiedAt: now,
+		})
+		update.ID = id
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return update, nil
+}
+
+// GetUserUpdate loads the details of the user update with the given ID. Returns nil if the update doesn't exist.
+func (m *MemoryDatabase) GetUserUpdate(ctx context.Context, id string, opts ...QueryOption) (*Update, error) {
+	var (
+		result Update
+		found  bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		r, i := find(s.updates, func(r memoryUpdate) bool { return r.ID == id })
+		if i >= 0 {
+			result, found = s.update(r)
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// ProcessUpdateForUsage uses an update to calculate a new usage value, which is then stored. The user must have an
+// active subscription.
+func (m *MemoryDatabase) ProcessUpdateForUsage(ctx context.Context, update *Update, opts ...QueryOption) error {
+	return processUpdateForUsage(ctx, m, update, opts...)
+}
+
+// ProcessUpdateForQuota uses an update to calculate a new quota value, which is then stored.
+func (m *MemoryDatabase) ProcessUpdateForQuota(ctx context.Context, update *Update, opts ...QueryOption) error {
+	return processUpdateForQuota(ctx, m, update, opts...)
+}
+
+// findAmount returns the index of the quota or usage for a resource type and subscription, or -1 if there isn't one.
+func findAmount(rows []memoryAmount, resourceTypeID, subscriptionID string) int {
+	_, i := find(rows, func(r memoryAmount) bool {
+		return r.ResourceTypeID == resourceTypeID && r.SubscriptionID == subscriptionID
+	})
+	return i
+}
+
+// insertAmount adds a quota or usage to a table after checking the table's constraints.
+func (s *memoryState) insertAmount(
+	table string, rows []memoryAmount, value float64, resourceTypeID, subscriptionID, actor string,
+) ([]memoryAmount, error) {
+	if findAmount(rows, resourceTypeID, subscriptionID) >= 0 {
+		return nil, violation(
+			uniqueViolation,
+			"duplicate key value violates unique constraint on table %q: resource type %q and subscription %q",
+			table, resourceTypeID, subscriptionID,
+		)
+	}
+	if err := s.requireResourceType(table, resourceTypeID); err != nil {
+		return nil, err
+	}
+	if err := s.requireSubscription(table, subscriptionID); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	return append(rows, memoryAmount{
+		ID:             uuid.NewString(),
+		SubscriptionID: subscriptionID,
+		ResourceTypeID: resourceTypeID,
+		Value:          value,
+		CreatedBy:      actor,
+		CreatedAt:      now,
+		LastModifiedBy: actor,
+		LastModifiedAt: now,
+	}), nil
+}
+
+// GetCurrentQuota returns the current quota value for a resource type and subscription, along with a flag
+// indicating whether the quota was found.
+func (m *MemoryDatabase) GetCurrentQuota(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error) {
+	var (
+		value float64
+		found bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if i := findAmount(s.quotas, resourceTypeID, subscriptionID); i >= 0 {
+			value, found = s.quotas[i].Value, true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+// quota joins a quota to its resource type.
+func (s *memoryState) quota(r memoryAmount) (Quota, bool) {
+	rt, ok := s.resourceType(r.ResourceTypeID)
+	if !ok {
+		return Quota{}, false
+	}
+	return Quota{
+		ID:             r.ID,
+		Quota:          r.Value,
+		ResourceType:   rt,
+		CreatedBy:      r.CreatedBy,
+		CreatedAt:      r.CreatedAt,
+		LastModifiedBy: r.LastModifiedBy,
+		LastModifiedAt: r.LastModifiedAt,
+	}, true
+}
+
+// LoadQuotaDetails retrieves details about a quota. Returns nil if the quota doesn't exist.
+func (m *MemoryDatabase) LoadQuotaDetails(
+	ctx context.Context,
+	resourceTypeID, subscriptionID string,
+	opts ...QueryOption,
+) (*Quota, error) {
+	var (
+		result Quota
+		found  bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if i := findAmount(s.quotas, resourceTypeID, subscriptionID); i >= 0 {
+			result, found = s.quota(s.quotas[i])
+		}
+		return nil
+	})
+	if err != nil || !found {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// UpsertQuota inserts or updates the quota for the given resource type and subscription.
+func (m *MemoryDatabase) UpsertQuota(ctx context.Context, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
+	return m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if i := findAmount(s.quotas, resourceTypeID, subscriptionID); i >= 0 {
+			s.quotas[i].Value = value
+			s.quotas[i].LastModifiedBy = qs.Actor()
+			s.quotas[i].LastModifiedAt = time.Now()
+			return nil
+		}
+
+		var err error
+		s.quotas, err = s.insertAmount("quotas", s.quotas, value, resourceTypeID, subscriptionID, qs.Actor())
+		return err
+	})
+}
+
+// GetCurrentUsage returns the current usage value for a resource type and subscription, along with a flag
+// indicating whether the usage was found.
+func (m *MemoryDatabase) GetCurrentUsage(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error) {
+	var (
+		value float64
+		found bool
+	)
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		if i := findAmount(s.usages, resourceTypeID, subscriptionID); i >= 0 {
+			value, found = s.usages[i].Value, true
+		}
+		return nil
+	})
+	return value, found, err
+}
+
+// UpsertUsage inserts a new usage or updates the existing usage for the resource type and subscription, depending
+// on the value of the update flag.
+func (m *MemoryDatabase) UpsertUsage(ctx context.Context, update bool, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
+	return m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		if !update {
+			var err error
+			s.usages, err = s.insertAmount("usages", s.usages, value, resourceTypeID, subscriptionID, qs.Actor())
+			return err
+		}
+
+		for i, r := range s.usages {
+			if r.ResourceTypeID == resourceTypeID && r.SubscriptionID == subscriptionID {
+				s.usages[i].Value = value
+				s.usages[i].LastModifiedBy = qs.Actor()
+				s.usages[i].LastModifiedAt = time.Now()
+			}
+		}
+		return nil
+	})
+}
+
+// CalculateUsage upserts a new usage value, ignoring the updates table.
+func (m *MemoryDatabase) CalculateUsage(ctx context.Context, updateType string, usage *Usage, opts ...QueryOption) error {
+	return calculateUsage(ctx, m, updateType, usage, opts...)
+}
+
+// GetUserOverages returns the quotas of a user's active subscriptions that have been reached or exceeded.
+func (m *MemoryDatabase) GetUserOverages(ctx context.Context, username string, opts ...QueryOption) ([]Overage, error) {
+	var overages []Overage
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		overages = s.overages(time.Now(), func(u User) bool { return u.Username == username })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return overages, nil
+}
+
+// ListOverages returns the overages of every user, ordered by username.
+func (m *MemoryDatabase) ListOverages(ctx context.Context, opts ...QueryOption) ([]Overage, error) {
+	var overages []Overage
+	err := m.query(opts, func(_ *QuerySettings, s *memoryState) error {
+		overages = s.overages(time.Now(), func(User) bool { return true })
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slices.SortStableFunc(overages, func(a, b Overage) int { return strings.Compare(a.User.Username, b.User.Username) })
+	return overages, nil
+}
+
+// overages returns the quotas of the active subscriptions of matching users that have been reached or exceeded.
+func (s *memoryState) overages(now time.Time, match func(User) bool) []Overage {
+	var overages []Overage
+	for _, sub := range s.subscriptions {
+		user, ok := s.user(sub.UserID)
+		if !ok || !match(user) || !sub.isActive(now) {
+			continue
+		}
+		plan, i := find(s.plans, func(p memoryPlan) bool { return p.ID == sub.PlanID })
+		if i < 0 {
+			continue
+		}
+		for _, quota := range s.quotas {
+			if quota.SubscriptionID != sub.ID {
+				continue
+			}
+			for _, usage := range s.usages {
+				if usage.SubscriptionID != sub.ID || usage.ResourceTypeID != quota.ResourceTypeID {
+					continue
+				}
+				rt, ok := s.resourceType(usage.ResourceTypeID)
+				if !ok || usage.Value < quota.Value {
+					continue
+				}
+				overages = append(overages, Overage{
+					SubscriptionID: sub.ID,
+					User:           user,
+					Plan:           Plan{ID: plan.ID, Name: plan.Name, Description: plan.Description},
+					ResourceType:   rt,
+					QuotaValue:     quota.Value,
+					UsageValue:     usage.Value,
+				})
+			}
+		}
+	}
+	return overages
+}
+
+// AddAuditRecord appends a record to the audit log. The actor is taken from the query settings.
+func (m *MemoryDatabase) AddAuditRecord(ctx context.Context, record *AuditRecord, opts ...QueryOption) error {
+	err := m.exec(opts, func(qs *QuerySettings, s *memoryState) error {
+		record.Actor = qs.Actor()
+		record.ID = uuid.NewString()
+		record.CreatedAt = time.Now()
+		s.auditLog = append(s.auditLog, *record)
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "unable to add the audit record")
+	}
+	return nil
+}
+
+// ListAuditRecords returns the records in the audit log that match the filter, most recent first. Accepts a
+// variable number of QueryOptions, including WithTX, WithQueryLimit and WithQueryOffset.
+func (m *MemoryDatabase) ListAuditRecords(ctx context.Context, filter *AuditFilter, opts ...QueryOption) ([]AuditRecord, error) {
+	var records []AuditRecord
+	err := m.query(opts, func(qs *QuerySettings, s *memoryState) error {
+		var matches []AuditRecord
+		for _, r := range slices.Backward(s.auditLog) {
+			switch {
+			case filter.Username != "" && r.Username != filter.Username:
+			case filter.Actor != "" && r.Actor != filter.Actor:
+			case filter.EntityType != "" && r.EntityType != filter.EntityType:
+			case !filter.Start.IsZero() && r.CreatedAt.Before(filter.Start):
+			case !filter.End.IsZero() && !r.CreatedAt.Before(filter.End):
+			default:
+				matches = append(matches, r)
+			}
+		}
+		slices.SortStableFunc(matches, func(a, b AuditRecord) int {
+			return b.CreatedAt.Compare(a.CreatedAt)
+		})
+		records = limitRows(qs, matches)
+		return nil
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to list the audit records")
+	}
+	return records, nil
+}
@@ -16,7 +16,10 @@ func (d *Database) GetOperationID(ctx context.Context, name string, opts ...Quer
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	query := db.From(t.UpdateOperations).
 		Select("id").
@@ -44,7 +47,10 @@ func (d *Database) GetOperation(ctx context.Context, id string, opts ...QueryOpt
 		result UpdateOperation
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	query := db.From(t.UpdateOperations).
 		Select("id", "name").
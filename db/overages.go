@@ -16,9 +16,44 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 		overages []Overage
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := overagesQuery(db).
+		Where(t.Users.Col("username").Eq(username)).
+		Executor()
+
+	if err = query.ScanStructsContext(ctx, &overages); err != nil {
+		return nil, err
+	}
+
+	return overages, nil
+}
+
+// ListOverages returns the overages of every user, ordered by username. Accepts a variable number of QueryOptions,
+// though only WithTX is currently supported.
+func (d *Database) ListOverages(ctx context.Context, opts ...QueryOption) ([]Overage, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := overagesQuery(db).Order(t.Users.Col("username").Asc())
+	d.LogSQL(query)
 
-	query := db.From(t.Subscriptions).
+	var overages []Overage
+	if err = query.ScanStructsContext(ctx, &overages); err != nil {
+		return nil, err
+	}
+
+	return overages, nil
+}
+
+// overagesQuery returns a query that lists the quotas in active subscriptions that have been reached or exceeded.
+func overagesQuery(db GoquDatabase) *goqu.SelectDataset {
+	return db.From(t.Subscriptions).
 		Select(
 			t.Subscriptions.Col("id").As("subscription_id"),
 
@@ -43,7 +78,6 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 		Join(t.Usages, goqu.On(t.Subscriptions.Col("id").Eq(t.Usages.Col("subscription_id")))).
 		Join(t.ResourceTypes, goqu.On(t.Usages.Col("resource_type_id").Eq(t.ResourceTypes.Col("id")))).
 		Where(goqu.And(
-			t.Users.Col("username").Eq(username),
 			goqu.Or(
 				CurrentTimestamp.Between(goqu.Range(t.Subscriptions.Col("effective_start_date"), t.Subscriptions.Col("effective_end_date"))),
 				goqu.And(
@@ -53,11 +87,5 @@ func (d *Database) GetUserOverages(ctx context.Context, username string, opts ..
 			),
 			t.Usages.Col("resource_type_id").Eq(t.Quotas.Col("resource_type_id")),
 			t.Usages.Col("usage").Gte(t.Quotas.Col("quota")),
-		)).Executor()
-
-	if err = query.ScanStructsContext(ctx, &overages); err != nil {
-		return nil, err
-	}
-
-	return overages, nil
+		))
 }
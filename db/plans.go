@@ -5,6 +5,7 @@ import (
 	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/pkg/errors"
 )
@@ -40,7 +41,10 @@ func planRatesDS(db GoquDatabase, planID string) *goqu.SelectDataset {
 
 func (d *Database) getPlanList(ctx context.Context, opts ...QueryOption) ([]Plan, error) {
 	wrapMsg := "unable to list the plans"
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the query.
 	query := db.From(t.Plans)
@@ -57,14 +61,17 @@ func (d *Database) getPlanList(ctx context.Context, opts ...QueryOption) ([]Plan
 
 func (d *Database) loadPlanQuotaDefaults(ctx context.Context, plan *Plan, opts ...QueryOption) error {
 	wrapMsg := fmt.Sprintf("unable to load the plan quota defaults for plan ID %s", plan.ID)
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	// Build the query.
 	query := planQuotaDefaultsDS(db, plan.ID)
 	d.LogSQL(query)
 
 	// Execute the query and scan the results.
-	err := query.ScanStructsContext(ctx, &plan.QuotaDefaults)
+	err = query.ScanStructsContext(ctx, &plan.QuotaDefaults)
 	if err != nil {
 		return errors.Wrap(err, wrapMsg)
 	}
@@ -73,14 +80,17 @@ func (d *Database) loadPlanQuotaDefaults(ctx context.Context, plan *Plan, opts .
 
 func (d *Database) loadPlanRates(ctx context.Context, plan *Plan, opts ...QueryOption) error {
 	wrapMsg := fmt.Sprintf("unable to load the plan rates for plan ID %s", plan.ID)
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	// Build the query.
 	query := planRatesDS(db, plan.ID)
 	d.LogSQL(query)
 
 	// Execute the query and scan the results.
-	err := query.ScanStructsContext(ctx, &plan.Rates)
+	err = query.ScanStructsContext(ctx, &plan.Rates)
 	if err != nil {
 		return errors.Wrap(err, wrapMsg)
 	}
@@ -122,7 +132,10 @@ func (d *Database) ListPlans(ctx context.Context, opts ...QueryOption) ([]Plan,
 
 func (d *Database) GetPlanByID(ctx context.Context, planID string, opts ...QueryOption) (*Plan, error) {
 	wrapMsg := fmt.Sprintf("unable to look up plan %s", planID)
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the query.
 	query := db.From(t.Plans).Where(t.Plans.Col("id").Eq(planID))
@@ -149,7 +162,10 @@ func (d *Database) GetPlanByID(ctx context.Context, planID string, opts ...Query
 
 func (d *Database) GetPlanByName(ctx context.Context, name string, opts ...QueryOption) (*Plan, error) {
 	wrapMsg := fmt.Sprintf("unable to look up plan %s", name)
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the query.
 	query := db.From(t.Plans).Where(t.Plans.Col("name").Eq(name))
@@ -175,7 +191,10 @@ func (d *Database) GetPlanByName(ctx context.Context, name string, opts ...Query
 }
 
 func (d *Database) AddPlan(ctx context.Context, plan *Plan, opts ...QueryOption) (string, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	ds := db.Insert(t.Plans).Rows(
 		goqu.Record{
@@ -224,3 +243,27 @@ func (d *Database) AddPlan(ctx context.Context, plan *Plan, opts ...QueryOption)
 
 	return newPlanID, nil
 }
+
+// SetPlanGracePeriod sets the number of days after a paid subscription to a plan ends during which its quotas still
+// apply. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) SetPlanGracePeriod(ctx context.Context, planID string, days int, opts ...QueryOption) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Update(t.Plans).
+		Set(goqu.Record{"grace_period_days": days}).
+		Where(t.Plans.Col("id").Eq(planID))
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the grace period for plan %s", planID)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return suberrors.ErrPlanNotFound.WithField("plan_id", planID)
+	}
+
+	return nil
+}
@@ -0,0 +1,278 @@
+package db
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// PlanVersion is an immutable snapshot of the rate and quota defaults of a plan. Each subscription refers to the
+// version of its plan that was in effect when the subscription was created.
+type PlanVersion struct {
+	ID            string                    `db:"id" goqu:"defaultifempty" json:"id"`
+	PlanID        string                    `db:"plan_id" json:"plan_id"`
+	Version       int                       `db:"version" json:"version"`
+	PlanRateID    string                    `db:"plan_rate_id" json:"plan_rate_id"`
+	Rate          float64                   `db:"rate" json:"rate"`
+	QuotaDefaults []PlanVersionQuotaDefault `db:"-" json:"quota_defaults"`
+	CreatedBy     string                    `db:"created_by" json:"created_by"`
+	CreatedAt     time.Time                 `db:"created_at" goqu:"defaultifempty" json:"created_at"`
+}
+
+// PlanVersionQuotaDefault is the default quota for a resource type in a plan version.
+type PlanVersionQuotaDefault struct {
+	ResourceTypeID   string  `db:"resource_type_id" json:"resource_type_id"`
+	ResourceTypeName string  `db:"resource_type_name" json:"resource_type_name"`
+	QuotaValue       float64 `db:"quota_value" json:"quota_value"`
+}
+
+// NewPlanVersion returns a snapshot of the rate and quota defaults that are currently in effect for a plan. The
+// version number, ID and creator are assigned when the version is stored.
+func NewPlanVersion(plan *Plan) (*PlanVersion, error) {
+	activeRate := plan.GetActiveRate()
+	if activeRate == nil {
+		return nil, suberrors.Conflict("the %s subscription plan has no effective rate", plan.Name)
+	}
+
+	quotaDefaults := make([]PlanVersionQuotaDefault, 0, len(plan.QuotaDefaults))
+	for _, qd := range plan.GetActiveQuotaDefaults() {
+		quotaDefaults = append(quotaDefaults, PlanVersionQuotaDefault{
+			ResourceTypeID:   qd.ResourceType.ID,
+			ResourceTypeName: qd.ResourceType.Name,
+			QuotaValue:       qd.QuotaValue,
+		})
+	}
+	sortPlanVersionQuotaDefaults(quotaDefaults)
+
+	return &PlanVersion{
+		PlanID:        plan.ID,
+		PlanRateID:    activeRate.ID,
+		Rate:          activeRate.Rate,
+		QuotaDefaults: quotaDefaults,
+	}, nil
+}
+
+// sortPlanVersionQuotaDefaults sorts quota defaults by resource type name.
+func sortPlanVersionQuotaDefaults(quotaDefaults []PlanVersionQuotaDefault) {
+	slices.SortFunc(quotaDefaults, func(a, b PlanVersionQuotaDefault) int {
+		return cmp.Compare(a.ResourceTypeName, b.ResourceTypeName)
+	})
+}
+
+// QuotaDefault returns the default quota for a resource type in the plan version, or zero if the version doesn't
+// include the resource type.
+func (v *PlanVersion) QuotaDefault(resourceTypeID string) float64 {
+	for _, qd := range v.QuotaDefaults {
+		if qd.ResourceTypeID == resourceTypeID {
+			return qd.QuotaValue
+		}
+	}
+	return 0
+}
+
+// sameCatalog returns true if two plan versions have the same rate and quota defaults.
+func (v *PlanVersion) sameCatalog(other *PlanVersion) bool {
+	if v.PlanRateID != other.PlanRateID || v.Rate != other.Rate || len(v.QuotaDefaults) != len(other.QuotaDefaults) {
+		return false
+	}
+	for _, qd := range v.QuotaDefaults {
+		if _, i := find(other.QuotaDefaults, func(o PlanVersionQuotaDefault) bool {
+			return o.ResourceTypeID == qd.ResourceTypeID && o.QuotaValue == qd.QuotaValue
+		}); i < 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// ensurePlanVersion implements EnsurePlanVersion for any repository.
+func ensurePlanVersion(ctx context.Context, d Repository, plan *Plan, opts ...QueryOption) (*PlanVersion, error) {
+	current, err := NewPlanVersion(plan)
+	if err != nil {
+		return nil, err
+	}
+
+	versions, err := d.ListPlanVersions(ctx, plan.ID, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	current.Version = 1
+	if len(versions) > 0 {
+		latest := &versions[len(versions)-1]
+		if latest.sameCatalog(current) {
+			return latest, nil
+		}
+		current.Version = latest.Version + 1
+	}
+
+	if err = d.AddPlanVersion(ctx, current, opts...); err != nil {
+		return nil, err
+	}
+
+	return current, nil
+}
+
+// EnsurePlanVersion returns the latest version of a plan if it matches the rate and quota defaults that are currently
+// in effect for the plan. Otherwise, a new version is recorded and returned. Accepts a variable number of
+// QueryOptions, including WithTX and WithActor.
+func (d *Database) EnsurePlanVersion(ctx context.Context, plan *Plan, opts ...QueryOption) (*PlanVersion, error) {
+	return ensurePlanVersion(ctx, d, plan, opts...)
+}
+
+func planVersionQuotaDefaultsDS(db GoquDatabase, planVersionID string) *goqu.SelectDataset {
+	return db.From(t.PlanVersionQuotaDefaults).
+		Select(
+			t.PlanVersionQuotaDefaults.Col("resource_type_id"),
+			t.RT.Col("name").As("resource_type_name"),
+			t.PlanVersionQuotaDefaults.Col("quota_value"),
+		).
+		Join(t.RT, goqu.On(t.PlanVersionQuotaDefaults.Col("resource_type_id").Eq(t.RT.Col("id")))).
+		Where(t.PlanVersionQuotaDefaults.Col("plan_version_id").Eq(planVersionID)).
+		Order(t.RT.Col("name").Asc())
+}
+
+// loadPlanVersionQuotaDefaults loads the quota defaults of each of the given plan versions.
+func (d *Database) loadPlanVersionQuotaDefaults(ctx context.Context, versions []PlanVersion, opts ...QueryOption) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	for i := range versions {
+		query := planVersionQuotaDefaultsDS(db, versions[i].ID)
+		d.LogSQL(query)
+
+		if err := query.ScanStructsContext(ctx, &versions[i].QuotaDefaults); err != nil {
+			return errors.Wrapf(err, "unable to load the quota defaults for plan version %s", versions[i].ID)
+		}
+	}
+
+	return nil
+}
+
+// getPlanVersion returns the plan version matching the given expressions, or nil if there isn't one.
+func (d *Database) getPlanVersion(ctx context.Context, wrapMsg string, opts []QueryOption, where ...goqu.Expression) (*PlanVersion, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.PlanVersions).Where(where...)
+	d.LogSQL(query)
+
+	var versions []PlanVersion
+	if err := query.ScanStructsContext(ctx, &versions); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	if len(versions) == 0 {
+		return nil, nil
+	}
+
+	if err := d.loadPlanVersionQuotaDefaults(ctx, versions, opts...); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+
+	return &versions[0], nil
+}
+
+// ListPlanVersions returns the versions of a plan, oldest first. Accepts a variable number of QueryOptions, but only
+// WithTX is currently supported.
+func (d *Database) ListPlanVersions(ctx context.Context, planID string, opts ...QueryOption) ([]PlanVersion, error) {
+	wrapMsg := fmt.Sprintf("unable to list the versions of plan %s", planID)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.PlanVersions).
+		Where(t.PlanVersions.Col("plan_id").Eq(planID)).
+		Order(t.PlanVersions.Col("version").Asc())
+	d.LogSQL(query)
+
+	var versions []PlanVersion
+	if err := query.ScanStructsContext(ctx, &versions); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+
+	if err := d.loadPlanVersionQuotaDefaults(ctx, versions, opts...); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+
+	return versions, nil
+}
+
+// GetPlanVersion returns a version of a plan by number, or nil if the plan doesn't have that version. Accepts a
+// variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) GetPlanVersion(ctx context.Context, planID string, version int, opts ...QueryOption) (*PlanVersion, error) {
+	return d.getPlanVersion(
+		ctx,
+		fmt.Sprintf("unable to look up version %d of plan %s", version, planID),
+		opts,
+		t.PlanVersions.Col("plan_id").Eq(planID),
+		t.PlanVersions.Col("version").Eq(version),
+	)
+}
+
+// GetPlanVersionByID returns the plan version with the given ID, or nil if it doesn't exist. Accepts a variable
+// number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) GetPlanVersionByID(ctx context.Context, planVersionID string, opts ...QueryOption) (*PlanVersion, error) {
+	return d.getPlanVersion(
+		ctx,
+		fmt.Sprintf("unable to look up plan version %s", planVersionID),
+		opts,
+		t.PlanVersions.Col("id").Eq(planVersionID),
+	)
+}
+
+// AddPlanVersion stores a new plan version along with its quota defaults. The ID, creator and creation time of the
+// version are filled in. Accepts a variable number of QueryOptions, including WithTX and WithActor.
+func (d *Database) AddPlanVersion(ctx context.Context, version *PlanVersion, opts ...QueryOption) error {
+	wrapMsg := fmt.Sprintf("unable to add version %d of plan %s", version.Version, version.PlanID)
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Insert(t.PlanVersions).
+		Rows(
+			goqu.Record{
+				"plan_id":      version.PlanID,
+				"version":      version.Version,
+				"plan_rate_id": version.PlanRateID,
+				"rate":         version.Rate,
+				"created_by":   qs.Actor(),
+			},
+		).
+		Returning(t.PlanVersions.Col("id"), t.PlanVersions.Col("created_by"), t.PlanVersions.Col("created_at"))
+	d.LogSQL(query)
+
+	if _, err := query.Executor().ScanStructContext(ctx, version); err != nil {
+		return errors.Wrap(err, wrapMsg)
+	}
+
+	for _, qd := range version.QuotaDefaults {
+		qdQuery := db.Insert(t.PlanVersionQuotaDefaults).
+			Rows(
+				goqu.Record{
+					"plan_version_id":  version.ID,
+					"resource_type_id": qd.ResourceTypeID,
+					"quota_value":      qd.QuotaValue,
+				},
+			)
+		d.LogSQL(qdQuery)
+
+		if _, err := qdQuery.Executor().ExecContext(ctx); err != nil {
+			return errors.Wrap(err, wrapMsg)
+		}
+	}
+
+	return nil
+}
@@ -19,7 +19,10 @@ func (d *Database) GetCurrentQuota(ctx context.Context, resourceTypeID, subscrip
 		quotaValue float64
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return 0, false, err
+	}
 
 	quotasE := db.From("quotas").
 		Select(goqu.C("quota")).
@@ -48,7 +51,10 @@ func (d *Database) LoadQuotaDetails(
 	resourceTypeID, subscriptionID string,
 	opts ...QueryOption,
 ) (*Quota, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the query.
 	query := db.From(t.Quotas).
@@ -87,19 +93,19 @@ func (d *Database) LoadQuotaDetails(
 // resource type and user plan. Accepts a variable number of QueryOptions,
 // though only WithTX is currently supported.
 func (d *Database) UpsertQuota(ctx context.Context, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
-	var (
-		err error
-		db  GoquDatabase
-	)
+	var err error
 
-	_, db = d.querySettings(opts...)
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
 
 	updateRecord := goqu.Record{
 		"quota":            value,
 		"resource_type_id": resourceTypeID,
 		"subscription_id":  subscriptionID,
-		"created_by":       "de",
-		"last_modified_by": "de",
+		"created_by":       qs.Actor(),
+		"last_modified_by": qs.Actor(),
 	}
 
 	upsertE := db.Insert("quotas").
@@ -107,7 +113,11 @@ func (d *Database) UpsertQuota(ctx context.Context, value float64, resourceTypeI
 		OnConflict(
 			goqu.DoUpdate(
 				"resource_type_id, subscription_id",
-				goqu.C("quota").Set(goqu.I("excluded.quota"))),
+				goqu.Record{
+					"quota":            goqu.I("excluded.quota"),
+					"last_modified_by": goqu.I("excluded.last_modified_by"),
+					"last_modified_at": CurrentTimestamp,
+				}),
 		).Executor()
 
 	log.Info(upsertE.ToSQL())
@@ -0,0 +1,241 @@
+package db
+
+import (
+	"context"
+	"time"
+)
+
+// Tx is a transaction started by a Repository. Transactions are passed to repository methods using WithTX or
+// WithTXRollbackCommit, and can only be used with the repository that started them.
+type Tx interface {
+	Commit() error
+	Rollback() error
+
+	// Wrap calls the function and commits the transaction if it succeeds or rolls the transaction back if it fails.
+	Wrap(fn func() error) error
+}
+
+// UserRepository contains the operations on users.
+type UserRepository interface {
+	GetUserID(ctx context.Context, username string, opts ...QueryOption) (string, error)
+	GetUser(ctx context.Context, id string, opts ...QueryOption) (*User, error)
+	UserExists(ctx context.Context, username string, opts ...QueryOption) (bool, error)
+	AddUser(ctx context.Context, username string, opts ...QueryOption) (string, error)
+	EnsureUser(ctx context.Context, username string, opts ...QueryOption) (*User, error)
+	RenameUser(ctx context.Context, userID, username string, opts ...QueryOption) error
+	ListUnfoldedUsers(ctx context.Context, opts ...QueryOption) ([]User, error)
+	MergeUsers(ctx context.Context, sourceID, targetID string, opts ...QueryOption) (*UserMerge, error)
+	ListUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) ([]UserListing, error)
+	CountUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) (int, error)
+}
+
+// ResourceTypeRepository contains the operations on resource types.
+type ResourceTypeRepository interface {
+	GetResourceTypeID(ctx context.Context, name, unit string, opts ...QueryOption) (string, error)
+	GetResourceType(ctx context.Context, id string, opts ...QueryOption) (*ResourceType, error)
+	GetResourceTypeByName(ctx context.Context, name string, opts ...QueryOption) (*ResourceType, error)
+	LookupResoureType(ctx context.Context, lookup *ResourceType, opts ...QueryOption) (*ResourceType, error)
+}
+
+// OperationRepository contains the operations on update operations.
+type OperationRepository interface {
+	GetOperationID(ctx context.Context, name string, opts ...QueryOption) (string, error)
+	GetOperation(ctx context.Context, id string, opts ...QueryOption) (*UpdateOperation, error)
+}
+
+// PlanRepository contains the operations on subscription plans.
+type PlanRepository interface {
+	ListPlans(ctx context.Context, opts ...QueryOption) ([]Plan, error)
+	GetPlanByID(ctx context.Context, planID string, opts ...QueryOption) (*Plan, error)
+	GetPlanByName(ctx context.Context, name string, opts ...QueryOption) (*Plan, error)
+	AddPlan(ctx context.Context, plan *Plan, opts ...QueryOption) (string, error)
+	SetPlanGracePeriod(ctx context.Context, planID string, days int, opts ...QueryOption) error
+
+	ListPlanVersions(ctx context.Context, planID string, opts ...QueryOption) ([]PlanVersion, error)
+	GetPlanVersion(ctx context.Context, planID string, version int, opts ...QueryOption) (*PlanVersion, error)
+	GetPlanVersionByID(ctx context.Context, planVersionID string, opts ...QueryOption) (*PlanVersion, error)
+	AddPlanVersion(ctx context.Context, version *PlanVersion, opts ...QueryOption) error
+	EnsurePlanVersion(ctx context.Context, plan *Plan, opts ...QueryOption) (*PlanVersion, error)
+}
+
+// SubscriptionRepository contains the operations on subscriptions.
+type SubscriptionRepository interface {
+	GetSubscriptionByID(ctx context.Context, subscriptionID string, opts ...QueryOption) (*Subscription, error)
+	GetActiveSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error)
+	SetActiveSubscription(
+		ctx context.Context, userID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
+	) (string, error)
+	UserHasActivePlan(ctx context.Context, username string, opts ...QueryOption) (bool, error)
+	UserOnPlan(ctx context.Context, username, planName string, opts ...QueryOption) (bool, error)
+	SubscriptionUsages(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Usage, error)
+	SubscriptionPlanRates(ctx context.Context, planID string, opts ...QueryOption) ([]PlanRate, error)
+	SubscriptionQuotas(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]Quota, error)
+	SubscriptionQuotaDefaults(ctx context.Context, planID string, opts ...QueryOption) ([]PlanQuotaDefault, error)
+	LoadSubscriptionDetails(ctx context.Context, subscription *Subscription, opts ...QueryOption) error
+	ListActiveSubscriptionsByPlanVersion(
+		ctx context.Context, planVersionID string, opts ...QueryOption,
+	) ([]Subscription, error)
+	SetSubscriptionPlanVersion(ctx context.Context, subscriptionID string, version *PlanVersion, opts ...QueryOption) error
+	ListPendingSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error)
+	ListDueSubscriptions(ctx context.Context, opts ...QueryOption) ([]Subscription, error)
+	ListSubscriptionsInEffectAt(
+		ctx context.Context, userID string, at time.Time, opts ...QueryOption,
+	) ([]Subscription, error)
+	SetSubscriptionEndDate(ctx context.Context, subscriptionID string, endDate time.Time, opts ...QueryOption) error
+	ActivateSubscription(ctx context.Context, subscriptionID string, opts ...QueryOption) (bool, error)
+	ListSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error)
+	GetGraceSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error)
+	CancelSubscription(
+		ctx context.Context, subscriptionID string, endDate time.Time, reason string, opts ...QueryOption,
+	) error
+}
+
+// QuotaRepository contains the operations on quotas.
+type QuotaRepository interface {
+	GetCurrentQuota(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error)
+	LoadQuotaDetails(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (*Quota, error)
+	UpsertQuota(ctx context.Context, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error
+}
+
+// UsageRepository contains the operations on usages.
+type UsageRepository interface {
+	GetCurrentUsage(ctx context.Context, resourceTypeID, subscriptionID string, opts ...QueryOption) (float64, bool, error)
+	UpsertUsage(
+		ctx context.Context, update bool, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption,
+	) error
+	CalculateUsage(ctx context.Context, updateType string, usage *Usage, opts ...QueryOption) error
+}
+
+// UpdateRepository contains the operations on usage and quota updates.
+type UpdateRepository interface {
+	UserUpdates(ctx context.Context, username string, opts ...QueryOption) ([]Update, error)
+	AddUserUpdate(ctx context.Context, update *Update, opts ...QueryOption) (*Update, error)
+	GetUserUpdate(ctx context.Context, id string, opts ...QueryOption) (*Update, error)
+	ProcessUpdateForUsage(ctx context.Context, update *Update, opts ...QueryOption) error
+	ProcessUpdateForQuota(ctx context.Context, update *Update, opts ...QueryOption) error
+}
+
+// OverageRepository contains the operations on overages.
+type OverageRepository interface {
+	GetUserOverages(ctx context.Context, username string, opts ...QueryOption) ([]Overage, error)
+	ListOverages(ctx context.Context, opts ...QueryOption) ([]Overage, error)
+}
+
+// AddonRepository contains the operations on add-ons and the add-ons applied to subscriptions.
+type AddonRepository interface {
+	AddAddon(ctx context.Context, addon *Addon, opts ...QueryOption) (string, error)
+	GetAddonByID(ctx context.Context, addonID string, opts ...QueryOption) (*Addon, error)
+	ListAddons(ctx context.Context, opts ...QueryOption) ([]Addon, error)
+	ListRatesForAddon(ctx context.Context, addonID string, opts ...QueryOption) ([]AddonRate, error)
+	ToggleAddonPaid(ctx context.Context, addonID string, opts ...QueryOption) (*Addon, error)
+	UpsertAddonRate(ctx context.Context, r AddonRate, opts ...QueryOption) error
+	UpdateAddonRates(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error
+	UpdateAddon(ctx context.Context, addonUpdateRecord *UpdateAddon, opts ...QueryOption) error
+	DeleteAddon(ctx context.Context, addonID string, opts ...QueryOption) error
+
+	GetSubscriptionAddonByID(ctx context.Context, subAddonID string, opts ...QueryOption) (*SubscriptionAddon, error)
+	ListSubscriptionAddons(ctx context.Context, subscriptionID string, opts ...QueryOption) ([]SubscriptionAddon, error)
+	ListSubscriptionAddonsByAddonID(ctx context.Context, addonID string, opts ...QueryOption) ([]SubscriptionAddon, error)
+	AddSubscriptionAddon(
+		ctx context.Context, subscriptionID, addonID string, opts ...QueryOption,
+	) (*SubscriptionAddon, error)
+	UpdateSubscriptionAddon(
+		ctx context.Context, updated *UpdateSubscriptionAddon, opts ...QueryOption,
+	) (*SubscriptionAddon, error)
+	DeleteSubscriptionAddon(ctx context.Context, subAddonID string, opts ...QueryOption) error
+}
+
+// GroupRepository contains the operations on groups, their members and their subscriptions.
+type GroupRepository interface {
+	AddGroup(ctx context.Context, group *Group, opts ...QueryOption) error
+	GetGroupByName(ctx context.Context, name string, opts ...QueryOption) (*Group, error)
+	ListGroups(ctx context.Context, opts ...QueryOption) ([]Group, error)
+	ListUserGroups(ctx context.Context, username string, opts ...QueryOption) ([]Group, error)
+	DeleteGroup(ctx context.Context, groupID string, opts ...QueryOption) (bool, error)
+
+	AddGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error)
+	RemoveGroupMember(ctx context.Context, groupID, userID string, opts ...QueryOption) (bool, error)
+	ListGroupMembers(ctx context.Context, groupID string, opts ...QueryOption) ([]User, error)
+
+	AddGroupSubscription(
+		ctx context.Context, groupID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
+	) (string, error)
+	GetActiveGroupSubscription(ctx context.Context, groupID string, opts ...QueryOption) (*GroupSubscription, error)
+	UpsertGroupQuota(
+		ctx context.Context, value float64, resourceTypeID, groupSubscriptionID string, opts ...QueryOption,
+	) error
+	ListGroupAllocations(ctx context.Context, groupID string, opts ...QueryOption) ([]GroupAllocation, error)
+	ListUserGroupAllocations(ctx context.Context, username string, opts ...QueryOption) ([]GroupAllocation, error)
+}
+
+// AuditRepository contains the operations on the audit log.
+type AuditRepository interface {
+	AddAuditRecord(ctx context.Context, record *AuditRecord, opts ...QueryOption) error
+	ListAuditRecords(ctx context.Context, filter *AuditFilter, opts ...QueryOption) ([]AuditRecord, error)
+}
+
+// ExportRepository contains the operations that stream rows for exports. Each method calls fn with one row at a time
+// and stops at the first error that fn returns.
+type ExportRepository interface {
+	ExportSubscriptions(
+		ctx context.Context, filter *ExportFilter, fn func(*SubscriptionExport) error, opts ...QueryOption,
+	) error
+	ExportQuotas(ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption) error
+	ExportUsages(ctx context.Context, filter *ExportFilter, fn func(*AmountExport) error, opts ...QueryOption) error
+	ExportSubscriptionAddons(
+		ctx context.Context, filter *ExportFilter, fn func(*SubscriptionAddonExport) error, opts ...QueryOption,
+	) error
+	ExportUpdates(ctx context.Context, filter *ExportFilter, fn func(*UpdateExport) error, opts ...QueryOption) error
+}
+
+// UsageRollupRepository contains the operations on the daily and monthly usage rollups and the state of their
+// refreshes.
+type UsageRollupRepository interface {
+	ListUsageRollups(ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption) ([]UsageRollup, error)
+	ListLatestUsageRollupsBefore(
+		ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption,
+	) ([]UsageRollup, error)
+	GetUsageRollupBefore(
+		ctx context.Context, userID, resourceTypeID, period string, before time.Time, opts ...QueryOption,
+	) (*UsageRollup, error)
+	ListUsageRollupKeys(ctx context.Context, since time.Time, userID string, opts ...QueryOption) ([]UsageRollupKey, error)
+	StreamRollupUpdates(
+		ctx context.Context, userID, resourceTypeID string, from time.Time, fn func(*RollupUpdate) error,
+		opts ...QueryOption,
+	) error
+	ListSubscriptionStartDates(ctx context.Context, userID string, opts ...QueryOption) ([]time.Time, error)
+	ReplaceUsageRollups(
+		ctx context.Context, userID, resourceTypeID, period string, from time.Time, rollups []UsageRollup,
+		opts ...QueryOption,
+	) error
+	GetUsageRollupWatermark(ctx context.Context, opts ...QueryOption) (time.Time, error)
+	SetUsageRollupWatermark(ctx context.Context, watermark time.Time, opts ...QueryOption) error
+}
+
+// Repository contains all of the operations supported by the subscriptions database. Database implements it using
+// PostgreSQL, and MemoryDatabase implements it in memory so that code that uses the database can be tested without
+// PostgreSQL.
+type Repository interface {
+	UserRepository
+	ResourceTypeRepository
+	OperationRepository
+	PlanRepository
+	SubscriptionRepository
+	QuotaRepository
+	UsageRepository
+	UpdateRepository
+	OverageRepository
+	AddonRepository
+	GroupRepository
+	AuditRepository
+	ExportRepository
+	UsageRollupRepository
+
+	// Begin starts a new transaction.
+	Begin() (Tx, error)
+}
+
+var (
+	_ Repository = (*Database)(nil)
+	_ Repository = (*MemoryDatabase)(nil)
+)
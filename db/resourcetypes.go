@@ -2,9 +2,9 @@ package db
 
 import (
 	"context"
-	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 )
 
@@ -17,15 +17,9 @@ func (d *Database) GetResourceTypeID(ctx context.Context, name, unit string, opt
 		db  GoquDatabase
 	)
 
-	querySettings := &QuerySettings{}
-	for _, opt := range opts {
-		opt(querySettings)
-	}
-
-	if querySettings.tx != nil {
-		db = querySettings.tx
-	} else {
-		db = d.goquDB
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return "", err
 	}
 
 	query := db.From(t.RT).
@@ -55,15 +49,9 @@ func (d *Database) GetResourceType(ctx context.Context, id string, opts ...Query
 		result ResourceType
 	)
 
-	querySettings := &QuerySettings{}
-	for _, opt := range opts {
-		opt(querySettings)
-	}
-
-	if querySettings.tx != nil {
-		db = querySettings.tx
-	} else {
-		db = d.goquDB
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
 	}
 
 	query := db.From(t.RT).
@@ -93,7 +81,10 @@ func (d *Database) GetResourceTypeByName(ctx context.Context, name string, opts
 		resourceType ResourceType
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	query := db.From(t.RT).
 		Select(
@@ -119,11 +110,16 @@ func (d *Database) LookupResoureType(
 	lookup *ResourceType,
 	opts ...QueryOption,
 ) (*ResourceType, error) {
+	return lookupResourceType(ctx, d, lookup, opts...)
+}
+
+// lookupResourceType implements LookupResoureType for any repository.
+func lookupResourceType(ctx context.Context, d ResourceTypeRepository, lookup *ResourceType, opts ...QueryOption) (*ResourceType, error) {
 	if lookup.ID != "" {
 		return d.GetResourceType(ctx, lookup.ID, opts...)
 	} else if lookup.Name != "" {
 		return d.GetResourceTypeByName(ctx, lookup.Name, opts...)
 	} else {
-		return nil, fmt.Errorf("either the resource type ID or name must be specified")
+		return nil, suberrors.BadRequest("either the resource type ID or name must be specified")
 	}
 }
@@ -0,0 +1,391 @@
+package db
+
+import (
+	"context"
+	"time"
+
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
+)
+
+// Periods covered by usage rollups.
+const (
+	RollupPeriodDay   = "day"
+	RollupPeriodMonth = "month"
+)
+
+// UsageRollup aggregates the usage updates recorded for a user and resource type during a day or a month. Added is
+// the sum of the values of the ADD updates in the period, and EndingValue is the usage at the end of the period
+// obtained by applying all of the user's updates for the resource type in order. The usage starts from zero at the
+// start of each of the user's subscriptions. Username is only set when rollups are listed.
+type UsageRollup struct {
+	UserID         string    `db:"user_id"`
+	Username       string    `db:"username"`
+	ResourceTypeID string    `db:"resource_type_id"`
+	Period         string    `db:"period"`
+	PeriodStart    time.Time `db:"period_start"`
+	Added          float64   `db:"added"`
+	EndingValue    float64   `db:"ending_value"`
+	UpdateCount    int       `db:"update_count"`
+}
+
+// UsageRollupKey identifies the rollups for a user and resource type that have to be rebuilt. From is the earliest
+// effective date of the updates that changed.
+type UsageRollupKey struct {
+	UserID         string    `db:"user_id"`
+	ResourceTypeID string    `db:"resource_type_id"`
+	From           time.Time `db:"from"`
+}
+
+// RollupUpdate is a usage update as it's seen when rollups are built.
+type RollupUpdate struct {
+	Operation     string    `db:"operation"`
+	Value         float64   `db:"value"`
+	EffectiveDate time.Time `db:"effective_date"`
+}
+
+// UsageRollupFilter selects the rollups returned by ListUsageRollups and ListLatestUsageRollupsBefore. Rollups are
+// included if their periods start at or after Start and before End. If PlanID is set, only the rollups of users who
+// had a subscription to the plan in effect at some time between Start and End are included. Fields that are blank or
+// zero aren't used, except that ResourceTypeID and Period are required.
+type UsageRollupFilter struct {
+	UserID         string
+	PlanID         string
+	ResourceTypeID string
+	Period         string
+	Start          time.Time
+	End            time.Time
+}
+
+// usageRollupsQuery returns a query that lists the rollups that match a filter, ignoring the dates of the periods.
+func usageRollupsQuery(db GoquDatabase, filter *UsageRollupFilter) *goqu.SelectDataset {
+	query := db.From(t.UsageRollups).
+		Join(t.Users, goqu.On(t.UsageRollups.Col("user_id").Eq(t.Users.Col("id")))).
+		Select(
+			t.UsageRollups.Col("user_id"),
+			t.Users.Col("username"),
+			t.UsageRollups.Col("resource_type_id"),
+			t.UsageRollups.Col("period"),
+			t.UsageRollups.Col("period_start"),
+			t.UsageRollups.Col("added"),
+			t.UsageRollups.Col("ending_value"),
+			t.UsageRollups.Col("update_count"),
+		).
+		Where(
+			t.UsageRollups.Col("resource_type_id").Eq(filter.ResourceTypeID),
+			t.UsageRollups.Col("period").Eq(filter.Period),
+		)
+
+	if filter.UserID != "" {
+		query = query.Where(t.UsageRollups.Col("user_id").Eq(filter.UserID))
+	}
+
+	if filter.PlanID != "" {
+		subscribers := db.From(t.Subscriptions).
+			Select(t.Subscriptions.Col("user_id")).
+			Where(t.Subscriptions.Col("plan_id").Eq(filter.PlanID))
+		if !filter.Start.IsZero() {
+			subscribers = subscribers.Where(
+				goqu.Or(
+					t.Subscriptions.Col("effective_end_date").IsNull(),
+					t.Subscriptions.Col("effective_end_date").Gte(filter.Start),
+				),
+			)
+		}
+		if !filter.End.IsZero() {
+			subscribers = subscribers.Where(t.Subscriptions.Col("effective_start_date").Lt(filter.End))
+		}
+
+		// Comparing with a dataset produces IN (subquery).
+		query = query.Where(t.UsageRollups.Col("user_id").Eq(subscribers))
+	}
+
+	return query
+}
+
+// ListUsageRollups returns the rollups that match a filter, ordered by the start of the period and then by
+// username. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListUsageRollups(
+	ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption,
+) ([]UsageRollup, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := usageRollupsQuery(db, filter).
+		Order(t.UsageRollups.Col("period_start").Asc(), t.Users.Col("username").Asc())
+	if !filter.Start.IsZero() {
+		query = query.Where(t.UsageRollups.Col("period_start").Gte(filter.Start))
+	}
+	if !filter.End.IsZero() {
+		query = query.Where(t.UsageRollups.Col("period_start").Lt(filter.End))
+	}
+	d.LogSQL(query)
+
+	var rollups []UsageRollup
+	if err := query.ScanStructsContext(ctx, &rollups); err != nil {
+		return nil, errors.Wrap(err, "unable to list usage rollups")
+	}
+
+	return rollups, nil
+}
+
+// ListLatestUsageRollupsBefore returns the latest rollup for each user that matches a filter whose period starts
+// before the start of the filter. The end of the filter is only used to find the users who were subscribed to the
+// plan. The ending values of these rollups are the usages at the start of the filter. Accepts a variable number of
+// QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListLatestUsageRollupsBefore(
+	ctx context.Context, filter *UsageRollupFilter, opts ...QueryOption,
+) ([]UsageRollup, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := usageRollupsQuery(db, filter).
+		Distinct(t.UsageRollups.Col("user_id")).
+		Where(t.UsageRollups.Col("period_start").Lt(filter.Start)).
+		Order(t.UsageRollups.Col("user_id").Asc(), t.UsageRollups.Col("period_start").Desc())
+	d.LogSQL(query)
+
+	var rollups []UsageRollup
+	if err := query.ScanStructsContext(ctx, &rollups); err != nil {
+		return nil, errors.Wrap(err, "unable to look up the latest usage rollups")
+	}
+
+	return rollups, nil
+}
+
+// GetUsageRollupBefore returns the latest rollup for a user and resource type whose period starts before the given
+// time, or nil if there isn't one. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) GetUsageRollupBefore(
+	ctx context.Context, userID, resourceTypeID, period string, before time.Time, opts ...QueryOption,
+) (*UsageRollup, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := usageRollupsQuery(db, &UsageRollupFilter{UserID: userID, ResourceTypeID: resourceTypeID, Period: period}).
+		Where(t.UsageRollups.Col("period_start").Lt(before)).
+		Order(t.UsageRollups.Col("period_start").Desc()).
+		Limit(1)
+	d.LogSQL(query)
+
+	var rollup UsageRollup
+	found, err := query.ScanStructContext(ctx, &rollup)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the usage rollup for user %s before %s", userID, before)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &rollup, nil
+}
+
+// ListUsageRollupKeys returns the users and resource types whose usage updates were recorded or changed at or after
+// the given time, along with the earliest effective date of those updates. All of the users and resource types that
+// have usage updates are returned if the time is zero, and only those of one user if the user ID isn't blank.
+// Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListUsageRollupKeys(
+	ctx context.Context, since time.Time, userID string, opts ...QueryOption,
+) ([]UsageRollupKey, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Updates).
+		Select(
+			t.Updates.Col("user_id"),
+			t.Updates.Col("resource_type_id"),
+			goqu.MIN(t.Updates.Col("effective_date")).As("from"),
+		).
+		Where(t.Updates.Col("value_type").Eq(UsagesTrackedMetric)).
+		GroupBy(t.Updates.Col("user_id"), t.Updates.Col("resource_type_id")).
+		Order(t.Updates.Col("user_id").Asc(), t.Updates.Col("resource_type_id").Asc())
+	if !since.IsZero() {
+		query = query.Where(t.Updates.Col("last_modified_at").Gte(since))
+	}
+	if userID != "" {
+		query = query.Where(t.Updates.Col("user_id").Eq(userID))
+	}
+	d.LogSQL(query)
+
+	var keys []UsageRollupKey
+	if err := query.ScanStructsContext(ctx, &keys); err != nil {
+		return nil, errors.Wrap(err, "unable to list the usage rollups to refresh")
+	}
+
+	return keys, nil
+}
+
+// StreamRollupUpdates calls fn with each of a user's usage updates for a resource type that took effect at or after
+// the given time, ordered by effective date. Updates with the same effective date are ordered by the time they were
+// recorded. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) StreamRollupUpdates(
+	ctx context.Context, userID, resourceTypeID string, from time.Time, fn func(*RollupUpdate) error,
+	opts ...QueryOption,
+) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.From(t.Updates).
+		Join(t.UpdateOperations, goqu.On(t.Updates.Col("update_operation_id").Eq(t.UpdateOperations.Col("id")))).
+		Select(
+			t.UpdateOperations.Col("name").As("operation"),
+			t.Updates.Col("value"),
+			t.Updates.Col("effective_date"),
+		).
+		Where(
+			t.Updates.Col("user_id").Eq(userID),
+			t.Updates.Col("resource_type_id").Eq(resourceTypeID),
+			t.Updates.Col("value_type").Eq(UsagesTrackedMetric),
+			t.Updates.Col("effective_date").Gte(from),
+		).
+		Order(t.Updates.Col("effective_date").Asc(), t.Updates.Col("created_at").Asc())
+	d.LogSQL(query)
+
+	if err := streamRows(ctx, query, fn); err != nil {
+		return errors.Wrapf(err, "unable to list the usage updates for user %s", userID)
+	}
+
+	return nil
+}
+
+// ListSubscriptionStartDates returns the start dates of a user's subscriptions in ascending order. Subscriptions that
+// were cancelled before they started never took effect, so they're left out. Accepts a variable number of
+// QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListSubscriptionStartDates(
+	ctx context.Context, userID string, opts ...QueryOption,
+) ([]time.Time, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Subscriptions).
+		Select(t.Subscriptions.Col("effective_start_date")).
+		Where(
+			t.Subscriptions.Col("user_id").Eq(userID),
+			goqu.Or(
+				t.Subscriptions.Col("effective_end_date").IsNull(),
+				t.Subscriptions.Col("effective_end_date").Gt(t.Subscriptions.Col("effective_start_date")),
+			),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Asc())
+	d.LogSQL(query)
+
+	var dates []time.Time
+	if err := query.ScanValsContext(ctx, &dates); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscription start dates for user %s", userID)
+	}
+
+	return dates, nil
+}
+
+// ReplaceUsageRollups replaces the rollups for a user and resource type whose periods start at or after the given
+// time. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ReplaceUsageRollups(
+	ctx context.Context, userID, resourceTypeID, period string, from time.Time, rollups []UsageRollup,
+	opts ...QueryOption,
+) error {
+	wrapMsg := "unable to replace the usage rollups for user " + userID
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	deleteQuery := db.From(t.UsageRollups).
+		Where(
+			t.UsageRollups.Col("user_id").Eq(userID),
+			t.UsageRollups.Col("resource_type_id").Eq(resourceTypeID),
+			t.UsageRollups.Col("period").Eq(period),
+			t.UsageRollups.Col("period_start").Gte(from),
+		).
+		Delete()
+	d.LogSQL(deleteQuery)
+	if _, err := deleteQuery.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, wrapMsg)
+	}
+
+	if len(rollups) == 0 {
+		return nil
+	}
+
+	rows := make([]any, len(rollups))
+	for i, r := range rollups {
+		rows[i] = goqu.Record{
+			"user_id":          userID,
+			"resource_type_id": resourceTypeID,
+			"period":           period,
+			"period_start":     r.PeriodStart,
+			"added":            r.Added,
+			"ending_value":     r.EndingValue,
+			"update_count":     r.UpdateCount,
+		}
+	}
+
+	// Another instance may be refreshing the same rollups at the same time. Both compute the rollups from the same
+	// updates, so the rows that are inserted last can simply replace the others.
+	insertQuery := db.Insert(t.UsageRollups).
+		Rows(rows...).
+		OnConflict(
+			goqu.DoUpdate(
+				"user_id, resource_type_id, period, period_start",
+				goqu.Record{
+					"added":        goqu.I("excluded.added"),
+					"ending_value": goqu.I("excluded.ending_value"),
+					"update_count": goqu.I("excluded.update_count"),
+				},
+			),
+		)
+	d.LogSQL(insertQuery)
+	if _, err := insertQuery.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, wrapMsg)
+	}
+
+	return nil
+}
+
+// GetUsageRollupWatermark returns the time that the usage rollups have been refreshed through. Accepts a variable
+// number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) GetUsageRollupWatermark(ctx context.Context, opts ...QueryOption) (time.Time, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	query := db.From(t.UsageRollupState).Select(t.UsageRollupState.Col("refreshed_through"))
+	d.LogSQL(query)
+
+	var watermark time.Time
+	if _, err := query.ScanValContext(ctx, &watermark); err != nil {
+		return watermark, errors.Wrap(err, "unable to look up when the usage rollups were last refreshed")
+	}
+
+	return watermark, nil
+}
+
+// SetUsageRollupWatermark records the time that the usage rollups have been refreshed through. Accepts a variable
+// number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) SetUsageRollupWatermark(ctx context.Context, watermark time.Time, opts ...QueryOption) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Update(t.UsageRollupState).Set(goqu.Record{"refreshed_through": watermark})
+	d.LogSQL(query)
+
+	if _, err := query.Executor().ExecContext(ctx); err != nil {
+		return errors.Wrap(err, "unable to record when the usage rollups were last refreshed")
+	}
+
+	return nil
+}
@@ -3,20 +3,29 @@ package tables
 import "github.com/doug-martin/goqu/v9"
 
 var (
-	UpdateOperations   = goqu.T("update_operations")
-	UOps               = UpdateOperations
-	Users              = goqu.T("users")
-	Subscriptions      = goqu.T("subscriptions")
-	SubscriptionAddons = goqu.T("subscription_addons")
-	Plans              = goqu.T("plans")
-	PlanQuotaDefaults  = goqu.T("plan_quota_defaults")
-	PQD                = PlanQuotaDefaults
-	ResourceTypes      = goqu.T("resource_types")
-	RT                 = ResourceTypes
-	Quotas             = goqu.T("quotas")
-	Usages             = goqu.T("usages")
-	Updates            = goqu.T("updates")
-	Addons             = goqu.T("addons")
-	PlanRates          = goqu.T("plan_rates")
-	AddonRates         = goqu.T("addon_rates")
+	UpdateOperations         = goqu.T("update_operations")
+	UOps                     = UpdateOperations
+	Users                    = goqu.T("users")
+	Subscriptions            = goqu.T("subscriptions")
+	SubscriptionAddons       = goqu.T("subscription_addons")
+	Plans                    = goqu.T("plans")
+	PlanQuotaDefaults        = goqu.T("plan_quota_defaults")
+	PQD                      = PlanQuotaDefaults
+	ResourceTypes            = goqu.T("resource_types")
+	RT                       = ResourceTypes
+	Quotas                   = goqu.T("quotas")
+	Usages                   = goqu.T("usages")
+	Updates                  = goqu.T("updates")
+	Addons                   = goqu.T("addons")
+	PlanRates                = goqu.T("plan_rates")
+	PlanVersions             = goqu.T("plan_versions")
+	PlanVersionQuotaDefaults = goqu.T("plan_version_quota_defaults")
+	AddonRates               = goqu.T("addon_rates")
+	AuditLog                 = goqu.T("audit_log")
+	Groups                   = goqu.T("groups")
+	GroupMembers             = goqu.T("group_members")
+	GroupSubscriptions       = goqu.T("group_subscriptions")
+	GroupQuotas              = goqu.T("group_quotas")
+	UsageRollups             = goqu.T("usage_rollups")
+	UsageRollupState         = goqu.T("usage_rollup_state")
 )
@@ -3,10 +3,10 @@ package db
 import (
 	"context"
 	"database/sql"
-	"fmt"
 	"time"
 
 	"github.com/cyverse-de/p/go/qms"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 	"google.golang.org/protobuf/types/known/timestamppb"
 )
@@ -71,6 +71,13 @@ func (u User) ToQMSUser() *qms.QMSUser {
 	}
 }
 
+// UserMerge reports what was moved when one user was merged into another.
+type UserMerge struct {
+	Subscriptions    int `json:"subscriptions"`
+	Updates          int `json:"updates"`
+	GroupMemberships int `json:"group_memberships"`
+}
+
 type ResourceType struct {
 	ID         string `db:"id" goqu:"defaultifempty"`
 	Name       string `db:"name"`
@@ -100,7 +107,7 @@ func (rt ResourceType) ValidateForPlan() error {
 
 	// We must have enough information to at least attempt to look up the resource type.
 	if rt.ID == "" && rt.Name == "" {
-		return fmt.Errorf("either the resource type name or the resource type ID is required")
+		return suberrors.BadRequest("either the resource type name or the resource type ID is required")
 	}
 
 	return nil
@@ -151,6 +158,21 @@ type Subscription struct {
 	LastModifiedAt     string              `db:"last_modified_at" goqu:"defaultifempty"`
 	Paid               bool                `db:"paid" goqu:"defaultifempty"`
 	Rate               PlanRate            `db:"plan_rates"`
+	PlanVersionID      string              `db:"plan_version_id"`
+	ActivatedAt        *time.Time          `db:"activated_at"`
+	CancelledAt        *time.Time          `db:"cancelled_at"`
+	CancelledBy        string              `db:"cancelled_by"`
+	CancellationReason string              `db:"cancellation_reason"`
+}
+
+// Pending returns true if the subscription was scheduled to start in the future and hasn't been activated yet.
+func (up Subscription) Pending() bool {
+	return up.ActivatedAt == nil
+}
+
+// Cancelled returns true if the subscription was cancelled.
+func (up Subscription) Cancelled() bool {
+	return up.CancelledAt != nil
 }
 
 func NewSubscriptionFromQMS(s *qms.Subscription) *Subscription {
@@ -217,11 +239,12 @@ func (up Subscription) ToQMSSubscription() *qms.Subscription {
 }
 
 type Plan struct {
-	ID            string             `db:"id" goqu:"defaultifempty"`
-	Name          string             `db:"name"`
-	Description   string             `db:"description"`
-	QuotaDefaults []PlanQuotaDefault `db:"-"`
-	Rates         []PlanRate         `db:"-"`
+	ID              string             `db:"id" goqu:"defaultifempty"`
+	Name            string             `db:"name"`
+	Description     string             `db:"description"`
+	GracePeriodDays int                `db:"grace_period_days"`
+	QuotaDefaults   []PlanQuotaDefault `db:"-"`
+	Rates           []PlanRate         `db:"-"`
 }
 
 func NewPlanFromQMS(q *qms.Plan) *Plan {
@@ -301,10 +324,10 @@ func (p Plan) Validate() error {
 
 	// The plan name and description are both required.
 	if p.Name == "" {
-		return fmt.Errorf("a plan name is required")
+		return suberrors.BadRequest("a plan name is required")
 	}
 	if p.Description == "" {
-		return fmt.Errorf("a plan description is required")
+		return suberrors.BadRequest("a plan description is required")
 	}
 
 	// Validate the quota defaults.
@@ -331,7 +354,7 @@ func (p Plan) ValidateQuotaDefaultUniqueness() error {
 	for _, qd := range p.QuotaDefaults {
 		key := qd.Key()
 		if uniquePlanQuotaDefaults[key] {
-			return fmt.Errorf("there can only be one quota default for each resource type and effective date")
+			return suberrors.BadRequest("there can only be one quota default for each resource type and effective date")
 		} else {
 			uniquePlanQuotaDefaults[key] = true
 		}
@@ -347,7 +370,7 @@ func (p Plan) ValidatePlanRateUniqueness() error {
 	for _, r := range p.Rates {
 		key := r.EffectiveDate.UnixMicro()
 		if uniquePlanRates[key] {
-			return fmt.Errorf("there can only be one plan rate for each effective date")
+			return suberrors.BadRequest("there can only be one plan rate for each effective date")
 		} else {
 			uniquePlanRates[key] = true
 		}
@@ -391,12 +414,12 @@ func (pqd PlanQuotaDefault) ValidateForPlan() error {
 
 	// The default quota value must be specified and greater than zero.
 	if pqd.QuotaValue <= 0 {
-		return fmt.Errorf("plan quota default values must be specified and greater than zero")
+		return suberrors.BadRequest("plan quota default values must be specified and greater than zero")
 	}
 
 	// The effective date must be specified.
 	if pqd.EffectiveDate.IsZero() {
-		return fmt.Errorf("all plan quota defaults must have an effective date")
+		return suberrors.BadRequest("all plan quota defaults must have an effective date")
 	}
 
 	return pqd.ResourceType.ValidateForPlan()
@@ -441,12 +464,12 @@ func (pr PlanRate) Validate() error {
 
 	// The rate can't be negative.
 	if pr.Rate < 0 {
-		return fmt.Errorf("the plan rate must not be less than zero")
+		return suberrors.BadRequest("the plan rate must not be less than zero")
 	}
 
 	// The effective date has to be specified.
 	if pr.EffectiveDate.IsZero() {
-		return fmt.Errorf("the effective date of the plan rate must be specified")
+		return suberrors.BadRequest("the effective date of the plan rate must be specified")
 	}
 
 	return nil
@@ -589,15 +612,15 @@ func (a *Addon) Validate() error {
 
 	// The name and description are both required.
 	if a.Name == "" {
-		return fmt.Errorf("name must be set")
+		return suberrors.BadRequest("name must be set")
 	}
 	if a.Description == "" {
-		return fmt.Errorf("description must be set")
+		return suberrors.BadRequest("description must be set")
 	}
 
 	// The default amount must be positive.
 	if a.DefaultAmount <= 0.0 {
-		return fmt.Errorf("default_amount must be greater than 0.0")
+		return suberrors.BadRequest("default_amount must be greater than 0.0")
 	}
 
 	// Verify that we have enough information to attempt to look up the resource type.
@@ -616,7 +639,7 @@ func (a *Addon) ValidateAddonRateUniqueness() error {
 	for _, r := range a.AddonRates {
 		key := r.EffectiveDate.UnixMicro()
 		if uniqueAddonRates[key] {
-			return fmt.Errorf("there can only be one plan rate for each effective date")
+			return suberrors.BadRequest("there can only be one plan rate for each effective date")
 		} else {
 			uniqueAddonRates[key] = true
 		}
@@ -682,12 +705,12 @@ func (r *AddonRate) Validate() error {
 
 	// The rate can't be negative.
 	if r.Rate < 0 {
-		return fmt.Errorf("the plan rate must not be less than zero")
+		return suberrors.BadRequest("the plan rate must not be less than zero")
 	}
 
 	// The effective date has to be specified.
 	if r.EffectiveDate.IsZero() {
-		return fmt.Errorf("the effective date of the plan rate must be specified")
+		return suberrors.BadRequest("the effective date of the plan rate must be specified")
 	}
 
 	return nil
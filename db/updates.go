@@ -2,9 +2,9 @@ package db
 
 import (
 	"context"
-	"fmt"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/sirupsen/logrus"
 )
@@ -18,7 +18,10 @@ func (d *Database) UserUpdates(ctx context.Context, username string, opts ...Que
 		db  GoquDatabase
 	)
 
-	querySettings, db := d.querySettings(opts...)
+	querySettings, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	query := db.From(t.Updates).
 		Select(
@@ -86,12 +89,12 @@ func (d *Database) UserUpdates(ctx context.Context, username string, opts ...Que
 // Update with the UUID filled in. Accepts a variable number of QueryOptions,
 // though only WithTx is currently supported.
 func (d *Database) AddUserUpdate(ctx context.Context, update *Update, opts ...QueryOption) (*Update, error) {
-	var (
-		err error
-		db  GoquDatabase
-	)
+	var err error
 
-	_, db = d.querySettings(opts...)
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := db.Insert("updates").Rows(
 		goqu.Record{
@@ -102,6 +105,8 @@ func (d *Database) AddUserUpdate(ctx context.Context, update *Update, opts ...Qu
 			"resource_type_id":    update.ResourceType.ID,
 			"user_id":             update.User.ID,
 			"metadata":            update.Metadata,
+			"created_by":          qs.Actor(),
+			"last_modified_by":    qs.Actor(),
 		},
 	).
 		Returning(goqu.C("id")).
@@ -120,7 +125,10 @@ func (d *Database) AddUserUpdate(ctx context.Context, update *Update, opts ...Qu
 
 // GetUserUpdate loads the details of the user update with the given ID.
 func (d *Database) GetUserUpdate(ctx context.Context, id string, opts ...QueryOption) (*Update, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the query.
 	query := db.From(t.Updates).
@@ -165,8 +173,14 @@ func (d *Database) GetUserUpdate(ctx context.Context, id string, opts ...QueryOp
 // ProcessUpdateForUsage accepts a new *Update, inserts it into the database,
 // then uses it to calculate new usage and upsert it into the database. Does not
 // accept any QueryOptions since it sets up the transaction and other options
-// itself.
+// itself. The user must have an active subscription; the error matches
+// ErrNoActiveSubscription otherwise.
 func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update, opts ...QueryOption) error {
+	return processUpdateForUsage(ctx, d, update, opts...)
+}
+
+// processUpdateForUsage implements ProcessUpdateForUsage for any repository.
+func processUpdateForUsage(ctx context.Context, d Repository, update *Update, opts ...QueryOption) error {
 	log = log.WithFields(logrus.Fields{"context": "usage update", "user": update.User.Username})
 
 	log.Debug("before getting active user plan")
@@ -176,39 +190,6 @@ func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update, op
 	}
 	log.Debugf("after getting active user plan %s", subscription.ID)
 
-	// create a subscription if there isn't one
-	if subscription.ID == "" {
-		user, err := d.EnsureUser(ctx, update.User.Username, opts...)
-		if err != nil {
-			log.Errorf("unable to ensure that the user exists in the database: %s", err)
-			return err
-		}
-
-		plan, err := d.GetPlanByName(ctx, DefaultPlanName, opts...)
-		if err != nil {
-			log.Errorf("unable to look up the default plan: %s", err)
-			return err
-		}
-
-		subscriptionOpts := DefaultSubscriptionOptions()
-		subscriptionID, err := d.SetActiveSubscription(ctx, user.ID, plan, subscriptionOpts, opts...)
-		if err != nil {
-			log.Errorf("unable to subscribe the user to the default plan: %s", err)
-			return err
-		}
-
-		subscription, err = d.GetSubscriptionByID(ctx, subscriptionID, opts...)
-		if err != nil {
-			log.Errorf("unable to look up the new user plan: %s", err)
-			return err
-		}
-		if subscription == nil {
-			err = fmt.Errorf("the newly inserted user plan could not be found")
-			log.Error(err)
-			return err
-		}
-	}
-
 	log.Debug("getting current usage")
 	usageValue, usageFound, err := d.GetCurrentUsage(ctx, update.ResourceType.ID, subscription.ID, opts...)
 	if err != nil {
@@ -223,7 +204,7 @@ func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update, op
 	case UpdateTypeAdd:
 		usageValue = usageValue + update.Value
 	default:
-		return fmt.Errorf("invalid update type: %s", update.UpdateOperation.Name)
+		return suberrors.ErrInvalidUpdateType.WithField("update_type", update.UpdateOperation.Name)
 	}
 	log.Debugf("new usage value is %f", usageValue)
 
@@ -241,6 +222,11 @@ func (d *Database) ProcessUpdateForUsage(ctx context.Context, update *Update, op
 // the database. Does not accept an QueryOptions since it sets up the
 // transaction and other options itself.
 func (d *Database) ProcessUpdateForQuota(ctx context.Context, update *Update, opts ...QueryOption) error {
+	return processUpdateForQuota(ctx, d, update, opts...)
+}
+
+// processUpdateForQuota implements ProcessUpdateForQuota for any repository.
+func processUpdateForQuota(ctx context.Context, d Repository, update *Update, opts ...QueryOption) error {
 	var err error
 
 	subscription, err := d.GetActiveSubscription(ctx, update.User.Username, opts...)
@@ -259,7 +245,7 @@ func (d *Database) ProcessUpdateForQuota(ctx context.Context, update *Update, op
 	case UpdateTypeAdd:
 		quotaValue = quotaValue + update.Value
 	default:
-		return fmt.Errorf("invalid update type: %s", update.UpdateOperation.Name)
+		return suberrors.ErrInvalidUpdateType.WithField("update_type", update.UpdateOperation.Name)
 	}
 
 	if err = d.UpsertQuota(
@@ -2,8 +2,8 @@ package db
 
 import (
 	"context"
-	"fmt"
 
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
 	"github.com/doug-martin/goqu/v9/exec"
 )
@@ -19,7 +19,10 @@ func (d *Database) GetCurrentUsage(ctx context.Context, resourceTypeID, subscrip
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return 0, false, err
+	}
 
 	usagesE := db.From("usages").
 		Select(goqu.C("usage")).
@@ -43,26 +46,28 @@ func (d *Database) GetCurrentUsage(ctx context.Context, resourceTypeID, subscrip
 // resource type and user plan indicated. Accepts a variable number of
 // QueryOptions, though only WithTX is currently supported.
 func (d *Database) UpsertUsage(ctx context.Context, update bool, value float64, resourceTypeID, subscriptionID string, opts ...QueryOption) error {
-	var (
-		err error
-		db  GoquDatabase
-	)
+	var err error
 
-	_, db = d.querySettings(opts...)
-
-	updateRecord := goqu.Record{
-		"usage":            value,
-		"resource_type_id": resourceTypeID,
-		"subscription_id":  subscriptionID,
-		"last_modified_by": "de",
-		"created_by":       "de",
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
 	}
 
 	var upsertE exec.QueryExecutor
 	if !update {
-		upsertE = db.Insert("usages").Rows(updateRecord).Executor()
+		upsertE = db.Insert("usages").Rows(goqu.Record{
+			"usage":            value,
+			"resource_type_id": resourceTypeID,
+			"subscription_id":  subscriptionID,
+			"last_modified_by": qs.Actor(),
+			"created_by":       qs.Actor(),
+		}).Executor()
 	} else {
-		upsertE = db.Update("usages").Set(updateRecord).Where(
+		upsertE = db.Update("usages").Set(goqu.Record{
+			"usage":            value,
+			"last_modified_by": qs.Actor(),
+			"last_modified_at": CurrentTimestamp,
+		}).Where(
 			goqu.And(
 				goqu.I("resource_type_id").Eq(resourceTypeID),
 				goqu.I("subscription_id").Eq(subscriptionID),
@@ -85,6 +90,11 @@ func (d *Database) UpsertUsage(ctx context.Context, update bool, value float64,
 // out of sync with the updates. Accepts a variable number of QueryOptions,
 // though only WithTX is currently supported.
 func (d *Database) CalculateUsage(ctx context.Context, updateType string, usage *Usage, opts ...QueryOption) error {
+	return calculateUsage(ctx, d, updateType, usage, opts...)
+}
+
+// calculateUsage implements CalculateUsage for any repository.
+func calculateUsage(ctx context.Context, d Repository, updateType string, usage *Usage, opts ...QueryOption) error {
 	var (
 		err           error
 		newUsageValue float64
@@ -102,7 +112,7 @@ func (d *Database) CalculateUsage(ctx context.Context, updateType string, usage
 	case UpdateTypeAdd:
 		newUsageValue = currentUsageValue + usage.Usage
 	default:
-		return fmt.Errorf("invalid update type: %s", updateType)
+		return suberrors.ErrInvalidUpdateType.WithField("update_type", updateType)
 	}
 
 	usage.Usage = newUsageValue
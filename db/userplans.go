@@ -2,11 +2,12 @@ package db
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/pkg/errors"
 )
 
 // SubscriptionOptions contains options for a new subscription.
@@ -14,15 +15,15 @@ type SubscriptionOptions struct {
 	Paid    bool
 	Periods int32
 	EndDate time.Time
+
+	// StartDate is the time that a scheduled subscription starts. The subscription starts immediately if it's the
+	// zero value or in the past.
+	StartDate time.Time
 }
 
-// DefaultSubscriptionOptions returns the default subscription options.
-func DefaultSubscriptionOptions() *SubscriptionOptions {
-	return &SubscriptionOptions{
-		Paid:    false,
-		Periods: 1,
-		EndDate: time.Now().AddDate(1, 0, 0),
-	}
+// Scheduled returns true if the options describe a subscription that starts in the future.
+func (o *SubscriptionOptions) Scheduled(now time.Time) bool {
+	return o.StartDate.After(now)
 }
 
 // subscriptionDS returns the goqu.SelectDataset for getting user plan info, but with
@@ -38,6 +39,11 @@ func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
 			t.Subscriptions.Col("last_modified_by").As("last_modified_by"),
 			t.Subscriptions.Col("last_modified_at").As("last_modified_at"),
 			t.Subscriptions.Col("paid").As("paid"),
+			t.Subscriptions.Col("plan_version_id").As("plan_version_id"),
+			t.Subscriptions.Col("activated_at").As("activated_at"),
+			t.Subscriptions.Col("cancelled_at").As("cancelled_at"),
+			goqu.COALESCE(t.Subscriptions.Col("cancelled_by"), "").As("cancelled_by"),
+			goqu.COALESCE(t.Subscriptions.Col("cancellation_reason"), "").As("cancellation_reason"),
 
 			t.Users.Col("id").As(goqu.C("users.id")),
 			t.Users.Col("username").As(goqu.C("users.username")),
@@ -45,6 +51,7 @@ func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
 			t.Plans.Col("id").As(goqu.C("plans.id")),
 			t.Plans.Col("name").As(goqu.C("plans.name")),
 			t.Plans.Col("description").As(goqu.C("plans.description")),
+			t.Plans.Col("grace_period_days").As(goqu.C("plans.grace_period_days")),
 
 			t.PlanRates.Col("id").As(goqu.C("plan_rates.id")),
 			t.PlanRates.Col("effective_date").As(goqu.C("plan_rates.effective_date")),
@@ -56,7 +63,10 @@ func subscriptionDS(db GoquDatabase) *goqu.SelectDataset {
 }
 
 func (d *Database) GetSubscriptionByID(ctx context.Context, subscriptionID string, opts ...QueryOption) (*Subscription, error) {
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ds := subscriptionDS(db).
 		Where(
@@ -76,7 +86,8 @@ func (d *Database) GetSubscriptionByID(ctx context.Context, subscriptionID strin
 	return &result, nil
 }
 
-// GetActiveSubscription returns the active user plan for the username passed in.
+// GetActiveSubscription returns the active user plan for the username passed in. Returns an error matching
+// ErrNoActiveSubscription if the user doesn't have an active subscription.
 // Accepts a variable number of QueryOptions, but only WithTX is currently
 // supported.
 func (d *Database) GetActiveSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
@@ -86,7 +97,10 @@ func (d *Database) GetActiveSubscription(ctx context.Context, username string, o
 		db     GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	effStartDate := goqu.I("subscriptions.effective_start_date")
 	effEndDate := goqu.I("subscriptions.effective_end_date")
@@ -104,9 +118,13 @@ func (d *Database) GetActiveSubscription(ctx context.Context, username string, o
 		Limit(1)
 	d.LogSQL(query)
 
-	if _, err = query.Executor().ScanStructContext(ctx, &result); err != nil {
+	found, err := query.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
 		return nil, err
 	}
+	if !found {
+		return nil, suberrors.ErrNoActiveSubscription.WithField("username", username)
+	}
 
 	log.Debugf("%+v", result)
 
@@ -116,15 +134,32 @@ func (d *Database) GetActiveSubscription(ctx context.Context, username string, o
 func (d *Database) SetActiveSubscription(
 	ctx context.Context, userID string, plan *Plan, subscriptionOpts *SubscriptionOptions, opts ...QueryOption,
 ) (string, error) {
-	_, db := d.querySettings(opts...)
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
+	actor := qs.Actor()
 
 	n := time.Now()
 	e := subscriptionOpts.EndDate
 
+	// Scheduled subscriptions remain pending until they're activated.
+	var activatedAt any = n
+	if subscriptionOpts.Scheduled(n) {
+		n = subscriptionOpts.StartDate
+		activatedAt = nil
+	}
+
 	// Get the active plan rate.
 	activePlanRate := plan.GetActiveRate()
 	if activePlanRate == nil {
-		return "", fmt.Errorf("the %s subscription plan has no effective rate", plan.Name)
+		return "", suberrors.Conflict("the %s subscription plan has no effective rate", plan.Name)
+	}
+
+	// Record the version of the plan that the user is subscribing to.
+	planVersion, err := d.EnsurePlanVersion(ctx, plan, opts...)
+	if err != nil {
+		return "", err
 	}
 
 	query := db.Insert(t.Subscriptions).
@@ -134,10 +169,12 @@ func (d *Database) SetActiveSubscription(
 				"effective_end_date":   e,
 				"user_id":              userID,
 				"plan_id":              plan.ID,
-				"created_by":           "de",
-				"last_modified_by":     "de",
+				"created_by":           actor,
+				"last_modified_by":     actor,
 				"paid":                 subscriptionOpts.Paid,
 				"plan_rate_id":         activePlanRate.ID,
+				"plan_version_id":      planVersion.ID,
+				"activated_at":         activatedAt,
 			},
 		).
 		Returning(t.Subscriptions.Col("id"))
@@ -166,8 +203,8 @@ func (d *Database) SetActiveSubscription(
 				"resource_type_id": quotaDefault.ResourceType.ID,
 				"subscription_id":  subscriptionID,
 				"quota":            quotaValue,
-				"created_by":       goqu.V("de"),
-				"last_modified_by": goqu.V("de"),
+				"created_by":       goqu.V(actor),
+				"last_modified_by": goqu.V(actor),
 			},
 		)
 		d.LogSQL(ds)
@@ -185,7 +222,10 @@ func (d *Database) UserHasActivePlan(ctx context.Context, username string, opts
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
 
 	effStartDate := goqu.I("subscriptions.effective_start_date")
 	effEndDate := goqu.I("subscriptions.effective_end_date")
@@ -212,7 +252,10 @@ func (d *Database) UserHasActivePlan(ctx context.Context, username string, opts
 func (d *Database) UserOnPlan(ctx context.Context, username, planName string, opts ...QueryOption) (bool, error) {
 	var err error
 
-	_, db := d.querySettings(opts...)
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
 
 	effStartDate := goqu.I("subscriptions.effective_start_date")
 	effEndDate := goqu.I("subscriptions.effective_end_date")
@@ -248,7 +291,10 @@ func (d *Database) SubscriptionUsages(ctx context.Context, subscriptionID string
 		usages []Usage
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	usagesQuery := db.From(t.Usages).
 		Select(
@@ -284,7 +330,10 @@ func (d *Database) SubscriptionPlanRates(ctx context.Context, planID string, opt
 		rates []PlanRate
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	ratesQuery := db.From(t.PlanRates).
 		Select(
@@ -312,7 +361,10 @@ func (d *Database) SubscriptionQuotas(ctx context.Context, subscriptionID string
 		quotas []Quota
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	quotasQuery := db.From(t.Quotas).
 		Select(
@@ -348,7 +400,10 @@ func (d *Database) SubscriptionQuotaDefaults(ctx context.Context, planID string,
 		defaults []PlanQuotaDefault
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	pqdQuery := db.From(t.PQD).
 		Select(
@@ -375,6 +430,11 @@ func (d *Database) SubscriptionQuotaDefaults(ctx context.Context, planID string,
 // LoadSubscriptionDetails adds PlanQuotaDefaults, quotas and usages into a user plan. Accepts a variable number of
 // QuotaOptions, though only WithTX is currently supported.
 func (d *Database) LoadSubscriptionDetails(ctx context.Context, subscription *Subscription, opts ...QueryOption) error {
+	return loadSubscriptionDetails(ctx, d, subscription, opts...)
+}
+
+// loadSubscriptionDetails implements LoadSubscriptionDetails for any repository.
+func loadSubscriptionDetails(ctx context.Context, d Repository, subscription *Subscription, opts ...QueryOption) error {
 	var (
 		err      error
 		defaults []PlanQuotaDefault
@@ -415,3 +475,325 @@ func (d *Database) LoadSubscriptionDetails(ctx context.Context, subscription *Su
 
 	return nil
 }
+
+// ListActiveSubscriptionsByPlanVersion returns the subscriptions that are currently in effect and were created under,
+// or have been migrated to, the given plan version. Accepts a variable number of QueryOptions, but only WithTX is
+// currently supported.
+func (d *Database) ListActiveSubscriptionsByPlanVersion(
+	ctx context.Context, planVersionID string, opts ...QueryOption,
+) ([]Subscription, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	effStartDate := goqu.I("subscriptions.effective_start_date")
+	effEndDate := goqu.I("subscriptions.effective_end_date")
+
+	query := subscriptionDS(db).
+		Where(
+			t.Subscriptions.Col("plan_version_id").Eq(planVersionID),
+			goqu.Or(
+				CurrentTimestamp.Between(goqu.Range(effStartDate, effEndDate)),
+				goqu.And(CurrentTimestamp.Gt(effStartDate), effEndDate.Is(nil)),
+			),
+		).
+		Order(t.Subscriptions.Col("id").Asc())
+	d.LogSQL(query)
+
+	var subscriptions []Subscription
+	if err := query.ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the active subscriptions for plan version %s", planVersionID)
+	}
+
+	return subscriptions, nil
+}
+
+// SetSubscriptionPlanVersion moves a subscription to a different version of its plan, along with the rate recorded
+// in that version. The quotas of the subscription aren't changed. Accepts a variable number of QueryOptions,
+// including WithTX and WithActor.
+func (d *Database) SetSubscriptionPlanVersion(
+	ctx context.Context, subscriptionID string, version *PlanVersion, opts ...QueryOption,
+) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Update(t.Subscriptions).
+		Set(
+			goqu.Record{
+				"plan_version_id":  version.ID,
+				"plan_rate_id":     version.PlanRateID,
+				"last_modified_by": qs.Actor(),
+				"last_modified_at": CurrentTimestamp,
+			},
+		).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID))
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to move subscription %s to plan version %s", subscriptionID, version.ID)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return suberrors.ErrSubscriptionNotFound.WithField("subscription_id", subscriptionID)
+	}
+
+	return nil
+}
+
+// ListPendingSubscriptions returns the user's subscriptions that were scheduled to start in the future and haven't
+// been activated or cancelled yet, ordered by start date. Accepts a variable number of QueryOptions, but only WithTX is currently
+// supported.
+func (d *Database) ListPendingSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := subscriptionDS(db).
+		Where(
+			t.Users.Col("username").Eq(username),
+			t.Subscriptions.Col("activated_at").IsNull(),
+			t.Subscriptions.Col("cancelled_at").IsNull(),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Asc())
+	d.LogSQL(query)
+
+	var subscriptions []Subscription
+	if err := query.ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the pending subscriptions for %s", username)
+	}
+
+	return subscriptions, nil
+}
+
+// ListDueSubscriptions returns the pending subscriptions of all users whose start dates have passed, ordered by start
+// date. Cancelled subscriptions are never activated, so they aren't included. Accepts a variable number of QueryOptions, but only WithTX and WithQueryLimit are currently supported.
+func (d *Database) ListDueSubscriptions(ctx context.Context, opts ...QueryOption) ([]Subscription, error) {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := subscriptionDS(db).
+		Where(
+			t.Subscriptions.Col("activated_at").IsNull(),
+			t.Subscriptions.Col("cancelled_at").IsNull(),
+			t.Subscriptions.Col("effective_start_date").Lte(CurrentTimestamp),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Asc())
+	if qs.hasLimit {
+		query = query.Limit(qs.limit)
+	}
+	d.LogSQL(query)
+
+	var subscriptions []Subscription
+	if err := query.ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrap(err, "unable to list the subscriptions that are due to be activated")
+	}
+
+	return subscriptions, nil
+}
+
+// ListSubscriptionsInEffectAt returns the user's activated subscriptions that started before the given time and end
+// after it. Accepts a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListSubscriptionsInEffectAt(
+	ctx context.Context, userID string, at time.Time, opts ...QueryOption,
+) ([]Subscription, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	effEndDate := t.Subscriptions.Col("effective_end_date")
+
+	query := subscriptionDS(db).
+		Where(
+			t.Subscriptions.Col("user_id").Eq(userID),
+			t.Subscriptions.Col("activated_at").IsNotNull(),
+			t.Subscriptions.Col("effective_start_date").Lt(at),
+			goqu.Or(effEndDate.Gt(at), effEndDate.IsNull()),
+		).
+		Order(t.Subscriptions.Col("effective_start_date").Asc())
+	d.LogSQL(query)
+
+	var subscriptions []Subscription
+	if err := query.ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions in effect for user %s", userID)
+	}
+
+	return subscriptions, nil
+}
+
+// SetSubscriptionEndDate changes the time that a subscription ends. Accepts a variable number of QueryOptions,
+// including WithTX and WithActor.
+func (d *Database) SetSubscriptionEndDate(
+	ctx context.Context, subscriptionID string, endDate time.Time, opts ...QueryOption,
+) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Update(t.Subscriptions).
+		Set(
+			goqu.Record{
+				"effective_end_date": endDate,
+				"last_modified_by":   qs.Actor(),
+				"last_modified_at":   CurrentTimestamp,
+			},
+		).
+		Where(t.Subscriptions.Col("id").Eq(subscriptionID))
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to set the end date of subscription %s", subscriptionID)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return suberrors.ErrSubscriptionNotFound.WithField("subscription_id", subscriptionID)
+	}
+
+	return nil
+}
+
+// ActivateSubscription records that a pending subscription has been activated. Returns false if the subscription
+// isn't pending, which happens when another instance of the service activated it first. Accepts a variable number
+// of QueryOptions, including WithTX and WithActor.
+func (d *Database) ActivateSubscription(ctx context.Context, subscriptionID string, opts ...QueryOption) (bool, error) {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
+
+	query := db.Update(t.Subscriptions).
+		Set(
+			goqu.Record{
+				"activated_at":     CurrentTimestamp,
+				"last_modified_by": qs.Actor(),
+				"last_modified_at": CurrentTimestamp,
+			},
+		).
+		Where(
+			t.Subscriptions.Col("id").Eq(subscriptionID),
+			t.Subscriptions.Col("activated_at").IsNull(),
+		)
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to activate subscription %s", subscriptionID)
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return false, errors.Wrapf(err, "unable to activate subscription %s", subscriptionID)
+	}
+
+	return rows > 0, nil
+}
+
+// ListSubscriptions returns all of the user's subscriptions, including subscriptions that have ended and
+// subscriptions that haven't started yet, with the most recent start date first. Accepts a variable number of
+// QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListSubscriptions(ctx context.Context, username string, opts ...QueryOption) ([]Subscription, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := subscriptionDS(db).
+		Where(t.Users.Col("username").Eq(username)).
+		Order(t.Subscriptions.Col("effective_start_date").Desc())
+	d.LogSQL(query)
+
+	var subscriptions []Subscription
+	if err := query.ScanStructsContext(ctx, &subscriptions); err != nil {
+		return nil, errors.Wrapf(err, "unable to list the subscriptions for %s", username)
+	}
+
+	return subscriptions, nil
+}
+
+// CancelSubscription ends a subscription at the given time and records who cancelled it and why. The reason may be
+// empty. The caller is expected to have checked that the subscription exists; an error matching
+// ErrSubscriptionCancelled is returned if it was already cancelled. Accepts a variable number of QueryOptions,
+// including WithTX and WithActor.
+func (d *Database) CancelSubscription(
+	ctx context.Context, subscriptionID string, endDate time.Time, reason string, opts ...QueryOption,
+) error {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+	actor := qs.Actor()
+
+	var cancellationReason any
+	if reason != "" {
+		cancellationReason = reason
+	}
+
+	query := db.Update(t.Subscriptions).
+		Set(
+			goqu.Record{
+				"effective_end_date":  endDate,
+				"cancelled_at":        CurrentTimestamp,
+				"cancelled_by":        actor,
+				"cancellation_reason": cancellationReason,
+				"last_modified_by":    actor,
+				"last_modified_at":    CurrentTimestamp,
+			},
+		).
+		Where(
+			t.Subscriptions.Col("id").Eq(subscriptionID),
+			t.Subscriptions.Col("cancelled_at").IsNull(),
+		)
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to cancel subscription %s", subscriptionID)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return suberrors.ErrSubscriptionCancelled.WithField("subscription_id", subscriptionID)
+	}
+
+	return nil
+}
+
+// GetGraceSubscription returns the user's most recent paid subscription that ended without being cancelled less than
+// its plan's grace period ago, or nil if there isn't one. Accepts a variable number of QueryOptions, but only WithTX
+// is currently supported.
+func (d *Database) GetGraceSubscription(ctx context.Context, username string, opts ...QueryOption) (*Subscription, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	effEndDate := t.Subscriptions.Col("effective_end_date")
+	graceEndDate := goqu.L("? + make_interval(days => ?)", effEndDate, t.Plans.Col("grace_period_days"))
+
+	query := subscriptionDS(db).
+		Where(
+			t.Users.Col("username").Eq(username),
+			t.Subscriptions.Col("paid").IsTrue(),
+			t.Subscriptions.Col("cancelled_at").IsNull(),
+			effEndDate.Lte(CurrentTimestamp),
+			graceEndDate.Gt(CurrentTimestamp),
+		).
+		Order(effEndDate.Desc()).
+		Limit(1)
+	d.LogSQL(query)
+
+	var result Subscription
+	found, err := query.Executor().ScanStructContext(ctx, &result)
+	if err != nil {
+		return nil, errors.Wrapf(err, "unable to look up the subscription in its grace period for %s", username)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	return &result, nil
+}
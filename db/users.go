@@ -2,9 +2,16 @@ package db
 
 import (
 	"context"
+	"fmt"
+	"strings"
+	"time"
 
+	t "github.com/cyverse-de/subscriptions/db/tables"
+	suberrors "github.com/cyverse-de/subscriptions/errors"
 	"github.com/doug-martin/goqu/v9"
+	"github.com/doug-martin/goqu/v9/exec"
 	"github.com/pkg/errors"
+	"github.com/samber/lo"
 )
 
 // GetUserID returns a user's UUID associated with their username.
@@ -16,7 +23,10 @@ func (d *Database) GetUserID(ctx context.Context, username string, opts ...Query
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	usersT := goqu.T("users")
 	query := db.From(usersT).
@@ -45,7 +55,10 @@ func (d *Database) GetUser(ctx context.Context, id string, opts ...QueryOption)
 		result User
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	usersT := goqu.T("users")
 	query := db.From(usersT).
@@ -67,7 +80,10 @@ func (d *Database) UserExists(ctx context.Context, username string, opts ...Quer
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return false, err
+	}
 
 	users := goqu.T("users")
 	count, err := db.From(users).Where(users.Col("username").Eq(username)).Count()
@@ -84,7 +100,10 @@ func (d *Database) AddUser(ctx context.Context, username string, opts ...QueryOp
 		db  GoquDatabase
 	)
 
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return "", err
+	}
 
 	ds := db.Insert("users").Rows(
 		goqu.Record{
@@ -114,7 +133,10 @@ func (d *Database) EnsureUser(ctx context.Context, username string, opts ...Quer
 	)
 
 	// Prepare to execute the statement.
-	_, db = d.querySettings(opts...)
+	_, db, err = d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
 
 	// Build the statement.
 	usersT := goqu.T("users")
@@ -143,3 +165,343 @@ func (d *Database) EnsureUser(ctx context.Context, username string, opts ...Quer
 
 	return &result, nil
 }
+
+// RenameUser changes a user's username. Accepts a variable number of QueryOptions, but only WithTX is currently
+// supported.
+func (d *Database) RenameUser(ctx context.Context, userID, username string, opts ...QueryOption) error {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return err
+	}
+
+	query := db.Update(t.Users).
+		Set(goqu.Record{"username": username}).
+		Where(t.Users.Col("id").Eq(userID))
+	d.LogSQL(query)
+
+	result, err := query.Executor().ExecContext(ctx)
+	if err != nil {
+		return errors.Wrapf(err, "unable to rename user %s to %s", userID, username)
+	}
+	if rows, err := result.RowsAffected(); err == nil && rows == 0 {
+		return suberrors.ErrUserNotFound.WithField("user_id", userID)
+	}
+
+	return nil
+}
+
+// ListUnfoldedUsers returns the users whose stored usernames contain upper case letters, ordered by username. Accepts
+// a variable number of QueryOptions, but only WithTX is currently supported.
+func (d *Database) ListUnfoldedUsers(ctx context.Context, opts ...QueryOption) ([]User, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := db.From(t.Users).
+		Select(t.Users.Col("id"), t.Users.Col("username")).
+		Where(t.Users.Col("username").Neq(goqu.Func("lower", t.Users.Col("username")))).
+		Order(t.Users.Col("username").Asc())
+	d.LogSQL(query)
+
+	var users []User
+	if err := query.ScanStructsContext(ctx, &users); err != nil {
+		return nil, errors.Wrap(err, "unable to list the users whose usernames contain upper case letters")
+	}
+
+	return users, nil
+}
+
+// MergeUsers moves the subscriptions, usage updates and group memberships of the source user to the target user,
+// then deletes the source user. The usages, quotas and add-ons of the subscriptions move along with them. Group
+// memberships that the target user already has are dropped. Accepts a variable number of QueryOptions, including
+// WithTX and WithActor.
+func (d *Database) MergeUsers(ctx context.Context, sourceID, targetID string, opts ...QueryOption) (*UserMerge, error) {
+	wrapMsg := fmt.Sprintf("unable to merge user %s into user %s", sourceID, targetID)
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var result UserMerge
+
+	// Move the subscriptions.
+	subscriptionsQuery := db.Update(t.Subscriptions).
+		Set(
+			goqu.Record{
+				"user_id":          targetID,
+				"last_modified_by": qs.Actor(),
+				"last_modified_at": CurrentTimestamp,
+			},
+		).
+		Where(t.Subscriptions.Col("user_id").Eq(sourceID))
+	d.LogSQL(subscriptionsQuery)
+	rows, err := execCount(ctx, subscriptionsQuery.Executor())
+	if err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	result.Subscriptions = rows
+
+	// Move the usage updates.
+	updatesQuery := db.Update(t.Updates).
+		Set(
+			goqu.Record{
+				"user_id":          targetID,
+				"last_modified_by": qs.Actor(),
+				"last_modified_at": CurrentTimestamp,
+			},
+		).
+		Where(t.Updates.Col("user_id").Eq(sourceID))
+	d.LogSQL(updatesQuery)
+	if rows, err = execCount(ctx, updatesQuery.Executor()); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	result.Updates = rows
+
+	// Move the group memberships that the target user doesn't already have.
+	membershipsQuery := db.Update(t.GroupMembers).
+		Set(goqu.Record{"user_id": targetID}).
+		Where(
+			t.GroupMembers.Col("user_id").Eq(sourceID),
+			// Comparing with a dataset produces NOT IN (subquery). NotIn would wrap the subquery in a second set of
+			// parentheses, which turns it into a scalar subquery.
+			t.GroupMembers.Col("group_id").Neq(
+				db.From(t.GroupMembers).
+					Select(t.GroupMembers.Col("group_id")).
+					Where(t.GroupMembers.Col("user_id").Eq(targetID)),
+			),
+		)
+	d.LogSQL(membershipsQuery)
+	if rows, err = execCount(ctx, membershipsQuery.Executor()); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	result.GroupMemberships = rows
+
+	// Delete the source user, along with any group memberships that were left behind.
+	deleteQuery := db.From(t.Users).
+		Where(t.Users.Col("id").Eq(sourceID)).
+		Delete()
+	d.LogSQL(deleteQuery)
+	if rows, err = execCount(ctx, deleteQuery.Executor()); err != nil {
+		return nil, errors.Wrap(err, wrapMsg)
+	}
+	if rows == 0 {
+		return nil, suberrors.ErrUserNotFound.WithField("user_id", sourceID)
+	}
+
+	return &result, nil
+}
+
+// execCount executes a statement and returns the number of rows that it affected.
+func execCount(ctx context.Context, executor exec.QueryExecutor) (int, error) {
+	result, err := executor.ExecContext(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(rows), nil
+}
+
+// UserFilter narrows down the users returned by ListUsers and counted by CountUsers. The filters on plans, payment
+// and expiry apply to each user's active subscription, so users without one only match if none of those filters is
+// set. Fields that are blank or nil aren't used.
+//
+// InOverage is compared with membership in InOverageUserIDs, which the caller has to fill in with the IDs of the
+// users who are in overage. Whether a user is in overage depends on grace periods and group quotas, which can't be
+// checked in the same query.
+type UserFilter struct {
+	UsernamePrefix   string
+	PlanName         string
+	Paid             *bool
+	ExpiresAfter     time.Time
+	ExpiresBefore    time.Time
+	InOverage        *bool
+	InOverageUserIDs []string
+}
+
+// UserListing is a user in a user listing along with their active subscription, which is nil if the user doesn't
+// have one. The quotas, usages, add-ons and rate of the subscription aren't included.
+type UserListing struct {
+	User
+	Subscription *Subscription
+}
+
+// userListingRow is a row in a user listing. The subscription columns are NULL if the user doesn't have an active
+// subscription.
+type userListingRow struct {
+	ID                 string     `db:"id"`
+	Username           string     `db:"username"`
+	SubscriptionID     *string    `db:"subscription_id"`
+	EffectiveStartDate *time.Time `db:"effective_start_date"`
+	EffectiveEndDate   *time.Time `db:"effective_end_date"`
+	Paid               *bool      `db:"paid"`
+	PlanVersionID      *string    `db:"plan_version_id"`
+	ActivatedAt        *time.Time `db:"activated_at"`
+	CancelledAt        *time.Time `db:"cancelled_at"`
+	CancelledBy        *string    `db:"cancelled_by"`
+	CancellationReason *string    `db:"cancellation_reason"`
+	CreatedBy          *string    `db:"created_by"`
+	CreatedAt          *time.Time `db:"created_at"`
+	PlanID             *string    `db:"plan_id"`
+	PlanName           *string    `db:"plan_name"`
+}
+
+// listing converts a row in a user listing to a UserListing.
+func (r *userListingRow) listing() UserListing {
+	user := User{ID: r.ID, Username: r.Username}
+	listing := UserListing{User: user}
+	if r.SubscriptionID == nil {
+		return listing
+	}
+
+	listing.Subscription = &Subscription{
+		ID:                 *r.SubscriptionID,
+		EffectiveStartDate: lo.FromPtr(r.EffectiveStartDate),
+		EffectiveEndDate:   lo.FromPtr(r.EffectiveEndDate),
+		User:               user,
+		Plan:               Plan{ID: lo.FromPtr(r.PlanID), Name: lo.FromPtr(r.PlanName)},
+		CreatedBy:          lo.FromPtr(r.CreatedBy),
+		CreatedAt:          lo.FromPtr(r.CreatedAt),
+		Paid:               lo.FromPtr(r.Paid),
+		PlanVersionID:      lo.FromPtr(r.PlanVersionID),
+		ActivatedAt:        r.ActivatedAt,
+		CancelledAt:        r.CancelledAt,
+		CancelledBy:        lo.FromPtr(r.CancelledBy),
+		CancellationReason: lo.FromPtr(r.CancellationReason),
+	}
+	return listing
+}
+
+// filtersSubscriptions returns true if any of the filters apply to the active subscription.
+func (f *UserFilter) filtersSubscriptions() bool {
+	return f.PlanName != "" || f.Paid != nil || !f.ExpiresAfter.IsZero() || !f.ExpiresBefore.IsZero()
+}
+
+// likeEscaper escapes the characters that have a special meaning in LIKE patterns.
+var likeEscaper = strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+
+// usersQuery returns a query that lists the users who match a filter, joined with their active subscriptions and the
+// plans of those subscriptions. Each user's active subscription is the one that GetActiveSubscription would return.
+func usersQuery(db GoquDatabase, filter *UserFilter) *goqu.SelectDataset {
+	latest := goqu.T("latest")
+	activeID := db.From(t.Subscriptions.As("latest")).
+		Select(latest.Col("id")).
+		Where(
+			latest.Col("user_id").Eq(t.Users.Col("id")),
+			goqu.Or(
+				CurrentTimestamp.Between(goqu.Range(latest.Col("effective_start_date"), latest.Col("effective_end_date"))),
+				goqu.And(
+					CurrentTimestamp.Gt(latest.Col("effective_start_date")),
+					latest.Col("effective_end_date").IsNull(),
+				),
+			),
+		).
+		Order(latest.Col("effective_start_date").Desc()).
+		Limit(1)
+
+	ds := db.From(t.Users).
+		LeftJoin(t.Subscriptions, goqu.On(t.Subscriptions.Col("id").Eq(activeID))).
+		LeftJoin(t.Plans, goqu.On(t.Subscriptions.Col("plan_id").Eq(t.Plans.Col("id"))))
+
+	if filter.UsernamePrefix != "" {
+		ds = ds.Where(t.Users.Col("username").Like(likeEscaper.Replace(filter.UsernamePrefix) + "%"))
+	}
+
+	// Users without an active subscription have NULL subscription columns, so these filters leave them out.
+	if filter.PlanName != "" {
+		ds = ds.Where(t.Plans.Col("name").Eq(filter.PlanName))
+	}
+	if filter.Paid != nil {
+		ds = ds.Where(t.Subscriptions.Col("paid").Eq(*filter.Paid))
+	}
+	if !filter.ExpiresAfter.IsZero() {
+		ds = ds.Where(t.Subscriptions.Col("effective_end_date").Gte(filter.ExpiresAfter))
+	}
+	if !filter.ExpiresBefore.IsZero() {
+		ds = ds.Where(t.Subscriptions.Col("effective_end_date").Lt(filter.ExpiresBefore))
+	}
+
+	if filter.InOverage != nil {
+		switch {
+		case len(filter.InOverageUserIDs) > 0 && *filter.InOverage:
+			ds = ds.Where(t.Users.Col("id").In(filter.InOverageUserIDs))
+		case len(filter.InOverageUserIDs) > 0:
+			ds = ds.Where(t.Users.Col("id").NotIn(filter.InOverageUserIDs))
+		case *filter.InOverage:
+			// Nobody is in overage.
+			ds = ds.Where(goqu.L("false"))
+		}
+	}
+
+	return ds
+}
+
+// ListUsers returns the users who match a filter, ordered by username, along with their active subscriptions.
+// Accepts a variable number of QueryOptions, including WithTX, WithQueryLimit and WithQueryOffset.
+func (d *Database) ListUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) ([]UserListing, error) {
+	qs, db, err := d.querySettings(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	query := usersQuery(db, filter).
+		Select(
+			t.Users.Col("id"),
+			t.Users.Col("username"),
+			t.Subscriptions.Col("id").As("subscription_id"),
+			t.Subscriptions.Col("effective_start_date"),
+			t.Subscriptions.Col("effective_end_date"),
+			t.Subscriptions.Col("paid"),
+			t.Subscriptions.Col("plan_version_id"),
+			t.Subscriptions.Col("activated_at"),
+			t.Subscriptions.Col("cancelled_at"),
+			t.Subscriptions.Col("cancelled_by"),
+			t.Subscriptions.Col("cancellation_reason"),
+			t.Subscriptions.Col("created_by"),
+			t.Subscriptions.Col("created_at"),
+			t.Plans.Col("id").As("plan_id"),
+			t.Plans.Col("name").As("plan_name"),
+		).
+		Order(t.Users.Col("username").Asc())
+	if qs.hasLimit {
+		query = query.Limit(qs.limit)
+	}
+	if qs.hasOffset {
+		query = query.Offset(qs.offset)
+	}
+	d.LogSQL(query)
+
+	var rows []userListingRow
+	if err := query.ScanStructsContext(ctx, &rows); err != nil {
+		return nil, errors.Wrap(err, "unable to list users")
+	}
+
+	users := make([]UserListing, len(rows))
+	for i := range rows {
+		users[i] = rows[i].listing()
+	}
+
+	return users, nil
+}
+
+// CountUsers returns the number of users who match a filter. Accepts a variable number of QueryOptions, but only
+// WithTX is currently supported.
+func (d *Database) CountUsers(ctx context.Context, filter *UserFilter, opts ...QueryOption) (int, error) {
+	_, db, err := d.querySettings(opts...)
+	if err != nil {
+		return 0, err
+	}
+
+	query := usersQuery(db, filter).Select(goqu.COUNT(t.Users.Col("id")))
+	d.LogSQL(query)
+
+	var count int
+	if _, err := query.ScanValContext(ctx, &count); err != nil {
+		return 0, errors.Wrap(err, "unable to count users")
+	}
+
+	return count, nil
+}
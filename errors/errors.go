@@ -2,103 +2,265 @@ package errors
 
 import (
 	"context"
+	"database/sql"
+	"fmt"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/cyverse-de/go-mod/gotelnats"
+	"github.com/cyverse-de/p/go/header"
 	"github.com/cyverse-de/p/go/svcerror"
+	"github.com/lib/pq"
 	"github.com/pkg/errors"
 )
 
+// Code identifies the kind of failure that an error represents. The code determines the HTTP status code and the
+// NATS error code used when the error is reported to a caller.
+type Code int
+
+const (
+	// CodeInternal indicates an unexpected failure in the service or one of its dependencies.
+	CodeInternal Code = iota
+
+	// CodeNotFound indicates that something the request refers to doesn't exist.
+	CodeNotFound
+
+	// CodeBadRequest indicates that the request is invalid.
+	CodeBadRequest
+
+	// CodeConflict indicates that the request conflicts with the current state of the data.
+	CodeConflict
+
+	// CodeUnimplemented indicates that the requested operation isn't supported by the service.
+	CodeUnimplemented
+)
+
+// String returns the name of the code.
+func (c Code) String() string {
+	switch c {
+	case CodeNotFound:
+		return "not found"
+	case CodeBadRequest:
+		return "bad request"
+	case CodeConflict:
+		return "conflict"
+	case CodeUnimplemented:
+		return "unimplemented"
+	default:
+		return "internal"
+	}
+}
+
+// Error is an error that carries a code and optional fields describing the failure, such as the identifier of an
+// entity that couldn't be found. Errors derived from another Error using WithField still match it with errors.Is,
+// and an Error can be found in a chain of wrapped errors with errors.As.
+type Error struct {
+	Code    Code
+	Message string
+	Fields  map[string]any
+
+	// The error that this one was derived from, if any.
+	base *Error
+}
+
+// NewError returns a new Error with the given code and a formatted message.
+func NewError(code Code, format string, args ...any) *Error {
+	return &Error{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// NotFound returns a new Error indicating that something the request refers to doesn't exist.
+func NotFound(format string, args ...any) *Error {
+	return NewError(CodeNotFound, format, args...)
+}
+
+// BadRequest returns a new Error indicating that the request is invalid.
+func BadRequest(format string, args ...any) *Error {
+	return NewError(CodeBadRequest, format, args...)
+}
+
+// Conflict returns a new Error indicating that the request conflicts with the current state of the data.
+func Conflict(format string, args ...any) *Error {
+	return NewError(CodeConflict, format, args...)
+}
+
+// Error returns the message followed by the fields in alphabetical order.
+func (e *Error) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+
+	keys := make([]string, 0, len(e.Fields))
+	for key := range e.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, len(keys))
+	for i, key := range keys {
+		fields[i] = fmt.Sprintf("%s=%v", key, e.Fields[key])
+	}
+
+	return fmt.Sprintf("%s: %s", e.Message, strings.Join(fields, ", "))
+}
+
+// Is reports whether the target is this error or the error that this error was derived from.
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok {
+		return false
+	}
+	return e == t || (e.base != nil && e.base == t)
+}
+
+// WithField returns a copy of the error that includes a field describing the failure.
+func (e *Error) WithField(key string, value any) *Error {
+	fields := make(map[string]any, len(e.Fields)+1)
+	for k, v := range e.Fields {
+		fields[k] = v
+	}
+	fields[key] = value
+
+	base := e.base
+	if base == nil {
+		base = e
+	}
+
+	return &Error{Code: e.Code, Message: e.Message, Fields: fields, base: base}
+}
+
 var (
-	ErrUserNotFound            = errors.New("user name not found")
-	ErrInvalidUsername         = errors.New("invalid username")
-	ErrInvalidResourceName     = errors.New("invalid resource name")
-	ErrInvalidUsageValue       = errors.New("invalid usage value")
-	ErrInvalidUpdateType       = errors.New("invalid update type")
-	ErrInvalidResourceUnit     = errors.New("invalid resource unit")
-	ErrInvalidOperationName    = errors.New("invalid operation name")
-	ErrInvalidValueType        = errors.New("invalid value type")
-	ErrInvalidValue            = errors.New("invalid value")
-	ErrInvalidEffectiveDate    = errors.New("invalid effective date")
-	ErrAddonNotFound           = errors.New("add-on not found")
-	ErrSubAddonNotFound        = errors.New("subscription add-on not found")
-	ErrSubscriptionAddonsExist = errors.New("subscription add-ons exist")
+	ErrUserNotFound            = NotFound("user name not found")
+	ErrUserExists              = Conflict("a user with the same username already exists")
+	ErrInvalidUsername         = BadRequest("invalid username")
+	ErrInvalidResourceName     = BadRequest("invalid resource name")
+	ErrInvalidUsageValue       = BadRequest("invalid usage value")
+	ErrInvalidUpdateType       = BadRequest("invalid update type")
+	ErrInvalidResourceUnit     = BadRequest("invalid resource unit")
+	ErrInvalidOperationName    = BadRequest("invalid operation name")
+	ErrInvalidValueType        = BadRequest("invalid value type")
+	ErrInvalidValue            = BadRequest("invalid value")
+	ErrInvalidEffectiveDate    = BadRequest("invalid effective date")
+	ErrAddonNotFound           = NotFound("add-on not found")
+	ErrSubAddonNotFound        = NotFound("subscription add-on not found")
+	ErrSubscriptionAddonsExist = Conflict("subscription add-ons exist")
+	ErrPlanNotFound            = NotFound("plan not found")
+	ErrNoActiveSubscription    = NotFound("no active subscription")
+	ErrPlanExists              = Conflict("a plan with the same name already exists")
+	ErrPlanVersionNotFound     = NotFound("plan version not found")
+	ErrSubscriptionNotFound    = NotFound("subscription not found")
+	ErrInvalidStartDate        = BadRequest("invalid start date")
+	ErrInvalidEndDate          = BadRequest("invalid end date")
+	ErrSubscriptionCancelled   = Conflict("the subscription has already been cancelled")
+	ErrSubscriptionEnded       = Conflict("the subscription has already ended")
+	ErrMissingField            = BadRequest("a required field is missing")
+	ErrGroupNotFound           = NotFound("group not found")
+	ErrGroupExists             = Conflict("a group with the same name already exists")
+	ErrGroupMemberNotFound     = NotFound("the user isn't a member of the group")
+	ErrNotImplemented          = NewError(CodeUnimplemented, "not implemented")
 )
 
 func New(s string) error {
 	return errors.New(s)
 }
 
+// Is reports whether any error in the chain of wrapped errors matches the target.
+func Is(err, target error) bool {
+	return errors.Is(err, target)
+}
+
+// As finds the first error in the chain of wrapped errors that matches the target, and if one is found, sets the
+// target to that error value and returns true.
+func As(err error, target any) bool {
+	return errors.As(err, target)
+}
+
+// CodeOf returns the code for an error. The code is taken from the first Error in the chain of wrapped errors if
+// there is one. Otherwise, PostgreSQL errors caused by invalid input or conflicting data and sql.ErrNoRows are mapped
+// to the corresponding codes, and any other error is internal.
+func CodeOf(err error) Code {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) {
+		switch pqErr.Code.Name() {
+		case "unique_violation":
+			return CodeConflict
+		case "foreign_key_violation":
+			// Deleting a row that's still referenced conflicts with the existing data. Inserting a row that refers
+			// to a missing row is a bad request.
+			if strings.HasPrefix(pqErr.Message, "update or delete") {
+				return CodeConflict
+			}
+			return CodeBadRequest
+		case "not_null_violation", "check_violation", "invalid_text_representation", "invalid_datetime_format",
+			"datetime_field_overflow", "numeric_value_out_of_range":
+			return CodeBadRequest
+		}
+	}
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return CodeNotFound
+	}
+
+	return CodeInternal
+}
+
 func HTTPStatusCode(err error) int {
-	switch err {
-	case ErrUserNotFound:
+	switch CodeOf(err) {
+	case CodeNotFound:
 		return http.StatusNotFound
-	case ErrInvalidUsername:
-		return http.StatusBadRequest
-	case ErrInvalidResourceName:
-		return http.StatusBadRequest
-	case ErrInvalidUsageValue:
-		return http.StatusBadRequest
-	case ErrInvalidUpdateType:
-		return http.StatusBadRequest
-	case ErrInvalidResourceUnit:
-		return http.StatusBadRequest
-	case ErrInvalidOperationName:
-		return http.StatusBadRequest
-	case ErrInvalidValueType:
+	case CodeBadRequest:
 		return http.StatusBadRequest
-	case ErrInvalidValue:
-		return http.StatusBadRequest
-	case ErrInvalidEffectiveDate:
-		return http.StatusBadRequest
-	case ErrAddonNotFound:
-		return http.StatusNotFound
-	case ErrSubAddonNotFound:
-		return http.StatusNotFound
-	case ErrSubscriptionAddonsExist:
+	case CodeConflict:
 		return http.StatusConflict
+	case CodeUnimplemented:
+		return http.StatusNotImplemented
 	default:
 		return http.StatusInternalServerError
 	}
 }
 
+// NatsStatusCode returns the NATS error code for an error. NATS doesn't have an error code for conflicts, so they're
+// reported as bad requests.
 func NatsStatusCode(err error) svcerror.ErrorCode {
-	switch err {
-	case ErrUserNotFound:
-		return svcerror.ErrorCode_NOT_FOUND
-	case ErrAddonNotFound:
+	switch CodeOf(err) {
+	case CodeNotFound:
 		return svcerror.ErrorCode_NOT_FOUND
-	case ErrSubAddonNotFound:
-		return svcerror.ErrorCode_NOT_FOUND
-	case ErrInvalidUsername:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidResourceName:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidUsageValue:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidUpdateType:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidResourceUnit:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidOperationName:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidValueType:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidValue:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrInvalidEffectiveDate:
-		return svcerror.ErrorCode_BAD_REQUEST
-	case ErrSubscriptionAddonsExist:
+	case CodeBadRequest, CodeConflict:
 		return svcerror.ErrorCode_BAD_REQUEST
+	case CodeUnimplemented:
+		return svcerror.ErrorCode_UNIMPLEMENTED
 	default:
 		return svcerror.ErrorCode_INTERNAL
 	}
 }
 
-func NatsError(ctx context.Context, err error) *svcerror.ServiceError {
+// NatsErrorFieldPrefix is the prefix of the response header entries that contain the fields of an error.
+const NatsErrorFieldPrefix = "error."
+
+// NatsError converts an error to the error information included in NATS and HTTP responses. The HTTP status code is
+// included so that HTTP handlers can respond with the same status as the HTTP error handler. The service error can
+// only hold a message, so the fields of an Error are also stored in the header of the response, with the field name
+// following NatsErrorFieldPrefix, so that callers don't have to parse them out of the message.
+func NatsError(ctx context.Context, responseHeader *header.Header, err error) *svcerror.ServiceError {
+	var e *Error
+	if responseHeader != nil && errors.As(err, &e) && len(e.Fields) > 0 {
+		if responseHeader.Map == nil {
+			responseHeader.Map = make(map[string]*header.Header_Value, len(e.Fields))
+		}
+		for key, value := range e.Fields {
+			responseHeader.Map[NatsErrorFieldPrefix+key] = &header.Header_Value{Value: []string{fmt.Sprint(value)}}
+		}
+	}
+
 	return gotelnats.InitServiceError(
 		ctx, err, &gotelnats.ErrorOptions{
-			ErrorCode: NatsStatusCode(err),
+			ErrorCode:  NatsStatusCode(err),
+			StatusCode: int32(HTTPStatusCode(err)),
 		},
 	)
 }
@@ -6,17 +6,29 @@ import (
 	"fmt"
 	"net/http"
 	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/cyverse-de/go-mod/cfg"
 	"github.com/cyverse-de/go-mod/gotelnats"
 	"github.com/cyverse-de/go-mod/logging"
 	"github.com/cyverse-de/go-mod/otelutils"
+	qmsinit "github.com/cyverse-de/go-mod/pbinit/qms"
 	"github.com/cyverse-de/go-mod/protobufjson"
 	qmssubs "github.com/cyverse-de/go-mod/subjects/qms"
+	"github.com/cyverse-de/subscriptions/admin"
 	"github.com/cyverse-de/subscriptions/app"
+	"github.com/cyverse-de/subscriptions/auth"
+	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/metrics"
+	"github.com/cyverse-de/subscriptions/migrations"
 	"github.com/cyverse-de/subscriptions/natscl"
 	"github.com/jmoiron/sqlx"
 	"github.com/knadh/koanf"
@@ -37,28 +49,223 @@ const serviceName = "subscriptions"
 
 var log = logging.Log.WithFields(logrus.Fields{"package": "main"})
 
+// defaultNATSAdminRole is the role required to call administrative NATS subjects if no other roles are configured.
+const defaultNATSAdminRole = "admin"
+
+// natsAdminSubjects lists the NATS subjects that modify plans, add-ons or quotas directly. These subjects are
+// restricted to administrators unless the configuration says otherwise.
+var natsAdminSubjects = []string{
+	qmssubs.AddQuota,
+	qmssubs.AddPlan,
+	qmssubs.UpsertQuotaDefaults,
+	qmssubs.AddAddon,
+	qmssubs.UpdateAddon,
+	qmssubs.DeleteAddon,
+	qmssubs.AddSubscriptionAddon,
+	qmssubs.DeleteSubscriptionAddon,
+	qmssubs.UpdateSubscriptionAddon,
+}
+
+// natsUserSubjects lists the NATS subjects that add users, usages and usage updates. Other services report usage on
+// these subjects without identifying a user in the request header, so they're only restricted to administrators if
+// nats.authorization.restrict_user_subjects is enabled.
+var natsUserSubjects = []string{
+	qmssubs.AddUser,
+	qmssubs.AddUserUpdate,
+	qmssubs.AddUserUsages,
+}
+
+// waitForWorkers waits for the background workers to stop. If the context is done first, the context's error is
+// returned.
+func waitForWorkers(ctx context.Context, workers *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// natsHandler associates the handler for a NATS subject with the type of response that it sends, so that requests can
+// be rejected with an error response that callers are able to decode.
+//
+//nolint:staticcheck
+type natsHandler struct {
+	handler     nats.Handler
+	newResponse auth.ResponseFactory
+}
+
+// newNATSResponse adapts a constructor for a specific response type to a response factory.
+func newNATSResponse[R gotelnats.DEResponse](constructor func() R) auth.ResponseFactory {
+	return func() gotelnats.DEResponse { return constructor() }
+}
+
+// natsSubjectPolicy builds the authorization policy for NATS subjects from the configuration. The administrative
+// subjects require the admin role by default, and so do the subjects that add users, usages and usage updates if
+// nats.authorization.restrict_user_subjects is enabled. The roles required for any subject can be changed in the
+// nats.authorization.subjects list, and the members of each role are listed in nats.authorization.roles.
+func natsSubjectPolicy(config *koanf.Koanf) *auth.SubjectPolicy {
+	policy := auth.NewSubjectPolicy()
+
+	subjects := natsAdminSubjects
+	if config.Bool("nats.authorization.restrict_user_subjects") {
+		subjects = append(slices.Clone(subjects), natsUserSubjects...)
+	}
+	for _, subject := range subjects {
+		policy.RequireRoles(subject, defaultNATSAdminRole)
+	}
+
+	for _, entry := range config.Slices("nats.authorization.subjects") {
+		subject := entry.String("subject")
+		if subject == "" {
+			log.Fatal("every entry in nats.authorization.subjects must include a subject")
+		}
+		policy.RequireRoles(subject, entry.Strings("roles")...)
+	}
+
+	for role, usernames := range config.StringsMap("nats.authorization.roles") {
+		policy.AddRoleMembers(role, usernames...)
+	}
+
+	return policy
+}
+
+// provisioningSettings reads the settings for subscribing users to the default plan from the configuration. Any
+// setting that isn't configured keeps its default value.
+func provisioningSettings(config *koanf.Koanf) *app.ProvisioningSettings {
+	settings := app.DefaultProvisioningSettings()
+
+	if config.Exists("provisioning.enabled") {
+		settings.Enabled = config.Bool("provisioning.enabled")
+	}
+	if config.Exists("provisioning.plan") {
+		settings.PlanName = config.String("provisioning.plan")
+	}
+	if config.Exists("provisioning.periods") {
+		settings.Periods = int32(config.Int("provisioning.periods"))
+	}
+
+	if settings.Enabled && settings.PlanName == "" {
+		log.Fatal("provisioning.plan must not be blank when provisioning is enabled")
+	}
+	if settings.Enabled && settings.Periods < 1 {
+		log.Fatal("provisioning.periods must be at least 1 when provisioning is enabled")
+	}
+
+	return settings
+}
+
+// usernameSettings reads the settings used to normalize usernames from the configuration.
+func usernameSettings(config *koanf.Koanf) *app.UsernameSettings {
+	caseFold := true
+	if config.Exists("users.case_fold") {
+		caseFold = config.Bool("users.case_fold")
+	}
+	settings := app.DefaultUsernameSettings(config.String("users.domain"), caseFold)
+
+	if config.Exists("users.allowed_pattern") {
+		allowed, err := regexp.Compile(config.String("users.allowed_pattern"))
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "users.allowed_pattern is not a valid regular expression"))
+		}
+		settings.Allowed = allowed
+	}
+
+	// Aliases are listed as objects rather than a map because usernames may contain the configuration key delimiter.
+	for _, alias := range config.Slices("users.aliases") {
+		from, to := alias.String("alias"), alias.String("username")
+		if from == "" || to == "" {
+			log.Fatal("each entry in users.aliases must include both alias and username")
+		}
+		settings.AddAlias(from, to)
+	}
+
+	return settings
+}
+
+// defaultActivationInterval is how often scheduled subscriptions are activated if no other interval is configured.
+const defaultActivationInterval = time.Minute
+
+// activationInterval reads the interval at which scheduled subscriptions are activated from the configuration. The
+// activation worker is disabled if the interval is zero.
+func activationInterval(config *koanf.Koanf) time.Duration {
+	if !config.Exists("activation.interval") {
+		return defaultActivationInterval
+	}
+
+	interval := config.Duration("activation.interval")
+	if interval < 0 {
+		log.Fatal("activation.interval must not be negative")
+	}
+
+	return interval
+}
+
+// defaultRollupInterval is how often the usage rollups are refreshed if no other interval is configured.
+const defaultRollupInterval = 5 * time.Minute
+
+// rollupInterval reads the interval at which the usage rollups are refreshed from the configuration. The rollup
+// worker is disabled if the interval is zero.
+func rollupInterval(config *koanf.Koanf) time.Duration {
+	if !config.Exists("rollups.interval") {
+		return defaultRollupInterval
+	}
+
+	interval := config.Duration("rollups.interval")
+	if interval < 0 {
+		log.Fatal("rollups.interval must not be negative")
+	}
+
+	return interval
+}
+
+// defaultOverageMetricsInterval is how often the users in overage are counted if no other interval is configured.
+const defaultOverageMetricsInterval = time.Minute
+
+// overageMetricsInterval reads the interval at which the users in overage are counted for the metrics from the
+// configuration. The count isn't refreshed if the interval is zero.
+func overageMetricsInterval(config *koanf.Koanf) time.Duration {
+	if !config.Exists("metrics.overage_interval") {
+		return defaultOverageMetricsInterval
+	}
+
+	interval := config.Duration("metrics.overage_interval")
+	if interval < 0 {
+		log.Fatal("metrics.overage_interval must not be negative")
+	}
+
+	return interval
+}
+
 func main() {
 	var (
 		err    error
 		config *koanf.Koanf
 		dbconn *sqlx.DB
 
-		configPath     = flag.String("config", cfg.DefaultConfigPath, "Path to the config file")
-		dotEnvPath     = flag.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
-		tlsCert        = flag.String("tlscert", gotelnats.DefaultTLSCertPath, "Path to the NATS TLS cert file")
-		tlsKey         = flag.String("tlskey", gotelnats.DefaultTLSKeyPath, "Path to the NATS TLS key file")
-		noTLS          = flag.Bool("no-tls", false, "Used to disable TLS for the connection to NATS")
-		caCert         = flag.String("tlsca", gotelnats.DefaultTLSCAPath, "Path to the NATS TLS CA file")
-		credsPath      = flag.String("creds", gotelnats.DefaultCredsPath, "Path to the NATS creds file")
-		noCreds        = flag.Bool("no-creds", false, "Used to disable client credentials for NATS")
-		maxReconnects  = flag.Int("max-reconnects", gotelnats.DefaultMaxReconnects, "Maximum number of reconnection attempts to NATS")
-		reconnectWait  = flag.Int("reconnect-wait", gotelnats.DefaultReconnectWait, "Seconds to wait between reconnection attempts to NATS")
-		natsSubject    = flag.String("subject", "cyverse.qms.>", "NATS subject to subscribe to")
-		natsQueue      = flag.String("queue", "cyverse.qms", "Name of the NATS queue to use")
-		envPrefix      = flag.String("env-prefix", "QMS_", "The prefix for environment variables")
-		reportOverages = flag.Bool("report-overages", true, "Allows the overages feature to effectively be shut down")
-		logLevel       = flag.String("log-level", "debug", "One of trace, debug, info, warn, error, fatal, or panic.")
-		listenPort     = flag.Int("port", 60000, "The port the service listens on for requests")
+		configPath      = flag.String("config", cfg.DefaultConfigPath, "Path to the config file")
+		dotEnvPath      = flag.String("dotenv-path", cfg.DefaultDotEnvPath, "Path to the dotenv file")
+		tlsCert         = flag.String("tlscert", gotelnats.DefaultTLSCertPath, "Path to the NATS TLS cert file")
+		tlsKey          = flag.String("tlskey", gotelnats.DefaultTLSKeyPath, "Path to the NATS TLS key file")
+		noTLS           = flag.Bool("no-tls", false, "Used to disable TLS for the connection to NATS")
+		caCert          = flag.String("tlsca", gotelnats.DefaultTLSCAPath, "Path to the NATS TLS CA file")
+		credsPath       = flag.String("creds", gotelnats.DefaultCredsPath, "Path to the NATS creds file")
+		noCreds         = flag.Bool("no-creds", false, "Used to disable client credentials for NATS")
+		maxReconnects   = flag.Int("max-reconnects", gotelnats.DefaultMaxReconnects, "Maximum number of reconnection attempts to NATS")
+		reconnectWait   = flag.Int("reconnect-wait", gotelnats.DefaultReconnectWait, "Seconds to wait between reconnection attempts to NATS")
+		natsSubject     = flag.String("subject", "cyverse.qms.>", "NATS subject to subscribe to")
+		natsQueue       = flag.String("queue", "cyverse.qms", "Name of the NATS queue to use")
+		envPrefix       = flag.String("env-prefix", "QMS_", "The prefix for environment variables")
+		reportOverages  = flag.Bool("report-overages", true, "Allows the overages feature to effectively be shut down")
+		logLevel        = flag.String("log-level", "debug", "One of trace, debug, info, warn, error, fatal, or panic.")
+		listenPort      = flag.Int("port", 60000, "The port the service listens on for requests")
+		shutdownTimeout = flag.Duration("shutdown-timeout", 25*time.Second, "The maximum time to wait for requests in progress when shutting down")
 	)
 
 	flag.Parse()
@@ -96,24 +303,64 @@ func main() {
 		log.Fatal(errors.Wrap(err, "Can't parse database.uri in the config file"))
 	}
 
-	userSuffix := strings.Trim(config.String("users.domain"), "@")
-	if userSuffix == "" {
+	dbconn = otelsqlx.MustConnect("postgres", dbURI,
+		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
+	log.Info("done connecting to the database")
+	dbconn.SetMaxOpenConns(10)
+	dbconn.SetConnMaxIdleTime(time.Minute)
+
+	command := flag.Arg(0)
+	if command == "migrate" {
+		applied, err := migrations.Apply(tracerCtx, dbconn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Infof("applied %d migration(s)", len(applied))
+		return
+	}
+	if command != "" && command != "admin" {
+		log.Fatalf("unrecognized command: %s", command)
+	}
+
+	// Make sure the database schema matches the version this service expects before doing anything else.
+	if err = migrations.Check(tracerCtx, dbconn); err != nil {
+		log.Fatal(errors.Wrap(err, "incompatible database schema; run `subscriptions migrate` to update it"))
+	}
+
+	provisioning := provisioningSettings(config)
+	if provisioning.Enabled {
+		log.Infof("users without a subscription are subscribed to the %s plan for %d period(s)",
+			provisioning.PlanName, provisioning.Periods)
+	} else {
+		log.Info("users without a subscription are not subscribed to a default plan")
+	}
+
+	usernames := usernameSettings(config)
+
+	// The administrative commands only need the database.
+	if command == "admin" {
+		adminApp := app.New(nil, db.New(dbconn), "", nil)
+		adminApp.Provisioning = provisioning
+		adminApp.Usernames = usernames
+		if err = admin.Run(tracerCtx, adminApp, flag.Args()[1:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if usernames.Domain == "" {
 		log.Fatal("users.domain must be set in the configuration file")
 	}
 
-	log.Infof("username suffix is configured as %s", userSuffix)
+	log.Infof("username domain is configured as %s", usernames.Domain)
+	log.Infof("usernames are case folded: %t; %d username alias(es) are configured", usernames.CaseFold,
+		len(usernames.Aliases))
 
 	natsCluster := config.String("nats.cluster")
 	if natsCluster == "" {
 		log.Fatalf("The %sNATS_CLUSTER environment variable or nats.cluster configuration value must be set", *envPrefix)
 	}
 
-	dbconn = otelsqlx.MustConnect("postgres", dbURI,
-		otelsql.WithAttributes(semconv.DBSystemPostgreSQL))
-	log.Info("done connecting to the database")
-	dbconn.SetMaxOpenConns(10)
-	dbconn.SetConnMaxIdleTime(time.Minute)
-
 	natsSettings := natscl.ConnectionSettings{
 		ClusterURLS:   natsCluster,
 		CredsPath:     *credsPath,
@@ -144,47 +391,181 @@ func main() {
 
 	natsClient := natscl.NewClient(natsConn, serviceName)
 
-	a := app.New(natsClient, dbconn, userSuffix)
+	// Set up authentication for the HTTP API unless it has been explicitly disabled.
+	var authenticator *auth.Authenticator
+	if config.Exists("auth.enabled") && !config.Bool("auth.enabled") {
+		log.Warn("authentication is disabled for the HTTP API")
+	} else {
+		authenticator, err = auth.New(&auth.Settings{
+			JWKSPath:      config.String("auth.jwks_path"),
+			KeyPath:       config.String("auth.key_path"),
+			Issuer:        config.String("auth.issuer"),
+			Audience:      config.String("auth.audience"),
+			UsernameClaim: config.String("auth.username_claim"),
+			RoleClaim:     config.String("auth.role_claim"),
+			UserRole:      config.String("auth.user_role"),
+			AdminRole:     config.String("auth.admin_role"),
+		})
+		if err != nil {
+			log.Fatal(errors.Wrap(err, "unable to configure authentication; set auth.enabled to false to disable it"))
+		}
+	}
+
+	// Report the database connection pool statistics and the number of users in overage along with the other metrics.
+	if err = metrics.RegisterDBStats(dbconn.DB); err != nil {
+		log.Fatal(err)
+	}
+	repo := db.New(dbconn)
+
+	a := app.New(natsClient, repo, usernames.Domain, authenticator)
+	a.Provisioning = provisioning
+	a.Usernames = usernames
+
+	// Activate scheduled subscriptions in the background when their start dates pass. The workers are tracked so
+	// that shutdown can wait for them to stop before closing the database connection.
+	var workers sync.WaitGroup
+	workerCtx, cancelWorker := context.WithCancel(tracerCtx)
+	defer cancelWorker()
+	if interval := activationInterval(config); interval > 0 {
+		log.Infof("scheduled subscriptions are activated every %s", interval)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.RunSubscriptionActivator(workerCtx, interval)
+		}()
+	} else {
+		log.Warn("the activation of scheduled subscriptions is disabled")
+	}
+
+	// Keep the daily and monthly usage rollups up to date with the usage updates.
+	if interval := rollupInterval(config); interval > 0 {
+		log.Infof("usage rollups are refreshed every %s", interval)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.RunUsageRollupWorker(workerCtx, interval)
+		}()
+	} else {
+		log.Warn("the refreshing of usage rollups is disabled")
+	}
+
+	// Keep the number of users in overage reported in the metrics up to date.
+	if interval := overageMetricsInterval(config); interval > 0 {
+		log.Infof("the number of users in overage is counted every %s", interval)
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			a.RunOverageMetricsWorker(workerCtx, interval)
+		}()
+	} else {
+		log.Warn("the counting of users in overage is disabled")
+	}
+
+	// The service is ready to handle requests when the database and NATS are available and the schema is up to date.
+	a.AddReadinessCheck("database", dbconn.PingContext)
+	a.AddReadinessCheck("nats", func(_ context.Context) error {
+		if status := natsConn.Conn.Status(); status != nats.CONNECTED {
+			return fmt.Errorf("the NATS connection is %s", strings.ToLower(status.String()))
+		}
+		return nil
+	})
+	a.AddReadinessCheck("schema", func(ctx context.Context) error {
+		return migrations.Check(ctx, dbconn)
+	})
 
 	//nolint:staticcheck
-	natsHandlers := map[string]nats.Handler{
-		qmssubs.GetUserUpdates: a.GetUserUpdatesHandler,
-		qmssubs.AddUserUpdate:  a.AddUserUpdateHandler,
+	natsHandlers := map[string]natsHandler{
+		qmssubs.GetUserUpdates: {a.GetUserUpdatesHandler, newNATSResponse(qmsinit.NewUpdateListResponse)},
+		qmssubs.AddUserUpdate:  {a.AddUserUpdateHandler, newNATSResponse(qmsinit.NewAddUpdateResponse)},
 
 		// Only call these two endpoints if you need to correct a usage value and
 		// bypass the updates tables.
-		qmssubs.GetUserUsages: a.GetUsagesHandler,
-		qmssubs.AddUserUsages: a.AddUsageHandler,
+		qmssubs.GetUserUsages: {a.GetUsagesHandler, newNATSResponse(qmsinit.NewUsageList)},
+		qmssubs.AddUserUsages: {a.AddUsageHandler, newNATSResponse(qmsinit.NewUsageResponse)},
 
 		// These will get used by frontend calls to check for user overages.
-		qmssubs.GetUserOverages:   a.GetUserOverages,
-		qmssubs.CheckUserOverages: a.CheckUserOverages,
-
-		qmssubs.UserSummary:             a.GetUserSummaryHandler,
-		qmssubs.AddUser:                 a.AddUserHandler,
-		qmssubs.GetSubscription:         a.GetSubscriptionHandler,
-		qmssubs.AddQuota:                a.AddQuotaHandler,
-		qmssubs.ListPlans:               a.ListPlansHandler,
-		qmssubs.AddPlan:                 a.AddPlanHandler,
-		qmssubs.GetPlan:                 a.GetPlanHandler,
-		qmssubs.UpsertQuotaDefaults:     a.UpsertQuotaDefaultsHandler,
-		qmssubs.AddAddon:                a.AddAddonHandler,
-		qmssubs.ListAddons:              a.ListAddonsHandler,
-		qmssubs.UpdateAddon:             a.UpdateAddonHandler,
-		qmssubs.DeleteAddon:             a.DeleteAddonHandler,
-		qmssubs.ListSubscriptionAddons:  a.ListSubscriptionAddonsHandler,
-		qmssubs.AddSubscriptionAddon:    a.AddSubscriptionAddonHandler,
-		qmssubs.DeleteSubscriptionAddon: a.DeleteSubscriptionAddonHandler,
-		qmssubs.UpdateSubscriptionAddon: a.UpdateSubscriptionAddonHandler,
-		qmssubs.GetSubscriptionAddon:    a.GetSubscriptionAddonHandler,
-	}
-
-	for subject, handler := range natsHandlers {
+		qmssubs.GetUserOverages:   {a.GetUserOverages, newNATSResponse(qmsinit.NewOverageList)},
+		qmssubs.CheckUserOverages: {a.CheckUserOverages, newNATSResponse(qmsinit.NewIsOverage)},
+
+		qmssubs.UserSummary:             {a.GetUserSummaryHandler, newNATSResponse(qmsinit.NewSubscriptionResponse)},
+		qmssubs.AddUser:                 {a.AddUserHandler, newNATSResponse(qmsinit.NewAddUserResponse)},
+		qmssubs.GetSubscription:         {a.GetSubscriptionHandler, newNATSResponse(qmsinit.NewSubscriptionResponse)},
+		qmssubs.AddQuota:                {a.AddQuotaHandler, newNATSResponse(qmsinit.NewQuotaResponse)},
+		qmssubs.ListPlans:               {a.ListPlansHandler, newNATSResponse(qmsinit.NewPlanList)},
+		qmssubs.AddPlan:                 {a.AddPlanHandler, newNATSResponse(qmsinit.NewPlanResponse)},
+		qmssubs.GetPlan:                 {a.GetPlanHandler, newNATSResponse(qmsinit.NewPlanResponse)},
+		qmssubs.UpsertQuotaDefaults:     {a.UpsertQuotaDefaultsHandler, newNATSResponse(qmsinit.NewQuotaDefaultResponse)},
+		qmssubs.AddAddon:                {a.AddAddonHandler, newNATSResponse(qmsinit.NewAddonResponse)},
+		qmssubs.ListAddons:              {a.ListAddonsHandler, newNATSResponse(qmsinit.NewAddonListResponse)},
+		qmssubs.UpdateAddon:             {a.UpdateAddonHandler, newNATSResponse(qmsinit.NewAddonResponse)},
+		qmssubs.DeleteAddon:             {a.DeleteAddonHandler, newNATSResponse(qmsinit.NewAddonResponse)},
+		qmssubs.ListSubscriptionAddons:  {a.ListSubscriptionAddonsHandler, newNATSResponse(qmsinit.NewSubscriptionAddonListResponse)},
+		qmssubs.AddSubscriptionAddon:    {a.AddSubscriptionAddonHandler, newNATSResponse(qmsinit.NewSubscriptionAddonResponse)},
+		qmssubs.DeleteSubscriptionAddon: {a.DeleteSubscriptionAddonHandler, newNATSResponse(qmsinit.NewSubscriptionAddonResponse)},
+		qmssubs.UpdateSubscriptionAddon: {a.UpdateSubscriptionAddonHandler, newNATSResponse(qmsinit.NewSubscriptionAddonResponse)},
+		qmssubs.GetSubscriptionAddon:    {a.GetSubscriptionAddonHandler, newNATSResponse(qmsinit.NewSubscriptionAddonResponse)},
+	}
+
+	// Restrict access to the NATS subjects unless authorization has been explicitly disabled.
+	policy := auth.NewSubjectPolicy()
+	if config.Exists("nats.authorization.enabled") && !config.Bool("nats.authorization.enabled") {
+		log.Warn("authorization is disabled for NATS subjects")
+	} else {
+		policy = natsSubjectPolicy(config)
+	}
+
+	for subject, h := range natsHandlers {
+		handler, err := policy.Wrap(subject, h.handler, h.newResponse, natsClient)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if handler, err = metrics.InstrumentNATSHandler(subject, handler); err != nil {
+			log.Fatal(err)
+		}
 		if err = natsClient.Subscribe(subject, handler); err != nil {
 			log.Fatal(err)
 		}
 	}
 
 	srv := fmt.Sprintf(":%s", strconv.Itoa(*listenPort))
-	log.Fatal(http.ListenAndServe(srv, a.Router))
+	server := &http.Server{Addr: srv, Handler: a.Router}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal(err)
+		}
+	}()
+
+	// Wait for a signal telling us to shut down.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	sig := <-signals
+	log.Infof("received %s, shutting down", sig)
+
+	// Stop accepting new requests and wait for the requests that are in progress and the background workers to
+	// finish, up to the deadline. The database connection is closed last because the handlers and workers may still be
+	// using it until then.
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancelShutdown()
+
+	cancelWorker()
+
+	if err = server.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("unable to shut down the HTTP server cleanly: %s", err)
+	}
+	log.Info("HTTP server stopped")
+
+	if err = natsClient.Drain(shutdownCtx); err != nil {
+		log.Errorf("unable to drain the NATS subscriptions: %s", err)
+	}
+	log.Info("NATS subscriptions drained")
+
+	if err = waitForWorkers(shutdownCtx, &workers); err != nil {
+		log.Errorf("the background workers didn't stop in time: %s", err)
+	}
+	log.Info("background workers stopped")
+
+	if err = dbconn.Close(); err != nil {
+		log.Errorf("unable to close the database connection: %s", err)
+	}
+	log.Info("shutdown complete")
 }
@@ -0,0 +1,202 @@
+// Package metrics defines the Prometheus metrics reported by the service and provides functions that instrument NATS
+// handlers and HTTP routes. The metrics are registered with the default Prometheus registry and exposed by Handler.
+package metrics
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/labstack/echo/v4"
+	"github.com/nats-io/nats.go"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "metrics"})
+
+// namespace is the prefix of every metric name reported by the service.
+const namespace = "subscriptions"
+
+// Results of overage checks.
+const (
+	OverageResultOverage = "overage"
+	OverageResultOK      = "ok"
+	OverageResultError   = "error"
+)
+
+// Kinds of subscriptions counted by SubscriptionsCreated.
+const (
+	// SubscriptionKindUser is a subscription that started for a user as soon as it was created.
+	SubscriptionKindUser = "user"
+
+	// SubscriptionKindScheduled is a user subscription that was scheduled to start later. These are counted when
+	// they're activated rather than when they're created.
+	SubscriptionKindScheduled = "scheduled"
+
+	// SubscriptionKindMigration is a user subscription that was moved to another version of its plan.
+	SubscriptionKindMigration = "migration"
+
+	// SubscriptionKindGroup is a subscription for a group.
+	SubscriptionKindGroup = "group"
+)
+
+// Results of usage rollup rebuilds.
+const (
+	RollupResultOK    = "ok"
+	RollupResultError = "error"
+)
+
+var (
+	// NATSRequests counts the requests received for each NATS subject.
+	NATSRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "requests_total",
+		Help:      "The number of requests received for each NATS subject.",
+	}, []string{"subject"})
+
+	// NATSRequestDuration records how long it takes to handle requests for each NATS subject.
+	NATSRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "nats",
+		Name:      "request_duration_seconds",
+		Help:      "The time taken to handle requests for each NATS subject.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"subject"})
+
+	// HTTPRequests counts the requests received for each HTTP route, along with the response status code.
+	HTTPRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "requests_total",
+		Help:      "The number of requests received for each HTTP route, by response status code.",
+	}, []string{"method", "route", "code"})
+
+	// HTTPRequestDuration records how long it takes to handle requests for each HTTP route.
+	HTTPRequestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "http",
+		Name:      "request_duration_seconds",
+		Help:      "The time taken to handle requests for each HTTP route.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "route"})
+
+	// UpdatesProcessed counts the usage and quota updates that have been processed.
+	UpdatesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_processed_total",
+		Help:      "The number of usage and quota updates processed, by value type, resource type and operation.",
+	}, []string{"value_type", "resource_type", "operation"})
+
+	// OverageChecks counts the checks for whether a user has exceeded a quota.
+	OverageChecks = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "overage_checks_total",
+		Help:      "The number of overage checks, by resource type and result.",
+	}, []string{"resource_type", "result"})
+
+	// SubscriptionsCreated counts the subscriptions that have taken effect for each plan, by the kind of subscription.
+	SubscriptionsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subscriptions_created_total",
+		Help:      "The number of subscriptions that have taken effect, by plan and kind of subscription.",
+	}, []string{"plan", "kind"})
+
+	// UsersInOverage reports the number of users who have reached or exceeded at least one quota. It's refreshed
+	// periodically in the background rather than when the metrics are collected, because counting the users is
+	// expensive.
+	UsersInOverage = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "users_in_overage",
+		Help:      "The number of users who have reached or exceeded at least one quota.",
+	})
+
+	// SubscriptionsActivated counts the scheduled subscriptions that have been activated for each plan.
+	SubscriptionsActivated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "subscriptions_activated_total",
+		Help:      "The number of scheduled subscriptions activated, by plan.",
+	}, []string{"plan"})
+
+	// UsageRollupsRebuilt counts the rebuilds of the usage rollups for a user and resource type.
+	UsageRollupsRebuilt = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "usage_rollups_rebuilt_total",
+		Help:      "The number of times the usage rollups for a user and resource type were rebuilt, by result.",
+	}, []string{"result"})
+)
+
+// Handler returns the HTTP handler that serves the metrics.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// RegisterDBStats reports the connection pool statistics of a database.
+func RegisterDBStats(db *sql.DB) error {
+	return prometheus.Register(collectors.NewDBStatsCollector(db, namespace))
+}
+
+// InstrumentNATSHandler returns a NATS handler that records the number of requests for the subject and how long the
+// handler takes to run. The handler must have the signature func(subject, reply string, request R).
+//
+//nolint:staticcheck
+func InstrumentNATSHandler(subject string, handler nats.Handler) (nats.Handler, error) {
+	handlerValue := reflect.ValueOf(handler)
+	handlerType := handlerValue.Type()
+
+	if handlerType.Kind() != reflect.Func || handlerType.NumIn() != 3 {
+		return nil, fmt.Errorf("unsupported handler type for subject %s: %s", subject, handlerType)
+	}
+
+	requests := NATSRequests.WithLabelValues(subject)
+	duration := NATSRequestDuration.WithLabelValues(subject)
+
+	wrapped := reflect.MakeFunc(handlerType, func(args []reflect.Value) []reflect.Value {
+		start := time.Now()
+		defer func() {
+			requests.Inc()
+			duration.Observe(time.Since(start).Seconds())
+		}()
+		return handlerValue.Call(args)
+	})
+
+	return wrapped.Interface(), nil
+}
+
+// HTTPMiddleware returns echo middleware that records the number of requests for each route, the response status
+// codes and how long the handlers take to run. Requests are labeled with the route pattern rather than the request
+// path so that path parameters don't create new label values.
+func HTTPMiddleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+
+			err := next(c)
+
+			// Let echo's error handler write the response so that the status code is known.
+			if err != nil {
+				c.Error(err)
+			}
+
+			route := c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			method := c.Request().Method
+			code := strconv.Itoa(c.Response().Status)
+
+			HTTPRequests.WithLabelValues(method, route, code).Inc()
+			HTTPRequestDuration.WithLabelValues(method, route).Observe(time.Since(start).Seconds())
+
+			return nil
+		}
+	}
+}
@@ -0,0 +1,220 @@
+// Package migrations contains the versioned SQL migrations that create and update the subscriptions database schema.
+// The migrations are embedded in the binary and the versions that have been applied are recorded in the
+// schema_migrations table.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+
+	"github.com/cyverse-de/go-mod/logging"
+	"github.com/jmoiron/sqlx"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+var log = logging.Log.WithFields(logrus.Fields{"package": "migrations"})
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// filenamePattern matches the names of migration files, which consist of a version number and a short name.
+var filenamePattern = regexp.MustCompile(`^(\d+)_(\w+)\.sql$`)
+
+// lockID is the key of the advisory lock that prevents more than one instance from applying migrations at once.
+const lockID = 7263840195
+
+var (
+	// ErrSchemaOutdated is returned when the database has not had all of the migrations applied to it.
+	ErrSchemaOutdated = errors.New("the database schema is out of date")
+
+	// ErrSchemaTooNew is returned when the database has migrations applied to it that this version of the service
+	// doesn't know about.
+	ErrSchemaTooNew = errors.New("the database schema is newer than this version of the service supports")
+)
+
+// Migration is a single schema migration.
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// All returns the embedded migrations sorted by version.
+func All() ([]Migration, error) {
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+
+	migrations := make([]Migration, 0, len(entries))
+	for _, entry := range entries {
+		match := filenamePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("invalid migration file name: %s", entry.Name())
+		}
+
+		version, err := strconv.Atoi(match[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "invalid migration version: %s", entry.Name())
+		}
+
+		contents, err := files.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		migrations = append(migrations, Migration{Version: version, Name: match[2], SQL: string(contents)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	for i := 1; i < len(migrations); i++ {
+		if migrations[i].Version == migrations[i-1].Version {
+			return nil, fmt.Errorf("duplicate migration version: %d", migrations[i].Version)
+		}
+	}
+
+	return migrations, nil
+}
+
+// LatestVersion returns the version of the newest embedded migration.
+func LatestVersion() (int, error) {
+	migrations, err := All()
+	if err != nil {
+		return 0, err
+	}
+	if len(migrations) == 0 {
+		return 0, nil
+	}
+	return migrations[len(migrations)-1].Version, nil
+}
+
+// queryer is implemented by both *sqlx.DB and *sqlx.Tx.
+type queryer interface {
+	GetContext(ctx context.Context, dest any, query string, args ...any) error
+}
+
+// currentVersion returns the newest migration version recorded in the database, or zero if no migrations have been
+// applied.
+func currentVersion(ctx context.Context, q queryer) (int, error) {
+	var exists bool
+	err := q.GetContext(ctx, &exists, "SELECT to_regclass('schema_migrations') IS NOT NULL")
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version sql.NullInt64
+	if err = q.GetContext(ctx, &version, "SELECT max(version) FROM schema_migrations"); err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// CurrentVersion returns the newest migration version recorded in the database, or zero if no migrations have been
+// applied.
+func CurrentVersion(ctx context.Context, dbconn *sqlx.DB) (int, error) {
+	return currentVersion(ctx, dbconn)
+}
+
+// Check returns an error if the database schema version doesn't match the newest embedded migration.
+func Check(ctx context.Context, dbconn *sqlx.DB) error {
+	latest, err := LatestVersion()
+	if err != nil {
+		return err
+	}
+
+	current, err := CurrentVersion(ctx, dbconn)
+	if err != nil {
+		return errors.Wrap(err, "unable to determine the database schema version")
+	}
+
+	switch {
+	case current < latest:
+		return errors.Wrapf(ErrSchemaOutdated, "database is at version %d, expected version %d", current, latest)
+	case current > latest:
+		return errors.Wrapf(ErrSchemaTooNew, "database is at version %d, expected version %d", current, latest)
+	default:
+		return nil
+	}
+}
+
+// Apply applies all pending migrations to the database in a single transaction and returns the migrations that were
+// applied. Nothing is applied if the database schema is newer than the newest embedded migration.
+func Apply(ctx context.Context, dbconn *sqlx.DB) ([]Migration, error) {
+	migrations, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := dbconn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", lockID); err != nil {
+		return nil, errors.Wrap(err, "unable to obtain the migration lock")
+	}
+
+	_, err = tx.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version integer NOT NULL PRIMARY KEY,
+			name text NOT NULL,
+			applied_at timestamp with time zone NOT NULL DEFAULT now()
+		)`)
+	if err != nil {
+		return nil, errors.Wrap(err, "unable to create the schema_migrations table")
+	}
+
+	current, err := currentVersion(ctx, tx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(migrations) > 0 && current > migrations[len(migrations)-1].Version {
+		return nil, errors.Wrapf(
+			ErrSchemaTooNew, "database is at version %d, expected version %d",
+			current, migrations[len(migrations)-1].Version,
+		)
+	}
+
+	var applied []Migration
+	for _, m := range migrations {
+		if m.Version <= current {
+			continue
+		}
+
+		log.Infof("applying migration %04d_%s", m.Version, m.Name)
+
+		if _, err = tx.ExecContext(ctx, m.SQL); err != nil {
+			return nil, errors.Wrapf(err, "unable to apply migration %04d_%s", m.Version, m.Name)
+		}
+
+		_, err = tx.ExecContext(ctx, "INSERT INTO schema_migrations (version, name) VALUES ($1, $2)", m.Version, m.Name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "unable to record migration %04d_%s", m.Version, m.Name)
+		}
+
+		applied = append(applied, m)
+	}
+
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	return applied, nil
+}
@@ -0,0 +1,136 @@
+-- The schema originally managed by the QMS repository. Every statement is idempotent so that the migration can be
+-- applied to databases that were created by QMS.
+
+CREATE EXTENSION IF NOT EXISTS "uuid-ossp";
+
+CREATE TABLE IF NOT EXISTS update_operations (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    name text NOT NULL UNIQUE
+);
+
+INSERT INTO update_operations (name) VALUES ('ADD'), ('SET') ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS resource_types (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    unit text NOT NULL,
+    consumable boolean NOT NULL DEFAULT false
+);
+
+INSERT INTO resource_types (name, unit, consumable) VALUES
+    ('cpu.hours', 'cpu hours', true),
+    ('data.size', 'bytes', false)
+ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS users (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    username text NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS plans (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    description text NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS plan_rates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    plan_id uuid NOT NULL REFERENCES plans (id) ON DELETE CASCADE,
+    effective_date timestamp with time zone NOT NULL,
+    rate numeric(10, 2) NOT NULL,
+    UNIQUE (plan_id, effective_date)
+);
+
+CREATE TABLE IF NOT EXISTS plan_quota_defaults (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    plan_id uuid NOT NULL REFERENCES plans (id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    quota_value numeric NOT NULL,
+    effective_date timestamp with time zone NOT NULL,
+    UNIQUE (plan_id, resource_type_id, effective_date)
+);
+
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    effective_start_date timestamp with time zone NOT NULL,
+    effective_end_date timestamp with time zone,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans (id) ON DELETE CASCADE,
+    plan_rate_id uuid NOT NULL REFERENCES plan_rates (id),
+    paid boolean NOT NULL DEFAULT false,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS subscriptions_user_id_index ON subscriptions (user_id);
+
+CREATE TABLE IF NOT EXISTS quotas (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    quota numeric NOT NULL,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    subscription_id uuid NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (resource_type_id, subscription_id)
+);
+
+CREATE TABLE IF NOT EXISTS usages (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    usage numeric NOT NULL,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    subscription_id uuid NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (resource_type_id, subscription_id)
+);
+
+CREATE TABLE IF NOT EXISTS updates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    value_type text NOT NULL CHECK (value_type IN ('usages', 'quotas')),
+    value numeric NOT NULL,
+    effective_date timestamp with time zone NOT NULL,
+    update_operation_id uuid NOT NULL REFERENCES update_operations (id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    metadata text,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS updates_user_id_index ON updates (user_id);
+
+CREATE TABLE IF NOT EXISTS addons (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    description text NOT NULL,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    default_amount numeric NOT NULL,
+    default_paid boolean NOT NULL DEFAULT true
+);
+
+CREATE TABLE IF NOT EXISTS addon_rates (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    addon_id uuid NOT NULL REFERENCES addons (id) ON DELETE CASCADE,
+    effective_date timestamp with time zone NOT NULL,
+    rate numeric(10, 2) NOT NULL,
+    UNIQUE (addon_id, effective_date)
+);
+
+CREATE TABLE IF NOT EXISTS subscription_addons (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    addon_id uuid NOT NULL REFERENCES addons (id),
+    subscription_id uuid NOT NULL REFERENCES subscriptions (id) ON DELETE CASCADE,
+    addon_rate_id uuid NOT NULL REFERENCES addon_rates (id),
+    amount numeric NOT NULL,
+    paid boolean NOT NULL DEFAULT true
+);
+
+CREATE INDEX IF NOT EXISTS subscription_addons_subscription_id_index ON subscription_addons (subscription_id);
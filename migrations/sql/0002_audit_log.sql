@@ -0,0 +1,16 @@
+-- The append-only log of changes to plans, add-ons, quotas, subscriptions and subscription add-ons.
+
+CREATE TABLE IF NOT EXISTS audit_log (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    entity_type text NOT NULL,
+    entity_id uuid NOT NULL,
+    action text NOT NULL,
+    username text,
+    actor text NOT NULL,
+    before_value jsonb,
+    after_value jsonb,
+    created_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS audit_log_username_created_at_index ON audit_log (username, created_at);
+CREATE INDEX IF NOT EXISTS audit_log_created_at_index ON audit_log (created_at);
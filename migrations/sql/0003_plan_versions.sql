@@ -0,0 +1,60 @@
+-- Immutable snapshots of the rate and quota defaults of each plan. Every subscription refers to the version of its
+-- plan that was in effect when the subscription was created.
+
+CREATE TABLE plan_versions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    plan_id uuid NOT NULL REFERENCES plans (id) ON DELETE CASCADE,
+    version integer NOT NULL CHECK (version > 0),
+    plan_rate_id uuid NOT NULL REFERENCES plan_rates (id),
+    rate numeric(10, 2) NOT NULL,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (plan_id, version)
+);
+
+CREATE TABLE plan_version_quota_defaults (
+    plan_version_id uuid NOT NULL REFERENCES plan_versions (id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    quota_value numeric NOT NULL,
+    PRIMARY KEY (plan_version_id, resource_type_id)
+);
+
+-- Plan versions can be deleted along with their plans, but they can't be changed.
+CREATE FUNCTION reject_plan_version_update() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'plan versions can''t be changed' USING ERRCODE = 'restrict_violation';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER plan_versions_immutable
+    BEFORE UPDATE ON plan_versions
+    FOR EACH ROW EXECUTE FUNCTION reject_plan_version_update();
+
+CREATE TRIGGER plan_version_quota_defaults_immutable
+    BEFORE UPDATE ON plan_version_quota_defaults
+    FOR EACH ROW EXECUTE FUNCTION reject_plan_version_update();
+
+-- Record the catalog currently in effect for each plan as its first version. The catalog that existing subscriptions
+-- were created under wasn't recorded, so they're assigned to the first version of their plan.
+INSERT INTO plan_versions (plan_id, version, plan_rate_id, rate, created_by)
+SELECT DISTINCT ON (plan_id) plan_id, 1, id, rate, 'schema migration'
+FROM plan_rates
+WHERE effective_date <= now()
+ORDER BY plan_id, effective_date DESC;
+
+INSERT INTO plan_version_quota_defaults (plan_version_id, resource_type_id, quota_value)
+SELECT DISTINCT ON (pv.id, pqd.resource_type_id) pv.id, pqd.resource_type_id, pqd.quota_value
+FROM plan_versions pv
+JOIN plan_quota_defaults pqd ON pqd.plan_id = pv.plan_id
+WHERE pqd.effective_date <= now()
+ORDER BY pv.id, pqd.resource_type_id, pqd.effective_date DESC;
+
+ALTER TABLE subscriptions ADD COLUMN plan_version_id uuid REFERENCES plan_versions (id);
+
+UPDATE subscriptions s SET plan_version_id = pv.id
+FROM plan_versions pv
+WHERE pv.plan_id = s.plan_id AND pv.version = 1;
+
+ALTER TABLE subscriptions ALTER COLUMN plan_version_id SET NOT NULL;
+
+CREATE INDEX subscriptions_plan_version_id_index ON subscriptions (plan_version_id);
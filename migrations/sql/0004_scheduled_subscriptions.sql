@@ -0,0 +1,8 @@
+-- Subscriptions can be scheduled to start in the future. A scheduled subscription is pending until the activation
+-- worker closes the user's previous subscription at the scheduled start date and records when it did so.
+
+ALTER TABLE subscriptions ADD COLUMN activated_at timestamp with time zone;
+
+UPDATE subscriptions SET activated_at = effective_start_date WHERE effective_start_date <= now();
+
+CREATE INDEX subscriptions_pending_index ON subscriptions (effective_start_date) WHERE activated_at IS NULL;
@@ -0,0 +1,9 @@
+-- Subscriptions can be cancelled before they end. A cancelled subscription records when it was cancelled, who
+-- cancelled it and, optionally, why.
+
+ALTER TABLE subscriptions ADD COLUMN cancelled_at timestamp with time zone;
+ALTER TABLE subscriptions ADD COLUMN cancelled_by text;
+ALTER TABLE subscriptions ADD COLUMN cancellation_reason text;
+
+ALTER TABLE subscriptions ADD CONSTRAINT subscriptions_cancelled_by_check
+    CHECK ((cancelled_at IS NULL) = (cancelled_by IS NULL));
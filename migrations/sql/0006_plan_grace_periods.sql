@@ -0,0 +1,4 @@
+-- The number of days after a paid subscription to a plan ends during which the subscription's quotas still apply to
+-- overage checks.
+
+ALTER TABLE plans ADD COLUMN grace_period_days integer NOT NULL DEFAULT 0 CHECK (grace_period_days >= 0);
@@ -0,0 +1,51 @@
+-- Groups of users, such as labs, that share a subscription. The quotas of a group's subscription are pooled: a member
+-- who reaches a quota in their personal subscription can keep using the resource until the combined usage of all of
+-- the group's members beyond their personal quotas reaches the group's quota.
+
+CREATE TABLE groups (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    name text NOT NULL UNIQUE,
+    description text NOT NULL DEFAULT '',
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now()
+);
+
+CREATE TABLE group_members (
+    group_id uuid NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    PRIMARY KEY (group_id, user_id)
+);
+
+CREATE INDEX group_members_user_id_index ON group_members (user_id);
+
+CREATE TABLE group_subscriptions (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    group_id uuid NOT NULL REFERENCES groups (id) ON DELETE CASCADE,
+    plan_id uuid NOT NULL REFERENCES plans (id) ON DELETE CASCADE,
+    effective_start_date timestamp with time zone NOT NULL,
+    effective_end_date timestamp with time zone NOT NULL,
+    paid boolean NOT NULL DEFAULT false,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    CHECK (effective_end_date >= effective_start_date)
+);
+
+CREATE INDEX group_subscriptions_group_id_index ON group_subscriptions (group_id);
+
+CREATE TABLE group_quotas (
+    id uuid NOT NULL DEFAULT uuid_generate_v1() PRIMARY KEY,
+    quota numeric NOT NULL,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    group_subscription_id uuid NOT NULL REFERENCES group_subscriptions (id) ON DELETE CASCADE,
+    created_by text NOT NULL,
+    created_at timestamp with time zone NOT NULL DEFAULT now(),
+    last_modified_by text NOT NULL,
+    last_modified_at timestamp with time zone NOT NULL DEFAULT now(),
+    UNIQUE (resource_type_id, group_subscription_id)
+);
@@ -0,0 +1,31 @@
+-- Daily and monthly aggregates of the usage updates recorded for each user and resource type, so that usage can be
+-- charted over time without scanning the updates table. The rollups are derived from the updates and can be rebuilt
+-- from them at any time. Periods start at midnight UTC.
+
+CREATE TABLE usage_rollups (
+    user_id uuid NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+    resource_type_id uuid NOT NULL REFERENCES resource_types (id) ON DELETE CASCADE,
+    period text NOT NULL CHECK (period IN ('day', 'month')),
+    period_start timestamp with time zone NOT NULL,
+    added numeric NOT NULL,
+    ending_value numeric NOT NULL,
+    update_count integer NOT NULL,
+    PRIMARY KEY (user_id, resource_type_id, period, period_start)
+);
+
+CREATE INDEX usage_rollups_resource_type_period_index ON usage_rollups (resource_type_id, period, period_start);
+
+-- The rollups are refreshed for the updates that were recorded or changed after the time in this table. It only ever
+-- contains one row.
+CREATE TABLE usage_rollup_state (
+    id boolean NOT NULL DEFAULT true PRIMARY KEY CHECK (id),
+    refreshed_through timestamp with time zone NOT NULL
+);
+
+INSERT INTO usage_rollup_state (refreshed_through) VALUES (to_timestamp(0));
+
+-- Finding the updates that changed since the last refresh and replaying the updates for a user and resource type both
+-- need to avoid scanning the whole table.
+CREATE INDEX updates_last_modified_at_index ON updates (last_modified_at);
+CREATE INDEX updates_user_id_resource_type_id_effective_date_index
+    ON updates (user_id, resource_type_id, effective_date);
@@ -72,10 +72,15 @@ func (s *ConnectionSettings) toConnectOptions() []nats.Option {
 		},
 	))
 
-	// A handler function to log an informational message when the NATS connection is closed.
+	// A handler function to log a message when the NATS connection is closed. The connection is closed without an
+	// error when the subscriptions are drained during shutdown.
 	options = append(options, nats.ClosedHandler(
 		func(nc *nats.Conn) {
-			log.Errorf("connection closed: %s", nc.LastError().Error())
+			if err := nc.LastError(); err != nil {
+				log.Errorf("connection closed: %s", err.Error())
+			} else {
+				log.Info("connection closed")
+			}
 		},
 	))
 
@@ -137,6 +142,36 @@ func (c *Client) Subscribe(subject string, handler nats.Handler) error {
 	return nil
 }
 
+// Drain stops the client's subscriptions from receiving new messages, waits for the handlers to finish processing the
+// messages that have already been received, and then closes the connection. If the context is done before draining
+// finishes, the connection is closed immediately and the context's error is returned.
+func (c *Client) Drain(ctx context.Context) error {
+	nc := c.conn.Conn
+
+	// Wrap the existing closed handler so that we can tell when draining is complete.
+	closed := make(chan struct{})
+	closedHandler := nc.ClosedHandler()
+	nc.SetClosedHandler(func(conn *nats.Conn) {
+		if closedHandler != nil {
+			closedHandler(conn)
+		}
+		close(closed)
+	})
+
+	log.Infof("draining %d NATS subscriptions", len(c.subscriptions))
+	if err := nc.Drain(); err != nil {
+		return err
+	}
+
+	select {
+	case <-closed:
+		return nil
+	case <-ctx.Done():
+		nc.Close()
+		return ctx.Err()
+	}
+}
+
 func (c *Client) Respond(ctx context.Context, replySubject string, response gotelnats.DEResponse) error {
 	return gotelnats.PublishResponse(ctx, c.conn, replySubject, response)
 }
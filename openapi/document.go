@@ -0,0 +1,238 @@
+// Package openapi builds the OpenAPI 3 document that describes the HTTP API and validates request bodies against it.
+package openapi
+
+import (
+	"reflect"
+	"strings"
+)
+
+// Version is the version of the OpenAPI specification that generated documents conform to.
+const Version = "3.0.3"
+
+// BearerAuth is the name of the security scheme used by endpoints that require a bearer token.
+const BearerAuth = "bearerAuth"
+
+// Info contains general information about the API.
+type Info struct {
+	Title       string `json:"title"`
+	Description string `json:"description,omitempty"`
+	Version     string `json:"version"`
+}
+
+// Parameter describes a path or query parameter accepted by an operation.
+type Parameter struct {
+	Name        string  `json:"name"`
+	In          string  `json:"in"`
+	Description string  `json:"description,omitempty"`
+	Required    bool    `json:"required,omitempty"`
+	Schema      *Schema `json:"schema"`
+}
+
+// PathParameter returns a required string path parameter.
+func PathParameter(name string) Parameter {
+	return Parameter{Name: name, In: "path", Required: true, Schema: &Schema{Type: "string"}}
+}
+
+// QueryParameter returns an optional query parameter with the given type.
+func QueryParameter(name, schemaType, format, description string) Parameter {
+	return Parameter{
+		Name:        name,
+		In:          "query",
+		Description: description,
+		Schema:      &Schema{Type: schemaType, Format: format},
+	}
+}
+
+// MediaType describes the body of a request or response for a single content type.
+type MediaType struct {
+	Schema *Schema `json:"schema"`
+}
+
+// RequestBody describes the body of a request.
+type RequestBody struct {
+	Required bool                 `json:"required,omitempty"`
+	Content  map[string]MediaType `json:"content"`
+}
+
+// Response describes a response returned by an operation.
+type Response struct {
+	Description string               `json:"description"`
+	Content     map[string]MediaType `json:"content,omitempty"`
+}
+
+// Operation describes a single HTTP method on a path.
+type Operation struct {
+	Summary     string                `json:"summary,omitempty"`
+	Description string                `json:"description,omitempty"`
+	OperationID string                `json:"operationId,omitempty"`
+	Tags        []string              `json:"tags,omitempty"`
+	Deprecated  bool                  `json:"deprecated,omitempty"`
+	Parameters  []Parameter           `json:"parameters,omitempty"`
+	RequestBody *RequestBody          `json:"requestBody,omitempty"`
+	Responses   map[string]*Response  `json:"responses"`
+	Security    []map[string][]string `json:"security,omitempty"`
+}
+
+// SecurityScheme describes a method of authenticating requests.
+type SecurityScheme struct {
+	Type         string `json:"type"`
+	Scheme       string `json:"scheme,omitempty"`
+	BearerFormat string `json:"bearerFormat,omitempty"`
+}
+
+// Components contains the reusable parts of the document.
+type Components struct {
+	Schemas         map[string]*Schema        `json:"schemas"`
+	SecuritySchemes map[string]SecurityScheme `json:"securitySchemes,omitempty"`
+}
+
+// Document is an OpenAPI 3 document.
+type Document struct {
+	OpenAPI    string                           `json:"openapi"`
+	Info       Info                             `json:"info"`
+	Paths      map[string]map[string]*Operation `json:"paths"`
+	Components Components                       `json:"components"`
+
+	// The names assigned to the schemas of Go types that have been added to the components.
+	schemaNames map[reflect.Type]string
+}
+
+// NewDocument returns an empty document that supports bearer token authentication.
+func NewDocument(info Info) *Document {
+	return &Document{
+		OpenAPI: Version,
+		Info:    info,
+		Paths:   make(map[string]map[string]*Operation),
+		Components: Components{
+			Schemas: make(map[string]*Schema),
+			SecuritySchemes: map[string]SecurityScheme{
+				BearerAuth: {Type: "http", Scheme: "bearer", BearerFormat: "JWT"},
+			},
+		},
+		schemaNames: make(map[reflect.Type]string),
+	}
+}
+
+// Endpoint contains the information used to describe an operation.
+type Endpoint struct {
+	Method      string
+	Path        string
+	Summary     string
+	Description string
+	Tags        []string
+	Deprecated  bool
+
+	// The query parameters accepted by the endpoint. Path parameters are taken from the path.
+	QueryParameters []Parameter
+
+	// Values of the types accepted in the request body and returned in the response body. The request body is
+	// omitted if Request is nil. A nil Response indicates that the endpoint returns plain text.
+	Request  any
+	Response any
+
+	// True if the endpoint requires a bearer token.
+	Secured bool
+}
+
+// echoPathParameters converts the parameters in an echo route path to OpenAPI path parameters and returns the
+// converted path along with the names of the parameters.
+func echoPathParameters(path string) (string, []string) {
+	var names []string
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			name := strings.TrimPrefix(segment, ":")
+			names = append(names, name)
+			segments[i] = "{" + name + "}"
+		}
+	}
+	return strings.Join(segments, "/"), names
+}
+
+// errorResponse returns the description of an error response.
+func (d *Document) errorResponse(description string, errorBody any) *Response {
+	return &Response{
+		Description: description,
+		Content:     map[string]MediaType{"application/json": {Schema: d.SchemaFor(errorBody)}},
+	}
+}
+
+// AddEndpoint adds an operation to the document. The value of errorBody is used to describe the body of error
+// responses. The operation is returned so that callers can make further changes to it.
+func (d *Document) AddEndpoint(endpoint *Endpoint, errorBody any) *Operation {
+	path, pathParams := echoPathParameters(endpoint.Path)
+
+	op := &Operation{
+		Summary:     endpoint.Summary,
+		Description: endpoint.Description,
+		Tags:        endpoint.Tags,
+		Deprecated:  endpoint.Deprecated,
+		Responses:   make(map[string]*Response),
+	}
+
+	for _, name := range pathParams {
+		op.Parameters = append(op.Parameters, PathParameter(name))
+	}
+	op.Parameters = append(op.Parameters, endpoint.QueryParameters...)
+
+	if endpoint.Request != nil {
+		op.RequestBody = &RequestBody{
+			Required: true,
+			Content:  map[string]MediaType{"application/json": {Schema: d.SchemaFor(endpoint.Request)}},
+		}
+		op.Responses["400"] = d.errorResponse("The request body or parameters are invalid.", errorBody)
+	}
+
+	if endpoint.Response != nil {
+		op.Responses["200"] = &Response{
+			Description: "Success.",
+			Content:     map[string]MediaType{"application/json": {Schema: d.SchemaFor(endpoint.Response)}},
+		}
+	} else {
+		op.Responses["200"] = &Response{
+			Description: "Success.",
+			Content:     map[string]MediaType{"text/plain": {Schema: &Schema{Type: "string"}}},
+		}
+	}
+
+	if endpoint.Secured {
+		op.Security = []map[string][]string{{BearerAuth: {}}}
+		op.Responses["401"] = d.errorResponse("A valid bearer token was not provided.", errorBody)
+		op.Responses["403"] = d.errorResponse("The caller is not allowed to use this endpoint.", errorBody)
+	}
+
+	// Handlers report other errors in the error field of the usual response body.
+	if endpoint.Response != nil {
+		op.Responses["default"] = &Response{
+			Description: "An error occurred. The error field of the response body describes it.",
+			Content:     map[string]MediaType{"application/json": {Schema: d.SchemaFor(endpoint.Response)}},
+		}
+	} else {
+		op.Responses["default"] = d.errorResponse("An error occurred.", errorBody)
+	}
+
+	item, ok := d.Paths[path]
+	if !ok {
+		item = make(map[string]*Operation)
+		d.Paths[path] = item
+	}
+	item[strings.ToLower(endpoint.Method)] = op
+
+	return op
+}
+
+// Operation returns the operation for the given method and echo route path, or nil if there isn't one.
+func (d *Document) Operation(method, path string) *Operation {
+	path, _ = echoPathParameters(path)
+	return d.Paths[path][strings.ToLower(method)]
+}
+
+// RequestSchema returns the schema of the request body for the given method and echo route path, or nil if the
+// operation doesn't accept a request body.
+func (d *Document) RequestSchema(method, path string) *Schema {
+	op := d.Operation(method, path)
+	if op == nil || op.RequestBody == nil {
+		return nil
+	}
+	return op.RequestBody.Content["application/json"].Schema
+}
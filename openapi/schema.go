@@ -0,0 +1,214 @@
+package openapi
+
+import (
+	"encoding/json"
+	"math"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// schemaRefPrefix is the prefix of references to schemas in the components of a document.
+const schemaRefPrefix = "#/components/schemas/"
+
+// Schema describes the shape of a JSON value. Only the parts of the OpenAPI schema object that are needed to describe
+// the types used by this service are included.
+type Schema struct {
+	Ref         string   `json:"$ref,omitempty"`
+	Type        string   `json:"type,omitempty"`
+	Format      string   `json:"format,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Nullable    bool     `json:"nullable,omitempty"`
+	Minimum     *float64 `json:"minimum,omitempty"`
+	Maximum     *float64 `json:"maximum,omitempty"`
+	Items       *Schema  `json:"items,omitempty"`
+
+	// The properties of an object. Objects described by Go structs don't accept any other properties.
+	Properties map[string]*Schema `json:"properties,omitempty"`
+
+	// Either a *Schema describing the values of a map or false for objects that only accept the listed properties.
+	AdditionalProperties any `json:"additionalProperties,omitempty"`
+}
+
+var (
+	timeType      = reflect.TypeOf(time.Time{})
+	marshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	messageType   = reflect.TypeOf((*proto.Message)(nil)).Elem()
+)
+
+// bounds returns a pointer to each of the given limits, for use as the minimum and maximum of a schema.
+func bounds(minimum, maximum float64) (*float64, *float64) {
+	return &minimum, &maximum
+}
+
+// integerSchema returns the schema for a Go integer type.
+func integerSchema(kind reflect.Kind) *Schema {
+	s := &Schema{Type: "integer"}
+	switch kind {
+	case reflect.Int8:
+		s.Format = "int32"
+		s.Minimum, s.Maximum = bounds(math.MinInt8, math.MaxInt8)
+	case reflect.Int16:
+		s.Format = "int32"
+		s.Minimum, s.Maximum = bounds(math.MinInt16, math.MaxInt16)
+	case reflect.Int32:
+		s.Format = "int32"
+	case reflect.Uint8:
+		s.Format = "int32"
+		s.Minimum, s.Maximum = bounds(0, math.MaxUint8)
+	case reflect.Uint16:
+		s.Format = "int32"
+		s.Minimum, s.Maximum = bounds(0, math.MaxUint16)
+	case reflect.Uint32:
+		s.Format = "int64"
+		s.Minimum, s.Maximum = bounds(0, math.MaxUint32)
+	case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+		s.Format = "int64"
+		s.Minimum, _ = bounds(0, 0)
+	default:
+		s.Format = "int64"
+	}
+	return s
+}
+
+// schemaName returns the name used for the schema of a struct type in the document components. Protocol buffer
+// messages are named after their full message names and other types are named after their Go package and type names.
+func schemaName(t reflect.Type) string {
+	if reflect.PointerTo(t).Implements(messageType) {
+		if msg, ok := reflect.New(t).Interface().(proto.Message); ok {
+			return string(msg.ProtoReflect().Descriptor().FullName())
+		}
+	}
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+// SchemaFor returns the schema describing the JSON encoding of the given value, as produced by encoding/json. The
+// schemas of named struct types are added to the document components and referred to by reference.
+func (d *Document) SchemaFor(value any) *Schema {
+	return d.schemaForType(reflect.TypeOf(value))
+}
+
+// schemaForType returns the schema describing the JSON encoding of values of the given type.
+func (d *Document) schemaForType(t reflect.Type) *Schema {
+	if t == nil {
+		return &Schema{}
+	}
+
+	if t.Kind() == reflect.Pointer {
+		s := d.schemaForType(t.Elem())
+		if s.Ref != "" {
+			return s
+		}
+		s.Nullable = true
+		return s
+	}
+
+	switch {
+	case t == timeType:
+		return &Schema{Type: "string", Format: "date-time"}
+	case t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType):
+		// Types with custom encodings can contain any JSON value.
+		return &Schema{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return &Schema{Type: "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return integerSchema(t.Kind())
+	case reflect.Float32:
+		return &Schema{Type: "number", Format: "float"}
+	case reflect.Float64:
+		return &Schema{Type: "number", Format: "double"}
+	case reflect.String:
+		return &Schema{Type: "string"}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return &Schema{Type: "string", Format: "byte", Nullable: true}
+		}
+		return &Schema{Type: "array", Items: d.schemaForType(t.Elem()), Nullable: true}
+	case reflect.Array:
+		return &Schema{Type: "array", Items: d.schemaForType(t.Elem())}
+	case reflect.Map:
+		return &Schema{Type: "object", AdditionalProperties: d.schemaForType(t.Elem()), Nullable: true}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return d.structSchema(t)
+		}
+		return d.structRef(t)
+	default:
+		return &Schema{}
+	}
+}
+
+// structRef adds the schema for a named struct type to the document components if it isn't there already and
+// returns a reference to it.
+func (d *Document) structRef(t reflect.Type) *Schema {
+	name, ok := d.schemaNames[t]
+	if !ok {
+		name = schemaName(t)
+		d.schemaNames[t] = name
+
+		// Add a placeholder first so that recursive types refer to the schema instead of building it again.
+		d.Components.Schemas[name] = &Schema{}
+		*d.Components.Schemas[name] = *d.structSchema(t)
+	}
+	return &Schema{Ref: schemaRefPrefix + name}
+}
+
+// structSchema builds the schema for a struct type using the same field naming rules as encoding/json.
+func (d *Document) structSchema(t reflect.Type) *Schema {
+	s := &Schema{
+		Type:                 "object",
+		Properties:           make(map[string]*Schema),
+		AdditionalProperties: false,
+	}
+	d.addStructFields(s, t)
+	return s
+}
+
+// addStructFields adds the fields of a struct type to an object schema. The fields of embedded structs are promoted
+// to the enclosing object, as they are by encoding/json.
+func (d *Document) addStructFields(s *Schema, t reflect.Type) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := field.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, _, _ := strings.Cut(tag, ",")
+
+		if field.Anonymous && name == "" {
+			embedded := field.Type
+			if embedded.Kind() == reflect.Pointer {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() == reflect.Struct {
+				d.addStructFields(s, embedded)
+				continue
+			}
+		}
+
+		if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		s.Properties[name] = d.schemaForType(field.Type)
+	}
+}
+
+// resolve follows a reference to a schema in the document components.
+func (d *Document) resolve(s *Schema) *Schema {
+	for s != nil && s.Ref != "" {
+		s = d.Components.Schemas[strings.TrimPrefix(s.Ref, schemaRefPrefix)]
+	}
+	return s
+}
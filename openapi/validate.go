@@ -0,0 +1,265 @@
+package openapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// FieldError describes a problem with a single field in a request body.
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// fieldPath returns the path to a property of an object.
+func fieldPath(parent, name string) string {
+	if parent == "" {
+		return name
+	}
+	return parent + "." + name
+}
+
+// displayPath returns the path used to identify a field in error messages.
+func displayPath(path string) string {
+	if path == "" {
+		return "(body)"
+	}
+	return path
+}
+
+// matchProperty finds the schema of an object property. Like encoding/json, it prefers an exact match but falls back
+// to a case-insensitive match.
+func matchProperty(schema *Schema, name string) (*Schema, bool) {
+	if property, ok := schema.Properties[name]; ok {
+		return property, true
+	}
+	for propertyName, property := range schema.Properties {
+		if strings.EqualFold(propertyName, name) {
+			return property, true
+		}
+	}
+	return nil, false
+}
+
+// jsonType returns the name of the JSON type of a decoded value.
+func jsonType(value any) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case json.Number:
+		return "number"
+	case string:
+		return "string"
+	case []any:
+		return "array"
+	case map[string]any:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
+
+// Validate checks a value decoded from JSON against a schema and returns a description of each problem found. The
+// value must be decoded with json.Decoder.UseNumber so that integers can be checked precisely. Null is accepted for
+// every field because encoding/json leaves the field unchanged when it decodes a null value.
+func (d *Document) Validate(schema *Schema, value any) []FieldError {
+	var errs []FieldError
+	d.validate(schema, value, "", &errs)
+	return errs
+}
+
+func (d *Document) validate(schema *Schema, value any, path string, errs *[]FieldError) {
+	schema = d.resolve(schema)
+	if schema == nil || schema.Type == "" || value == nil {
+		return
+	}
+
+	addError := func(format string, args ...any) {
+		*errs = append(*errs, FieldError{Field: displayPath(path), Message: fmt.Sprintf(format, args...)})
+	}
+
+	switch schema.Type {
+	case "object":
+		obj, ok := value.(map[string]any)
+		if !ok {
+			addError("expected an object but found %s", jsonType(value))
+			return
+		}
+
+		names := make([]string, 0, len(obj))
+		for name := range obj {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			if property, ok := matchProperty(schema, name); ok {
+				d.validate(property, obj[name], fieldPath(path, name), errs)
+				continue
+			}
+			switch additional := schema.AdditionalProperties.(type) {
+			case *Schema:
+				d.validate(additional, obj[name], fieldPath(path, name), errs)
+			case bool:
+				if !additional {
+					*errs = append(*errs, FieldError{Field: fieldPath(path, name), Message: "unknown field"})
+				}
+			}
+		}
+
+	case "array":
+		arr, ok := value.([]any)
+		if !ok {
+			addError("expected an array but found %s", jsonType(value))
+			return
+		}
+		for i, item := range arr {
+			d.validate(schema.Items, item, path+"["+strconv.Itoa(i)+"]", errs)
+		}
+
+	case "string":
+		str, ok := value.(string)
+		if !ok {
+			addError("expected a string but found %s", jsonType(value))
+			return
+		}
+		switch schema.Format {
+		case "byte":
+			if _, err := base64.StdEncoding.DecodeString(str); err != nil {
+				addError("expected a base64 encoded string")
+			}
+		case "date-time":
+			if _, err := time.Parse(time.RFC3339Nano, str); err != nil {
+				addError("expected an RFC 3339 timestamp")
+			}
+		}
+
+	case "integer":
+		num, ok := value.(json.Number)
+		if !ok {
+			addError("expected an integer but found %s", jsonType(value))
+			return
+		}
+		n, ok := new(big.Int).SetString(num.String(), 10)
+		if !ok {
+			addError("expected an integer but found %s", num)
+			return
+		}
+		minimum, maximum := integerLimits(schema)
+		if n.Cmp(minimum) < 0 || n.Cmp(maximum) > 0 {
+			addError("expected an integer between %s and %s", minimum, maximum)
+		}
+
+	case "number":
+		if _, ok := value.(json.Number); !ok {
+			addError("expected a number but found %s", jsonType(value))
+		}
+
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			addError("expected a boolean but found %s", jsonType(value))
+		}
+	}
+}
+
+// integerLimits returns the range of values accepted by an integer schema.
+func integerLimits(schema *Schema) (*big.Int, *big.Int) {
+	var minimum, maximum *big.Int
+	switch schema.Format {
+	case "int32":
+		minimum, maximum = big.NewInt(-1<<31), big.NewInt(1<<31-1)
+	default:
+		minimum, maximum = big.NewInt(-1<<63), big.NewInt(1<<63-1)
+	}
+	if schema.Minimum != nil {
+		minimum, _ = new(big.Float).SetFloat64(*schema.Minimum).Int(nil)
+	}
+	if schema.Maximum != nil {
+		maximum, _ = new(big.Float).SetFloat64(*schema.Maximum).Int(nil)
+	}
+
+	// Unsigned 64-bit integers can exceed the maximum value of the int64 format.
+	if schema.Minimum != nil && *schema.Minimum == 0 && schema.Maximum == nil {
+		maximum = new(big.Int).SetUint64(1<<64 - 1)
+	}
+
+	return minimum, maximum
+}
+
+// ValidationError is returned when a request body doesn't match the schema of the operation.
+type ValidationError struct {
+	Message string
+	Fields  []FieldError
+}
+
+// Error implements the error interface.
+func (e *ValidationError) Error() string {
+	if len(e.Fields) == 0 {
+		return e.Message
+	}
+	return fmt.Sprintf("%s: %s: %s", e.Message, e.Fields[0].Field, e.Fields[0].Message)
+}
+
+// ValidateBody reads a JSON request body and checks it against the schema. The body can still be read by the caller
+// afterwards.
+func (d *Document) ValidateBody(schema *Schema, r *http.Request) error {
+	if r.Body == nil {
+		return &ValidationError{Message: "a request body is required"}
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+
+	var value any
+	if err = decoder.Decode(&value); err != nil {
+		if err == io.EOF {
+			return &ValidationError{Message: "a request body is required"}
+		}
+		return &ValidationError{Message: fmt.Sprintf("the request body is not valid JSON: %s", err)}
+	}
+	if decoder.More() {
+		return &ValidationError{Message: "the request body contains more than one JSON value"}
+	}
+
+	if fieldErrors := d.Validate(schema, value); len(fieldErrors) > 0 {
+		return &ValidationError{Message: "the request body is invalid", Fields: fieldErrors}
+	}
+
+	return nil
+}
+
+// ValidationMiddleware returns echo middleware that validates request bodies against the given schema. The
+// errorFunc converts validation errors into the error returned to echo.
+func (d *Document) ValidationMiddleware(schema *Schema, errorFunc func(*ValidationError) error) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			err := d.ValidateBody(schema, c.Request())
+			if validationErr, ok := err.(*ValidationError); ok {
+				return errorFunc(validationErr)
+			}
+			if err != nil {
+				return err
+			}
+			return next(c)
+		}
+	}
+}
@@ -1,11 +1,11 @@
 package utils
 
 import (
-	"fmt"
 	"regexp"
 	"time"
 
 	"github.com/cyverse-de/subscriptions/db"
+	"github.com/cyverse-de/subscriptions/errors"
 )
 
 const (
@@ -30,7 +30,7 @@ func layoutForValue(value string) (string, error) {
 	case RFC3339Regexp.MatchString(value):
 		return RFC3339, nil
 	default:
-		return "", fmt.Errorf("unrecognized timestamp layout: %s", value)
+		return "", errors.BadRequest("unrecognized timestamp layout").WithField("timestamp", value)
 	}
 }
 
@@ -55,26 +55,63 @@ func ParseTimestamp(value string) (time.Time, error) {
 	return t, err
 }
 
+// StartTimeForValue returns the start time to use for the given date value. If the given date value is empty then
+// the zero time is returned, which indicates that the subscription starts immediately. Otherwise, the timestamp will
+// be parsed using ParseTimestamp.
+func StartTimeForValue(value string) (time.Time, error) {
+	var t time.Time
+
+	// The subscription starts immediately if the value is empty.
+	if value == "" {
+		return t, nil
+	}
+
+	// Parse the timestamp.
+	t, err := ParseTimestamp(value)
+	if err != nil {
+		return t, errors.ErrInvalidStartDate.WithField("start_date", value)
+	}
+
+	// Return an error if the time is in the past.
+	if t.Before(time.Now()) {
+		return t, errors.BadRequest("the start date must be in the future")
+	}
+
+	return t, nil
+}
+
 // EndTimeForValue returns the time to use for the given date value. If the given date value is empty then the
 // resulting timestamp will be one year from the current time. Otherwise, the timestamp will be parsed using
 // ParseTimestamp.
 func EndTimeForValue(value string) (time.Time, error) {
+	return EndTimeForValueAfter(value, time.Now())
+}
+
+// EndTimeForValueAfter returns the time to use for the given date value in a subscription that starts at the given
+// time. If the given date value is empty then the resulting timestamp will be one year after the start time.
+// Otherwise, the timestamp will be parsed using ParseTimestamp.
+func EndTimeForValueAfter(value string, start time.Time) (time.Time, error) {
 	var t time.Time
 
 	// Use the default end time if the value is empty.
 	if value == "" {
-		return time.Now().AddDate(1, 0, 0), nil
+		return start.AddDate(1, 0, 0), nil
 	}
 
 	// Parse the timestamp.
 	t, err := ParseTimestamp(value)
 	if err != nil {
-		return t, err
+		return t, errors.ErrInvalidEndDate.WithField("end_date", value)
 	}
 
 	// Return an error if the time is in the past.
 	if t.Before(time.Now()) {
-		return t, fmt.Errorf("the end date must be in the future")
+		return t, errors.BadRequest("the end date must be in the future").WithField("end_date", value)
+	}
+
+	// Return an error if the subscription would end before it starts.
+	if !t.After(start) {
+		return t, errors.BadRequest("the end date must be after the start date").WithField("end_date", value)
 	}
 
 	return t, nil
@@ -91,7 +128,7 @@ func PeriodsForRequestValue(value int32) (int32, error) {
 
 	// Return an error if the selected value is negative.
 	if value < 0 {
-		return 0, fmt.Errorf("the number of periods must be greater than zero")
+		return 0, errors.BadRequest("the number of periods must be greater than zero").WithField("periods", value)
 	}
 
 	return value, nil
@@ -99,21 +136,38 @@ func PeriodsForRequestValue(value int32) (int32, error) {
 
 // OptsForValues returns subscription options for a set of request values.
 func OptsForValues(paid bool, periodsVal int32, endTimeVal string) (*db.SubscriptionOptions, error) {
+	return ScheduledOptsForValues(paid, periodsVal, "", endTimeVal)
+}
+
+// ScheduledOptsForValues returns subscription options for a set of request values, including the date that the
+// subscription starts. The subscription starts immediately if the start date value is empty.
+func ScheduledOptsForValues(paid bool, periodsVal int32, startTimeVal, endTimeVal string) (*db.SubscriptionOptions, error) {
 	// Vaidate the periods.
 	periods, err := PeriodsForRequestValue(periodsVal)
 	if err != nil {
 		return nil, err
 	}
 
-	// Parse and validate the end time.
-	endTime, err := EndTimeForValue(endTimeVal)
+	// Parse and validate the start time.
+	startTime, err := StartTimeForValue(startTimeVal)
+	if err != nil {
+		return nil, err
+	}
+
+	// Parse and validate the end time, which defaults to one year after the start time.
+	start := startTime
+	if start.IsZero() {
+		start = time.Now()
+	}
+	endTime, err := EndTimeForValueAfter(endTimeVal, start)
 	if err != nil {
 		return nil, err
 	}
 
 	return &db.SubscriptionOptions{
-		Paid:    paid,
-		Periods: periods,
-		EndDate: endTime,
+		Paid:      paid,
+		Periods:   periods,
+		EndDate:   endTime,
+		StartDate: startTime,
 	}, nil
 }